@@ -0,0 +1,212 @@
+//
+// Hash algorithm and external hash commands.
+//
+// Files are hashed with SHA256 unless hash_algorithm names another algorithm; hashes other than SHA256 are
+// recorded with the algorithm as a prefix ("blake3:<hex>"), so they never compare equal to a SHA256 one. SHA256
+// and BLAKE3 (see blake3.go) are built in. Any algorithm can be computed by an external command instead, for
+// sites with a hardware-accelerated hashing appliance or a vendor's tuned binary:
+//
+//   "hash_algorithm": "blake3",
+//   "hash_commands": { "blake3": "b3sum --no-names", "sha256": "/opt/accel/sha256sum" },
+//   "hash_command_batch": 64
+//
+// The command gets the paths of local files as arguments and the content of remote ones on stdin, and prints a
+// line per file starting with the hex digest (the sha256sum / b3sum format, with or without the names). With
+// hash_command_batch, the files of a hash worker's batch are passed to one run of the command, that many at a
+// time; otherwise it runs once per file.
+//
+// It applies to the "full" policy; chunked and sampled hashes stay SHA256. Files that need the content to go
+// through the tool (transforms, normalize_eol, chunk digests or fingerprints) are hashed by the tool itself,
+// which for an algorithm that isn't built in is an error.
+//
+// GPU hashing goes through the same door. The digest of one file is a sequential chain of blocks (SHA256, MD5),
+// so a GPU only pays off hashing many files side by side, which is what a GPU hasher's command line does when
+// given a batch: set it as the command with hash_command_batch large enough to keep the card busy (a few hundred
+// files) and fewer hash_threads_new/old, as each run of it takes a whole batch. There is no in-process CUDA or
+// OpenCL backend: it would tie the build to cgo and a vendor toolkit on every host, for what the command gives.
+//
+
+package main
+
+import (
+  "bufio"
+  "bytes"
+  "crypto/sha256"
+  "fmt"
+  "hash"
+  "io"
+  "os/exec"
+  "regexp"
+  "strings"
+  "sync"
+)
+
+var external_digest = regexp.MustCompile(`^\\?([0-9a-fA-F]+)`)
+
+func hash_algorithm() string {
+  if conf.Hash_algorithm == "" {
+    return "sha256"
+  }
+  return strings.ToLower(conf.Hash_algorithm)
+}
+
+// hash_prefix is what the recorded hashes of the algorithm start with
+func hash_prefix() string {
+  if hash_algorithm() == "sha256" {
+    return ""
+  }
+  return hash_algorithm() + ":"
+}
+
+// builtin_algorithm tells if the tool can compute the algorithm itself
+func builtin_algorithm() bool {
+  return hash_algorithm() == "sha256" || hash_algorithm() == "blake3"
+}
+
+// new_hash returns a hash of the algorithm, for the full policy
+func new_hash() hash.Hash {
+  if hash_algorithm() == "blake3" {
+    return new_blake3()
+  }
+  return sha256.New()
+}
+
+func external_command() string {
+  return conf.Hash_commands[hash_algorithm()]
+}
+
+func check_hash_algorithm() error {
+  if hash_algorithm() == "sha256" {
+    return nil
+  }
+  if !builtin_algorithm() && external_command() == "" {
+    return fmt.Errorf("hash_algorithm %s has no built-in implementation: set a command for it in hash_commands", hash_algorithm())
+  }
+  // these are SHA256 whatever the algorithm, and would never match
+  if conf.Old_sidecars {
+    return fmt.Errorf("old_sidecars hold SHA256 hashes and can't be used with hash_algorithm %s", hash_algorithm())
+  }
+  return nil
+}
+
+// external_ok tells if a file can be hashed by the external command
+func external_ok(side string, file string, p *policy, extras bool) bool {
+  return external_command() != "" && p.Action == "full" && !p.Normalize_eol && !transformed(side, file) &&
+    !want_chunks(extras) && !want_cdc(extras)
+}
+
+// results of batched runs of the command, by side and file, waiting for hash_one to pick them up
+var prehashed = map[string]string{}
+var prehashed_mu sync.Mutex
+
+// external_hash hashes a file with the external command; ok is false if it has to be hashed by the tool itself
+func external_hash(side string, file string, p *policy, extras bool) (hash string, ok bool, err error) {
+  if !external_ok(side, file, p, extras) {
+    if !builtin_algorithm() && p.Action == "full" {
+      return "", true, fmt.Errorf("%s has to be hashed by the tool (transforms, normalize_eol or chunk digests), which can't compute %s", file, hash_algorithm())
+    }
+    return "", false, nil
+  }
+
+  key := side + "\x00" + file
+  prehashed_mu.Lock()
+  hash, found := prehashed[key]
+  delete(prehashed, key)
+  prehashed_mu.Unlock()
+  if found {
+    return hash, true, nil
+  }
+
+  var sums []string
+  if rm := remotes[side]; rm != nil {
+    in, err := rm.open(side_name(side, file))
+    if err != nil {
+      return "", true, fmt.Errorf("opening: %s", err)
+    }
+    sums, err = run_hash_command(nil, in)
+    if cerr := in.Close(); err == nil && cerr != nil {
+      err = fmt.Errorf("reading: %s", cerr)
+    }
+    if err != nil {
+      return "", true, err
+    }
+  } else if sums, err = run_hash_command([]string{side_path(side, file)}, nil); err != nil {
+    return "", true, err
+  }
+  return hash_prefix() + sums[0], true, nil
+}
+
+// prehash runs the external command on the local files of a batch, hash_command_batch at a time. The function
+// it returns drops the digests not picked up (files claimed by another worker, or left at a deadline), which
+// would be stale by the time they are hashed again.
+func prehash(side string, group []work_item) func() {
+  if conf.Hash_command_batch <= 0 || remotes[side] != nil {
+    return func() {}
+  }
+  var files []string
+  for _, w := range group {
+    if external_ok(side, w.filename, policy_for(w.filename, w.size), true) {
+      files = append(files, w.filename)
+    }
+  }
+  for len(files) > 0 {
+    n := conf.Hash_command_batch
+    if n > len(files) {
+      n = len(files)
+    }
+    var paths []string
+    for _, file := range files[:n] {
+      paths = append(paths, side_path(side, file))
+    }
+    sums, err := run_hash_command(paths, nil)
+    if err != nil {
+      // left to be hashed one by one, which tells which file failed
+      le.Print("error hashing a batch of ", n, " files in path_", side, ": ", err)
+    } else {
+      prehashed_mu.Lock()
+      for i, file := range files[:n] {
+        prehashed[side + "\x00" + file] = hash_prefix() + sums[i]
+      }
+      prehashed_mu.Unlock()
+    }
+    files = files[n:]
+  }
+  return func() {
+    prehashed_mu.Lock()
+    for _, w := range group {
+      delete(prehashed, side + "\x00" + w.filename)
+    }
+    prehashed_mu.Unlock()
+  }
+}
+
+// run_hash_command runs the external command on some paths, or on stdin, and returns a digest per path
+func run_hash_command(paths []string, stdin io.Reader) ([]string, error) {
+  // the paths are passed as arguments of the shell, never parsed by it
+  cmd := exec.Command("sh", append([]string{"-c", external_command() + ` "$@"`, "sh"}, paths...)...)
+  cmd.Stdin = stdin
+  var stderr bytes.Buffer
+  cmd.Stderr = &stderr
+  out, err := cmd.Output()
+  if err != nil {
+    return nil, fmt.Errorf("%s: %s %s", external_command(), err, strings.TrimSpace(stderr.String()))
+  }
+
+  want := len(paths)
+  if want == 0 {
+    want = 1
+  }
+  var sums []string
+  lines := bufio.NewScanner(bytes.NewReader(out))
+  for lines.Scan() {
+    m := external_digest.FindStringSubmatch(lines.Text())
+    if m == nil {
+      return nil, fmt.Errorf("%s printed %q, not a digest", external_command(), lines.Text())
+    }
+    sums = append(sums, strings.ToLower(m[1]))
+  }
+  if len(sums) != want {
+    return nil, fmt.Errorf("%s printed %d digests for %d files", external_command(), len(sums), want)
+  }
+  return sums, nil
+}
@@ -0,0 +1,215 @@
+//
+// Corruption-pattern analytics.
+//
+// A flat list of mismatching files hides what they have in common. The report groups the mismatches by the
+// device each copy sits on, top-level directory, size, modification (copy) date and, for diagnosed files, the
+// alignment of the first differing offset, and points out where most of them fall into a single group:
+// everything on one LUN, everything at a 1 MiB boundary, everything copied on the same day.
+//
+// The files that couldn't be hashed are grouped the same way by cause (permission, missing, io, timeout, db or
+// other, see error_cause) and, for each cause, by directory, so they can be dealt with a cause at a time: a
+// chmod of a few directories, a disk to replace, a table to look after.
+//
+
+package main
+
+import (
+  "database/sql"
+  "fmt"
+  "io"
+  "sort"
+  "strings"
+
+  pq "github.com/lib/pq"
+)
+
+// a group holding at least this share of the mismatches (and at least cluster_min of them) is pointed out
+const cluster_share = 0.5
+const cluster_min = 5
+
+type pattern_counts map[string]int64
+
+// write lists the largest groups of what is counted, and points out a cluster
+func (c pattern_counts) write(w io.Writer, what string, dimension string, total int64) {
+  if len(c) == 0 {
+    return
+  }
+  type group struct {
+    name string
+    n int64
+  }
+  var groups []group
+  for name, n := range c {
+    groups = append(groups, group{name, n})
+  }
+  sort.Slice(groups, func(i, j int) bool {
+    if groups[i].n != groups[j].n {
+      return groups[i].n > groups[j].n
+    }
+    return groups[i].name < groups[j].name
+  })
+
+  var shown []string
+  for i, g := range groups {
+    if i == 5 {
+      shown = append(shown, fmt.Sprintf("%d more", len(groups)-i))
+      break
+    }
+    shown = append(shown, fmt.Sprintf("%s: %d", g.name, g.n))
+  }
+  fmt.Fprintf(w, "# %s by %s: %s\n", what, dimension, strings.Join(shown, ", "))
+
+  top := groups[0]
+  if len(groups) > 1 && top.n >= cluster_min && float64(top.n) >= cluster_share * float64(total) {
+    fmt.Fprintf(w, "#   clustered: %d of %d %s (%.0f%%) are in %s %s\n", top.n, total, what, 100*float64(top.n)/float64(total), dimension, top.name)
+  }
+}
+
+// human_size formats a power of two in the largest binary unit that divides it
+func human_size(n int64) string {
+  units := []string{"B", "KiB", "MiB", "GiB", "TiB", "PiB"}
+  u := 0
+  for n >= 1024 && n % 1024 == 0 && u < len(units)-1 {
+    n /= 1024
+    u++
+  }
+  return fmt.Sprintf("%d%s", n, units[u])
+}
+
+func size_bucket(size int64) string {
+  if size == 0 {
+    return "empty"
+  }
+  b := int64(1)
+  for b*2 <= size && b < 1<<62 {
+    b *= 2
+  }
+  return human_size(b) + "-" + human_size(b*2)
+}
+
+// alignment_bucket names the largest power-of-two boundary (512 bytes or more) an offset falls on
+func alignment_bucket(offset int64) string {
+  switch {
+  case offset < 0:
+    return "identical on re-read"
+  case offset == 0:
+    return "offset 0"
+  case offset % 512 != 0:
+    return "unaligned"
+  }
+  a := int64(512)
+  for offset % (a*2) == 0 && a < 1<<40 {
+    a *= 2
+  }
+  return "aligned to " + human_size(a)
+}
+
+func device_bucket(side string, file string) string {
+  if remotes[side] != nil {
+    return ""
+  }
+  dev, ok := device_id(side_path(side, file))
+  if !ok {
+    return ""
+  }
+  if disks := physical_disks(dev); len(disks) > 0 {
+    return strings.Join(disks, ",")
+  }
+  return fmt.Sprintf("device %#x", dev)
+}
+
+// write_mismatch_patterns adds the grouped view of the mismatches to the report summary
+func write_mismatch_patterns(w io.Writer, total int64) {
+  by_new_device := pattern_counts{}
+  by_old_device := pattern_counts{}
+  by_dir := pattern_counts{}
+  by_size := pattern_counts{}
+  by_date := pattern_counts{}
+  by_offset := pattern_counts{}
+  devices := map[string]string{} // device of each directory, stat'ed once
+
+  err := each_row(fmt.Sprintf("select filename, size, changed, first_diff from %s where hash_new <> hash_old", pq.QuoteIdentifier(conf.Table_name)), func(rows *sql.Rows) error {
+    var file string
+    var size int64
+    var changed sql.NullTime
+    var first_diff sql.NullInt64
+    if err := rows.Scan(&file, &size, &changed, &first_diff); err != nil {
+      return err
+    }
+
+    for _, side := range []string{"new", "old"} {
+      key := side + ":" + dir_of(file)
+      dev, seen := devices[key]
+      if !seen {
+        dev = device_bucket(side, file)
+        devices[key] = dev
+      }
+      if dev == "" {
+        continue
+      }
+      if side == "new" {
+        by_new_device[dev]++
+      } else {
+        by_old_device[dev]++
+      }
+    }
+
+    by_dir[strings.SplitN(file, "/", 2)[0]]++
+    by_size[size_bucket(size)]++
+    if changed.Valid {
+      by_date[changed.Time.Format("2006-01-02")]++
+    }
+    if first_diff.Valid {
+      by_offset[alignment_bucket(first_diff.Int64)]++
+    }
+    return nil
+  })
+  die_if(err)
+
+  by_new_device.write(w, "mismatches", "new device", total)
+  by_old_device.write(w, "mismatches", "old device", total)
+  by_dir.write(w, "mismatches", "top-level directory", total)
+  by_size.write(w, "mismatches", "size", total)
+  by_date.write(w, "mismatches", "modification date", total)
+  by_offset.write(w, "mismatches", "first difference", total)
+}
+
+// write_error_patterns adds the errors by cause and directory to the report summary
+func write_error_patterns(w io.Writer) {
+  var total int64
+  by_cause := pattern_counts{}
+  by_dir := map[string]pattern_counts{}
+
+  err := each_row(fmt.Sprintf("select filename, error_new, error_old from %s where error_new is not null or error_old is not null", pq.QuoteIdentifier(conf.Table_name)), func(rows *sql.Rows) error {
+    var file string
+    var error_new, error_old sql.NullString
+    if err := rows.Scan(&file, &error_new, &error_old); err != nil {
+      return err
+    }
+    for _, e := range []sql.NullString{error_new, error_old} {
+      if !e.Valid {
+        continue
+      }
+      cause := error_cause(e.String)
+      if by_dir[cause] == nil {
+        by_dir[cause] = pattern_counts{}
+      }
+      total++
+      by_cause[cause]++
+      dir := dir_of(file)
+      if dir == "" {
+        dir = "."
+      }
+      by_dir[cause][dir]++
+    }
+    return nil
+  })
+  die_if(err)
+
+  by_cause.write(w, "errors", "cause", total)
+  for _, cause := range error_causes {
+    if c := by_dir[cause]; c != nil {
+      c.write(w, cause + " errors", "directory", by_cause[cause])
+    }
+  }
+}
@@ -0,0 +1,197 @@
+//
+// Batched claiming.
+//
+// With batch_size set, hash workers don't share a single cursor. Each one claims the next batch_size outstanding
+// rows in filename order with one UPDATE ... RETURNING, so a batch covers one or a few neighbouring directories,
+// hashes them, and stores all of their hashes in one statement. Rows locked by other processes are skipped, and
+// the claim position only moves forward, so files that fail or are skipped are tried once per pass.
+//
+
+package main
+
+import (
+  "fmt"
+  "sort"
+  "sync"
+
+  pq "github.com/lib/pq"
+)
+
+type batch_cursor struct {
+  mu sync.Mutex
+  last string // the highest filename claimed so far in this phase
+  done bool
+}
+
+// next claims, for owner, the following batch of up to limit rows matching where; it returns an empty batch
+// once there are none left
+func (c *batch_cursor) next(side string, where string, owner string, limit int) ([]work_item, error) {
+  c.mu.Lock()
+  defer c.mu.Unlock()
+  if c.done {
+    return nil, nil
+  }
+
+  t := pq.QuoteIdentifier(conf.Table_name)
+  res, err := db.Query(fmt.Sprintf(`update %s set status = $1, claimed_by = $2, claimed_at = now() where filename in (
+      select filename from %s where %s and filename > $3 order by filename limit $4 for update skip locked
+    ) returning filename, size`, t, t, where), "hashing_"+side, owner, c.last, limit)
+  if err != nil {
+    return nil, err
+  }
+  defer res.Close()
+
+  var batch []work_item
+  for res.Next() {
+    var w work_item
+    if err = res.Scan(&w.filename, &w.size); err != nil {
+      return nil, err
+    }
+    batch = append(batch, w)
+  }
+  if err = res.Err(); err != nil {
+    return nil, err
+  }
+
+  if len(batch) == 0 {
+    c.done = true
+    return nil, nil
+  }
+  sort.Slice(batch, func(i, j int) bool { return batch[i].filename < batch[j].filename })
+  c.last = batch[len(batch)-1].filename
+  sort_work(side, batch)
+  return batch, nil
+}
+
+// hash_batches runs a pool of batch workers over the rows matching where
+func hash_batches(side string, where string, threads int, phase *phase_progress) {
+  cursor := &batch_cursor{}
+  pool := start_pool(threads, func() error {
+    batch_worker(side, where, cursor, phase)
+    return nil
+  })
+  pool.Wait()
+}
+
+func batch_worker(side string, where string, cursor *batch_cursor, phase *phase_progress) {
+  for {
+    pause_gate.wait()
+    if deadline_passed() {
+      return
+    }
+
+    batch, err := cursor.next(side, where, worker_id, conf.Batch_size)
+    if err != nil {
+      le.Print("error claiming a batch of ",side," files: ",err)
+      return
+    }
+    if len(batch) == 0 {
+      return
+    }
+
+    bspan := sampled_span("hash_batch", phase.span)
+    bspan.set("files", len(batch))
+
+    var hashed []work_item
+    var hashes, skipped []string
+    var extras []*digests
+    for _, w := range batch {
+      pause_gate.wait()
+      p := policy_for(w.filename, w.size)
+      if p.Action == "skip" || deadline_passed() {
+        skipped = append(skipped, w.filename)
+        continue
+      }
+
+      hash, extra, err := compute_hash_digests(side, w.filename, p, true)
+      if err != nil && retry_later(side, w, err) {
+        skipped = append(skipped, w.filename) // released with the skipped, for the retry queue to claim again
+        continue
+      }
+      if err != nil {
+        le.Print("error hashing ",side," ",w.filename,": ",err)
+        record_error(side, w.filename, err)
+        continue
+      }
+      hashed = append(hashed, w)
+      hashes = append(hashes, hash)
+      extras = append(extras, extra)
+    }
+
+    if len(skipped) > 0 {
+      if err = release_claims(skipped); err != nil {
+        le.Print("error releasing skipped files: ",err)
+      }
+    }
+
+    dspan := start_span("db.update", bspan)
+    err = store_hashes(side, hashed, hashes)
+    dspan.finish(err)
+    bspan.finish(err)
+    if err != nil {
+      le.Print("error adding hashes to DB: ", err)
+      for _, w := range hashed {
+        record_error(side, w.filename, fmt.Errorf("adding hash to DB: %s", err))
+      }
+      continue
+    }
+    confirm_batch(side, hashed, hashes)
+    for i, w := range hashed {
+      if hashes[i] == "" {
+        continue // didn't read back right
+      }
+      phase.done(w.size)
+      after_hash(side, w.filename, extras[i])
+    }
+  }
+}
+
+// confirm_batch reads the hashes of a batch back, in one query unless some read back differently. The hashes of
+// files that don't read back right are recorded as errors and blanked.
+func confirm_batch(side string, files []work_item, hashes []string) {
+  if !conf.Readback || len(files) == 0 {
+    return
+  }
+  names := make([]string, len(files))
+  for i, w := range files {
+    names[i] = w.filename
+  }
+  bad, _, err := read_back(side, names, hashes)
+  if err != nil {
+    le.Print("error reading back the hashes of a batch, trying them one by one: ", err)
+    bad = bad[:0]
+    for i := range names {
+      bad = append(bad, i)
+    }
+  }
+  for _, i := range bad {
+    if err = confirm_stored(side, names[i], hashes[i], worker_id); err != nil {
+      le.Print("error hashing ",side," ",names[i],": ",err)
+      record_error(side, names[i], err)
+      hashes[i] = ""
+    }
+  }
+}
+
+// store_hashes writes the hashes of a batch in one statement and releases their claims
+func store_hashes(side string, files []work_item, hashes []string) error {
+  if len(files) == 0 {
+    return nil
+  }
+  names := make([]string, len(files))
+  for i, w := range files {
+    names[i] = w.filename
+  }
+  _, err := db_exec(fmt.Sprintf(`update %s t set %s = v.hash, %s = null, %s = now(), %s = $3, status = null, claimed_by = null, claimed_at = null
+    from unnest($1::text[], $2::text[]) as v(filename, hash) where t.filename = v.filename`,
+    pq.QuoteIdentifier(conf.Table_name), pq.QuoteIdentifier("hash_"+side), pq.QuoteIdentifier("error_"+side), pq.QuoteIdentifier("hashed_at_"+side), pq.QuoteIdentifier("hashed_by_"+side)),
+    pq.Array(names), pq.Array(hashes), worker_id)
+  return err
+}
+
+// release_claims hands files claimed by this worker back without hashing them
+func release_claims(files []string) error {
+  _, err := db_exec(fmt.Sprintf("update %s set status = null, claimed_by = null, claimed_at = null where filename = any($1) and claimed_by = $2",
+    pq.QuoteIdentifier(conf.Table_name)), pq.Array(files), worker_id)
+  return err
+}
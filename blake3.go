@@ -0,0 +1,180 @@
+//
+// BLAKE3, built in.
+//
+// With "hash_algorithm": "blake3" files are hashed with BLAKE3 without an external command. BLAKE3 is a tree
+// hash: the content is split into 1 KiB chunks whose digests are combined pairwise, so the subtrees of one file
+// can be hashed on different cores. A local file hashed with the "full" policy is read in segments of
+// blake3_segment_mb (default 4) by blake3_threads goroutines (default: all cores), independently of how many
+// files are hashed at the same time (hash_threads_new/old); a file of a single segment or less is hashed by
+// one. The segment buffers are leased from the memory budget (memory.go). Content read as a stream (remote
+// trees, transforms, normalize_eol, extra digests) goes through the sequential hasher.
+//
+
+package main
+
+import (
+  "io"
+  "math/bits"
+  "os"
+  "runtime"
+
+  "lukechampine.com/blake3"
+  "lukechampine.com/blake3/guts"
+)
+
+func blake3_threads() int {
+  if conf.Blake3_threads > 0 {
+    return conf.Blake3_threads
+  }
+  return runtime.NumCPU()
+}
+
+// blake3_segment is the length a thread hashes at a time, a power of two number of chunks
+func blake3_segment() int64 {
+  mb := int64(4)
+  if conf.Blake3_segment_mb > 0 {
+    mb = int64(conf.Blake3_segment_mb)
+  }
+  return int64(1) << (63 - bits.LeadingZeros64(uint64(mb << 20)))
+}
+
+func new_blake3() *blake3.Hasher {
+  return blake3.New(32, nil)
+}
+
+// blake3_tree is the stack of subtree chaining values of the content hashed so far, as in the reference
+// implementation: one per height at most, the heights being the bits of the number of chunks. A tree can also
+// be a subtree starting base chunks into the file.
+type blake3_tree struct {
+  stack [64][8]uint32
+  base uint64
+  chunks uint64
+}
+
+func (t *blake3_tree) push(cv [8]uint32, height int) {
+  i := height
+  for t.chunks & (1 << i) != 0 {
+    cv = guts.ChainingValue(guts.ParentNode(t.stack[i], cv, &guts.IV, 0))
+    i++
+  }
+  t.stack[i] = cv
+  t.chunks += 1 << height
+}
+
+// add hashes whole chunks, starting at a multiple of 16 chunks or with fewer than that
+func (t *blake3_tree) add(buf []byte) {
+  var block [guts.MaxSIMD * guts.ChunkSize]byte
+  for len(buf) >= len(block) {
+    copy(block[:], buf)
+    t.push(guts.ChainingValue(guts.CompressBuffer(&block, len(block), &guts.IV, t.base + t.chunks, 0)), 4)
+    buf = buf[len(block):]
+  }
+  for ; len(buf) > 0; buf = buf[guts.ChunkSize:] {
+    t.push(guts.ChainingValue(guts.CompressChunk(buf[:guts.ChunkSize], &guts.IV, t.base + t.chunks, 0)), 0)
+  }
+}
+
+// root finishes the hash with the last chunk, which may be partial or empty
+func (t *blake3_tree) root(last []byte) []byte {
+  n := guts.CompressChunk(last, &guts.IV, t.base + t.chunks, 0)
+  for i := bits.TrailingZeros64(t.chunks); i < bits.Len64(t.chunks); i++ {
+    if t.chunks & (1 << i) != 0 {
+      n = guts.ParentNode(t.stack[i], guts.ChainingValue(n), &guts.IV, 0)
+    }
+  }
+  n.Flags |= guts.FlagRoot
+  out := guts.WordsToBytes(guts.CompressNode(n))
+  return out[:32]
+}
+
+// blake3_file hashes a local file with its segments spread over blake3_threads goroutines
+func blake3_file(f *os.File) ([]byte, error) {
+  fi, err := f.Stat()
+  if err != nil {
+    return nil, err
+  }
+  size := fi.Size()
+  seg := blake3_segment()
+
+  // the last chunk ends the tree and is hashed last, even when it is whole
+  before_last := int64(0)
+  if size > 0 {
+    before_last = (size - 1) / guts.ChunkSize * guts.ChunkSize
+  }
+  segments := before_last / seg
+
+  var t blake3_tree
+  height := bits.TrailingZeros64(uint64(seg / guts.ChunkSize))
+  if segments > 1 {
+    // a segment buffer per thread and the tail's, from the memory budget
+    threads := blake3_threads()
+    if int64(threads) > segments {
+      threads = int(segments)
+    }
+    if threads = memory_fits(seg, threads + 1) - 1; threads < 1 {
+      threads = 1
+    }
+    release := lease_memory(seg * int64(threads + 1))
+    defer release()
+
+    cvs := make([][8]uint32, segments)
+    next := make(chan int64)
+    pool := start_pool(threads, func() error {
+      buf := make([]byte, seg)
+      var failed error
+      for i := range next {
+        if failed != nil {
+          continue
+        }
+        if _, err := f.ReadAt(buf, i * seg); err != nil {
+          failed = err
+          continue
+        }
+        // each segment is a subtree of its own, its chunks counted from where it sits in the file
+        s := blake3_tree{base: uint64(i * seg / guts.ChunkSize)}
+        s.add(buf)
+        cvs[i] = s.stack[height]
+      }
+      return failed
+    })
+    for i := int64(0); i < segments; i++ {
+      next <- i
+    }
+    close(next)
+    if err := pool.Wait(); err != nil {
+      return nil, err
+    }
+    for _, cv := range cvs {
+      t.push(cv, height)
+    }
+  } else {
+    segments = 0
+  }
+
+  // what is left after the segments is hashed in order, a segment at a time
+  tail := before_last - segments * seg
+  if tail > seg {
+    tail = seg
+  }
+  if segments == 0 {
+    release := lease_memory(tail)
+    defer release()
+  }
+  buf := make([]byte, tail)
+  for off := segments * seg; off < before_last; {
+    n := seg
+    if before_last - off < n {
+      n = before_last - off
+    }
+    if _, err := f.ReadAt(buf[:n], off); err != nil {
+      return nil, err
+    }
+    t.add(buf[:n])
+    off += n
+  }
+  last := make([]byte, size - before_last)
+  if _, err := f.ReadAt(last, before_last); err != nil && err != io.EOF {
+    return nil, err
+  }
+  return t.root(last), nil
+}
@@ -0,0 +1,82 @@
+//
+// Error-rate circuit breaker.
+//
+// If more than max_errors files fail within error_window seconds (a mount died, a server went away), the
+// breaker trips: operators are alerted through alert_command, and the run is paused (error_action "pause",
+// the default; resume with SIGUSR2, the control endpoint or "notify resume") or stopped ("abort"), the run then
+// being recorded as aborted, and the process exiting with status 3.
+//
+
+package main
+
+import (
+  "fmt"
+  "os"
+  "os/exec"
+  "strings"
+  "sync"
+  "time"
+)
+
+type circuit_breaker struct {
+  mu sync.Mutex
+  errors []time.Time
+}
+
+var breaker circuit_breaker
+
+func error_window() time.Duration {
+  if conf.Error_window > 0 {
+    return time.Duration(conf.Error_window) * time.Second
+  }
+  return 5 * time.Minute
+}
+
+// failure counts one error, and trips the breaker if there have been too many recently
+func (b *circuit_breaker) failure() {
+  if conf.Max_errors <= 0 {
+    return
+  }
+  b.mu.Lock()
+  now := time.Now()
+  cutoff := now.Add(-error_window())
+  recent := b.errors[:0]
+  for _, t := range b.errors {
+    if t.After(cutoff) {
+      recent = append(recent, t)
+    }
+  }
+  b.errors = append(recent, now)
+  tripped := len(b.errors) > conf.Max_errors
+  if tripped {
+    b.errors = nil // start counting afresh after a resume
+  }
+  b.mu.Unlock()
+
+  if !tripped {
+    return
+  }
+  msg := fmt.Sprintf("more than %d errors within %s on table %s", conf.Max_errors, error_window(), conf.Table_name)
+  notify("error-threshold", msg, "")
+  if conf.Error_action == "abort" {
+    alert(msg + ", aborting the run")
+    // notifications go out as they are sent, so once the run is recorded as aborted nothing is left to flush
+    finish_run("aborted")
+    os.Exit(3)
+  }
+  alert(msg + ", pausing hash workers")
+  pause_gate.pause("errors")
+}
+
+// alert logs a message for operators and passes it to alert_command on stdin
+func alert(msg string) {
+  le.Print("ALERT: ", msg)
+  if conf.Alert_command == "" {
+    return
+  }
+  cmd := exec.Command("sh", "-c", conf.Alert_command)
+  cmd.Stdin = strings.NewReader(msg + "\n")
+  if out, err := cmd.CombinedOutput(); err != nil {
+    le.Print("alert command failed: ", err, ": ", string(out))
+  }
+}
@@ -0,0 +1,49 @@
+//
+// Creation time.
+//
+// The records-management policy requires a migration to preserve creation times. With "btime": true every hashed
+// file also gets its birth time recorded (btime_new/btime_old) where the platform and filesystem report it:
+// statx on Linux, the stat birth time on macOS, the creation time on Windows. The report lists the files
+// whose creation times differ, to the second, as BTIME problems.
+//
+
+package main
+
+import (
+  "fmt"
+  "io"
+  "time"
+
+  pq "github.com/lib/pq"
+)
+
+func record_btime(side string, file string) error {
+  if remotes[side] != nil {
+    return nil
+  }
+  btime, ok, err := birth_time(side_path(side, file))
+  if err != nil || !ok {
+    return err
+  }
+  _, err = db_exec(fmt.Sprintf("update %s set %s = $2 where filename = $1", pq.QuoteIdentifier(conf.Table_name),
+    pq.QuoteIdentifier("btime_"+side)), file, btime)
+  return err
+}
+
+func write_btime_report(w io.Writer) int64 {
+  rows, err := db.Query(fmt.Sprintf(`select filename, btime_new, btime_old from %s
+    where date_trunc('second', btime_new) <> date_trunc('second', btime_old) order by filename`, pq.QuoteIdentifier(conf.Table_name)))
+  die_if(err)
+  defer rows.Close()
+
+  var problems int64
+  for rows.Next() {
+    var file string
+    var btime_new, btime_old time.Time
+    die_if(rows.Scan(&file, &btime_new, &btime_old))
+    fmt.Fprintf(w, "BTIME\t%s\tnew=%s old=%s\n", file, btime_new.Format(time.RFC3339), btime_old.Format(time.RFC3339))
+    problems++
+  }
+  die_if(rows.Err())
+  return problems
+}
@@ -0,0 +1,14 @@
+package main
+
+import (
+  "syscall"
+  "time"
+)
+
+func birth_time(path string) (time.Time, bool, error) {
+  var st syscall.Stat_t
+  if err := syscall.Stat(path, &st); err != nil {
+    return time.Time{}, false, err
+  }
+  return time.Unix(st.Birthtimespec.Unix()), true, nil
+}
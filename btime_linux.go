@@ -0,0 +1,21 @@
+package main
+
+import (
+  "time"
+
+  "golang.org/x/sys/unix"
+)
+
+func birth_time(path string) (time.Time, bool, error) {
+  var st unix.Statx_t
+  if err := unix.Statx(unix.AT_FDCWD, path, 0, unix.STATX_BTIME, &st); err != nil {
+    if err == unix.ENOSYS {
+      return time.Time{}, false, nil
+    }
+    return time.Time{}, false, err
+  }
+  if st.Mask & unix.STATX_BTIME == 0 {
+    return time.Time{}, false, nil // not kept by this filesystem
+  }
+  return time.Unix(st.Btime.Sec, int64(st.Btime.Nsec)), true, nil
+}
@@ -0,0 +1,11 @@
+//go:build !linux && !darwin && !windows
+
+package main
+
+import (
+  "time"
+)
+
+func birth_time(path string) (time.Time, bool, error) {
+  return time.Time{}, false, nil
+}
@@ -0,0 +1,19 @@
+package main
+
+import (
+  "os"
+  "syscall"
+  "time"
+)
+
+func birth_time(path string) (time.Time, bool, error) {
+  fi, err := os.Stat(path)
+  if err != nil {
+    return time.Time{}, false, err
+  }
+  d, ok := fi.Sys().(*syscall.Win32FileAttributeData)
+  if !ok {
+    return time.Time{}, false, nil
+  }
+  return time.Unix(0, d.CreationTime.Nanoseconds()), true, nil
+}
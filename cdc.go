@@ -0,0 +1,173 @@
+//
+// Content-defined chunk fingerprints.
+//
+// With cdc_fingerprints set, the content of each file is also cut into chunks at positions chosen by a rolling
+// gear hash (FastCDC, averaging cdc_avg_kb, 1 MB by default) and a fingerprint of every chunk is stored in
+// cdc_new/cdc_old. Since the cut points follow the content, an insertion or a damaged range only changes the
+// chunks around it; when the two copies of a file mismatch, the report compares their fingerprints to show
+// roughly which byte ranges differ and how much of the file is affected.
+//
+
+package main
+
+import (
+  "crypto/sha256"
+  "encoding/binary"
+  "fmt"
+  "hash"
+  "math/bits"
+  "math/rand"
+  "strings"
+
+  pq "github.com/lib/pq"
+)
+
+// each stored chunk is its length followed by the first cdc_fp_size bytes of its SHA256
+const cdc_fp_size = 16
+
+// the gear table must never change, or fingerprints stored by earlier runs stop lining up
+var gear = func() (g [256]uint64) {
+  rnd := rand.New(rand.NewSource(0x1c4ec4))
+  for i := range g {
+    g[i] = rnd.Uint64()
+  }
+  return
+}()
+
+type cdc_writer struct {
+  min, avg, max int64
+  mask_s, mask_l uint64 // stricter before the average size, looser after it (normalized chunking)
+  fp uint64
+  n int64 // bytes in the current chunk
+  h hash.Hash
+  out []byte
+}
+
+func new_cdc_writer() *cdc_writer {
+  avg := int64(1) << 20
+  if conf.Cdc_avg_kb > 0 {
+    avg = int64(conf.Cdc_avg_kb) << 10
+  }
+  b := bits.Len64(uint64(avg)) - 1
+  // the high bits of the gear hash depend on the most bytes, so the masks select from the top
+  return &cdc_writer{
+    min: avg / 4,
+    avg: avg,
+    max: avg * 4,
+    mask_s: ^uint64(0) << uint(64-b-2),
+    mask_l: ^uint64(0) << uint(64-b+2),
+    h: sha256.New(),
+  }
+}
+
+func (c *cdc_writer) Write(p []byte) (int, error) {
+  total := len(p)
+  for len(p) > 0 {
+    cut := -1
+    for i, b := range p {
+      c.fp = (c.fp << 1) + gear[b]
+      c.n++
+      if c.n < c.min {
+        continue
+      }
+      mask := c.mask_s
+      if c.n >= c.avg {
+        mask = c.mask_l
+      }
+      if c.fp & mask == 0 || c.n >= c.max {
+        cut = i
+        break
+      }
+    }
+    if cut < 0 {
+      c.h.Write(p)
+      break
+    }
+    c.h.Write(p[:cut+1])
+    c.emit()
+    p = p[cut+1:]
+  }
+  return total, nil
+}
+
+func (c *cdc_writer) emit() {
+  var buf [4]byte
+  binary.BigEndian.PutUint32(buf[:], uint32(c.n))
+  c.out = append(c.out, buf[:]...)
+  c.out = append(c.out, c.h.Sum(nil)[:cdc_fp_size]...)
+  c.h.Reset()
+  c.fp = 0
+  c.n = 0
+}
+
+// finish ends the last chunk and returns the fingerprints as stored
+func (c *cdc_writer) finish() []byte {
+  if c.n > 0 {
+    c.emit()
+  }
+  if c.out == nil {
+    return []byte{}
+  }
+  return c.out
+}
+
+func record_cdc(side string, file string, fps []byte) error {
+  _, err := db_exec(fmt.Sprintf("update %s set %s = $2 where filename = $1", pq.QuoteIdentifier(conf.Table_name), pq.QuoteIdentifier("cdc_"+side)),
+    file, fps)
+  return err
+}
+
+type cdc_chunk struct {
+  offset int64
+  length int64
+  fp string
+}
+
+func decode_cdc(buf []byte) []cdc_chunk {
+  var chunks []cdc_chunk
+  var offset int64
+  for len(buf) >= 4+cdc_fp_size {
+    n := int64(binary.BigEndian.Uint32(buf))
+    chunks = append(chunks, cdc_chunk{offset, n, string(buf[4:4+cdc_fp_size])})
+    offset += n
+    buf = buf[4+cdc_fp_size:]
+  }
+  return chunks
+}
+
+// cdc_diff describes which byte ranges of the new copy have no matching chunk in the old copy
+func cdc_diff(new_fps []byte, old_fps []byte) string {
+  old := map[string]bool{}
+  for _, c := range decode_cdc(old_fps) {
+    old[c.fp] = true
+  }
+
+  type span struct{ from, to int64 }
+  var ranges []span
+  var size, differs int64
+  for _, c := range decode_cdc(new_fps) {
+    size += c.length
+    if old[c.fp] {
+      continue
+    }
+    differs += c.length
+    if n := len(ranges); n > 0 && ranges[n-1].to == c.offset {
+      ranges[n-1].to += c.length
+    } else {
+      ranges = append(ranges, span{c.offset, c.offset + c.length})
+    }
+  }
+  if size == 0 {
+    return ""
+  }
+
+  var shown []string
+  for i, r := range ranges {
+    if i == 10 {
+      shown = append(shown, fmt.Sprintf("... %d more", len(ranges)-i))
+      break
+    }
+    shown = append(shown, fmt.Sprintf("%d-%d", r.from, r.to-1))
+  }
+  return fmt.Sprintf("differs in %d of %d bytes (%.1f%%), %d ranges: %s", differs, size, 100*float64(differs)/float64(size), len(ranges), strings.Join(shown, ", "))
+}
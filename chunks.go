@@ -0,0 +1,138 @@
+//
+// Per-chunk digests, for partial re-verification.
+//
+// With chunk_digests set, the digest of every chunk_size piece of a file is stored next to its hash (chunks_new,
+// chunks_old). After a partial rewrite of a large file, only the chunks the write could have touched need to be
+// read again:
+//
+//   integrity_check recheck [-side new|old] [-offset bytes] [-length bytes] file...
+//
+// Without -offset/-length every chunk is compared, which still tells which parts of the file changed.
+//
+
+package main
+
+import (
+  "bytes"
+  "crypto/sha256"
+  "database/sql"
+  "encoding/binary"
+  "flag"
+  "fmt"
+  "io"
+  "os"
+
+  pq "github.com/lib/pq"
+)
+
+// encode_chunks packs the chunk size and the chunk digests into the value stored in chunks_<side>
+func encode_chunks(sums [][]byte) []byte {
+  buf := make([]byte, 8, 8+len(sums)*sha256.Size)
+  binary.BigEndian.PutUint64(buf, uint64(chunk_size()))
+  for _, s := range sums {
+    buf = append(buf, s...)
+  }
+  return buf
+}
+
+func decode_chunks(buf []byte) (int64, [][]byte, error) {
+  if len(buf) < 8 || (len(buf)-8) % sha256.Size != 0 {
+    return 0, nil, fmt.Errorf("malformed chunk digests")
+  }
+  cs := int64(binary.BigEndian.Uint64(buf))
+  var sums [][]byte
+  for p := buf[8:]; len(p) > 0; p = p[sha256.Size:] {
+    sums = append(sums, p[:sha256.Size])
+  }
+  return cs, sums, nil
+}
+
+func record_chunks(side string, file string, sums [][]byte) error {
+  _, err := db_exec(fmt.Sprintf("update %s set %s = $2 where filename = $1", pq.QuoteIdentifier(conf.Table_name), pq.QuoteIdentifier("chunks_"+side)),
+    file, encode_chunks(sums))
+  return err
+}
+
+func recheck_command(args []string) {
+  fs := flag.NewFlagSet("recheck", flag.ExitOnError)
+  side := fs.String("side", "new", "Which tree to re-read: new or old")
+  offset := fs.Int64("offset", 0, "Start of the byte range that may have changed")
+  length := fs.Int64("length", 0, "Length of the byte range that may have changed (0: up to the end of the file)")
+  fs.Parse(args)
+
+  changed := false
+  for _, file := range fs.Args() {
+    ok, err := recheck_file(*side, file, *offset, *length)
+    if err != nil {
+      le.Print("ERROR ", file, ": ", err)
+      changed = true
+      continue
+    }
+    if !ok {
+      changed = true
+    }
+  }
+  if changed {
+    os.Exit(1)
+  }
+}
+
+// recheck_file re-reads the chunks of a file overlapping offset..offset+length and compares them to the stored digests
+func recheck_file(side string, file string, offset int64, length int64) (bool, error) {
+  if remotes[side] != nil || transformed(side, file) {
+    return false, fmt.Errorf("rechecking chunks needs random access to the file as stored")
+  }
+
+  var stored []byte
+  var size int64
+  err := db.QueryRow(fmt.Sprintf("select %s, size from %s where filename = $1", pq.QuoteIdentifier("chunks_"+side), pq.QuoteIdentifier(conf.Table_name)), file).Scan(&stored, &size)
+  if err == sql.ErrNoRows {
+    return false, fmt.Errorf("not in table %s", conf.Table_name)
+  }
+  if err != nil {
+    return false, err
+  }
+  if stored == nil {
+    return false, fmt.Errorf("no chunk digests stored")
+  }
+  cs, sums, err := decode_chunks(stored)
+  if err != nil {
+    return false, err
+  }
+
+  f, err := os.Open(side_path(side, file))
+  if err != nil {
+    return false, err
+  }
+  defer f.Close()
+  fi, err := f.Stat()
+  if err != nil {
+    return false, err
+  }
+
+  ok := true
+  if fi.Size() != size {
+    lw.Printf("CHANGED %s: size was %d, now %d", file, size, fi.Size())
+    ok = false
+  }
+
+  first := offset / cs
+  last := (fi.Size() + cs - 1) / cs - 1
+  if length > 0 && (offset+length-1) / cs < last {
+    last = (offset+length-1) / cs
+  }
+  for i := first; i <= last; i++ {
+    h := sha256.New()
+    if _, err = io.Copy(h, io.NewSectionReader(f, i*cs, cs)); err != nil {
+      return false, fmt.Errorf("reading chunk %d: %s", i, err)
+    }
+    if i >= int64(len(sums)) || !bytes.Equal(h.Sum(nil), sums[i]) {
+      lw.Printf("CHANGED %s: chunk %d (bytes %d-%d)", file, i, i*cs, (i+1)*cs-1)
+      ok = false
+    }
+  }
+  if ok {
+    l.Printf("OK %s: chunks %d-%d unchanged", file, first, last)
+  }
+  return ok, nil
+}
@@ -0,0 +1,54 @@
+//
+// Confirmation for destructive commands.
+//
+// Commands that delete or rewrite state describe exactly what they will affect and ask before acting;
+// -yes answers for them, for use from scripts.
+//
+
+package main
+
+import (
+  "bufio"
+  "fmt"
+  "os"
+  "strings"
+
+  pq "github.com/lib/pq"
+)
+
+var assume_yes bool
+
+func confirm(what string) bool {
+  fmt.Println(what)
+  if assume_yes {
+    fmt.Println("proceeding (-yes)")
+    return true
+  }
+  fmt.Print("Proceed? [y/N] ")
+  answer, err := bufio.NewReader(os.Stdin).ReadString('\n')
+  if err != nil {
+    fmt.Println()
+    l.Print("no confirmation (", err, "); use -yes to run without a prompt")
+    return false
+  }
+  answer = strings.ToLower(strings.TrimSpace(answer))
+  return answer == "y" || answer == "yes"
+}
+
+// truncate_table empties the state table, and the companion tables given (quoted), so the next run walks the
+// tree again; it tells whether it did
+func truncate_table(companions ...string) bool {
+  rows := count_rows()
+  what := fmt.Sprintf("This will delete all %d rows (hashes included) from table %s.", rows, conf.Table_name)
+  if len(companions) > 0 {
+    what = fmt.Sprintf("This will delete all %d rows (hashes included) from table %s, and all rows of %s.", rows, conf.Table_name, strings.Join(companions, ", "))
+  }
+  if !confirm(what) {
+    l.Print("aborted")
+    return false
+  }
+  _, err := db.Exec(fmt.Sprintf("truncate table %s", strings.Join(append([]string{pq.QuoteIdentifier(conf.Table_name)}, companions...), ", ")))
+  die_if(err)
+  l.Print("table ", conf.Table_name, " truncated")
+  return true
+}
@@ -0,0 +1,78 @@
+//
+// Local pause/resume control: signals (see signals_unix.go) and an optional HTTP endpoint.
+//
+//   control_listen = "127.0.0.1:8765"
+//   curl -X POST localhost:8765/pause ; curl -X POST localhost:8765/resume ; curl localhost:8765/status
+//   curl -X POST 'localhost:8765/prioritize?prefix=projects/urgent/&level=5'
+//
+// Pausing only stops workers from picking up new files; files being hashed are finished, and nothing is lost.
+//
+
+package main
+
+import (
+  "fmt"
+  "net/http"
+)
+
+func (g *gate) is_paused() bool {
+  g.mu.Lock()
+  defer g.mu.Unlock()
+  return len(g.reasons) > 0
+}
+
+func start_control_server() {
+  if conf.Control_listen == "" {
+    return
+  }
+
+  mux := http.NewServeMux()
+  mux.HandleFunc("/pause", func(w http.ResponseWriter, r *http.Request) {
+    if r.Method != "POST" {
+      http.Error(w, "use POST", http.StatusMethodNotAllowed)
+      return
+    }
+    pause_gate.pause("operator")
+    fmt.Fprintln(w, "paused")
+  })
+  mux.HandleFunc("/resume", func(w http.ResponseWriter, r *http.Request) {
+    if r.Method != "POST" {
+      http.Error(w, "use POST", http.StatusMethodNotAllowed)
+      return
+    }
+    pause_gate.operator_resume()
+    fmt.Fprintln(w, "resumed")
+  })
+  mux.HandleFunc("/prioritize", func(w http.ResponseWriter, r *http.Request) {
+    if r.Method != "POST" {
+      http.Error(w, "use POST", http.StatusMethodNotAllowed)
+      return
+    }
+    level := 1
+    if v := r.URL.Query().Get("level"); v != "" {
+      if _, err := fmt.Sscan(v, &level); err != nil {
+        http.Error(w, "bad level", http.StatusBadRequest)
+        return
+      }
+    }
+    n, err := set_priority(r.URL.Query().Get("prefix"), level)
+    if err != nil {
+      http.Error(w, err.Error(), http.StatusInternalServerError)
+      return
+    }
+    fmt.Fprintln(w, "prioritized", n, "files")
+  })
+  mux.HandleFunc("/status", func(w http.ResponseWriter, r *http.Request) {
+    if pause_gate.is_paused() {
+      fmt.Fprintln(w, "paused")
+    } else {
+      fmt.Fprintln(w, "running")
+    }
+  })
+
+  l.Print("control endpoint listening on ", conf.Control_listen)
+  go func() {
+    err := http.ListenAndServe(conf.Control_listen, mux)
+    l.Print("control endpoint stopped: ", err)
+  }()
+}
@@ -0,0 +1,458 @@
+//
+// Coordinator/worker over gRPC.
+//
+// Worker machines don't need database access or credentials: the process with the database serves batches of
+// work on coordinator_listen, and "integrity_check -worker" with coordinator_address set pulls batches, hashes
+// them against its own new_path/old_path and streams the results back. The policy of each file travels with it;
+// transforms and remote trees are taken from the worker's own configuration. A worker hashing with another
+// hash_algorithm than the coordinator is refused work, and stops.
+//
+//   coordinator:  "coordinator_listen": ":7070", "coordinator_token": "...", "coordinator_cert"/"coordinator_key"
+//   worker:       "coordinator_address": "coord:7070", "coordinator_token": "...", "coordinator_ca" (for TLS)
+//
+// Messages are JSON-encoded, so no generated code is involved. Remote workers appear in <table>_workers as
+// remote:<host>:<pid> while they are active, kept alive by a heartbeat every heartbeat_interval even through a
+// long batch, and their claims expire like any other worker's if they go away. A result arriving after its claim
+// expired is dropped, the file being hashed again by whoever claimed it next, and logged.
+// The coordinator hashes alongside its workers, and once the tree is done waits for their outstanding batches.
+//
+
+package main
+
+import (
+  "context"
+  "encoding/json"
+  "fmt"
+  "io"
+  "net"
+  "os"
+  "strings"
+  "sync"
+  "sync/atomic"
+  "time"
+
+  pq "github.com/lib/pq"
+  "google.golang.org/grpc"
+  "google.golang.org/grpc/codes"
+  "google.golang.org/grpc/credentials"
+  "google.golang.org/grpc/credentials/insecure"
+  "google.golang.org/grpc/metadata"
+  "google.golang.org/grpc/status"
+)
+
+type json_codec struct{}
+
+func (json_codec) Marshal(v interface{}) ([]byte, error) { return json.Marshal(v) }
+
+func (json_codec) Unmarshal(data []byte, v interface{}) error { return json.Unmarshal(data, v) }
+
+func (json_codec) Name() string { return "json" }
+
+type claim_request struct {
+  Worker string `json:"worker"`
+  Max int `json:"max"`
+  Algorithm string `json:"algorithm"` // the worker's hash_algorithm
+}
+
+type remote_item struct {
+  Side string `json:"side"`
+  Filename string `json:"filename"`
+  Size int64 `json:"size"`
+  Action string `json:"action"`
+  Normalize_eol bool `json:"normalize_eol"`
+}
+
+type claim_reply struct {
+  Items []remote_item `json:"items"`
+  Finished bool `json:"finished"` // no more work will come; the worker can exit
+}
+
+type hash_result struct {
+  Worker string `json:"worker"`
+  Side string `json:"side"`
+  Filename string `json:"filename"`
+  Hash string `json:"hash"`
+  Error string `json:"error"`
+}
+
+type report_reply struct {
+  Stored int `json:"stored"`
+}
+
+type heartbeat_request struct {
+  Worker string `json:"worker"`
+}
+
+// results of remote workers that came after their claim had expired, over the life of the process
+var late_results int64
+
+var coordinator_desc = grpc.ServiceDesc{
+  ServiceName: "integrity_check.Coordinator",
+  HandlerType: (*interface{})(nil),
+  Methods: []grpc.MethodDesc{{
+    MethodName: "Claim",
+    Handler: func(srv interface{}, ctx context.Context, dec func(interface{}) error, _ grpc.UnaryServerInterceptor) (interface{}, error) {
+      var req claim_request
+      if err := dec(&req); err != nil {
+        return nil, err
+      }
+      if err := check_token(ctx); err != nil {
+        return nil, err
+      }
+      if req.Algorithm != hash_algorithm() {
+        return nil, status.Errorf(codes.FailedPrecondition, "the coordinator hashes with %s, worker %s with %q", hash_algorithm(), req.Worker, req.Algorithm)
+      }
+      return remote_claim(req.Worker, req.Max)
+    },
+  }, {
+    MethodName: "Heartbeat",
+    Handler: func(srv interface{}, ctx context.Context, dec func(interface{}) error, _ grpc.UnaryServerInterceptor) (interface{}, error) {
+      var req heartbeat_request
+      if err := dec(&req); err != nil {
+        return nil, err
+      }
+      if err := check_token(ctx); err != nil {
+        return nil, err
+      }
+      if req.Worker == "" {
+        return nil, status.Error(codes.InvalidArgument, "no worker name")
+      }
+      if err := touch_remote_worker(req.Worker); err != nil {
+        return nil, status.Error(codes.Unavailable, err.Error())
+      }
+      return &report_reply{}, nil
+    },
+  }},
+  Streams: []grpc.StreamDesc{{
+    StreamName: "Report",
+    ClientStreams: true,
+    Handler: func(srv interface{}, stream grpc.ServerStream) error {
+      if err := check_token(stream.Context()); err != nil {
+        return err
+      }
+      stored := 0
+      for {
+        var r hash_result
+        err := stream.RecvMsg(&r)
+        if err == io.EOF {
+          return stream.SendMsg(&report_reply{Stored: stored})
+        }
+        if err != nil {
+          return err
+        }
+        if err = store_remote_result(&r); err != nil {
+          le.Print("error storing result from ", r.Worker, ": ", err)
+          return status.Error(codes.Internal, err.Error())
+        }
+        stored++
+      }
+    },
+  }},
+}
+
+func check_token(ctx context.Context) error {
+  if conf.Coordinator_token == "" {
+    return nil
+  }
+  md, _ := metadata.FromIncomingContext(ctx)
+  for _, v := range md.Get("authorization") {
+    if v == "Bearer " + conf.Coordinator_token {
+      return nil
+    }
+  }
+  return status.Error(codes.Unauthenticated, "missing or wrong token")
+}
+
+
+// Coordinator side
+
+var coordinator struct {
+  mu sync.Mutex
+  cursors map[string]*batch_cursor // one pass over each side for the remote workers
+  finished bool
+}
+
+// remote_sides lists the sides remote workers hash, with the extra condition of their phase
+func remote_sides() [][2]string {
+  sides := [][2]string{{"new", "verified_by is null and archive is null"}}
+  if has_old() {
+    sides = append(sides, [2]string{"old", glacier_condition()})
+  }
+  return sides
+}
+
+func start_coordinator() error {
+  if conf.Coordinator_listen == "" {
+    return nil
+  }
+  coordinator.cursors = map[string]*batch_cursor{}
+
+  opts := []grpc.ServerOption{grpc.ForceServerCodec(json_codec{})}
+  if conf.Coordinator_cert != "" {
+    creds, err := credentials.NewServerTLSFromFile(conf.Coordinator_cert, conf.Coordinator_key)
+    if err != nil {
+      return err
+    }
+    opts = append(opts, grpc.Creds(creds))
+  }
+  lis, err := net.Listen("tcp", conf.Coordinator_listen)
+  if err != nil {
+    return err
+  }
+  srv := grpc.NewServer(opts...)
+  srv.RegisterService(&coordinator_desc, nil)
+  l.Print("serving work to remote workers on ", conf.Coordinator_listen)
+  go func() {
+    err := srv.Serve(lis)
+    l.Print("coordinator stopped: ", err)
+  }()
+  return nil
+}
+
+// touch_remote_worker registers a remote worker, or refreshes its heartbeat
+func touch_remote_worker(worker string) error {
+  host := strings.SplitN(worker, ":", 2)[0]
+  _, err := db_exec(fmt.Sprintf(`insert into %s (worker_id, host, started, heartbeat) values ($1, $2, now(), now())
+    on conflict (worker_id) do update set heartbeat = now()`, workers_table()), "remote:"+worker, host)
+  return err
+}
+
+func remote_claim(worker string, max int) (*claim_reply, error) {
+  if worker == "" {
+    return nil, status.Error(codes.InvalidArgument, "no worker name")
+  }
+  if err := touch_remote_worker(worker); err != nil {
+    return nil, status.Error(codes.Unavailable, err.Error())
+  }
+  if max <= 0 || max > 1000 {
+    max = 100
+  }
+
+  coordinator.mu.Lock()
+  finished := coordinator.finished
+  coordinator.mu.Unlock()
+  if finished || deadline_passed() {
+    return &claim_reply{Finished: true}, nil
+  }
+
+  for _, s := range remote_sides() {
+    side := s[0]
+    coordinator.mu.Lock()
+    cursor := coordinator.cursors[side]
+    if cursor == nil {
+      cursor = &batch_cursor{}
+      coordinator.cursors[side] = cursor
+    }
+    coordinator.mu.Unlock()
+
+    batch, err := cursor.next(side, phase_where(side, s[1]), "remote:"+worker, max)
+    if err != nil {
+      return nil, status.Error(codes.Unavailable, err.Error())
+    }
+
+    reply := &claim_reply{}
+    var skipped []string
+    for _, w := range batch {
+      p := policy_for(w.filename, w.size)
+      if p.Action == "skip" {
+        skipped = append(skipped, w.filename)
+        continue
+      }
+      reply.Items = append(reply.Items, remote_item{side, w.filename, w.size, p.Action, p.Normalize_eol})
+    }
+    if len(skipped) > 0 {
+      _, err = db_exec(fmt.Sprintf("update %s set status = null, claimed_by = null, claimed_at = null where filename = any($1)",
+        pq.QuoteIdentifier(conf.Table_name)), pq.Array(skipped))
+      if err != nil {
+        le.Print("error releasing skipped files: ", err)
+      }
+    }
+    if len(batch) > 0 {
+      return reply, nil
+    }
+  }
+  return &claim_reply{}, nil // nothing right now; ask again later
+}
+
+func store_remote_result(r *hash_result) error {
+  if err := touch_remote_worker(r.Worker); err != nil {
+    return err
+  }
+  if r.Side != "new" && r.Side != "old" {
+    return fmt.Errorf("unknown side %q", r.Side)
+  }
+  t := pq.QuoteIdentifier(conf.Table_name)
+  if r.Error != "" {
+    le.Print("error hashing ",r.Side," ",r.Filename," on ",r.Worker,": ",r.Error)
+    record_error(r.Side, r.Filename, fmt.Errorf("%s", r.Error))
+    return nil
+  }
+  // only accept the result while the row is still claimed by that worker
+  res, err := db_exec(fmt.Sprintf("update %s set %s = $2, %s = null, %s = now(), %s = $4, status = null, claimed_by = null, claimed_at = null where filename = $1 and claimed_by = $3",
+    t, pq.QuoteIdentifier("hash_"+r.Side), pq.QuoteIdentifier("error_"+r.Side), pq.QuoteIdentifier("hashed_at_"+r.Side), pq.QuoteIdentifier("hashed_by_"+r.Side)),
+    r.Filename, r.Hash, "remote:"+r.Worker, r.Worker)
+  if err != nil {
+    return err
+  }
+  // a result that came too late for its claim was not stored, and has nothing to read back
+  if n, err := res.RowsAffected(); err == nil && n == 0 {
+    atomic.AddInt64(&late_results, 1)
+    lw.Print("dropped the hash of ",r.Side," ",r.Filename," from ",r.Worker,": its claim expired before it came")
+    return nil
+  }
+  if err = confirm_stored(r.Side, r.Filename, r.Hash, r.Worker); err != nil {
+    le.Print("error storing ",r.Side," ",r.Filename," from ",r.Worker,": ",err)
+    record_error(r.Side, r.Filename, err)
+    return nil
+  }
+  check_mismatch(r.Filename)
+  return nil
+}
+
+// wait_for_remote_workers waits until the remote workers have gone through every side and returned their batches,
+// then tells them to stop
+func wait_for_remote_workers() {
+  for {
+    coordinator.mu.Lock()
+    done := true
+    for _, s := range remote_sides() {
+      if c := coordinator.cursors[s[0]]; c == nil || !c.exhausted() {
+        done = false
+      }
+    }
+    coordinator.mu.Unlock()
+
+    if _, err := reclaim_stale_work(); err != nil {
+      le.Print("error releasing work of lost workers: ", err)
+    }
+    var claimed int64
+    err := db.QueryRow(fmt.Sprintf("select count(*) from %s where status is not null and claimed_by like 'remote:%%'", pq.QuoteIdentifier(conf.Table_name))).Scan(&claimed)
+    die_if(err)
+
+    var workers int64
+    err = db.QueryRow(fmt.Sprintf("select count(*) from %s where worker_id like 'remote:%%'", workers_table())).Scan(&workers)
+    die_if(err)
+
+    // without any remote worker around, there's nothing to wait for
+    if (done || workers == 0) && claimed == 0 {
+      break
+    }
+    l.Printf("waiting for remote workers: %d files out", claimed)
+    time.Sleep(15 * time.Second)
+  }
+
+  coordinator.mu.Lock()
+  coordinator.finished = true
+  coordinator.mu.Unlock()
+}
+
+func (c *batch_cursor) exhausted() bool {
+  c.mu.Lock()
+  defer c.mu.Unlock()
+  return c.done
+}
+
+
+// Worker side
+
+func dial_coordinator() (*grpc.ClientConn, error) {
+  creds := insecure.NewCredentials()
+  if conf.Coordinator_ca != "" {
+    var err error
+    if creds, err = credentials.NewClientTLSFromFile(conf.Coordinator_ca, ""); err != nil {
+      return nil, err
+    }
+  }
+  return grpc.NewClient(conf.Coordinator_address,
+    grpc.WithTransportCredentials(creds),
+    grpc.WithDefaultCallOptions(grpc.ForceCodec(json_codec{})))
+}
+
+func coordinator_context() context.Context {
+  ctx := context.Background()
+  if conf.Coordinator_token != "" {
+    ctx = metadata.AppendToOutgoingContext(ctx, "authorization", "Bearer " + conf.Coordinator_token)
+  }
+  return ctx
+}
+
+// run_remote_worker hashes batches handed out by the coordinator until it says the run is finished
+func run_remote_worker() {
+  host, _ := os.Hostname()
+  worker_id = fmt.Sprintf("%s:%d", host, os.Getpid())
+
+  conn, err := dial_coordinator()
+  die_if(err)
+  defer conn.Close()
+  l.Print("working for coordinator ", conf.Coordinator_address, " as ", worker_id)
+
+  // keeps the claims of the batches being hashed, however long they take
+  go func() {
+    for range time.Tick(heartbeat_interval()) {
+      err := conn.Invoke(coordinator_context(), "/integrity_check.Coordinator/Heartbeat", &heartbeat_request{Worker: worker_id}, &report_reply{})
+      if err != nil {
+        le.Print("error sending heartbeat to the coordinator: ", err)
+      }
+    }
+  }()
+
+  max := conf.Batch_size
+  if max <= 0 {
+    max = 32
+  }
+
+  // a worker's own hash_threads_new, whichever side its batches are of
+  pool := start_pool(hash_threads("new"), func() error {
+    for {
+      pause_gate.wait()
+      var reply claim_reply
+      err := conn.Invoke(coordinator_context(), "/integrity_check.Coordinator/Claim", &claim_request{Worker: worker_id, Max: max, Algorithm: hash_algorithm()}, &reply)
+      if status.Code(err) == codes.FailedPrecondition {
+        return fmt.Errorf("refused by the coordinator: %s", status.Convert(err).Message())
+      }
+      if err != nil {
+        le.Print("error claiming work: ", err)
+        time.Sleep(15 * time.Second)
+        continue
+      }
+      if reply.Finished {
+        return nil
+      }
+      if len(reply.Items) == 0 {
+        time.Sleep(15 * time.Second)
+        continue
+      }
+      if err = remote_batch(conn, reply.Items); err != nil {
+        le.Print("error reporting results: ", err)
+      }
+    }
+  })
+  die_if(pool.Wait())
+  l.Print("coordinator reports the run finished")
+}
+
+// remote_batch hashes one batch, streaming each result back as soon as it is known
+func remote_batch(conn *grpc.ClientConn, items []remote_item) error {
+  stream, err := conn.NewStream(coordinator_context(), &coordinator_desc.Streams[0], "/integrity_check.Coordinator/Report")
+  if err != nil {
+    return err
+  }
+  for _, item := range items {
+    pause_gate.wait()
+    r := hash_result{Worker: worker_id, Side: item.Side, Filename: item.Filename}
+    hash, err := compute_hash(item.Side, item.Filename, &policy{Pattern: "**", Action: item.Action, Normalize_eol: item.Normalize_eol})
+    if err != nil {
+      le.Print("error hashing ",item.Side," ",item.Filename,": ",err)
+      r.Error = err.Error()
+    }
+    r.Hash = hash
+    if err = stream.SendMsg(&r); err != nil {
+      return err
+    }
+  }
+  if err = stream.CloseSend(); err != nil {
+    return err
+  }
+  var ack report_reply
+  return stream.RecvMsg(&ack)
+}
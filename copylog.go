@@ -0,0 +1,285 @@
+//
+// Verifying what a copy tool copied.
+//
+// "-from-log <file>" fills a new, empty table with the files a copy tool says it transferred, instead of walking
+// path_new, so the run verifies what was copied rather than whatever happens to be there now. Two logs are read,
+// told apart by their content:
+//
+//   rsync      the output of --itemize-changes (-i), or a --log-file with %i in its format (the default): the
+//              files received or sent (">f" / "<f" items); paths are relative to path_new
+//   robocopy   a /LOG or /UNILOG (UTF-16) log with its header: the files listed as New File, Newer, Older or
+//              Changed; paths are made relative to the Source of the header
+//
+// Each file listed is stat'ed in path_new as the walk would. One listed but not found there is still added, so it
+// shows up as missing in the report.
+//
+// The list is also kept in <table>_copied. "integrity_check import-log <file>" only fills that one, for a table
+// filled by a walk as usual; with both, the report checks the bookkeeping of the transfer itself, with
+// COPIED_MISSING lines for files the log lists but the walk didn't find and NOT_COPIED lines for files the walk
+// found but the log doesn't list.
+//
+
+package main
+
+import (
+  "bufio"
+  "bytes"
+  "database/sql"
+  "flag"
+  "fmt"
+  "io"
+  "os"
+  "regexp"
+  "strconv"
+  "strings"
+  "time"
+  "unicode/utf16"
+
+  pq "github.com/lib/pq"
+)
+
+// an itemized change, optionally behind the timestamp and pid of a log file line
+var rsync_item = regexp.MustCompile(`^(?:\d{4}/\d\d/\d\d \d\d:\d\d:\d\d \[\d+\] )?([<>ch.*][fdLDS][^ ]{9}) (.+)$`)
+
+type copied_file struct {
+  name string
+  size interface{} // from the log, if it has it
+}
+
+func copied_table() string {
+  return pq.QuoteIdentifier(conf.Table_name + "_copied")
+}
+
+// read_copy_log returns the files a copy log lists, once each and without those the policies skip
+func read_copy_log(filename string) ([]copied_file, error) {
+  data, err := os.ReadFile(filename)
+  if err != nil {
+    return nil, err
+  }
+  data = utf16_to_utf8(data)
+
+  var files []copied_file
+  if bytes.Contains(data, []byte("ROBOCOPY")) {
+    files, err = parse_robocopy(data)
+  } else {
+    files, err = parse_rsync(data)
+  }
+  if err != nil {
+    return nil, fmt.Errorf("%s: %s", filename, err)
+  }
+
+  seen := map[string]bool{}
+  var listed []copied_file
+  for _, f := range files {
+    if seen[f.name] {
+      continue // copied more than once, e.g. by a retried transfer
+    }
+    seen[f.name] = true
+    if policy_for(f.name, 0).Action != "skip" {
+      listed = append(listed, f)
+    }
+  }
+  l.Print(filename, " lists ", len(listed), " copied files")
+  return listed, nil
+}
+
+// record_copied keeps the list of a copy log in <table>_copied, replacing any earlier one
+func record_copied(files []copied_file) error {
+  if _, err := db.Exec(fmt.Sprintf("drop table if exists %s", copied_table())); err != nil {
+    return err
+  }
+  if _, err := db.Exec(fmt.Sprintf("create table %s (filename text, size bigint)", copied_table())); err != nil {
+    return err
+  }
+  if err := set_table_access(copied_table()); err != nil {
+    return err
+  }
+  txn, err := db.Begin()
+  if err != nil {
+    return err
+  }
+  defer txn.Rollback()
+  stmt, err := txn.Prepare(pq.CopyIn(conf.Table_name + "_copied", "filename", "size"))
+  if err != nil {
+    return err
+  }
+  for _, f := range files {
+    if _, err = stmt.Exec(f.name, f.size); err != nil {
+      return err
+    }
+  }
+  if _, err = stmt.Exec(); err != nil {
+    return err
+  }
+  if err = stmt.Close(); err != nil {
+    return err
+  }
+  return txn.Commit()
+}
+
+func import_log_command(args []string) {
+  fs := flag.NewFlagSet("import-log", flag.ExitOnError)
+  fs.Parse(args)
+  if fs.NArg() != 1 {
+    die_if(fmt.Errorf("usage: import-log <rsync or robocopy log>"))
+  }
+  files, err := read_copy_log(fs.Arg(0))
+  die_if(err)
+  err = record_copied(files)
+  die_if(err)
+  l.Print("copy log imported; the report now checks it against the walk")
+}
+
+func import_copy_log(filename string) error {
+  files, err := read_copy_log(filename)
+  if err != nil {
+    return err
+  }
+  if err = record_copied(files); err != nil {
+    return err
+  }
+
+  staging, err := start_walk_sink()
+  if err != nil {
+    return err
+  }
+  missing := 0
+  for _, f := range files {
+
+    var row []interface{}
+    info, err := os.Lstat(side_path("new", f.name))
+    switch {
+    case err == nil && policy_for(f.name, info.Size()).Action == "skip":
+      continue
+    case err == nil:
+      row = copy_row(f.name, info.Size(), info.ModTime(), nil, nil, stat_fields(info))
+    default:
+      missing++
+      row = copy_row(f.name, 0, time.Time{}, nil, nil, no_stat())
+      row[1], row[2] = f.size, nil
+    }
+    if err = staging.add(row...); err != nil {
+      return err
+    }
+  }
+  if missing > 0 {
+    lw.Print(missing, " of the copied files are not in path_new")
+  }
+  return staging.finish()
+}
+
+// utf16_to_utf8 converts a log written as UTF-16 with a byte order mark (robocopy /UNILOG)
+func utf16_to_utf8(data []byte) []byte {
+  if len(data) < 2 || data[0] != 0xff || data[1] != 0xfe {
+    return data
+  }
+  units := make([]uint16, (len(data) - 2) / 2)
+  for i := range units {
+    units[i] = uint16(data[2 + 2*i]) | uint16(data[3 + 2*i]) << 8
+  }
+  return []byte(string(utf16.Decode(units)))
+}
+
+func parse_rsync(data []byte) ([]copied_file, error) {
+  var files []copied_file
+  lines := bufio.NewScanner(bytes.NewReader(data))
+  lines.Buffer(nil, 1 << 20)
+  for lines.Scan() {
+    m := rsync_item.FindStringSubmatch(lines.Text())
+    if m == nil || m[1][1] != 'f' || m[1][0] != '>' && m[1][0] != '<' {
+      continue
+    }
+    files = append(files, copied_file{name: strings.TrimPrefix(m[2], "./")})
+  }
+  if err := lines.Err(); err != nil {
+    return nil, err
+  }
+  if len(files) == 0 {
+    return nil, fmt.Errorf("no transferred files found; was rsync run with --itemize-changes?")
+  }
+  return files, nil
+}
+
+var robocopy_copied = map[string]bool{"New File": true, "Newer": true, "Older": true, "Changed": true}
+
+func parse_robocopy(data []byte) ([]copied_file, error) {
+  var files []copied_file
+  source, dir := "", ""
+  lines := bufio.NewScanner(bytes.NewReader(data))
+  lines.Buffer(nil, 1 << 20)
+  for lines.Scan() {
+    line := lines.Text()
+    if i := strings.IndexByte(line, '\r'); i >= 0 {
+      line = line[:i] // progress percentages follow after carriage returns
+    }
+    if trimmed := strings.TrimSpace(line); strings.HasPrefix(trimmed, "Source :") {
+      source = strings.TrimSpace(strings.TrimPrefix(trimmed, "Source :"))
+      if !strings.HasSuffix(source, `\`) {
+        source += `\`
+      }
+      continue
+    }
+
+    // file lines are class, size and name; directory lines count and path, with the class for new ones
+    var fields []string
+    for _, f := range strings.Split(line, "\t") {
+      if f = strings.TrimSpace(f); f != "" {
+        fields = append(fields, f)
+      }
+    }
+    if len(fields) < 2 {
+      continue
+    }
+    last := fields[len(fields) - 1]
+    under_source := source != "" && strings.HasPrefix(strings.ToLower(last), strings.ToLower(source))
+    if strings.HasSuffix(last, `\`) && under_source {
+      dir = strings.Replace(last[len(source):], `\`, "/", -1)
+      continue
+    }
+    if len(fields) != 3 || !robocopy_copied[fields[0]] {
+      continue
+    }
+    name := dir + fields[2]
+    if under_source {
+      name = strings.Replace(last[len(source):], `\`, "/", -1) // logged with full paths (/FP)
+    }
+    var size interface{}
+    if n, err := strconv.ParseInt(fields[1], 10, 64); err == nil {
+      size = n // without /BYTES sizes are rounded, like "1.2 m"
+    }
+    files = append(files, copied_file{name: name, size: size})
+  }
+  if err := lines.Err(); err != nil {
+    return nil, err
+  }
+  if source == "" {
+    return nil, fmt.Errorf("no Source in the robocopy log; was it written with /NJH?")
+  }
+  return files, nil
+}
+
+// write_copy_log_report lists the differences between the walk and the copy log, if one was imported
+func write_copy_log_report(w io.Writer) int64 {
+  exists, err := table_exists(conf.Table_name + "_copied")
+  die_if(err)
+  if !exists {
+    return 0
+  }
+  t := pq.QuoteIdentifier(conf.Table_name)
+
+  var problems int64
+  err = each_row(fmt.Sprintf(`select 'COPIED_MISSING', c.filename from %s c where not exists (select 1 from %s t where t.filename = c.filename)
+    union all
+    select 'NOT_COPIED', t.filename from %s t where t.archive is null and not exists (select 1 from %s c where c.filename = t.filename)
+    order by 2`, copied_table(), t, t, copied_table()), func(rows *sql.Rows) error {
+    var kind, file string
+    if err := rows.Scan(&kind, &file); err != nil {
+      return err
+    }
+    fmt.Fprintf(w, "%s\t%s\n", kind, file)
+    problems++
+    return nil
+  })
+  die_if(err)
+  return problems
+}
@@ -0,0 +1,142 @@
+//
+// Cost of remote trees.
+//
+// Cloud storage bills per API call and per byte read out. Every remote backend is metered: each open and stat
+// counts as one call, and a listing as one call per 1000 entries (the page size of S3 and most object stores);
+// the bytes read through open count as egress. The totals of a run (api_calls, egress_bytes) and the cost they
+// come to at cost_per_1000_calls and cost_per_gb_egress (est_cost) are kept in its row of <table>_runs, updated
+// every minute and at the end.
+//
+// With cost_budget set, the cost so far plus that of the remote files still to be hashed is projected every
+// minute; once it exceeds the budget an alert is raised and the hash workers are paused ("budget"). Resuming
+// through the usual operator means (SIGUSR2, the control endpoint, "notify resume") accepts the projected cost
+// and lets the run carry on.
+//
+
+package main
+
+import (
+  "fmt"
+  "io"
+  "sync/atomic"
+  "time"
+
+  pq "github.com/lib/pq"
+)
+
+var api_calls int64
+var egress_bytes int64
+
+// metered counts the calls and bytes of a remote backend
+type metered struct {
+  remote
+}
+
+func (m metered) walk(fn func(name string, size int64, mtime time.Time) error) error {
+  var n int64
+  err := m.remote.walk(func(name string, size int64, mtime time.Time) error {
+    if n%1000 == 0 {
+      atomic.AddInt64(&api_calls, 1)
+    }
+    n++
+    return fn(name, size, mtime)
+  })
+  if n == 0 {
+    atomic.AddInt64(&api_calls, 1)
+  }
+  return err
+}
+
+func (m metered) stat(name string) (int64, error) {
+  atomic.AddInt64(&api_calls, 1)
+  return m.remote.stat(name)
+}
+
+func (m metered) open(name string) (io.ReadCloser, error) {
+  atomic.AddInt64(&api_calls, 1)
+  in, err := m.remote.open(name)
+  if err != nil {
+    return nil, err
+  }
+  return &chained_reader{Reader: metered_reader{in}, close: in.Close}, nil
+}
+
+type metered_reader struct {
+  r io.Reader
+}
+
+func (m metered_reader) Read(p []byte) (int, error) {
+  n, err := m.r.Read(p)
+  atomic.AddInt64(&egress_bytes, int64(n))
+  return n, err
+}
+
+// unmetered returns the backend behind the meter
+func unmetered(rm remote) remote {
+  if m, ok := rm.(metered); ok {
+    return m.remote
+  }
+  return rm
+}
+
+func cost_of(calls int64, bytes int64) float64 {
+  return float64(calls)/1000*conf.Cost_per_1000_calls + float64(bytes)/(1<<30)*conf.Cost_per_gb_egress
+}
+
+// record_cost stores the totals of the run so far
+func record_cost() {
+  if run_id == 0 || len(remotes) == 0 {
+    return
+  }
+  calls, bytes := atomic.LoadInt64(&api_calls), atomic.LoadInt64(&egress_bytes)
+  _, err := db_exec(fmt.Sprintf("update %s set api_calls = $2, egress_bytes = $3, est_cost = $4 where run_id = $1", runs_table()),
+    run_id, calls, bytes, cost_of(calls, bytes))
+  if err != nil {
+    le.Print("error recording the cost of the run: ", err)
+  }
+}
+
+// projected_cost is the cost so far plus that of hashing the remote files still outstanding
+func projected_cost() (float64, error) {
+  calls, bytes := atomic.LoadInt64(&api_calls), atomic.LoadInt64(&egress_bytes)
+  for _, side := range []string{"new", "old"} {
+    if remotes[side] == nil {
+      continue
+    }
+    var files, size int64
+    err := db.QueryRow(fmt.Sprintf("select count(*), coalesce(sum(size), 0) from %s where %s is null", pq.QuoteIdentifier(conf.Table_name),
+      pq.QuoteIdentifier("hash_"+side))).Scan(&files, &size)
+    if err != nil {
+      return 0, err
+    }
+    calls += files
+    bytes += size
+  }
+  return cost_of(calls, bytes), nil
+}
+
+func start_cost_tracking() {
+  if len(remotes) == 0 {
+    return
+  }
+  go func() {
+    over := false
+    for range time.Tick(time.Minute) {
+      record_cost()
+      if conf.Cost_budget <= 0 || over {
+        continue
+      }
+      projected, err := projected_cost()
+      if err != nil {
+        le.Print("error projecting the cost of the run: ", err)
+        continue
+      }
+      if projected > conf.Cost_budget {
+        // only once: an operator resuming has accepted the projection
+        over = true
+        alert(fmt.Sprintf("projected cost %.2f of table %s exceeds the budget of %.2f, pausing hash workers", projected, conf.Table_name, conf.Cost_budget))
+        pause_gate.pause("budget")
+      }
+    }
+  }()
+}
@@ -0,0 +1,140 @@
+//
+// Database helpers: connection settings, and statements bounded by a timeout.
+//
+
+package main
+
+import (
+  "context"
+  "database/sql"
+  "fmt"
+  "net/url"
+  "strings"
+  "sync/atomic"
+  "time"
+
+  pq "github.com/lib/pq"
+)
+
+// connection_string adds the configured connection options and per-connection settings to db_connstr.
+// lib/pq sends parameters it doesn't know itself to the server as run-time settings for every connection.
+// Sessions are named after the tool unless db_connstr or db_application_name says otherwise, so DBAs can
+// tell them apart in pg_stat_activity.
+func connection_string() (string, error) {
+  params := map[string]string{}
+  for k, v := range map[string]string{"sslmode": conf.Db_sslmode, "sslrootcert": conf.Db_sslrootcert, "sslcert": conf.Db_sslcert, "sslkey": conf.Db_sslkey} {
+    if v != "" {
+      params[k] = v
+    }
+  }
+  if conf.Db_connect_timeout > 0 {
+    params["connect_timeout"] = fmt.Sprint(conf.Db_connect_timeout)
+  }
+  if conf.Db_application_name != "" {
+    params["application_name"] = conf.Db_application_name
+  } else if !strings.Contains(conf.Db_connstr, "application_name") {
+    params["application_name"] = "integrity_check"
+  }
+  if conf.Db_statement_timeout != "" {
+    params["statement_timeout"] = conf.Db_statement_timeout
+  }
+  if conf.Db_lock_timeout != "" {
+    params["lock_timeout"] = conf.Db_lock_timeout
+  }
+  if conf.Read_only {
+    params["default_transaction_read_only"] = "on"
+  }
+
+  connstr := conf.Db_connstr
+  if len(params) == 0 {
+    return connstr, nil
+  }
+
+  if strings.HasPrefix(connstr, "postgres://") || strings.HasPrefix(connstr, "postgresql://") {
+    u, err := url.Parse(connstr)
+    if err != nil {
+      return "", err
+    }
+    q := u.Query()
+    for k, v := range params {
+      q.Set(k, v)
+    }
+    u.RawQuery = q.Encode()
+    return u.String(), nil
+  }
+
+  for k, v := range params {
+    connstr += fmt.Sprintf(" %s='%s'", k, strings.NewReplacer(`\`, `\\`, `'`, `\'`).Replace(v))
+  }
+  return connstr, nil
+}
+
+func query_timeout() time.Duration {
+  if conf.Db_query_timeout > 0 {
+    return time.Duration(conf.Db_query_timeout) * time.Second
+  }
+  return 5 * time.Minute
+}
+
+// db_exec runs a statement that is cancelled if it doesn't complete within db_query_timeout
+func db_exec(query string, args ...interface{}) (sql.Result, error) {
+  ctx, cancel := context.WithTimeout(context.Background(), query_timeout())
+  defer cancel()
+  return db.ExecContext(ctx, query, args...)
+}
+
+// cursor_batch is how many rows each_row fetches at a time
+const cursor_batch = 10000
+
+// each_row runs a query through a server-side cursor and calls fn for every row, so even a result of hundreds of
+// millions of rows is gone through with the memory of one batch. The rows passed to fn are only valid during the call.
+func each_row(query string, fn func(rows *sql.Rows) error, args ...interface{}) error {
+  txn, err := db.Begin()
+  if err != nil {
+    return err
+  }
+  defer txn.Rollback()
+
+  if _, err = txn.Exec("declare each_row no scroll cursor for " + query, args...); err != nil {
+    return err
+  }
+  for {
+    rows, err := txn.Query(fmt.Sprintf("fetch forward %d from each_row", cursor_batch))
+    if err != nil {
+      return err
+    }
+    n := 0
+    for rows.Next() {
+      n++
+      if err = fn(rows); err != nil {
+        rows.Close()
+        return err
+      }
+    }
+    if err = rows.Err(); err != nil {
+      return err
+    }
+    rows.Close()
+    if n < cursor_batch {
+      return txn.Commit()
+    }
+  }
+}
+
+// record_error stores the reason a file could not be hashed on one side, and releases its claim
+func record_error(side string, file string, err error) {
+  if is_cold(side, err) {
+    mark_cold(file)
+    return
+  }
+  if error_class(err.Error()) == "MISSING" {
+    fail_fast_found("missing", side+" "+file)
+  }
+  atomic.AddInt64(&errors_total, 1)
+  breaker.failure()
+
+  _, dberr := db_exec(fmt.Sprintf("update %s set %s = $2, status = null, claimed_by = null, claimed_at = null where filename = $1",pq.QuoteIdentifier(conf.Table_name),pq.QuoteIdentifier("error_"+side)), file, err.Error())
+  if dberr != nil {
+    le.Print("error recording error for ",file,": ",dberr)
+  }
+}
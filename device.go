@@ -0,0 +1,78 @@
+//
+// Device affinity between the OLD and NEW trees.
+//
+// When both trees sit on the same disks, hashing them at the same time makes the spindles seek between the
+// two and both phases crawl, so they run one after the other. When they are on different devices, running
+// the old-hash and new-hash phases side by side roughly halves the wall-clock time.
+//
+//   device_affinity = ""          phases run one after the other (default)
+//                     "shared"    same, stated explicitly
+//                     "separate"  phases run concurrently
+//                     "auto"      concurrently, unless the trees share a filesystem or an underlying disk
+//
+// -concurrent-phases on the command line is the same as device_affinity "separate". Each phase has its own pool
+// of hash_threads_new / hash_threads_old workers (8 by default), so a slow tree doesn't hold up the other one,
+// and its own progress: <table>_progress gets a row for each, and the log a line for each while both run.
+//
+
+package main
+
+import (
+  "fmt"
+)
+
+func phases_concurrent() bool {
+  switch conf.Device_affinity {
+  case "", "shared":
+    return false
+  case "separate":
+    return true
+  case "auto":
+    shared, reason := trees_share_devices()
+    l.Print("device affinity: ", reason)
+    return !shared
+  }
+  die_if(fmt.Errorf("unknown device_affinity: %s", conf.Device_affinity))
+  return false
+}
+
+// hash_threads is the size of the worker pool hashing one side; baseline verification, replicas and remote
+// workers take the size of NEW's
+func hash_threads(side string) int {
+  n := conf.Hash_threads_new
+  if side == "old" {
+    n = conf.Hash_threads_old
+  }
+  if n > 0 {
+    return n
+  }
+  return 8
+}
+
+func trees_share_devices() (bool, string) {
+  if remotes["new"] != nil || remotes["old"] != nil {
+    return false, "remote tree, assuming separate devices"
+  }
+  dev_new, ok_new := device_id(conf.New_path)
+  dev_old, ok_old := device_id(conf.Old_path)
+  if !ok_new || !ok_old {
+    return true, "can't determine devices, assuming shared"
+  }
+  if dev_new == dev_old {
+    return true, "both trees are on the same filesystem"
+  }
+
+  disks_new := physical_disks(dev_new)
+  disks_old := physical_disks(dev_old)
+  for _, a := range disks_new {
+    for _, b := range disks_old {
+      if a == b {
+        return true, "both trees use disk " + a
+      }
+    }
+  }
+  if len(disks_new) == 0 || len(disks_old) == 0 {
+    return false, "different filesystems, underlying disks unknown"
+  }
+  return false, fmt.Sprintf("separate disks %v and %v", disks_new, disks_old)
+}
@@ -0,0 +1,38 @@
+//go:build linux
+
+package main
+
+import (
+  "fmt"
+  "os"
+  "path/filepath"
+)
+
+// physical_disks lists the whole disks backing a block device, following device-mapper/md slaves
+// and mapping partitions to their disk. Devices without a sysfs entry (NFS, ZFS, tmpfs) yield nothing.
+func physical_disks(dev uint64) []string {
+  major := (dev >> 8) & 0xfff | (dev >> 32) & 0xfffff000
+  minor := dev & 0xff | (dev >> 12) & 0xffffff00
+  sys, err := filepath.EvalSymlinks(fmt.Sprintf("/sys/dev/block/%d:%d", major, minor))
+  if err != nil {
+    return nil
+  }
+  return disks_of(sys)
+}
+
+func disks_of(sys string) []string {
+  slaves, _ := os.ReadDir(filepath.Join(sys, "slaves"))
+  if len(slaves) > 0 {
+    var disks []string
+    for _, s := range slaves {
+      if real, err := filepath.EvalSymlinks(filepath.Join(sys, "slaves", s.Name())); err == nil {
+        disks = append(disks, disks_of(real)...)
+      }
+    }
+    return disks
+  }
+  if _, err := os.Stat(filepath.Join(sys, "partition")); err == nil {
+    return []string{filepath.Base(filepath.Dir(sys))}
+  }
+  return []string{filepath.Base(sys)}
+}
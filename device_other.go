@@ -0,0 +1,7 @@
+//go:build !linux
+
+package main
+
+func physical_disks(dev uint64) []string {
+  return nil
+}
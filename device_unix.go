@@ -0,0 +1,25 @@
+//go:build !windows
+
+package main
+
+import (
+  "os"
+  "syscall"
+)
+
+func device_id(path string) (uint64, bool) {
+  var st syscall.Stat_t
+  if err := syscall.Stat(path, &st); err != nil {
+    return 0, false
+  }
+  return uint64(st.Dev), true
+}
+
+// file_identity returns the device and inode of a file, which tell two paths to the same directory apart
+func file_identity(info os.FileInfo) ([2]uint64, bool) {
+  st, ok := info.Sys().(*syscall.Stat_t)
+  if !ok {
+    return [2]uint64{}, false
+  }
+  return [2]uint64{uint64(st.Dev), uint64(st.Ino)}, true
+}
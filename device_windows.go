@@ -0,0 +1,15 @@
+//go:build windows
+
+package main
+
+import (
+  "os"
+)
+
+func device_id(path string) (uint64, bool) {
+  return 0, false
+}
+
+func file_identity(info os.FileInfo) ([2]uint64, bool) {
+  return [2]uint64{}, false
+}
@@ -0,0 +1,179 @@
+//
+// Mismatch diagnostics.
+//
+// A hash mismatch only says that two copies differ. With diagnose_mismatches set (or on demand with the
+// "diagnose" command), every mismatching file is read again on both sides and compared byte by byte: the first
+// differing offset goes to first_diff and the bytes around it, from both copies, to diff_context. A first_diff
+// of -1 means the copies came out identical on the second read, which points at a flaky read path rather than
+// damaged data. Offsets that always fall on the same boundary are how broken copy tools give themselves away.
+//
+
+package main
+
+import (
+  "bufio"
+  "bytes"
+  "fmt"
+  "io"
+  "os"
+
+  pq "github.com/lib/pq"
+)
+
+// bytes of context shown before and after the first difference
+const diff_context = 16
+
+// open_content opens a file of one side the way it is hashed: from its remote tree if it has one, and with transforms applied
+func open_content(side string, file string) (io.ReadCloser, error) {
+  var in io.ReadCloser
+  var err error
+  if rm := remotes[side]; rm != nil {
+    in, err = rm.open(side_name(side, file))
+  } else {
+    in, err = os.Open(side_path(side, file))
+  }
+  if err != nil {
+    return nil, err
+  }
+  r, err := transform_reader(side, file, in)
+  if err != nil {
+    in.Close()
+    return nil, err
+  }
+  return &chained_reader{Reader: r, close: func() error {
+    r.Close()
+    return in.Close()
+  }}, nil
+}
+
+// first_difference compares two streams and returns the offset of the first differing byte (-1 if there is none)
+// and a hexdump of both around it
+func first_difference(a io.Reader, b io.Reader) (int64, string, error) {
+  ra := bufio.NewReaderSize(a, 1<<20)
+  rb := bufio.NewReaderSize(b, 1<<20)
+  var offset int64
+  var prev_a, prev_b []byte // the bytes just before the current block, for context
+
+  for {
+    ba, err_a := ra.Peek(1 << 20)
+    bb, err_b := rb.Peek(1 << 20)
+    if err_a != nil && err_a != io.EOF && err_a != bufio.ErrBufferFull {
+      return 0, "", fmt.Errorf("reading new: %s", err_a)
+    }
+    if err_b != nil && err_b != io.EOF && err_b != bufio.ErrBufferFull {
+      return 0, "", fmt.Errorf("reading old: %s", err_b)
+    }
+
+    n := len(ba)
+    if len(bb) < n {
+      n = len(bb)
+    }
+    i := 0
+    for i < n && ba[i] == bb[i] {
+      i++
+    }
+    if i < n || len(ba) != len(bb) {
+      // a difference, or one copy ends before the other
+      return offset + int64(i), fmt.Sprintf("@%d new: %s / old: %s", offset + int64(i),
+        hex_context(prev_a, ba, i), hex_context(prev_b, bb, i)), nil
+    }
+    if n == 0 {
+      return -1, "", nil
+    }
+
+    prev_a = append(prev_a[:0], ba[max_int(0, n-diff_context):n]...)
+    prev_b = append(prev_b[:0], bb[max_int(0, n-diff_context):n]...)
+    ra.Discard(n)
+    rb.Discard(n)
+    offset += int64(n)
+  }
+}
+
+func max_int(a, b int) int {
+  if a > b {
+    return a
+  }
+  return b
+}
+
+// hex_context dumps the bytes around position i of block, marking the first differing byte with brackets
+func hex_context(prev []byte, block []byte, i int) string {
+  var before []byte
+  if i >= diff_context {
+    before = block[i-diff_context:i]
+  } else {
+    before = append(append([]byte{}, prev[max_int(0, len(prev)-(diff_context-i)):]...), block[:i]...)
+  }
+  end := i + diff_context
+  if end > len(block) {
+    end = len(block)
+  }
+
+  var out bytes.Buffer
+  fmt.Fprintf(&out, "% x", before)
+  if i < len(block) {
+    fmt.Fprintf(&out, " [%02x] % x", block[i], block[i+1:end])
+  } else {
+    out.WriteString(" [EOF]")
+  }
+  return out.String()
+}
+
+func diagnose_file(file string) (int64, string, error) {
+  a, err := open_content("new", file)
+  if err != nil {
+    return 0, "", fmt.Errorf("opening new: %s", err)
+  }
+  defer a.Close()
+  b, err := open_content("old", file)
+  if err != nil {
+    return 0, "", fmt.Errorf("opening old: %s", err)
+  }
+  defer b.Close()
+  return first_difference(a, b)
+}
+
+// diagnose_mismatches locates the first difference of every mismatching file that hasn't been diagnosed yet
+func diagnose_mismatches() {
+  query := fmt.Sprintf("select filename from %s where hash_new <> hash_old and first_diff is null and archive is null", pq.QuoteIdentifier(conf.Table_name))
+  query += work_filter()
+  l.Print("diagnosing mismatches: ", query)
+
+  res, err := db.Query(query)
+  die_if(err)
+
+  update := fmt.Sprintf("update %s set first_diff = $2, diff_context = $3 where filename = $1", pq.QuoteIdentifier(conf.Table_name))
+
+  threads := 4
+  to_check := make(chan string, threads)
+  pool := start_pool(threads, func() error {
+    for file := range to_check {
+      pause_gate.wait()
+      offset, context, err := diagnose_file(file)
+      if err != nil {
+        le.Print("error diagnosing ", file, ": ", err)
+        continue
+      }
+      if offset < 0 {
+        context = "copies are identical on re-read"
+      } else {
+        context = "first difference " + context
+      }
+      lw.Print("MISMATCH ", file, ": ", context)
+      if _, err = db_exec(update, file, offset, context); err != nil {
+        le.Print("error recording diagnosis: ", err)
+      }
+    }
+    return nil
+  })
+
+  for res.Next() {
+    var file string
+    die_if(res.Scan(&file))
+    to_check <- file
+  }
+  die_if(res.Err())
+  res.Close()
+  close(to_check)
+  pool.Wait()
+}
@@ -0,0 +1,84 @@
+//
+// Configuration from the environment.
+//
+// Every setting can also be given as an environment variable named INTEGRITY_CHECK_ followed by its name in upper
+// case (INTEGRITY_CHECK_NEW_PATH, INTEGRITY_CHECK_DB_CONNSTR, ...), which overrides the config file. Lists and
+// objects (policies, replicas, ...) take the same JSON as in the file. Without a config file, and with -conf left
+// at its default, the environment alone is enough, which suits a container started as a Kubernetes Job; an empty
+// db_connstr leaves the connection to the standard PGHOST/PGUSER/PGPASSWORD/PGDATABASE variables.
+//
+// Without table_name, the table is named after the trees it compares, e.g. icheck_project42_1f3a9c2e, so
+// repeated runs over the same paths find their state again.
+//
+// There is no SQLite fallback: the work queue depends on PostgreSQL (COPY, SKIP LOCKED, LISTEN/NOTIFY).
+//
+
+package main
+
+import (
+  "encoding/json"
+  "fmt"
+  "hash/fnv"
+  "os"
+  "path/filepath"
+  "reflect"
+  "regexp"
+  "strconv"
+  "strings"
+)
+
+const env_prefix = "INTEGRITY_CHECK_"
+
+// apply_env sets every configuration field that has an environment variable
+func apply_env() error {
+  v := reflect.ValueOf(&conf).Elem()
+  t := v.Type()
+  for i := 0; i < t.NumField(); i++ {
+    name := strings.Split(t.Field(i).Tag.Get("json"), ",")[0]
+    value, ok := os.LookupEnv(env_prefix + strings.ToUpper(name))
+    if !ok {
+      continue
+    }
+    f := v.Field(i)
+    var err error
+    switch f.Kind() {
+    case reflect.String:
+      f.SetString(value)
+    case reflect.Int, reflect.Int64:
+      var n int64
+      n, err = strconv.ParseInt(value, 10, 64)
+      f.SetInt(n)
+    case reflect.Float64:
+      var x float64
+      x, err = strconv.ParseFloat(value, 64)
+      f.SetFloat(x)
+    case reflect.Bool:
+      var b bool
+      b, err = strconv.ParseBool(value)
+      f.SetBool(b)
+    default:
+      err = json.Unmarshal([]byte(value), f.Addr().Interface())
+    }
+    if err != nil {
+      return fmt.Errorf("%s%s: %s", env_prefix, strings.ToUpper(name), err)
+    }
+  }
+  return nil
+}
+
+var not_identifier = regexp.MustCompile(`[^a-z0-9_]+`)
+
+// default_table_name derives a table name from the compared paths
+func default_table_name() string {
+  h := fnv.New32a()
+  h.Write([]byte(conf.New_path + "\x00" + conf.Old_path))
+  base := not_identifier.ReplaceAllString(strings.ToLower(filepath.Base(conf.New_path)), "_")
+  base = strings.Trim(base, "_")
+  if len(base) > 30 {
+    base = base[:30]
+  }
+  if base == "" {
+    return fmt.Sprintf("icheck_%08x", h.Sum32())
+  }
+  return fmt.Sprintf("icheck_%s_%08x", base, h.Sum32())
+}
@@ -0,0 +1,146 @@
+//
+// Coordination between instances through Postgres LISTEN/NOTIFY.
+//
+// All instances working on a table listen on the <table>_events channel:
+//   walk_done  the coordinator has committed the file walk
+//   work       rows were queued for (re-)hashing
+//   pause      hash workers stop picking up new files
+//   resume     hash workers carry on
+//   priority   files were given a priority (see priority.go)
+//
+// Instances started with -worker never walk; they wait for walk_done if the table is still empty, and stay
+// idle after finishing until more work is announced. "integrity_check notify pause" sends an event by hand.
+//
+
+package main
+
+import (
+  "fmt"
+  "sync"
+  "time"
+
+  pq "github.com/lib/pq"
+)
+
+func events_channel() string {
+  return conf.Table_name + "_events"
+}
+
+// work_events receives a value whenever walk_done or work is announced
+var work_events = make(chan string, 1)
+
+func notify_event(event string) error {
+  _, err := db_exec("select pg_notify($1, $2)", events_channel(), event)
+  return err
+}
+
+// listen_events subscribes to the events channel and dispatches what arrives until the process exits
+func listen_events() error {
+  connstr, err := connection_string()
+  if err != nil {
+    return err
+  }
+  listener := pq.NewListener(connstr, time.Second, time.Minute, func(ev pq.ListenerEventType, err error) {
+    if err != nil {
+      l.Print("event listener: ", err)
+    }
+  })
+  if err = listener.Listen(events_channel()); err != nil {
+    return err
+  }
+
+  go func() {
+    for n := range listener.Notify {
+      if n == nil {
+        continue // reconnected; events sent meanwhile are lost
+      }
+      l.Print("received event: ", n.Extra)
+      switch n.Extra {
+      case "pause":
+        pause_gate.pause("operator")
+      case "resume":
+        pause_gate.operator_resume()
+      case "priority":
+        announce_priority()
+      case "walk_done", "work":
+        select {
+        case work_events <- n.Extra:
+        default:
+        }
+      }
+    }
+  }()
+  return nil
+}
+
+
+// gate blocks hash workers while paused for any reason: "operator" (signals, control endpoint, pause event),
+// "errors" (circuit breaker), "budget" (cost projection) or "mount" (health check). An operator resume clears
+// all but "mount", which only lifts once the mounts are healthy again. Waiting ends at the deadline too, so
+// a paused run still stops on time; callers check deadline_passed() after wait().
+type gate struct {
+  mu sync.Mutex
+  cond *sync.Cond
+  reasons map[string]bool
+}
+
+var pause_gate = new_gate()
+
+func new_gate() *gate {
+  g := &gate{reasons: map[string]bool{}}
+  g.cond = sync.NewCond(&g.mu)
+  return g
+}
+
+func (g *gate) pause(reason string) {
+  g.mu.Lock()
+  defer g.mu.Unlock()
+  if !g.reasons[reason] {
+    l.Print("pausing hash workers (", reason, ")")
+  }
+  g.reasons[reason] = true
+}
+
+func (g *gate) resume(reasons ...string) {
+  g.mu.Lock()
+  defer g.mu.Unlock()
+  for _, reason := range reasons {
+    if g.reasons[reason] {
+      l.Print("resuming hash workers (", reason, ")")
+    }
+    delete(g.reasons, reason)
+  }
+  if len(g.reasons) == 0 {
+    g.cond.Broadcast()
+  }
+}
+
+// operator_resume lifts the pauses an operator is allowed to override
+func (g *gate) operator_resume() {
+  g.resume("operator", "errors", "budget")
+}
+
+func (g *gate) wait() {
+  g.mu.Lock()
+  defer g.mu.Unlock()
+  for len(g.reasons) > 0 && !deadline_passed() {
+    g.cond.Wait()
+  }
+}
+
+// wake lets waiting workers look at the deadline again, while the pause stays
+func (g *gate) wake() {
+  g.mu.Lock()
+  defer g.mu.Unlock()
+  g.cond.Broadcast()
+}
+
+func send_event(event string) {
+  switch event {
+  case "walk_done", "work", "pause", "resume", "priority":
+  default:
+    die_if(fmt.Errorf("unknown event: %s", event))
+  }
+  die_if(notify_event(event))
+  l.Print("sent ", event, " to ", events_channel())
+}
@@ -0,0 +1,54 @@
+//go:build linux
+
+package main
+
+import (
+  "os"
+  "syscall"
+  "unsafe"
+)
+
+// FS_IOC_FIEMAP, _IOWR('f', 11, struct fiemap)
+const fs_ioc_fiemap = 0xc020660b
+
+type fiemap_extent struct {
+  logical uint64
+  physical uint64
+  length uint64
+  reserved64 [2]uint64
+  flags uint32
+  reserved [3]uint32
+}
+
+type fiemap struct {
+  start uint64
+  length uint64
+  flags uint32
+  mapped_extents uint32
+  extent_count uint32
+  reserved uint32
+  extents [1]fiemap_extent
+}
+
+// physical_offset returns the device and physical byte offset where a file's first extent starts
+func physical_offset(fullpath string) (uint64, uint64, error) {
+  fd, err := os.Open(fullpath)
+  if err != nil {
+    return 0, 0, err
+  }
+  defer fd.Close()
+
+  var st syscall.Stat_t
+  if err = syscall.Fstat(int(fd.Fd()), &st); err != nil {
+    return 0, 0, err
+  }
+
+  fm := fiemap{length: ^uint64(0), extent_count: 1}
+  if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, fd.Fd(), fs_ioc_fiemap, uintptr(unsafe.Pointer(&fm))); errno != 0 {
+    return 0, 0, errno
+  }
+  if fm.mapped_extents == 0 {
+    return uint64(st.Dev), 0, nil // empty or fully inline
+  }
+  return uint64(st.Dev), fm.extents[0].physical, nil
+}
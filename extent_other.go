@@ -0,0 +1,11 @@
+//go:build !linux
+
+package main
+
+import (
+  "fmt"
+)
+
+func physical_offset(fullpath string) (uint64, uint64, error) {
+  return 0, 0, fmt.Errorf("physical extents are only available on Linux")
+}
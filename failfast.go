@@ -0,0 +1,32 @@
+//
+// Fail fast.
+//
+// For smoke tests of a copy, where any difference means the whole copy is redone anyway, -fail-fast stops the run
+// at the first mismatch or missing file (an OLD or NEW file that isn't there). Like at a deadline, the files being
+// hashed are finished and stored and no new ones are started; the run is then recorded as "failed" and the
+// process exits 1. Only this process stops; other workers and shards carry on.
+//
+
+package main
+
+import (
+  "sync/atomic"
+)
+
+var fail_fast bool
+var failed_fast int32
+
+// fail_fast_found stops the run, if -fail-fast was given
+func fail_fast_found(what string, file string) {
+  if !fail_fast {
+    return
+  }
+  if atomic.CompareAndSwapInt32(&failed_fast, 0, 1) {
+    lw.Print("fail-fast: ", what, " ", file, ": finishing the files being hashed and stopping")
+    pause_gate.wake()
+  }
+}
+
+func stopped_fast() bool {
+  return atomic.LoadInt32(&failed_fast) != 0
+}
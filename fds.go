@@ -0,0 +1,124 @@
+//
+// Budget of open file descriptors.
+//
+// Past the limit of the process (RLIMIT_NOFILE: ulimit -n, LimitNOFILE= in a systemd unit), opening anything
+// fails with "too many open files", which would show up as errors on whichever files happen to be opened then.
+// At startup the soft limit is raised to the hard one, and the descriptors the configured concurrency can hold
+// at once are counted against it:
+//
+//   fd_reserve (default 64)      the log, stdio, notifiers, the queries of the main loop and the like
+//   db_maxconnections            a socket each; without a limit, one per worker
+//   walk_threads                 the directory each one lists
+//   hash_threads_new/old         the file each one reads, or the connection to a remote tree, and the pipes of
+//                                an external hash command (3 more); both pools count when the phases can run
+//                                side by side (device_affinity separate or auto). Baseline verification, the
+//                                replicas and remote workers use a pool the size of NEW's, with nothing else
+//                                hashing, so they fit in the same budget
+//
+// When that doesn't fit, the largest of the pools is cut down a worker at a time until it does, with a line in
+// the log; with "fd_limit": "fail" the run stops instead, saying how many were needed. A file or directory
+// still failing to open for lack of descriptors (another process sharing a per-user limit, say) is retried as
+// a transient error (see retry.go) rather than recorded.
+//
+// There is no such limit on Windows.
+//
+
+package main
+
+import (
+  "fmt"
+  "strings"
+  "syscall"
+  "time"
+)
+
+var fd_exhausted_errnos = []syscall.Errno{syscall.EMFILE, syscall.ENFILE}
+
+func fd_reserve() int {
+  if conf.Fd_reserve > 0 {
+    return conf.Fd_reserve
+  }
+  return 64
+}
+
+func is_fd_exhausted(err error) bool {
+  return err != nil && mentions(err.Error(), fd_exhausted_errnos)
+}
+
+func fd_retries() int {
+  return 5
+}
+
+func fd_backoff() time.Duration {
+  return time.Second
+}
+
+// fds_per_hasher counts what a hash worker holds open at once
+func fds_per_hasher() int {
+  if external_command() != "" {
+    return 4
+  }
+  return 1
+}
+
+func check_fd_budget() error {
+  if conf.Fd_limit != "" && conf.Fd_limit != "reduce" && conf.Fd_limit != "fail" {
+    return fmt.Errorf("unknown fd_limit %q, expected reduce or fail", conf.Fd_limit)
+  }
+  limit, ok := fd_limit()
+  if !ok {
+    return nil
+  }
+
+  side_by_side := conf.Device_affinity == "separate" || conf.Device_affinity == "auto"
+  n_new, n_old, walkers, conns := hash_threads("new"), hash_threads("old"), walk_threads(), conf.Db_maxconnections
+  need := func() int {
+    hashers := n_new
+    if side_by_side {
+      hashers += n_old
+    } else if n_old > hashers {
+      hashers = n_old
+    }
+    db := conns
+    if db <= 0 {
+      db = hashers + walkers
+    }
+    return fd_reserve() + db + walkers + hashers * fds_per_hasher()
+  }
+  wanted := need()
+  if wanted <= limit {
+    return nil
+  }
+  if conf.Fd_limit == "fail" {
+    return fmt.Errorf("the configured workers can hold %d file descriptors open at once, more than the limit of %d: raise it (ulimit -n, LimitNOFILE=) or lower hash_threads_new/old, walk_threads and db_maxconnections", wanted, limit)
+  }
+
+  // one worker less from the largest pool at a time
+  for need() > limit {
+    p := &n_new
+    for _, q := range []*int{&n_old, &walkers, &conns} {
+      if *q > *p {
+        p = q
+      }
+    }
+    if *p <= 1 {
+      return fmt.Errorf("the limit of %d file descriptors is too low even for a single worker each: raise it (ulimit -n, LimitNOFILE=)", limit)
+    }
+    *p--
+  }
+
+  var cut []string
+  for _, c := range []struct { name string; from, to int }{
+    {"hash_threads_new", hash_threads("new"), n_new},
+    {"hash_threads_old", hash_threads("old"), n_old},
+    {"walk_threads", walk_threads(), walkers},
+    {"db_maxconnections", conf.Db_maxconnections, conns},
+  } {
+    if c.to != c.from {
+      cut = append(cut, fmt.Sprintf("%s %d -> %d", c.name, c.from, c.to))
+    }
+  }
+  conf.Hash_threads_new, conf.Hash_threads_old, conf.Walk_threads, conf.Db_maxconnections = n_new, n_old, walkers, conns
+  l.Print("the workers would need ", wanted, " file descriptors, the limit is ", limit, "; reduced ", strings.Join(cut, ", "))
+  return nil
+}
@@ -0,0 +1,29 @@
+//go:build !windows
+
+package main
+
+import (
+  "math"
+  "syscall"
+)
+
+// fd_limit raises the soft limit on open files to the hard one, and returns it
+func fd_limit() (int, bool) {
+  var lim syscall.Rlimit
+  if err := syscall.Getrlimit(syscall.RLIMIT_NOFILE, &lim); err != nil {
+    lw.Print("can't get the limit on open files: ", err)
+    return 0, false
+  }
+  if lim.Cur < lim.Max {
+    raised := lim
+    raised.Cur = lim.Max
+    // macOS refuses more than its kern.maxfilesperproc, the limit stays as it was then
+    if err := syscall.Setrlimit(syscall.RLIMIT_NOFILE, &raised); err == nil {
+      lim = raised
+    }
+  }
+  if uint64(lim.Cur) > math.MaxInt32 {
+    return math.MaxInt32, true
+  }
+  return int(lim.Cur), true
+}
@@ -0,0 +1,6 @@
+package main
+
+// fd_limit: Windows has no limit on open handles to budget
+func fd_limit() (int, bool) {
+  return 0, false
+}
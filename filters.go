@@ -0,0 +1,31 @@
+//
+// Named work filters.
+//
+// Besides where_clause, the config can name filters for partial runs:
+//
+//   "filters": {"projectA": "filename like 'projA/%'", "big": "size > 1000000000"}
+//
+// and "-filter projectA" (or "-filter projectA,big" for both) applies them to this run, on top of where_clause.
+//
+
+package main
+
+import (
+  "fmt"
+  "strings"
+)
+
+var active_filters []string // conditions of the filters selected with -filter
+
+func select_filters(names string) error {
+  for _, name := range strings.Split(names, ",") {
+    name = strings.TrimSpace(name)
+    cond, ok := conf.Filters[name]
+    if !ok {
+      return fmt.Errorf("no filter named %q in the config", name)
+    }
+    active_filters = append(active_filters, "(" + cond + ")")
+  }
+  l.Print("using filters ", names)
+  return nil
+}
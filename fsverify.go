@@ -0,0 +1,106 @@
+//
+// Filesystem-level verification of the NEW tree.
+//
+// ZFS and Btrfs keep a checksum for every block they store. When NEW lives on one of them, a clean scrub
+// is proof that every block reads back as written, so the SHA256 pass over NEW can be replaced by a single
+// scrub and the rows get tagged as "verified by filesystem" instead.
+//
+
+package main
+
+import (
+  "fmt"
+  "os/exec"
+  "strconv"
+  "strings"
+
+  pq "github.com/lib/pq"
+)
+
+// fs_verify runs (or consumes the results of) a scrub of the filesystem holding new_path.
+// It returns nil only if the filesystem reports no checksum or read errors.
+func fs_verify() error {
+  switch conf.Fs_verify {
+  case "btrfs":
+    return btrfs_verify(conf.New_path)
+  case "zfs":
+    return zfs_verify(conf.New_path)
+  }
+  return fmt.Errorf("unknown fs_verify type: %s", conf.Fs_verify)
+}
+
+func btrfs_verify(path string) error {
+  args := []string{"scrub", "status", "-R", path}
+  if conf.Fs_scrub {
+    // -B waits for the scrub to finish and prints the same raw stats as "status -R"
+    args = []string{"scrub", "start", "-B", "-R", path}
+  }
+  l.Print("running: btrfs ", strings.Join(args, " "))
+  out, err := exec.Command("btrfs", args...).CombinedOutput()
+  if err != nil {
+    return fmt.Errorf("btrfs scrub: %s: %s", err, out)
+  }
+
+  found := false
+  for _, line := range strings.Split(string(out), "\n") {
+    kv := strings.SplitN(strings.TrimSpace(line), ":", 2)
+    if len(kv) != 2 || !strings.HasSuffix(kv[0], "_errors") || kv[0] == "corrected_errors" {
+      continue
+    }
+    n, err := strconv.ParseUint(strings.TrimSpace(kv[1]), 10, 64)
+    if err != nil {
+      continue
+    }
+    found = true
+    if n > 0 {
+      return fmt.Errorf("btrfs scrub reported %s: %d", kv[0], n)
+    }
+  }
+  if !found {
+    return fmt.Errorf("btrfs scrub: could not find error counters in output: %s", out)
+  }
+  return nil
+}
+
+func zfs_verify(path string) error {
+  pool := conf.Zfs_pool
+  if pool == "" {
+    out, err := exec.Command("zfs", "list", "-H", "-o", "name", path).Output()
+    if err != nil {
+      return fmt.Errorf("finding zfs dataset for %s: %s", path, err)
+    }
+    pool = strings.SplitN(strings.TrimSpace(string(out)), "/", 2)[0]
+  }
+
+  if conf.Fs_scrub {
+    l.Print("running: zpool scrub -w ", pool)
+    if out, err := exec.Command("zpool", "scrub", "-w", pool).CombinedOutput(); err != nil {
+      return fmt.Errorf("zpool scrub: %s: %s", err, out)
+    }
+  }
+
+  out, err := exec.Command("zpool", "status", "-p", pool).CombinedOutput()
+  if err != nil {
+    return fmt.Errorf("zpool status: %s: %s", err, out)
+  }
+  status := string(out)
+  if !strings.Contains(status, "scrub repaired") {
+    return fmt.Errorf("zpool %s has no completed scrub", pool)
+  }
+  if !strings.Contains(status, "with 0 errors") || !strings.Contains(status, "No known data errors") {
+    return fmt.Errorf("zpool %s reports errors:\n%s", pool, status)
+  }
+  return nil
+}
+
+// mark_fs_verified tags all outstanding rows of the new tree as verified by the filesystem;
+// filter holds extra conditions as returned by work_filter()
+func mark_fs_verified(filter string) (int64, error) {
+  query := fmt.Sprintf("update %s set verified_by = $1 where hash_new is null and verified_by is null", pq.QuoteIdentifier(conf.Table_name))
+  query += filter
+  res, err := db_exec(query, "filesystem:"+conf.Fs_verify)
+  if err != nil {
+    return 0, err
+  }
+  return res.RowsAffected()
+}
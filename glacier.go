@@ -0,0 +1,275 @@
+//
+// Restoring the OLD tree from Glacier.
+//
+// Objects in the S3 Glacier and Deep Archive storage classes can't be read until a temporary copy has been
+// restored, which takes hours and is billed per request and per GB. With "glacier_restore": true and old_path on
+// S3 through rclone (rclone:<remote>:<bucket>/<path>), an OLD file that can't be read because it is archived is
+// marked cold (restore column) instead of failing. After the OLD phase, one instance at a time then:
+//
+//   - requests restores of cold files, keeping at most glacier_batch (1000 by default) outstanding, at
+//     glacier_tier (Bulk, Standard or Expedited; Bulk by default) for glacier_lifetime_days (1 by default),
+//   - checks every glacier_poll seconds (900 by default) which of them are back, and hashes those,
+//
+// until every cold file has been hashed or the deadline passes. A restored copy that expired before it was
+// hashed is simply found cold again. Restore requests, the bytes restored and their estimated cost, from
+// glacier_cost_per_1000 (per 1000 requests) and glacier_cost_per_gb, are added up in the run's row of <table>_runs.
+//
+
+package main
+
+import (
+  "context"
+  "encoding/json"
+  "fmt"
+  "os"
+  "strings"
+  "time"
+
+  pq "github.com/lib/pq"
+)
+
+func check_glacier() error {
+  if !conf.Glacier_restore {
+    return nil
+  }
+  if _, ok := unmetered(remotes["old"]).(*rclone_remote); !ok {
+    return fmt.Errorf("glacier_restore needs old_path on S3 through rclone")
+  }
+  switch conf.Glacier_tier {
+  case "", "Bulk", "Standard", "Expedited":
+  default:
+    return fmt.Errorf("glacier_tier must be Bulk, Standard or Expedited, got %q", conf.Glacier_tier)
+  }
+  return nil
+}
+
+// is_cold says whether reading an OLD file failed because the object is archived
+func is_cold(side string, err error) bool {
+  return conf.Glacier_restore && side == "old" && strings.Contains(err.Error(), "InvalidObjectState")
+}
+
+func mark_cold(file string) {
+  _, err := db_exec(fmt.Sprintf("update %s set restore = 'cold', restore_requested_at = null, status = null, claimed_by = null, claimed_at = null where filename = $1",
+    pq.QuoteIdentifier(conf.Table_name)), file)
+  if err != nil {
+    le.Print("error marking ", file, " as archived: ", err)
+  }
+}
+
+// glacier_condition keeps the OLD phase away from files that are waiting for a restore
+func glacier_condition() string {
+  if !conf.Glacier_restore {
+    return ""
+  }
+  return "(restore is null or restore = 'restored')"
+}
+
+// old_phase hashes the OLD tree, restoring archived files if configured to
+func old_phase() {
+  hash_phase("old", glacier_condition())
+  if conf.Glacier_restore {
+    err := glacier_phase()
+    die_if(err)
+  }
+}
+
+func glacier_batch() int {
+  if conf.Glacier_batch > 0 {
+    return conf.Glacier_batch
+  }
+  return 1000
+}
+
+func glacier_poll() time.Duration {
+  if conf.Glacier_poll > 0 {
+    return time.Duration(conf.Glacier_poll) * time.Second
+  }
+  return 15 * time.Minute
+}
+
+func glacier_phase() error {
+  // only one instance at a time sends restores; the others hash what comes back in their OLD phase
+  ctx := context.Background()
+  conn, err := db.Conn(ctx)
+  if err != nil {
+    return err
+  }
+  defer conn.Close()
+  var locked bool
+  if err = conn.QueryRowContext(ctx, "select pg_try_advisory_lock(hashtext('integrity_check glacier ' || $1))", conf.Table_name).Scan(&locked); err != nil || !locked {
+    return err
+  }
+  defer conn.ExecContext(ctx, "select pg_advisory_unlock(hashtext('integrity_check glacier ' || $1))", conf.Table_name)
+
+  t := pq.QuoteIdentifier(conf.Table_name)
+  for !deadline_passed() {
+    var cold, requested int
+    err = db.QueryRow(fmt.Sprintf("select count(*) filter (where restore = 'cold'), count(*) filter (where restore = 'requested') from %s where hash_old is null%s",
+      t, work_filter())).Scan(&cold, &requested)
+    if err != nil {
+      return err
+    }
+    if cold == 0 && requested == 0 {
+      return nil
+    }
+    l.Print("glacier: ", cold, " archived files waiting, ", requested, " restores outstanding")
+
+    if n := glacier_batch() - requested; n > 0 && cold > 0 {
+      if err = request_restores(n); err != nil {
+        return err
+      }
+    }
+    restored, err := check_restores()
+    if err != nil {
+      return err
+    }
+    if restored > 0 {
+      hash_phase("old", "restore = 'restored'")
+      continue
+    }
+    wait := glacier_poll()
+    if !deadline.IsZero() && time.Until(deadline) < wait {
+      wait = time.Until(deadline)
+    }
+    time.Sleep(wait)
+  }
+  return nil
+}
+
+// old_names returns the OLD names of up to limit files in a restore state, mapped to their filenames
+func old_names(state string, limit int) (map[string]string, int64, error) {
+  query := fmt.Sprintf("select filename, size from %s where restore = $1 and hash_old is null%s order by filename", pq.QuoteIdentifier(conf.Table_name), work_filter())
+  if limit > 0 {
+    query += fmt.Sprintf(" limit %d", limit)
+  }
+  rows, err := db.Query(query, state)
+  if err != nil {
+    return nil, 0, err
+  }
+  defer rows.Close()
+  names := map[string]string{}
+  var bytes int64
+  for rows.Next() {
+    var file string
+    var size int64
+    if err = rows.Scan(&file, &size); err != nil {
+      return nil, 0, err
+    }
+    names[side_name("old", file)] = file
+    bytes += size
+  }
+  return names, bytes, rows.Err()
+}
+
+// rclone_backend runs "rclone backend <command>" on the OLD root for the listed objects, and decodes its output
+func rclone_backend(command string, names map[string]string, out interface{}, opts ...string) error {
+  list, err := os.CreateTemp("", "integrity_check-glacier-")
+  if err != nil {
+    return err
+  }
+  defer os.Remove(list.Name())
+  for name := range names {
+    fmt.Fprintln(list, name)
+  }
+  if err = list.Close(); err != nil {
+    return err
+  }
+
+  rm := unmetered(remotes["old"]).(*rclone_remote)
+  args := []string{"backend", command, rm.root, "--files-from-raw", list.Name()}
+  for _, o := range opts {
+    args = append(args, "-o", o)
+  }
+  b, err := rm.command(args...).Output()
+  if err != nil {
+    return fmt.Errorf("rclone backend %s: %s", command, err)
+  }
+  return json.Unmarshal(b, out)
+}
+
+func request_restores(limit int) error {
+  names, bytes, err := old_names("cold", limit)
+  if err != nil || len(names) == 0 {
+    return err
+  }
+  tier := conf.Glacier_tier
+  if tier == "" {
+    tier = "Bulk"
+  }
+  days := conf.Glacier_lifetime_days
+  if days <= 0 {
+    days = 1
+  }
+
+  var results []struct {
+    Status string
+    Remote string
+  }
+  err = rclone_backend("restore", names, &results, "priority="+tier, fmt.Sprintf("lifetime=%d", days))
+  if err != nil {
+    return err
+  }
+  update := fmt.Sprintf("update %s set restore = 'requested', restore_requested_at = now() where filename = $1", pq.QuoteIdentifier(conf.Table_name))
+  sent := 0
+  for _, r := range results {
+    file, ok := names[r.Remote]
+    if !ok {
+      continue
+    }
+    if r.Status != "OK" && !strings.Contains(r.Status, "RestoreAlreadyInProgress") {
+      le.Print("glacier: error requesting restore of ", r.Remote, ": ", r.Status)
+      continue
+    }
+    if _, err = db_exec(update, file); err != nil {
+      return err
+    }
+    sent++
+  }
+  l.Print("glacier: requested ", sent, " restores (", bytes, " bytes) at tier ", tier)
+  return record_restore_cost(sent, bytes)
+}
+
+// check_restores marks the requested files that are readable again as restored
+func check_restores() (int, error) {
+  names, _, err := old_names("requested", 0)
+  if err != nil || len(names) == 0 {
+    return 0, err
+  }
+  var statuses []struct {
+    Remote string
+    RestoreStatus *struct {
+      IsRestoreInProgress bool
+      RestoreExpiryDate time.Time
+    }
+  }
+  if err = rclone_backend("restore-status", names, &statuses, "all"); err != nil {
+    return 0, err
+  }
+  update := fmt.Sprintf("update %s set restore = 'restored' where filename = $1", pq.QuoteIdentifier(conf.Table_name))
+  restored := 0
+  for _, s := range statuses {
+    file, ok := names[s.Remote]
+    if !ok || s.RestoreStatus == nil || s.RestoreStatus.IsRestoreInProgress {
+      continue
+    }
+    if _, err = db_exec(update, file); err != nil {
+      return restored, err
+    }
+    restored++
+  }
+  if restored > 0 {
+    l.Print("glacier: ", restored, " files restored")
+  }
+  return restored, nil
+}
+
+// record_restore_cost adds restore requests to the totals of the run
+func record_restore_cost(requests int, bytes int64) error {
+  cost := float64(requests)/1000*conf.Glacier_cost_per_1000 + float64(bytes)/(1<<30)*conf.Glacier_cost_per_gb
+  if run_id == 0 {
+    return nil
+  }
+  _, err := db_exec(fmt.Sprintf(`update %s set restore_requests = coalesce(restore_requests, 0) + $2, restore_bytes = coalesce(restore_bytes, 0) + $3,
+    restore_cost = coalesce(restore_cost, 0) + $4 where run_id = $1`, runs_table()), run_id, requests, bytes, cost)
+  return err
+}
@@ -0,0 +1,73 @@
+//
+// Encrypted output.
+//
+// File listings reveal project names, so with "gpg_recipients" set, reports, summaries and manifests are
+// encrypted to those keys by gpg on the way out and never touch the disk in plaintext. The recipients' public
+// keys have to be in the keyring of the user running the tool; "gpg_binary" and "gpg_flags" adjust the call
+// (e.g. "--homedir /etc/integrity_check/gnupg"). Output to stdout is ASCII-armored.
+//
+
+package main
+
+import (
+  "io"
+  "os"
+  "os/exec"
+  "strings"
+)
+
+type gpg_writer struct {
+  io.WriteCloser // gpg's stdin
+  cmd *exec.Cmd
+}
+
+func (g *gpg_writer) Close() error {
+  err := g.WriteCloser.Close()
+  if werr := g.cmd.Wait(); err == nil {
+    err = werr
+  }
+  return err
+}
+
+type stdout_writer struct {
+  io.Writer
+}
+
+func (stdout_writer) Close() error { return nil }
+
+// create_output opens a file for a report or manifest, or stdout for an empty name, encrypting what is
+// written to it if so configured
+func create_output(filename string) (io.WriteCloser, error) {
+  if len(conf.Gpg_recipients) == 0 {
+    if filename == "" {
+      return stdout_writer{os.Stdout}, nil
+    }
+    return os.Create(filename)
+  }
+
+  bin := conf.Gpg_binary
+  if bin == "" {
+    bin = "gpg"
+  }
+  args := append(strings.Fields(conf.Gpg_flags), "--batch", "--yes", "--encrypt")
+  for _, r := range conf.Gpg_recipients {
+    args = append(args, "--recipient", r)
+  }
+  if filename == "" {
+    args = append(args, "--armor", "--output", "-")
+  } else {
+    args = append(args, "--output", filename)
+  }
+
+  cmd := exec.Command(bin, args...)
+  cmd.Stdout = os.Stdout
+  cmd.Stderr = os.Stderr
+  in, err := cmd.StdinPipe()
+  if err != nil {
+    return nil, err
+  }
+  if err = cmd.Start(); err != nil {
+    return nil, err
+  }
+  return &gpg_writer{in, cmd}, nil
+}
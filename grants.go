@@ -0,0 +1,52 @@
+//
+// Table ownership and privileges.
+//
+// With table_owner set, every table the tool creates (the state table and its _workers, _progress, _replicas,
+// _runs and _shards companions) is handed over to that role, and "grants" maps roles to the privileges they get on
+// them, e.g. {"auditors": "select", "ops": "select, update"}. Both are applied each time the tables are set up, so a
+// new table never needs fixing by hand; the connecting role has to be a member of the owner role.
+//
+
+package main
+
+import (
+  "fmt"
+  "strings"
+
+  pq "github.com/lib/pq"
+)
+
+var table_privileges = map[string]bool{"select": true, "insert": true, "update": true, "delete": true,
+  "truncate": true, "references": true, "trigger": true, "all": true}
+
+// privilege_list checks a comma-separated list of table privileges, as it ends up in the GRANT as is
+func privilege_list(privileges string) (string, error) {
+  var list []string
+  for _, p := range strings.Split(privileges, ",") {
+    p = strings.ToLower(strings.TrimSpace(p))
+    if !table_privileges[p] {
+      return "", fmt.Errorf("unknown table privilege %q", p)
+    }
+    list = append(list, p)
+  }
+  return strings.Join(list, ", "), nil
+}
+
+// set_table_access applies table_owner and grants to a table, given as a quoted identifier
+func set_table_access(table string) error {
+  if conf.Table_owner != "" {
+    if _, err := db.Exec(fmt.Sprintf("alter table %s owner to %s", table, pq.QuoteIdentifier(conf.Table_owner))); err != nil {
+      return fmt.Errorf("setting owner of %s: %s", table, err)
+    }
+  }
+  for role, privileges := range conf.Grants {
+    list, err := privilege_list(privileges)
+    if err != nil {
+      return err
+    }
+    if _, err = db.Exec(fmt.Sprintf("grant %s on %s to %s", list, table, pq.QuoteIdentifier(role))); err != nil {
+      return fmt.Errorf("granting %s on %s to %s: %s", list, table, role, err)
+    }
+  }
+  return nil
+}
@@ -0,0 +1,478 @@
+//
+// Computing the recorded hash of one file on one side, according to its policy.
+//
+
+package main
+
+import (
+  "crypto/sha256"
+  "encoding"
+  "encoding/binary"
+  "fmt"
+  "hash"
+  "hash/fnv"
+  "io"
+  "math/rand"
+  "os"
+  "sort"
+  "sync"
+)
+
+// side_root returns the root of a tree: "new", "old", or "replica:<name>"
+func side_root(side string) string {
+  switch side {
+  case "new":
+    return conf.New_path
+  case "old":
+    return conf.Old_path
+  }
+  for i := range conf.Replicas {
+    if replica_side(&conf.Replicas[i]) == side {
+      return conf.Replicas[i].Path
+    }
+  }
+  return ""
+}
+
+// side_name returns the name of a state table entry in a tree, relative to its root
+func side_name(side string, file string) string {
+  if side == "old" {
+    return old_name(file)
+  }
+  return file
+}
+
+// side_path returns the full path of a state table entry in a tree
+func side_path(side string, file string) string {
+  return side_root(side)+"/"+side_name(side, file)
+}
+
+func compute_hash(side string, file string, p *policy) (string, error) {
+  hash, _, err := compute_hash_digests(side, file, p, false)
+  return hash, err
+}
+
+// digests collected along with a file's hash for the features that want them
+type digests struct {
+  chunks [][]byte // one per chunk_size piece, with chunk_digests
+  cdc []byte // content-defined chunk fingerprints, with cdc_fingerprints
+}
+
+func want_chunks(extras bool) bool {
+  return extras && conf.Chunk_digests
+}
+
+func want_cdc(extras bool) bool {
+  return extras && conf.Cdc_fingerprints
+}
+
+// compute_hash_digests also returns the configured extra digests of the content when extras is set and
+// the policy reads the whole file; the size and sampled policies have none
+func compute_hash_digests(side string, file string, p *policy, extras bool) (string, *digests, error) {
+  if side == "old" && conf.Old_sidecars {
+    if hash, ok, err := sidecar_hash(file, p); ok {
+      return hash, nil, err
+    }
+  }
+
+  if hash, ok, err := external_hash(side, file, p, extras); ok {
+    return hash, nil, err
+  }
+
+  if rm := remotes[side]; rm != nil {
+    return compute_remote_hash(rm, side, file, p, extras)
+  }
+
+  if conf.Polite_latency_ms > 0 {
+    polite.acquire()
+    defer polite.release()
+    probe_latency(side_path(side, file))
+  }
+
+  return retry_hash(side, file, p, extras)
+}
+
+// local_hash hashes a file of a local tree, opening it with open
+func local_hash(side string, file string, p *policy, extras bool, open func(string) (*os.File, error)) (string, *digests, error) {
+  f, err := open(side_path(side, file))
+  if err != nil {
+    return "", nil, fmt.Errorf("opening: %s", err)
+  }
+  defer f.Close()
+
+  if p.Action == "size" {
+    fi, err := f.Stat()
+    if err != nil {
+      return "", nil, err
+    }
+    return fmt.Sprintf("size:%d", fi.Size()), nil, nil
+  }
+
+  if p.Action == "chunked" && !transformed(side, file) && !p.Normalize_eol && !want_cdc(extras) {
+    sums, err := chunk_sums(f)
+    if err != nil {
+      return "", nil, fmt.Errorf("reading: %s", err)
+    }
+    var d *digests
+    if want_chunks(extras) {
+      d = &digests{chunks: sums}
+    }
+    return fmt.Sprintf("chunked:%x", combine_sums(sums)), d, nil
+  }
+
+  if p.Action == "sampled" {
+    if transformed(side, file) {
+      return "", nil, fmt.Errorf("sampled verification needs random access and can't be combined with transforms")
+    }
+    sum, err := sampled_sum(f, file)
+    if err != nil {
+      return "", nil, fmt.Errorf("reading: %s", err)
+    }
+    return fmt.Sprintf("sampled:%x", sum), nil, nil
+  }
+
+  if conf.Sparse_holes && (p.Action == "full" || p.Action == "chunked") {
+    if r, ok := sparse_reader(f); ok {
+      return hash_stream(side, file, p, r, extras)
+    }
+  }
+
+  if p.Action == "full" && hash_algorithm() == "blake3" && !want_chunks(extras) && !want_cdc(extras) && !transformed(side, file) && !p.Normalize_eol {
+    // hashed on several cores, a subtree each
+    sum, err := blake3_file(f)
+    if err != nil {
+      return "", nil, fmt.Errorf("reading: %s", err)
+    }
+    return fmt.Sprintf("%s%x", hash_prefix(), sum), nil, nil
+  }
+
+  if p.Action == "full" && hash_algorithm() == "sha256" && conf.Mmap_min_mb > 0 && !want_chunks(extras) && !want_cdc(extras) && !transformed(side, file) && !p.Normalize_eol {
+    fi, err := f.Stat()
+    if err != nil {
+      return "", nil, err
+    }
+    // large files can be hashed through a memory mapping, which saves a read() per buffer
+    if fi.Size() >= conf.Mmap_min_mb << 20 {
+      sum, err := mmap_sum(f)
+      if err != nil {
+        return "", nil, fmt.Errorf("reading: %s", err)
+      }
+      return fmt.Sprintf("%x", sum), nil, nil
+    }
+  }
+
+  return hash_stream(side, file, p, f, extras)
+}
+
+func compute_remote_hash(rm remote, side string, file string, p *policy, extras bool) (string, *digests, error) {
+  name := side_name(side, file)
+
+  switch p.Action {
+  case "size":
+    size, err := rm.stat(name)
+    if err != nil {
+      return "", nil, err
+    }
+    return fmt.Sprintf("size:%d", size), nil, nil
+  case "sampled":
+    return "", nil, fmt.Errorf("sampled verification needs random access, which remote trees don't provide")
+  }
+
+  in, err := rm.open(name)
+  if err != nil {
+    return "", nil, fmt.Errorf("opening: %s", err)
+  }
+  hash, d, err := hash_stream(side, file, p, in, extras)
+  if cerr := in.Close(); err == nil && cerr != nil {
+    return "", nil, fmt.Errorf("reading: %s", cerr)
+  }
+  return hash, d, err
+}
+
+// hash_stream hashes content read sequentially, for the "full" and "chunked" policies
+func hash_stream(side string, file string, p *policy, in io.Reader, extras bool) (string, *digests, error) {
+  r, err := transform_reader(side, file, in)
+  if err != nil {
+    return "", nil, err
+  }
+
+  var h hash.Hash
+  chunks := new_chunked_hash()
+  if p.Action == "chunked" {
+    h = chunks
+  } else {
+    h = new_hash()
+  }
+  writers := []io.Writer{h}
+  if want_chunks(extras) && p.Action != "chunked" {
+    writers = append(writers, chunks)
+  }
+  cdc := new_cdc_writer()
+  if want_cdc(extras) {
+    writers = append(writers, cdc)
+  }
+  w := io.MultiWriter(writers...)
+  var sink io.Writer = w
+  eol := &eol_writer{w: w}
+  if p.Normalize_eol {
+    sink = eol
+  }
+  // through the leased buffer, whatever r implements
+  buf, release := read_buffer(in)
+  _, err = io.CopyBuffer(sink, struct{ io.Reader }{r}, buf)
+  release()
+  if cerr := r.Close(); err == nil {
+    err = cerr
+  }
+  if err != nil {
+    return "", nil, fmt.Errorf("reading: %s", err)
+  }
+  eol.flush()
+
+  prefix := ""
+  if p.Normalize_eol {
+    prefix = "eol:"
+  }
+  if p.Action == "chunked" {
+    prefix += "chunked:"
+  } else {
+    prefix += hash_prefix()
+  }
+  var d *digests
+  if want_chunks(extras) || want_cdc(extras) {
+    d = &digests{}
+    if want_chunks(extras) {
+      d.chunks = chunks.sums()
+    }
+    if want_cdc(extras) {
+      d.cdc = cdc.finish()
+    }
+  }
+  return fmt.Sprintf("%s%x", prefix, h.Sum(nil)), d, nil
+}
+
+// eol_writer passes content through with CRLF line endings turned into LF
+type eol_writer struct {
+  w io.Writer
+  cr bool // the previous write ended in a CR
+}
+
+func (e *eol_writer) Write(p []byte) (int, error) {
+  out := make([]byte, 0, len(p)+1)
+  for i, b := range p {
+    if e.cr && b != '\n' {
+      out = append(out, '\r')
+    }
+    e.cr = false
+    if b == '\r' {
+      if i == len(p)-1 {
+        e.cr = true // decide when the next byte arrives
+        continue
+      }
+      if p[i+1] == '\n' {
+        continue
+      }
+    }
+    out = append(out, b)
+  }
+  if _, err := e.w.Write(out); err != nil {
+    return 0, err
+  }
+  return len(p), nil
+}
+
+// flush writes out a CR left pending at the very end of the content
+func (e *eol_writer) flush() {
+  if e.cr {
+    e.w.Write([]byte{'\r'})
+    e.cr = false
+  }
+}
+
+
+// The chunked digest is the SHA256 of the concatenated SHA256 digests of each chunk_size piece of the file.
+// It can be computed in parallel when the file allows random access, or sequentially from a stream.
+
+func chunk_size() int64 {
+  if conf.Chunk_size_mb > 0 {
+    return int64(conf.Chunk_size_mb) << 20
+  }
+  return 64 << 20
+}
+
+type chunked_hash struct {
+  chunk hash.Hash
+  fill int64
+  digests hash.Hash
+  done [][]byte // digests of the chunks completed so far
+}
+
+func new_chunked_hash() *chunked_hash {
+  return &chunked_hash{chunk: sha256.New(), digests: sha256.New()}
+}
+
+func (c *chunked_hash) Write(p []byte) (int, error) {
+  n := len(p)
+  for len(p) > 0 {
+    take := chunk_size() - c.fill
+    if int64(len(p)) < take {
+      take = int64(len(p))
+    }
+    c.chunk.Write(p[:take])
+    c.fill += take
+    p = p[take:]
+    if c.fill == chunk_size() {
+      sum := c.chunk.Sum(nil)
+      c.digests.Write(sum)
+      c.done = append(c.done, sum)
+      c.chunk.Reset()
+      c.fill = 0
+    }
+  }
+  return n, nil
+}
+
+func (c *chunked_hash) Sum(b []byte) []byte {
+  // work on a copy of the running state, so Sum doesn't disturb further writes
+  state, _ := c.digests.(encoding.BinaryMarshaler).MarshalBinary()
+  d := sha256.New()
+  d.(encoding.BinaryUnmarshaler).UnmarshalBinary(state)
+  if c.fill > 0 {
+    d.Write(c.chunk.Sum(nil))
+  }
+  return d.Sum(b)
+}
+
+func (c *chunked_hash) Reset() {
+  c.chunk.Reset()
+  c.digests.Reset()
+  c.fill = 0
+  c.done = nil
+}
+
+// sums returns the digest of every chunk, including a final partial one
+func (c *chunked_hash) sums() [][]byte {
+  if c.fill > 0 {
+    return append(c.done[:len(c.done):len(c.done)], c.chunk.Sum(nil))
+  }
+  return c.done
+}
+
+func (c *chunked_hash) Size() int { return sha256.Size }
+
+func (c *chunked_hash) BlockSize() int { return sha256.BlockSize }
+
+// chunk_sums hashes the chunks of a file in parallel
+func chunk_sums(f *os.File) ([][]byte, error) {
+  fi, err := f.Stat()
+  if err != nil {
+    return nil, err
+  }
+  size := fi.Size()
+  cs := chunk_size()
+  n := int((size + cs - 1) / cs)
+  sums := make([][]byte, n)
+  errs := make([]error, n)
+
+  threads := conf.Chunk_threads
+  if threads <= 0 {
+    threads = 4
+  }
+  next := make(chan int)
+  var cwg sync.WaitGroup
+  cwg.Add(threads)
+  for t := 0; t < threads; t++ {
+    go func() {
+      defer cwg.Done()
+      for i := range next {
+        h := sha256.New()
+        _, errs[i] = io.Copy(h, io.NewSectionReader(f, int64(i)*cs, cs))
+        sums[i] = h.Sum(nil)
+      }
+    }()
+  }
+  for i := 0; i < n; i++ {
+    next <- i
+  }
+  close(next)
+  cwg.Wait()
+
+  for i := 0; i < n; i++ {
+    if errs[i] != nil {
+      return nil, errs[i]
+    }
+  }
+  return sums, nil
+}
+
+// combine_sums turns the chunk digests into the chunked digest of the whole file
+func combine_sums(sums [][]byte) []byte {
+  d := sha256.New()
+  for _, s := range sums {
+    d.Write(s)
+  }
+  return d.Sum(nil)
+}
+
+
+// The sampled digest covers the file size, the first and last sample_head_mb/sample_tail_mb and sample_blocks
+// interior blocks at offsets drawn from a generator seeded with the filename, so both sides sample the same places.
+
+func sampled_sum(f *os.File, file string) ([]byte, error) {
+  fi, err := f.Stat()
+  if err != nil {
+    return nil, err
+  }
+  size := fi.Size()
+
+  head := int64(16) << 20
+  if conf.Sample_head_mb > 0 {
+    head = int64(conf.Sample_head_mb) << 20
+  }
+  tail := int64(16) << 20
+  if conf.Sample_tail_mb > 0 {
+    tail = int64(conf.Sample_tail_mb) << 20
+  }
+  blocks := 64
+  if conf.Sample_blocks > 0 {
+    blocks = conf.Sample_blocks
+  }
+  block := int64(1) << 20
+  if conf.Sample_block_kb > 0 {
+    block = int64(conf.Sample_block_kb) << 10
+  }
+
+  h := sha256.New()
+  binary.Write(h, binary.BigEndian, size)
+
+  if size <= head+tail+block {
+    // small enough that sampling would read most of it anyway
+    _, err = io.Copy(h, f)
+    return h.Sum(nil), err
+  }
+
+  if _, err = io.Copy(h, io.NewSectionReader(f, 0, head)); err != nil {
+    return nil, err
+  }
+
+  seed := fnv.New64a()
+  seed.Write([]byte(file))
+  rnd := rand.New(rand.NewSource(int64(seed.Sum64())))
+  span := size - head - tail - block
+  offsets := make([]int64, blocks)
+  for i := range offsets {
+    offsets[i] = head + rnd.Int63n(span+1)
+  }
+  sort.Slice(offsets, func(i, j int) bool { return offsets[i] < offsets[j] })
+  for _, off := range offsets {
+    binary.Write(h, binary.BigEndian, off)
+    if _, err = io.Copy(h, io.NewSectionReader(f, off, block)); err != nil {
+      return nil, err
+    }
+  }
+
+  if _, err = io.Copy(h, io.NewSectionReader(f, size-tail, tail)); err != nil {
+    return nil, err
+  }
+  return h.Sum(nil), nil
+}
@@ -0,0 +1,94 @@
+//
+// Mount health checks.
+//
+// A stale NFS mount (or one that quietly dropped out, leaving the empty mountpoint) makes every open fail or
+// hang, and the run would record each file as an error. Before the hash phases and every health_interval
+// seconds, each local root gets a statfs and, if configured, a read of a canary file (canary_new/canary_old,
+// relative to the root), each bounded by health_timeout. While a probe fails, hash workers are paused.
+//
+
+package main
+
+import (
+  "fmt"
+  "io"
+  "os"
+  "time"
+)
+
+func health_timeout() time.Duration {
+  if conf.Health_timeout > 0 {
+    return time.Duration(conf.Health_timeout) * time.Second
+  }
+  return 10 * time.Second
+}
+
+func health_interval() time.Duration {
+  if conf.Health_interval > 0 {
+    return time.Duration(conf.Health_interval) * time.Second
+  }
+  return time.Minute
+}
+
+// probe_root checks one tree, giving up after health_timeout (the probe may stay stuck in the kernel)
+func probe_root(root string, canary string) error {
+  done := make(chan error, 1)
+  go func() {
+    if err := statfs(root); err != nil {
+      done <- err
+      return
+    }
+    if canary != "" {
+      f, err := os.Open(root + "/" + canary)
+      if err != nil {
+        done <- err
+        return
+      }
+      defer f.Close()
+      if _, err = io.CopyN(io.Discard, f, 4096); err != nil && err != io.EOF {
+        done <- err
+        return
+      }
+    }
+    done <- nil
+  }()
+
+  select {
+  case err := <-done:
+    return err
+  case <-time.After(health_timeout()):
+    return fmt.Errorf("no response within %s", health_timeout())
+  }
+}
+
+// check_mounts probes the local roots, pausing hash workers while any of them is unhealthy
+func check_mounts() bool {
+  trees := []struct{ side, root, canary string }{
+    {"new", conf.New_path, conf.Canary_new},
+    {"old", conf.Old_path, conf.Canary_old},
+  }
+  healthy := true
+  for _, t := range trees {
+    if t.root == "" || remotes[t.side] != nil {
+      continue
+    }
+    if err := probe_root(t.root, t.canary); err != nil {
+      l.Print("mount health: ", t.side, " tree ", t.root, " is unhealthy: ", err)
+      healthy = false
+    }
+  }
+  if healthy {
+    pause_gate.resume("mount")
+  } else {
+    pause_gate.pause("mount")
+  }
+  return healthy
+}
+
+func start_health_monitor() {
+  go func() {
+    for range time.Tick(health_interval()) {
+      check_mounts()
+    }
+  }()
+}
@@ -0,0 +1,12 @@
+//go:build !windows
+
+package main
+
+import (
+  "syscall"
+)
+
+func statfs(root string) error {
+  var st syscall.Statfs_t
+  return syscall.Statfs(root, &st)
+}
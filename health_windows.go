@@ -0,0 +1,12 @@
+//go:build windows
+
+package main
+
+import (
+  "os"
+)
+
+func statfs(root string) error {
+  _, err := os.Stat(root)
+  return err
+}
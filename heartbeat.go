@@ -0,0 +1,112 @@
+//
+// Worker heartbeats and reclamation of abandoned work.
+//
+// A hash worker claims a row by setting its status ("hashing_new"/"hashing_old") and claimed_by before
+// reading the file, and clears both when the hash is stored. Every process registers itself in
+// <table>_workers and refreshes its heartbeat; at startup, rows claimed by processes whose heartbeat is
+// older than the lease are released, so work held by a crashed run is picked up again.
+//
+
+package main
+
+import (
+  "fmt"
+  "os"
+  "time"
+
+  pq "github.com/lib/pq"
+)
+
+var worker_id string
+
+func workers_table() string {
+  return pq.QuoteIdentifier(conf.Table_name + "_workers")
+}
+
+func heartbeat_interval() time.Duration {
+  if conf.Heartbeat_interval > 0 {
+    return time.Duration(conf.Heartbeat_interval) * time.Second
+  }
+  return 30 * time.Second
+}
+
+func lease() time.Duration {
+  if conf.Lease_seconds > 0 {
+    return time.Duration(conf.Lease_seconds) * time.Second
+  }
+  return 5 * heartbeat_interval()
+}
+
+// start_heartbeat registers this process as a worker and keeps its heartbeat fresh until the process exits
+func start_heartbeat() error {
+  host, _ := os.Hostname()
+  worker_id = fmt.Sprintf("%s:%d", host, os.Getpid())
+
+  _, err := db.Exec(fmt.Sprintf(`
+    create table if not exists %s (
+      worker_id text primary key,
+      host text,
+      pid int,
+      started timestamp,
+      heartbeat timestamp
+    )
+    `, workers_table()))
+  if err != nil {
+    return err
+  }
+  if err = set_table_access(workers_table()); err != nil {
+    return err
+  }
+
+  _, err = db.Exec(fmt.Sprintf(`insert into %s (worker_id, host, pid, started, heartbeat) values ($1, $2, $3, now(), now())
+    on conflict (worker_id) do update set started = now(), heartbeat = now()`, workers_table()), worker_id, host, os.Getpid())
+  if err != nil {
+    return err
+  }
+
+  go func() {
+    for range time.Tick(heartbeat_interval()) {
+      if _, err := db_exec(fmt.Sprintf("update %s set heartbeat = now() where worker_id = $1", workers_table()), worker_id); err != nil {
+        le.Print("error updating heartbeat: ", err)
+      }
+    }
+  }()
+  return nil
+}
+
+func stop_heartbeat() {
+  if _, err := db_exec(fmt.Sprintf("delete from %s where worker_id = $1", workers_table()), worker_id); err != nil {
+    le.Print("error removing worker: ", err)
+  }
+}
+
+// reclaim_stale_work releases rows claimed by workers whose lease has expired
+func reclaim_stale_work() (int64, error) {
+  live := fmt.Sprintf("select worker_id from %s where heartbeat > now() - $1::interval", workers_table())
+  interval := fmt.Sprintf("%d seconds", int(lease().Seconds()))
+
+  res, err := db.Exec(fmt.Sprintf("update %s set status = null, claimed_by = null, claimed_at = null where status is not null and (claimed_by is null or claimed_by not in (%s))",
+    pq.QuoteIdentifier(conf.Table_name), live), interval)
+  if err != nil {
+    return 0, err
+  }
+  n, err := res.RowsAffected()
+  if err != nil {
+    return 0, err
+  }
+
+  _, err = db.Exec(fmt.Sprintf("delete from %s where heartbeat <= now() - $1::interval", workers_table()), interval)
+  return n, err
+}
+
+// claim marks a file as being hashed by this worker; it returns false if someone else holds it, or has
+// already hashed it
+func claim(side string, file string) (bool, error) {
+  res, err := db_exec(fmt.Sprintf("update %s set status = $2, claimed_by = $3, claimed_at = now() where filename = $1 and status is null and %s is null",
+    pq.QuoteIdentifier(conf.Table_name), pq.QuoteIdentifier("hash_"+side)), file, "hashing_"+side, worker_id)
+  if err != nil {
+    return false, err
+  }
+  n, err := res.RowsAffected()
+  return n > 0, err
+}
@@ -0,0 +1,80 @@
+//
+// Hooks: external commands run at fixed points of a run.
+//
+//   "hooks": { "pre-run": "/usr/local/bin/check-window", "per-mismatch": "/usr/local/bin/open-ticket" }
+//
+// Each command is run with sh -c and gets a JSON object on stdin describing the point it is called at (hook,
+// table, host, run_id, and for per-mismatch the file and both hashes; post-run adds the status). The hook points
+// are pre-run (once the run is registered, before the walk; a failing pre-run hook stops the run), post-walk (the
+// table is populated), per-mismatch (a file hashed differently on both sides) and post-run (the run has finished).
+// Failures of the other hooks are logged and the run carries on.
+//
+
+package main
+
+import (
+  "bytes"
+  "encoding/json"
+  "fmt"
+  "os"
+  "os/exec"
+  "time"
+)
+
+var hook_points = []string{"pre-run", "post-walk", "per-mismatch", "post-run"}
+
+func check_hooks() error {
+  for name := range conf.Hooks {
+    known := false
+    for _, h := range hook_points {
+      known = known || h == name
+    }
+    if !known {
+      return fmt.Errorf("unknown hook %q", name)
+    }
+  }
+  return nil
+}
+
+func has_hook(name string) bool {
+  return conf.Hooks[name] != ""
+}
+
+// run_hook runs the command of a hook point, if there is one, with the payload and the common fields on stdin
+func run_hook(name string, payload map[string]interface{}) error {
+  command := conf.Hooks[name]
+  if command == "" {
+    return nil
+  }
+  if payload == nil {
+    payload = map[string]interface{}{}
+  }
+  host, _ := os.Hostname()
+  payload["hook"] = name
+  payload["table"] = conf.Table_name
+  payload["host"] = host
+  payload["run_id"] = run_id
+  payload["time"] = time.Now()
+  b, err := json.Marshal(payload)
+  if err != nil {
+    return err
+  }
+
+  cmd := exec.Command("sh", "-c", command)
+  cmd.Stdin = bytes.NewReader(b)
+  out, err := cmd.CombinedOutput()
+  if len(out) > 0 {
+    l.Print(name, " hook: ", string(bytes.TrimSpace(out)))
+  }
+  if err != nil {
+    return fmt.Errorf("%s hook failed: %s", name, err)
+  }
+  return nil
+}
+
+// log_hook runs a hook whose failure doesn't stop the run
+func log_hook(name string, payload map[string]interface{}) {
+  if err := run_hook(name, payload); err != nil {
+    le.Print(err)
+  }
+}
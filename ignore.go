@@ -0,0 +1,107 @@
+//
+// Per-directory ignore files.
+//
+// A .integrityignore file (name set by ignore_filename) in any directory of NEW excludes matching files and
+// directories below it from the walk, using gitignore syntax: "#" comments, "!" re-includes, a trailing "/"
+// only matches directories, patterns containing a "/" are relative to the ignore file's directory, others
+// match a name at any depth, and "**" matches any number of directories. Rules in deeper directories and later
+// lines take precedence. Remote trees don't support ignore files.
+//
+
+package main
+
+import (
+  "bufio"
+  "os"
+  "path"
+  "strings"
+)
+
+type ignore_rule struct {
+  pattern []string // segments, when anchored
+  name string // base name pattern, when not anchored
+  negate bool
+  dir_only bool
+}
+
+// ignore_list holds the rules of one directory, chained to those of its parents
+type ignore_list struct {
+  parent *ignore_list
+  base string // directory of the ignore file, relative to the root
+  rules []ignore_rule
+}
+
+func ignore_filename() string {
+  if conf.Ignore_filename != "" {
+    return conf.Ignore_filename
+  }
+  return ".integrityignore"
+}
+
+// load_ignores returns the rules in effect inside dir: the parent's, plus those of dir's own ignore file
+func load_ignores(parent *ignore_list, dir string, rel string) *ignore_list {
+  fd, err := os.Open(dir + "/" + ignore_filename())
+  if err != nil {
+    return parent
+  }
+  defer fd.Close()
+
+  list := &ignore_list{parent: parent, base: rel}
+  scanner := bufio.NewScanner(fd)
+  for scanner.Scan() {
+    line := strings.TrimRight(scanner.Text(), " \t\r")
+    if line == "" || strings.HasPrefix(line, "#") {
+      continue
+    }
+    var r ignore_rule
+    if strings.HasPrefix(line, "!") {
+      r.negate = true
+      line = line[1:]
+    } else if strings.HasPrefix(line, `\`) {
+      line = line[1:]
+    }
+    if strings.HasSuffix(line, "/") {
+      r.dir_only = true
+      line = strings.TrimRight(line, "/")
+    }
+    if strings.Contains(line, "/") {
+      r.pattern = strings.Split(strings.TrimPrefix(line, "/"), "/")
+    } else {
+      r.name = line
+    }
+    list.rules = append(list.rules, r)
+  }
+  if err = scanner.Err(); err != nil {
+    le.Print("error reading ", fd.Name(), ": ", err)
+  }
+  return list
+}
+
+// ignored reports whether rel (relative to the root) is excluded
+func (list *ignore_list) ignored(rel string, is_dir bool) bool {
+  for ; list != nil; list = list.parent {
+    sub := rel
+    if list.base != "" {
+      if !strings.HasPrefix(rel, list.base + "/") {
+        continue
+      }
+      sub = strings.TrimPrefix(rel, list.base + "/")
+    }
+    for i := len(list.rules) - 1; i >= 0; i-- {
+      r := &list.rules[i]
+      if r.dir_only && !is_dir {
+        continue
+      }
+      var match bool
+      if r.pattern != nil {
+        match = match_segments(r.pattern, strings.Split(sub, "/"))
+      } else {
+        match, _ = path.Match(r.name, path.Base(sub))
+      }
+      if match {
+        return !r.negate
+      }
+    }
+  }
+  return false
+}
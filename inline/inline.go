@@ -0,0 +1,129 @@
+//
+// Package inline lets copy pipelines hash content while moving it, and hand the hash to integrity_check instead
+// of having it read the file again.
+//
+// Wrap the stream being copied in a Reader (or a Writer), copy as usual, then register the result:
+//
+//   src := inline.NewReader(in)
+//   n, err := io.Copy(out, src)
+//   ...
+//   reg, err := inline.Open(db, "integrity_check_archive")
+//   err = reg.Register(ctx, "projects/a/file.tif", "old", src)
+//
+// The hash is SHA-256 in the format integrity_check records for the "full" policy. Registered hashes go to
+// <table>_inline, and are taken over by the next run once the file is in the state table with the same size,
+// for files whose policy is "full" without transforms or line-ending normalization; the rest are hashed as usual.
+//
+// Filenames are the state table's: relative to new_path, whichever side is registered. A hash of the stream
+// read from the source vouches for OLD only: registering it as NEW as well would take the copy on trust, so
+// the destination should be hashed by integrity_check itself (or registered from a separate read of it).
+//
+
+package inline
+
+import (
+  "context"
+  "crypto/sha256"
+  "database/sql"
+  "fmt"
+  "hash"
+  "io"
+
+  pq "github.com/lib/pq"
+)
+
+// Sum is implemented by Reader and Writer
+type Sum interface {
+  Hash() string
+  Size() int64
+}
+
+// Reader hashes everything read through it
+type Reader struct {
+  r io.Reader
+  h hash.Hash
+  n int64
+}
+
+func NewReader(r io.Reader) *Reader {
+  return &Reader{r: r, h: sha256.New()}
+}
+
+func (r *Reader) Read(p []byte) (int, error) {
+  n, err := r.r.Read(p)
+  r.h.Write(p[:n])
+  r.n += int64(n)
+  return n, err
+}
+
+// Hash returns the hash of what has been read so far
+func (r *Reader) Hash() string {
+  return fmt.Sprintf("%x", r.h.Sum(nil))
+}
+
+// Size returns the number of bytes read so far
+func (r *Reader) Size() int64 {
+  return r.n
+}
+
+// Writer hashes everything written through it
+type Writer struct {
+  w io.Writer
+  h hash.Hash
+  n int64
+}
+
+func NewWriter(w io.Writer) *Writer {
+  return &Writer{w: w, h: sha256.New()}
+}
+
+func (w *Writer) Write(p []byte) (int, error) {
+  n, err := w.w.Write(p)
+  w.h.Write(p[:n])
+  w.n += int64(n)
+  return n, err
+}
+
+func (w *Writer) Hash() string {
+  return fmt.Sprintf("%x", w.h.Sum(nil))
+}
+
+func (w *Writer) Size() int64 {
+  return w.n
+}
+
+// Registry records hashes for an integrity_check state table
+type Registry struct {
+  db *sql.DB
+  table string
+}
+
+// Open prepares registering hashes for the state table, through a database handle of the caller's
+func Open(db *sql.DB, table string) (*Registry, error) {
+  g := &Registry{db: db, table: pq.QuoteIdentifier(table + "_inline")}
+  _, err := db.Exec(fmt.Sprintf(`
+    create table if not exists %s (
+      filename text,
+      side text,
+      size bigint,
+      hash text,
+      registered_at timestamp default now(),
+      primary key (filename, side)
+    )
+    `, g.table))
+  if err != nil {
+    return nil, err
+  }
+  return g, nil
+}
+
+// Register records the hash of a file on one side ("new" or "old"), replacing one registered before
+func (g *Registry) Register(ctx context.Context, filename string, side string, s Sum) error {
+  if side != "new" && side != "old" {
+    return fmt.Errorf("side must be new or old, got %q", side)
+  }
+  _, err := g.db.ExecContext(ctx, fmt.Sprintf(`insert into %s (filename, side, size, hash) values ($1, $2, $3, $4)
+    on conflict (filename, side) do update set size = excluded.size, hash = excluded.hash, registered_at = now()`, g.table),
+    filename, side, s.Size(), s.Hash())
+  return err
+}
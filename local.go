@@ -0,0 +1,288 @@
+//
+// Database-less mode.
+//
+// For small jobs (up to a million files or so), "state_file": "state.jsonl.gz" keeps the whole state in memory
+// and in that file instead of Postgres, so no database needs to be set up:
+//
+//   integrity_check -conf small.json             walk (if the state file doesn't exist yet), hash, print the report
+//   integrity_check -conf small.json report      print the report of the state file
+//
+// The state is saved every minute and at the end, so an interrupted run carries on where it was. Policies,
+// ignore files, transforms and remote trees work as usual; what needs the database (archive members, replicas,
+// workers, and the auxiliary digests) is not available.
+//
+
+package main
+
+import (
+  "bufio"
+  "compress/gzip"
+  "encoding/json"
+  "fmt"
+  "io"
+  "os"
+  "sort"
+  "sync"
+  "time"
+)
+
+type local_entry struct {
+  Filename string `json:"filename"`
+  Size int64 `json:"size"`
+  Changed time.Time `json:"changed"`
+  Hash_new string `json:"hash_new,omitempty"`
+  Hash_old string `json:"hash_old,omitempty"`
+  Error_new string `json:"error_new,omitempty"`
+  Error_old string `json:"error_old,omitempty"`
+}
+
+type local_state struct {
+  mu sync.Mutex
+  entries map[string]*local_entry
+}
+
+// add collects the walk; it is the row_sink of the walkers in this mode
+func (s *local_state) add(values ...interface{}) error {
+  e := &local_entry{Filename: values[0].(string), Size: values[1].(int64), Changed: values[2].(time.Time)}
+  s.mu.Lock()
+  defer s.mu.Unlock()
+  s.entries[e.Filename] = e
+  return nil
+}
+
+func (s *local_state) sorted() []*local_entry {
+  list := make([]*local_entry, 0, len(s.entries))
+  for _, e := range s.entries {
+    list = append(list, e)
+  }
+  sort.Slice(list, func(i, j int) bool { return list[i].Filename < list[j].Filename })
+  return list
+}
+
+func load_local_state(filename string) (*local_state, bool, error) {
+  s := &local_state{entries: map[string]*local_entry{}}
+  fd, err := os.Open(filename)
+  if os.IsNotExist(err) {
+    return s, false, nil
+  }
+  if err != nil {
+    return nil, false, err
+  }
+  defer fd.Close()
+  gz, err := gzip.NewReader(fd)
+  if err != nil {
+    return nil, false, err
+  }
+  dec := json.NewDecoder(gz)
+  for {
+    var e local_entry
+    if err = dec.Decode(&e); err == io.EOF {
+      break
+    } else if err != nil {
+      return nil, false, fmt.Errorf("reading %s: %s", filename, err)
+    }
+    s.entries[e.Filename] = &e
+  }
+  return s, true, nil
+}
+
+// save writes the state next to the state file and moves it into place
+func (s *local_state) save(filename string) error {
+  s.mu.Lock()
+  defer s.mu.Unlock()
+  tmp := filename + ".tmp"
+  fd, err := os.Create(tmp)
+  if err != nil {
+    return err
+  }
+  defer fd.Close()
+  gz := gzip.NewWriter(fd)
+  w := bufio.NewWriter(gz)
+  enc := json.NewEncoder(w)
+  for _, e := range s.sorted() {
+    if err = enc.Encode(e); err != nil {
+      return err
+    }
+  }
+  if err = w.Flush(); err != nil {
+    return err
+  }
+  if err = gz.Close(); err != nil {
+    return err
+  }
+  if err = fd.Close(); err != nil {
+    return err
+  }
+  return os.Rename(tmp, filename)
+}
+
+func run_local(args []string) {
+  if conf.Archive_members != "" || len(conf.Replicas) > 0 {
+    die_if(fmt.Errorf("archive_members and replicas need a database"))
+  }
+  state, exists, err := load_local_state(conf.State_file)
+  die_if(err)
+
+  if len(args) > 0 && args[0] == "report" {
+    write_local_report(os.Stdout, state)
+    return
+  }
+  if len(args) > 0 {
+    die_if(fmt.Errorf("%q needs a database; with state_file only a run and report are available", args[0]))
+  }
+
+  if !exists {
+    l.Print("no state yet, starting file walk")
+    walk_time = time.Now()
+    sink = state
+    if rm := remotes["new"]; rm != nil {
+      err = rm.walk(func(name string, size int64, mtime time.Time) error {
+        if policy_for(name, size).Action == "skip" {
+          return nil
+        }
+        return state.add(name, size, mtime)
+      })
+      die_if(err)
+    } else {
+      walk_tree(conf.New_path)
+    }
+    l.Print("walk done: ", len(state.entries), " files")
+    die_if(state.save(conf.State_file))
+  }
+
+  stop := make(chan struct{})
+  go func() {
+    for {
+      select {
+      case <-stop:
+        return
+      case <-time.After(time.Minute):
+        if err := state.save(conf.State_file); err != nil {
+          le.Print("error saving state: ", err)
+        }
+      }
+    }
+  }()
+
+  if has_old() && phases_concurrent() {
+    old_done := start_pool(1, func() error {
+      local_phase(state, "old")
+      return nil
+    })
+    local_phase(state, "new")
+    old_done.Wait()
+  } else {
+    local_phase(state, "new")
+    if has_old() {
+      local_phase(state, "old")
+    }
+  }
+  close(stop)
+  die_if(state.save(conf.State_file))
+
+  if stopped_fast() {
+    lw.Print("stopped at the first difference (-fail-fast)")
+    if has_old() {
+      write_local_report(os.Stdout, state)
+    }
+    os.Exit(1)
+  }
+
+  if !has_old() {
+    l.Print("hashing complete. Baseline of path_new is in ", conf.State_file)
+    return
+  }
+  write_local_report(os.Stdout, state)
+}
+
+// local_phase hashes the files of one side that have neither a hash nor an error yet
+func local_phase(state *local_state, side string) {
+  var todo []*local_entry
+  for _, e := range state.sorted() {
+    if side == "new" && e.Hash_new == "" && e.Error_new == "" || side == "old" && e.Hash_old == "" && e.Error_old == "" {
+      todo = append(todo, e)
+    }
+  }
+  l.Print("building hashes in path_", side, ": ", len(todo), " files")
+
+  to_hash := make(chan *local_entry)
+  pool := start_pool(hash_threads(side), func() error {
+    for e := range to_hash {
+      p := policy_for(e.Filename, e.Size)
+      if p.Action == "skip" {
+        continue
+      }
+      pause_gate.wait()
+      if deadline_passed() {
+        continue
+      }
+      hash, err := compute_hash(side, e.Filename, p)
+      state.mu.Lock()
+      switch {
+      case err != nil && side == "new":
+        e.Error_new = err.Error()
+      case err != nil:
+        e.Error_old = err.Error()
+      case side == "new":
+        e.Hash_new = hash
+      default:
+        e.Hash_old = hash
+      }
+      mismatch := e.Hash_new != "" && e.Hash_old != "" && e.Hash_new != e.Hash_old
+      state.mu.Unlock()
+      if err != nil {
+        le.Print("error hashing ", side, " ", e.Filename, ": ", err)
+        if error_class(err.Error()) == "MISSING" {
+          fail_fast_found("missing", side+" "+e.Filename)
+        }
+      }
+      if mismatch {
+        fail_fast_found("mismatch", e.Filename)
+      }
+    }
+    return nil
+  })
+  for _, e := range todo {
+    if deadline_passed() {
+      break
+    }
+    to_hash <- e
+  }
+  close(to_hash)
+  pool.Wait()
+}
+
+// write_local_report writes the report in the same format as the database-backed one
+func write_local_report(out io.Writer, state *local_state) {
+  w := bufio.NewWriter(out)
+  defer w.Flush()
+
+  state.mu.Lock()
+  defer state.mu.Unlock()
+  list := state.sorted()
+  var matched, mismatched, pending, errors int
+  for _, e := range list {
+    switch {
+    case e.Error_new != "" || e.Error_old != "":
+      errors++
+    case e.Hash_new == "" || e.Hash_old == "":
+      pending++
+    case e.Hash_new == e.Hash_old:
+      matched++
+    default:
+      mismatched++
+    }
+  }
+  fmt.Fprintf(w, "# integrity_check %s\n", build_version())
+  fmt.Fprintf(w, "# state %s: %d files, %d match, %d mismatch, %d errors, %d pending\n", conf.State_file, len(list), matched, mismatched, errors, pending)
+  for _, e := range list {
+    switch {
+    case e.Error_new != "":
+      fmt.Fprintf(w, "ERROR_NEW\t%s\t%d\t%s\n", e.Filename, e.Size, e.Error_new)
+    case e.Error_old != "":
+      fmt.Fprintf(w, "ERROR_OLD\t%s\t%d\t%s\n", e.Filename, e.Size, e.Error_old)
+    case e.Hash_new != "" && e.Hash_old != "" && e.Hash_new != e.Hash_old:
+      fmt.Fprintf(w, "MISMATCH\t%s\t%d\tnew=%s old=%s\n", e.Filename, e.Size, e.Hash_new, e.Hash_old)
+    }
+  }
+}
@@ -0,0 +1,142 @@
+//
+// Log destinations.
+//
+// By default the log goes to stdout. With log_file set it is written to that file instead, rotated once it
+// grows past log_max_mb (100 by default) with log_keep old files kept (file.1 being the newest, 5 by default).
+// With syslog set ("local" for the local daemon, or "udp://host:514" / "tcp://host:514") it is also sent to syslog
+// under syslog_facility (default "daemon"), with errors (logged through le) at severity err, differences found
+// and trouble worked around (lw) at warning, and everything else (l) at info. Set log_stdout to keep logging to
+// stdout as well.
+//
+
+package main
+
+import (
+  "fmt"
+  "io"
+  "log"
+  "os"
+  "sync"
+)
+
+// le logs errors, lw mismatches, drift and trouble worked around; l everything else
+var le = log.New(os.Stdout, "", log.Ldate|log.Ltime|log.Lshortfile)
+var lw = log.New(os.Stdout, "", log.Ldate|log.Ltime|log.Lshortfile)
+
+func setup_logging() error {
+  var outputs []io.Writer
+  if conf.Log_file != "" {
+    max := int64(100) << 20
+    if conf.Log_max_mb > 0 {
+      max = int64(conf.Log_max_mb) << 20
+    }
+    keep := 5
+    if conf.Log_keep > 0 {
+      keep = conf.Log_keep
+    }
+    f, err := open_rotating(conf.Log_file, max, keep)
+    if err != nil {
+      return err
+    }
+    outputs = append(outputs, f)
+  }
+  if conf.Syslog != "" {
+    s, err := open_syslog(conf.Syslog, conf.Syslog_facility)
+    if err != nil {
+      return fmt.Errorf("syslog: %s", err)
+    }
+    outputs = append(outputs, s)
+  }
+  if len(outputs) == 0 {
+    return nil
+  }
+  if conf.Log_stdout {
+    outputs = append(outputs, os.Stdout)
+  }
+  l.SetOutput(leveled_writer{"info", outputs})
+  le.SetOutput(leveled_writer{"err", outputs})
+  lw.SetOutput(leveled_writer{"warning", outputs})
+  return nil
+}
+
+// severity_writer is a log output that tells the severities of lines apart, as syslog does
+type severity_writer interface {
+  write_at(severity string, p []byte) error
+}
+
+// leveled_writer writes the lines of one logger to every output, at its severity where the output cares
+type leveled_writer struct {
+  severity string
+  outputs []io.Writer
+}
+
+func (w leveled_writer) Write(p []byte) (int, error) {
+  for _, o := range w.outputs {
+    var err error
+    if s, ok := o.(severity_writer); ok {
+      err = s.write_at(w.severity, p)
+    } else {
+      _, err = o.Write(p)
+    }
+    if err != nil {
+      return 0, err
+    }
+  }
+  return len(p), nil
+}
+
+type rotating_file struct {
+  mu sync.Mutex
+  path string
+  max int64
+  keep int
+  fd *os.File
+  size int64
+}
+
+func open_rotating(path string, max int64, keep int) (*rotating_file, error) {
+  r := &rotating_file{path: path, max: max, keep: keep}
+  return r, r.open()
+}
+
+func (r *rotating_file) open() error {
+  fd, err := os.OpenFile(r.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+  if err != nil {
+    return err
+  }
+  fi, err := fd.Stat()
+  if err != nil {
+    fd.Close()
+    return err
+  }
+  r.fd = fd
+  r.size = fi.Size()
+  return nil
+}
+
+func (r *rotating_file) Write(p []byte) (int, error) {
+  r.mu.Lock()
+  defer r.mu.Unlock()
+  if r.size > 0 && r.size + int64(len(p)) > r.max {
+    if err := r.rotate(); err != nil {
+      fmt.Fprintln(os.Stderr, "error rotating log file:", err)
+    }
+  }
+  n, err := r.fd.Write(p)
+  r.size += int64(n)
+  return n, err
+}
+
+// rotate shifts file.1 .. file.<keep-1> up by one, moves the current file to file.1 and starts a new one
+func (r *rotating_file) rotate() error {
+  r.fd.Close()
+  os.Remove(fmt.Sprintf("%s.%d", r.path, r.keep))
+  for i := r.keep - 1; i >= 1; i-- {
+    os.Rename(fmt.Sprintf("%s.%d", r.path, i), fmt.Sprintf("%s.%d", r.path, i+1))
+  }
+  if err := os.Rename(r.path, r.path + ".1"); err != nil {
+    r.open()
+    return err
+  }
+  return r.open()
+}
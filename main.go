@@ -6,7 +6,9 @@
 // 1. Create the table to store state, if it does not exist
 // 2. If there are no entries in the table, start a transaction to add files; traverse all of the files in /path/to/DATA_NEW and add them to the table; the file walk has directory-level concurrency
 // 3. For each file, compute a SHA256 hash for the /path/to/DATA_NEW version and store it in the database; this is done with a concurrency level
+//    (if fs_verify is set and a ZFS/Btrfs scrub of DATA_NEW is clean, files are marked as verified by the filesystem instead)
 // 4. For each file, compute a SHA256 hash for the /path/to/DATA_OLD version and store it in the database; this is done with a concurrency level
+//    (without old_path this step is skipped, and the table - plus an optional sha256sum manifest - is a baseline of DATA_NEW)
 //
 // @tudorxp 2019
 
@@ -17,16 +19,17 @@ import (
   "database/sql"
   "flag"
   "fmt"
+  "io"
   "encoding/json"
   "log"
   "os"
-  "io"
   "sync"
+  "sync/atomic"
   "path/filepath"
   "strings"
-  // "time"
+  "time"
   pq "github.com/lib/pq"
-  "crypto/sha256"
+  "golang.org/x/sync/errgroup"
   // "github.com/davecgh/go-spew/spew"
 )
 
@@ -36,28 +39,311 @@ var conf struct {
   Db_connstr string `json:"db_connstr"`
   Table_name string `json:"table_name"`
   Where_clause string `json:"where_clause"`
+  Filters map[string]string `json:"filters"`
   Db_maxconnections int `json:"db_maxconnections"`
   Db_idleconnections int `json:"db_idleconnections"`
+  Fs_verify string `json:"fs_verify"`
+  Fs_scrub bool `json:"fs_scrub"`
+  Zfs_pool string `json:"zfs_pool"`
+  Archive_members string `json:"archive_members"`
+  Transforms []transform `json:"transforms"`
+  Policies []policy `json:"policies"`
+  Chunk_size_mb int `json:"chunk_size_mb"`
+  Chunk_threads int `json:"chunk_threads"`
+  Min_size int64 `json:"min_size"`
+  Max_size int64 `json:"max_size"`
+  Tiers []tier `json:"tiers"`
+  Sample_head_mb int `json:"sample_head_mb"`
+  Sample_tail_mb int `json:"sample_tail_mb"`
+  Sample_blocks int `json:"sample_blocks"`
+  Sample_block_kb int `json:"sample_block_kb"`
+  Rclone_binary string `json:"rclone_binary"`
+  Rclone_flags string `json:"rclone_flags"`
+  Remote_timeout int `json:"remote_timeout"`
+  Webhdfs_port int `json:"webhdfs_port"`
+  Hdfs_user string `json:"hdfs_user"`
+  Smb_streams bool `json:"smb_streams"`
+  Db_statement_timeout string `json:"db_statement_timeout"`
+  Db_lock_timeout string `json:"db_lock_timeout"`
+  Db_query_timeout int `json:"db_query_timeout"`
+  Db_sslmode string `json:"db_sslmode"`
+  Db_sslrootcert string `json:"db_sslrootcert"`
+  Db_sslcert string `json:"db_sslcert"`
+  Db_sslkey string `json:"db_sslkey"`
+  Db_connect_timeout int `json:"db_connect_timeout"`
+  Db_application_name string `json:"db_application_name"`
+  Heartbeat_interval int `json:"heartbeat_interval"`
+  Lease_seconds int `json:"lease_seconds"`
+  Control_listen string `json:"control_listen"`
+  Progress_interval int `json:"progress_interval"`
+  Device_affinity string `json:"device_affinity"`
+  Hash_threads_new int `json:"hash_threads_new"`
+  Hash_threads_old int `json:"hash_threads_old"`
+  Pipeline bool `json:"pipeline"`
+  Watch_settle int `json:"watch_settle"`
+  Hash_algorithm string `json:"hash_algorithm"`
+  Hash_commands map[string]string `json:"hash_commands"`
+  Hash_command_batch int `json:"hash_command_batch"`
+  Blake3_threads int `json:"blake3_threads"`
+  Blake3_segment_mb int `json:"blake3_segment_mb"`
+  Manifest string `json:"manifest"`
+  Replicas []replica `json:"replicas"`
+  Detect_mime bool `json:"detect_mime"`
+  Ignore_filename string `json:"ignore_filename"`
+  Max_errors int `json:"max_errors"`
+  Error_window int `json:"error_window"`
+  Error_action string `json:"error_action"`
+  Alert_command string `json:"alert_command"`
+  Canary_new string `json:"canary_new"`
+  Canary_old string `json:"canary_old"`
+  Health_interval int `json:"health_interval"`
+  Health_timeout int `json:"health_timeout"`
+  Batch_size int `json:"batch_size"`
+  Schedule string `json:"schedule"`
+  Mmap_min_mb int64 `json:"mmap_min_mb"`
+  Chunk_digests bool `json:"chunk_digests"`
+  Cdc_fingerprints bool `json:"cdc_fingerprints"`
+  Cdc_avg_kb int `json:"cdc_avg_kb"`
+  Diagnose_mismatches bool `json:"diagnose_mismatches"`
+  Otlp_endpoint string `json:"otlp_endpoint"`
+  Otlp_headers map[string]string `json:"otlp_headers"`
+  Otlp_sample_files float64 `json:"otlp_sample_files"`
+  Statsd_address string `json:"statsd_address"`
+  Statsd_prefix string `json:"statsd_prefix"`
+  Statsd_interval int `json:"statsd_interval"`
+  Log_file string `json:"log_file"`
+  Log_max_mb int `json:"log_max_mb"`
+  Log_keep int `json:"log_keep"`
+  Log_stdout bool `json:"log_stdout"`
+  Syslog string `json:"syslog"`
+  Syslog_facility string `json:"syslog_facility"`
+  Watchdog_stall int `json:"watchdog_stall"`
+  Shards int `json:"shards"`
+  Read_only bool `json:"read_only"`
+  Table_owner string `json:"table_owner"`
+  Grants map[string]string `json:"grants"`
+  Partitions int `json:"partitions"`
+  Partition_by string `json:"partition_by"`
+  Gpg_recipients []string `json:"gpg_recipients"`
+  Gpg_binary string `json:"gpg_binary"`
+  Gpg_flags string `json:"gpg_flags"`
+  Retention_days int `json:"retention_days"`
+  Archive_dir string `json:"archive_dir"`
+  Sparse_holes bool `json:"sparse_holes"`
+  Btime bool `json:"btime"`
+  Compare_mtime bool `json:"compare_mtime"`
+  Mtime_tolerance float64 `json:"mtime_tolerance"`
+  Mtime_offset float64 `json:"mtime_offset"`
+  Plan_mbps float64 `json:"plan_mbps"`
+  Plan_max_hours float64 `json:"plan_max_hours"`
+  Plan_max_tb float64 `json:"plan_max_tb"`
+  Nice int `json:"nice"`
+  Io_class string `json:"io_class"`
+  Io_priority int `json:"io_priority"`
+  Max_procs int `json:"max_procs"`
+  Memory_limit_mb int `json:"memory_limit_mb"`
+  Hash_memory_mb int `json:"hash_memory_mb"`
+  Read_buffer_kb int `json:"read_buffer_kb"`
+  Fd_limit string `json:"fd_limit"`
+  Fd_reserve int `json:"fd_reserve"`
+  Polite_latency_ms int `json:"polite_latency_ms"`
+  Polite_interval int `json:"polite_interval"`
+  Walk_threads int `json:"walk_threads"`
+  Walk_commit_rows int `json:"walk_commit_rows"`
+  State_file string `json:"state_file"`
+  Redis_address string `json:"redis_address"`
+  Redis_password string `json:"redis_password"`
+  Redis_db int `json:"redis_db"`
+  Notifiers []notifier_config `json:"notifiers"`
+  Hooks map[string]string `json:"hooks"`
+  Quarantine_dir string `json:"quarantine_dir"`
+  Quarantine_action string `json:"quarantine_action"`
+  Worm_side string `json:"worm_side"`
+  Worm_expect string `json:"worm_expect"`
+  Worm_s3_bucket string `json:"worm_s3_bucket"`
+  Worm_s3_prefix string `json:"worm_s3_prefix"`
+  Worm_s3_mode string `json:"worm_s3_mode"`
+  Worm_aws_binary string `json:"worm_aws_binary"`
+  Glacier_restore bool `json:"glacier_restore"`
+  Glacier_tier string `json:"glacier_tier"`
+  Glacier_batch int `json:"glacier_batch"`
+  Glacier_lifetime_days int `json:"glacier_lifetime_days"`
+  Glacier_poll int `json:"glacier_poll"`
+  Glacier_cost_per_gb float64 `json:"glacier_cost_per_gb"`
+  Glacier_cost_per_1000 float64 `json:"glacier_cost_per_1000"`
+  Cost_per_1000_calls float64 `json:"cost_per_1000_calls"`
+  Cost_per_gb_egress float64 `json:"cost_per_gb_egress"`
+  Cost_budget float64 `json:"cost_budget"`
+  Nfs bool `json:"nfs"`
+  Nfs_retries int `json:"nfs_retries"`
+  Nfs_backoff_ms int `json:"nfs_backoff_ms"`
+  Nfs_actimeo float64 `json:"nfs_actimeo"`
+  Nfs_filehandles bool `json:"nfs_filehandles"`
+  Smb bool `json:"smb"`
+  Smb_retries int `json:"smb_retries"`
+  File_retries int `json:"file_retries"`
+  File_backoff_s int `json:"file_backoff_s"`
+  Readback bool `json:"readback"`
+  Readback_retries int `json:"readback_retries"`
+  Smb_backoff_ms int `json:"smb_backoff_ms"`
+  Smb_transient_errors []string `json:"smb_transient_errors"`
+  Old_sidecars bool `json:"old_sidecars"`
+  Old_sidecar_suffix string `json:"old_sidecar_suffix"`
+  Write_sidecars string `json:"write_sidecars"`
+  Coordinator_listen string `json:"coordinator_listen"`
+  Coordinator_address string `json:"coordinator_address"`
+  Coordinator_token string `json:"coordinator_token"`
+  Coordinator_cert string `json:"coordinator_cert"`
+  Coordinator_key string `json:"coordinator_key"`
+  Coordinator_ca string `json:"coordinator_ca"`
+}
+
+// Columns added to the state table after the original schema
+var extra_columns = []string{
+  "verified_by text",
+  "archive text",
+  "member text",
+  "dos_attrs_new text",
+  "dos_attrs_old text",
+  "streams_new text",
+  "streams_old text",
+  "verify_status text",
+  "verified_at timestamp",
+  "error_new text",
+  "error_old text",
+  "mime text",
+  "hashed_at_new timestamp",
+  "hashed_at_old timestamp",
+  "hashed_by_new text",
+  "hashed_by_old text",
+  "chunks_new bytea",
+  "chunks_old bytea",
+  "cdc_new bytea",
+  "cdc_old bytea",
+  "first_diff bigint",
+  "diff_context text",
+  "nlink bigint",
+  "uid bigint",
+  "gid bigint",
+  "mode integer",
+  "ctime timestamp",
+  "blocks bigint",
+  "blocks_old bigint",
+  "btime_new timestamp",
+  "btime_old timestamp",
+  "changed_old timestamp",
+  "priority integer",
+  "walked_at timestamp",
+  "quarantined text",
+  "quarantined_at timestamp",
+  "worm text",
+  "worm_ok boolean",
+  "restore text",
+  "restore_requested_at timestamp",
+  "verdict text",
+  "verdict_at timestamp",
+  "status text",
+  "claimed_by text",
+  "claimed_at timestamp",
 }
 
 var db *sql.DB
-var stmt *sql.Stmt
 
 var l = log.New(os.Stdout, "", log.Ldate|log.Ltime|log.Lshortfile)
 
-var wg sync.WaitGroup
-
 
 func main() {
 
-  l.Print("Starting up")
-
   conf_filename := flag.String("conf", "config.json", "JSON Config filename")
+  show_version := flag.Bool("version", false, "Print the version and exit")
+  flag.BoolVar(&assume_yes, "yes", false, "Don't ask for confirmation before destructive operations")
+  flag.BoolVar(&fail_fast, "fail-fast", false, "Stop the run at the first mismatch or missing file, once the files being hashed are done")
+  flag.BoolVar(&no_tiers, "no-tiers", false, "Ignore size tiers and verify every file according to its pattern policy")
+  shard := flag.String("shard", "", "Only hash this shard of the files, as k/n with k from 1 to n; shard 1/n walks and coordinates")
+  read_only := flag.Bool("read-only", false, "Only run status and report, without any DDL or writes, for a role limited to SELECT")
+  max_duration := flag.String("max-duration", "", "Stop starting new work after this long (e.g. 8h) and exit with the run incomplete")
+  stop_at := flag.String("stop-at", "", "Stop starting new work at this time of day (e.g. 06:00) and exit with the run incomplete")
+  seed_from := flag.String("seed-from", "", "Instead of walking, start from the files of this earlier run table")
+  from_log := flag.String("from-log", "", "Instead of walking, start from the files an rsync --itemize-changes or robocopy log says were copied")
+  restat_older := flag.String("restat-older-than", "", "With -seed-from, stat again the entries walked longer ago than this (e.g. 30d)")
+  filter := flag.String("filter", "", "Only work on files matching these named filters from the config, separated by commas")
+  worker_mode := flag.Bool("worker", false, "Only hash: wait for another instance to walk, and stay idle for more work when done")
+  pipeline := flag.Bool("pipeline", false, "Hash the NEW and OLD copies of each file back to back, reporting mismatches as they are found")
+  concurrent_phases := flag.Bool("concurrent-phases", false, "Hash path_old and path_new at the same time, as with device_affinity \"separate\"")
   flag.Parse()
 
+  if *show_version {
+    fmt.Println("integrity_check", build_version())
+    return
+  }
+  l.Print("Starting up integrity_check ", build_version())
+
   var err error
   err = load_config(conf_filename)
   die_if(err)
+  if *concurrent_phases {
+    conf.Device_affinity = "separate"
+  }
+  if *pipeline {
+    conf.Pipeline = true
+  }
+  err = setup_logging()
+  die_if(err)
+  err = apply_resource_limits()
+  die_if(err)
+  err = init_shard()
+  die_if(err)
+  if *shard != "" {
+    err = parse_shard(*shard)
+    die_if(err)
+  }
+  if *filter != "" {
+    err = select_filters(*filter)
+    die_if(err)
+  }
+  err = set_deadline(*max_duration, *stop_at)
+  die_if(err)
+  err = init_remotes()
+  die_if(err)
+  err = start_notifiers()
+  die_if(err)
+  err = check_hooks()
+  die_if(err)
+  err = check_quarantine()
+  die_if(err)
+  err = check_worm()
+  die_if(err)
+  err = check_glacier()
+  die_if(err)
+  err = check_write_sidecars()
+  die_if(err)
+  err = check_hash_algorithm()
+  die_if(err)
+  err = check_fd_budget()
+  die_if(err)
+  if *read_only {
+    conf.Read_only = true
+  }
+
+  if flag.Arg(0) == "preflight" {
+    // looks at path_old only, no database needed
+    preflight_command(flag.Args()[1:])
+    return
+  }
+
+  if conf.State_file != "" {
+    // no database: state is kept in a local file
+    handle_signals()
+    run_local(flag.Args())
+    return
+  }
+
+  if *worker_mode && conf.Coordinator_address != "" {
+    // no database: everything goes through the coordinator
+    handle_signals()
+    run_remote_worker()
+    return
+  }
 
   // spew.Dump(conf)
 
@@ -66,6 +352,19 @@ func main() {
 
   // spew.Dump(db.Stats())
 
+  if conf.Read_only {
+    run_read_only(flag.Args())
+    return
+  }
+
+  switch flag.Arg(0) {
+  case "notify":
+    send_event(flag.Arg(1))
+    return
+  case "status":
+    show_status()
+    return
+  }
 
 
   // Create the state table if it does not exit
@@ -77,141 +376,435 @@ func main() {
       size bigint,
       hash_new text,
       hash_old text
-    )
-    `,pq.QuoteIdentifier(conf.Table_name)))
+    ) %s
+    `,pq.QuoteIdentifier(conf.Table_name), partition_clause()))
   die_if(err)
+  err = set_table_access(pq.QuoteIdentifier(conf.Table_name))
+  die_if(err)
+  err = create_partitions()
+  die_if(err)
+
+  for _, col := range extra_columns {
+    _, err = db.Exec(fmt.Sprintf("alter table %s add column if not exists %s",pq.QuoteIdentifier(conf.Table_name),col))
+    die_if(err)
+  }
 
   // TODO: index table
 
-  // Check the number of rows in stable
+  if len(conf.Replicas) > 0 {
+    err = create_replicas_table()
+    die_if(err)
+  }
 
-  rows := 0
-  err = db.QueryRow(fmt.Sprintf("select count(*) from %s",pq.QuoteIdentifier(conf.Table_name))).Scan(&rows)
+  switch flag.Arg(0) {
+  case "verify":
+    err = start_run()
+    die_if(err)
+    if !verify_baseline() {
+      finish_run("drift")
+      os.Exit(1)
+    }
+    finish_run("complete")
+    return
+  case "report":
+    report_command(flag.Args()[1:])
+    return
+  case "truncate":
+    truncate_table()
+    return
+  case "reset":
+    reset_command(flag.Arg(1))
+    return
+  case "requeue":
+    requeue_command(flag.Args()[1:])
+    return
+  case "recheck":
+    recheck_command(flag.Args()[1:])
+    return
+  case "diagnose":
+    diagnose_mismatches()
+    return
+  case "quarantine":
+    quarantine_command()
+    return
+  case "premis":
+    premis_command(flag.Args()[1:])
+    return
+  case "import-log":
+    import_log_command(flag.Args()[1:])
+    return
+  case "write-sidecars":
+    if conf.Write_sidecars == "" {
+      conf.Write_sidecars = "file"
+    }
+    err = check_write_sidecars()
+    die_if(err)
+    err = write_sidecars()
+    die_if(err)
+    return
+  case "prioritize":
+    prioritize_command(flag.Args()[1:])
+    return
+  case "archive-run":
+    archive_run_command(flag.Args()[1:])
+    return
+  }
+
+  err = start_heartbeat()
   die_if(err)
+  defer stop_heartbeat()
 
-  if rows==0 { 
-    l.Print("empty table, starting file walk")  
+  err = start_run()
+  die_if(err)
+  l.Print("starting run ",run_id)
+
+  if err = run_hook("pre-run", nil); err != nil {
+    finish_run("aborted")
+    die_if(err)
+  }
+
+  reclaimed, err := reclaim_stale_work()
+  die_if(err)
+  if reclaimed > 0 {
+    l.Print("released ",reclaimed," files claimed by workers that are no longer running")
+  }
+
+  // Listen before counting rows, so a walk_done sent after the count can't be missed
+  err = listen_events()
+  die_if(err)
+
+  handle_signals()
+  start_control_server()
+
+  err = start_progress()
+  die_if(err)
+
+  err = start_statsd()
+  die_if(err)
+
+  start_cost_tracking()
+
+  start_health_monitor()
+  start_polite()
+
+  err = start_coordinator()
+  die_if(err)
 
-    // Walk through directory structure using a number of threads
-    to_walk := make (chan string, 16)
+  err = start_redis()
+  die_if(err)
+
+  if *worker_mode {
+    start_retention()
+  }
+
+  start_systemd()
+  defer sd_notify("STOPPING=1")
+
+  if flag.Arg(0) == "watch" {
+    watch_command()
+    return
+  }
+
+  // Check the number of rows in stable
 
-    txn, err := db.Begin()
+  rows := count_rows()
+  var walked time.Time // shards count as done only if they finished after this
+
+  if rows==0 && (*worker_mode || shard_index > 0) {
+    l.Print("empty table, waiting for the coordinator to finish the walk")
+    for rows == 0 {
+      <- work_events
+      rows = count_rows()
+    }
+  }
+
+  if rows==0 && *seed_from != "" {
+    err = db.QueryRow("select now()::timestamp").Scan(&walked)
     die_if(err)
-    stmt, err = txn.Prepare(pq.CopyIn(conf.Table_name, "filename", "size", "changed"))
+    walk_time = walked
+
+    err = seed_walk(*seed_from, *restat_older)
     die_if(err)
+    rows = count_rows()
+    err = notify_event("walk_done")
+    die_if(err)
+    log_hook("post-walk", map[string]interface{}{"files": rows})
+  }
 
-    go spawn_walkers(to_walk)
+  if rows==0 && *from_log != "" {
+    err = db.QueryRow("select now()::timestamp").Scan(&walked)
+    die_if(err)
+    walk_time = walked
 
-    wg.Add(1)
-    to_walk <- conf.New_path
+    err = import_copy_log(*from_log)
+    die_if(err)
+    rows = count_rows()
+    err = notify_event("walk_done")
+    die_if(err)
+    log_hook("post-walk", map[string]interface{}{"files": rows})
+  }
 
-    wg.Wait()
+  if rows==0 { 
+    l.Print("empty table, starting file walk")  
 
-    close(to_walk)
-    l.Print("walk done")
+    err = db.QueryRow("select now()::timestamp").Scan(&walked)
+    die_if(err)
+    walk_time = walked
 
-    _, err = stmt.Exec()
+    staging, err := start_walk_sink()
     die_if(err)
-    err = stmt.Close()
+    sink = staging
+
+    walk_span := start_span("walk", run_span)
+
+    if rm := remotes["new"]; rm != nil {
+      // remote trees are listed in one go by their backend
+      err = rm.walk(func(name string, size int64, mtime time.Time) error {
+        if policy_for(name, size).Action == "skip" {
+          return nil
+        }
+        if err := sink.add(copy_row(name, size, mtime, nil, nil, no_stat())...); err != nil {
+          return err
+        }
+        if n := atomic.AddInt64(&walked_files, 1); n % 1000000 == 0 {
+          l.Print("walked ",n," files")
+        }
+        return nil
+      })
+      die_if(err)
+    } else {
+      // Walk through directory structure using a number of threads
+      walk_tree(conf.New_path)
+    }
+
+    l.Print("walk done: ", atomic.LoadInt64(&walked_files), " files")
+
+    err = staging.finish()
     die_if(err)
-    err = txn.Commit()
+    rows = count_rows()
+    walk_span.set("files", rows)
+    walk_span.finish(nil)
+
+    err = notify_event("walk_done")
     die_if(err)
+    log_hook("post-walk", map[string]interface{}{"files": rows})
   }
 
+  milestone("walk")
 
-  // Let's compute the new hashes
+  if !*worker_mode && shard_index == 0 {
+    plan_or_exit()
+  }
 
-  l.Print("building hashes in path_new")
+  for {
+    hash_all()
+    if !*worker_mode || deadline_passed() {
+      break
+    }
+    l.Print("waiting for more work")
+    <- work_events
+  }
 
-  query := fmt.Sprintf("select filename from %s where hash_new is null",pq.QuoteIdentifier(conf.Table_name))
-  if conf.Where_clause != "" {
-    query += " and " + conf.Where_clause
+  if conf.Coordinator_listen != "" {
+    wait_for_remote_workers()
+    // pick up anything released by workers that went away
+    hash_all()
   }
-  l.Print("getting statement of work: ",query)
 
-  res, err := db.Query(query)
-  die_if(err)
+  if stopped_fast() {
+    finish_run("failed")
+    lw.Print("stopped at the first difference (-fail-fast)")
+    os.Exit(1)
+  }
 
-  // spawn hashers
-  hash_threads := 8
-  to_hash := make (chan string, hash_threads)
-  wg.Add(hash_threads)
+  if deadline_passed() {
+    finish_run("incomplete")
+    l.Print("stopped at the deadline; the next run carries on from here")
+    return
+  }
+
+  if sharded() {
+    err = shard_done()
+    die_if(err)
+    if shard_index > 0 {
+      finish_run("complete")
+      l.Print("shard ",shard_index," complete")
+      return
+    }
+    wait_for_shards(walked)
+    // from here on, the coordinator covers the whole table
+    shard_count = 0
+  }
 
-  for i:=0; i<hash_threads; i++ {
-    go hash_new_file(to_hash)
+  if has_old() {
+    milestone("compare")
   }
 
-  for res.Next() {
-    var filename string
-    err = res.Scan(&filename)
+  if conf.Diagnose_mismatches && conf.Old_path != "" {
+    diagnose_mismatches()
+  }
+
+  if conf.Manifest != "" {
+    err = write_manifest(conf.Manifest)
     die_if(err)
-    // l.Print("sending to hash channel: ",filename)
-    to_hash <- filename
   }
-  
-  res.Close()
-  close(to_hash)
-  wg.Wait()
 
+  if conf.Write_sidecars != "" {
+    err = write_sidecars()
+    die_if(err)
+  }
 
-  // And now let's compute the old hashes
+  finish_run("complete")
 
-  l.Print("building hashes in path_old")
+  if !has_old() {
+    l.Print("hashing complete. Baseline of path_new is in table ",conf.Table_name)
+    return
+  }
 
-  query = fmt.Sprintf("select filename from %s where hash_old is null",pq.QuoteIdentifier(conf.Table_name))
-  if conf.Where_clause != "" {
-    query += " and " + conf.Where_clause
+  l.Print("hashing complete. Run \"integrity_check report\" for the comparison")
+
+}
+
+func count_rows() int {
+  rows := 0
+  err := db.QueryRow(fmt.Sprintf("select count(*) from %s",pq.QuoteIdentifier(conf.Table_name))).Scan(&rows)
+  die_if(err)
+  return rows
+}
+
+// hash_all runs the hashing phases over all outstanding work
+func hash_all() {
+
+  if !check_mounts() {
+    l.Print("waiting for the mounts to recover before hashing")
   }
-  l.Print("getting statement of work: ",query)
 
-  res, err = db.Query(query)
+  // If the filesystem can vouch for path_new, skip hashing it
+
+  if conf.Fs_verify != "" {
+    l.Print("verifying path_new via ",conf.Fs_verify," checksums")
+    err := fs_verify()
+    if err == nil {
+      n, err := mark_fs_verified(work_filter())
+      die_if(err)
+      l.Print("filesystem reports no errors, marked ",n," files as verified by filesystem")
+    } else {
+      lw.Print("filesystem verification failed, falling back to hashing: ",err)
+    }
+  }
+
+
+  // Copy pipelines may have registered hashes already
+
+  err := apply_registered()
   die_if(err)
 
-  // spawn hashers
-  hash_threads = 8
-  to_hash = make (chan string, hash_threads)
-  wg.Add(hash_threads)
 
-  for i:=0; i<hash_threads; i++ {
-    go hash_old_file(to_hash)
+  // With the trees on separate devices, the old hashes are computed alongside the new ones
+
+  // Without old_path there is nothing to compare against: just build the baseline of path_new
+
+  single := !has_old()
+
+  if conf.Pipeline && !single {
+    pipeline_phase()
+  }
+
+  var old_done errgroup.Group
+  concurrent := !single && phases_concurrent()
+  if concurrent {
+    old_done.Go(func() error {
+      old_phase()
+      return nil
+    })
   }
 
-  for res.Next() {
-    var filename string
-    err = res.Scan(&filename)
+
+  // Let's compute the new hashes
+
+  hash_phase("new", "verified_by is null and archive is null")
+
+
+  // Archive members on the new side are hashed by streaming through each archive once
+
+  if conf.Archive_members != "" {
+    l.Print("building hashes of archive members in path_new")
+
+    query := fmt.Sprintf("select distinct archive from %s where hash_new is null and verified_by is null and archive is not null",pq.QuoteIdentifier(conf.Table_name))
+    query += work_filter()
+    res, err := db.Query(query)
     die_if(err)
-    // l.Print("sending to hash channel: ",filename)
-    to_hash <- filename
+
+    threads := hash_threads("new")
+    to_hash := make (chan string, threads)
+    pool := start_pool(threads, func() error {
+      hash_archives(to_hash)
+      return nil
+    })
+
+    for res.Next() {
+      var archive string
+      err = res.Scan(&archive)
+      die_if(err)
+      to_hash <- archive
+    }
+
+    res.Close()
+    close(to_hash)
+    pool.Wait()
   }
-  
-  res.Close()
-  close(to_hash)
-  wg.Wait()
 
-  // TODO: implement check logic against DB
-  // something like:
-  // select filename from icheck where hash_new is not null and hash_old is not null and hash_new <> hash_old ?
 
-  l.Print("hashing complete. Run comparison queries on database please")
+  // And now let's compute the old hashes
 
+  if concurrent {
+    old_done.Wait()
+  } else if !single {
+    old_phase()
+  }
+
+
+  // Further replicas, for N-way comparison
+
+  for i := range conf.Replicas {
+    replica_phase(&conf.Replicas[i])
+  }
 }
 
 func load_config(config_filename *string) error {
 
+  // Without -conf, a missing config.json is fine: everything can come from the environment
+  explicit := false
+  flag.Visit(func(f *flag.Flag) {
+    if f.Name == "conf" {
+      explicit = true
+    }
+  })
+
   fd, err := os.Open(*config_filename)
-  if err != nil {
+  if err == nil {
+    // Lazily close file on any of the function exit paths
+    defer fd.Close()
+
+    // Create a new JSON decoder for the input stream - which can be anything that is capable of being read from
+    js := json.NewDecoder(fd)
+    if err = js.Decode(&conf); err != nil {
+      return fmt.Errorf("decoding json: %s", err)
+    }
+  } else if explicit || !os.IsNotExist(err) {
     return err
+  } else {
+    l.Print("no ",*config_filename,", configuring from the environment")
   }
 
-  // Lazily close file on any of the function exit paths
-  defer fd.Close()
-
-  // Create a new JSON decoder for the input stream - which can be anything that is capable of being read from
-  js := json.NewDecoder(fd)
-  if err = js.Decode(&conf); err != nil {
-    return fmt.Errorf("decoding json: %s", err)
+  if err = apply_env(); err != nil {
+    return err
   }
 
+  if conf.Table_name == "" {
+    conf.Table_name = default_table_name()
+    l.Print("using table ",conf.Table_name)
+  }
   return nil
 }
 
@@ -225,8 +818,10 @@ func die_if(err error) {
 
 func init_db() {
   var err error
-  l.Printf("got connstr: %s", conf.Db_connstr)
-  db, err = sql.Open("postgres", conf.Db_connstr)
+  l.Printf("got connstr: %s", redact_connstr(conf.Db_connstr))
+  connstr, err := connection_string()
+  die_if(err)
+  db, err = sql.Open("postgres", connstr)
   die_if(err)
   err = db.Ping()
   die_if(err)
@@ -234,133 +829,414 @@ func init_db() {
   db.SetMaxIdleConns(conf.Db_idleconnections)
 }
 
-func spawn_walkers(to_walk chan string) {
-  for p := range to_walk {
-    // l.Print("spawn walker: ",p)
-    go walk_dir(p,to_walk)
-  } 
+// walk_job is a directory to walk, with the ignore rules in effect above it
+type walk_job struct {
+  path string
+  ignores *ignore_list
+}
+
+// walk_queue holds the directories found but not walked yet. Walking depth first keeps it short.
+type walk_queue struct {
+  mu sync.Mutex
+  cond *sync.Cond
+  jobs []walk_job
+  pending int // queued or being walked
 }
 
-func walk_dir (dir string,to_walk chan string) {
-  defer wg.Done()
+func (q *walk_queue) push(j walk_job) {
+  q.mu.Lock()
+  defer q.mu.Unlock()
+  q.jobs = append(q.jobs, j)
+  q.pending++
+  q.cond.Signal()
+}
 
-  visit := func (path string, info os.FileInfo, err error) error {
-    if path != dir  && err==nil && info.IsDir() {
-      // l.Print("add path: ",path)
-      wg.Add(1)
-      to_walk <- path
-      return filepath.SkipDir
-    }
-    if info.Mode().IsRegular() {
-      _, err := stmt.Exec( strings.TrimPrefix(path,conf.New_path+"/") ,info.Size(), info.ModTime())
-      die_if(err)
-    }
-    return nil  
+// pop returns the next directory to walk, or false once the whole tree is walked
+func (q *walk_queue) pop() (walk_job, bool) {
+  q.mu.Lock()
+  defer q.mu.Unlock()
+  for len(q.jobs) == 0 && q.pending > 0 {
+    q.cond.Wait()
+  }
+  if len(q.jobs) == 0 {
+    return walk_job{}, false
   }
+  j := q.jobs[len(q.jobs)-1]
+  q.jobs = q.jobs[:len(q.jobs)-1]
+  return j, true
+}
 
-  filepath.Walk(dir,visit)
+func (q *walk_queue) done() {
+  q.mu.Lock()
+  defer q.mu.Unlock()
+  q.pending--
+  if q.pending == 0 {
+    q.cond.Broadcast()
+  }
 }
 
+func walk_threads() int {
+  if conf.Walk_threads > 0 {
+    return conf.Walk_threads
+  }
+  return 16
+}
 
+var walked_files int64
 
+// walked_dirs holds the device and inode of every directory walked, so a directory reachable by more than one
+// path, through a bind mount or a bind mount loop, is walked only once
+var walked_dirs sync.Map
 
-func hash_new_file (to_hash chan string) {
-  defer wg.Done()
+// first_visit tells if a directory hasn't been walked yet under another path
+func first_visit(path string) bool {
+  info, err := os.Lstat(path)
+  if err != nil {
+    return true
+  }
+  id, ok := file_identity(info)
+  if !ok {
+    return true
+  }
+  if first, seen := walked_dirs.LoadOrStore(id, path); seen {
+    l.Print("skipping ",path,": same directory as ",first)
+    return false
+  }
+  return true
+}
 
-  for {
-    file, ok := <- to_hash
-    if !ok {
-      return // channel closed
-    }
-    
-    // l.Print("got file: ",file)
-    f, err := os.Open(conf.New_path+"/"+file)
-    if err != nil{
-      l.Print("error opening: ",file,": ",err)
-      continue
+// walk_tree walks a tree with a fixed number of walkers, so neither goroutines nor open directories grow
+// with the size of the tree; files go into the COPY stream as their directory entries are read
+func walk_tree(root string) {
+  q := &walk_queue{}
+  q.cond = sync.NewCond(&q.mu)
+  first_visit(root)
+  q.push(walk_job{path: root})
+
+  pool := start_pool(walk_threads(), func() error {
+    for {
+      j, ok := q.pop()
+      if !ok {
+        return nil
+      }
+      // l.Print("walker: ",j.path)
+      walk_dir(j, q.push)
+      q.done()
     }
+  })
+  pool.Wait()
+}
 
-    h:=sha256.New()
-    if _ , err = io.Copy(h, f); err!= nil {
-      l.Print("error reading from ",file,": ",err)
-      f.Close()
-      continue
-    }
-    hash:=h.Sum(nil)
-    // l.Printf("hash for %s: %x",file,hash)
+func walk_dir (job walk_job, add func(walk_job)) {
 
-    // add to DB
+  dir := job.path
+  ignores := load_ignores(job.ignores, dir, strings.TrimPrefix(strings.TrimPrefix(dir,conf.New_path),"/"))
 
-    tx, err := db.Begin()
+  visit := func (path string, entry os.DirEntry) {
+    if entry.IsDir() {
+      if ignores.ignored(strings.TrimPrefix(path,conf.New_path+"/"), true) || !first_visit(path) {
+        return
+      }
+      // l.Print("add path: ",path)
+      add(walk_job{path: path, ignores: ignores})
+      return
+    }
+    if !entry.Type().IsRegular() {
+      return
+    }
+    // only files need an lstat; the type of the others comes with the directory entry
+    info, err := entry.Info()
     if err != nil {
-      l.Print("error adding hash to DB: ", err)
-      continue
+      info, err = retry_lstat(path)
     }
-
-    _, err = tx.Exec( fmt.Sprintf("update %s set hash_new = $2 where filename = $1",pq.QuoteIdentifier(conf.Table_name)), file, fmt.Sprintf("%x",hash) )
     if err != nil {
-      l.Print("error adding hash to DB: ", err)
-      continue
+      le.Print("error reading ",path,": ",err)
+      return
+    }
+    rel := strings.TrimPrefix(path,conf.New_path+"/")
+    if ignores.ignored(rel, false) || policy_for(rel, info.Size()).Action == "skip" {
+      return
+    }
+    if conf.Archive_members != "" && archive_base(rel) != "" {
+      if err := walk_archive(path,rel); err != nil {
+        le.Print("error reading archive ",path,": ",err)
+      }
+      return
+    }
+    err = sink.add(copy_row(rel, info.Size(), info.ModTime(), nil, nil, stat_fields(info))...)
+    die_if(err)
+    if n := atomic.AddInt64(&walked_files, 1); n % 1000000 == 0 {
+      l.Print("walked ",n," files")
     }
+  }
 
-    err = tx.Commit()
+  // entries are read in batches in directory order rather than all at once and sorted, so a directory of
+  // millions of files is streamed through
+  // after a transient error (see retry.go) the listing is read again, skipping the entries already visited
+  visited := 0
+  err := retry_transient("reading directory "+dir, func() error {
+    d, err := os.Open(dir)
     if err != nil {
-      l.Print("error adding hash to DB: ", err)
-      continue
+      return err
     }
+    defer d.Close()
+    skip := visited
+    for {
+      entries, err := d.ReadDir(walk_batch)
+      for _, entry := range entries {
+        if skip > 0 {
+          skip--
+          continue
+        }
+        visit(filepath.Join(dir, entry.Name()), entry)
+        visited++
+      }
+      if err == io.EOF {
+        return nil
+      }
+      if err != nil {
+        return err
+      }
+    }
+  })
+  if err != nil {
+    le.Print("error reading directory ",dir,": ",err)
+  }
+}
+
+// walk_batch is how many directory entries are read at a time
+const walk_batch = 4096
+
+
+
+
+// work_filter returns the conditions (prefixed with " and ") limiting which rows are worked on by this process
+func work_filter() string {
+  filter := ""
+  if conf.Where_clause != "" {
+    filter += " and " + conf.Where_clause
+  }
+  for _, cond := range active_filters {
+    filter += " and " + cond
+  }
+  if conf.Min_size > 0 {
+    filter += fmt.Sprintf(" and size >= %d", conf.Min_size)
+  }
+  if conf.Max_size > 0 {
+    filter += fmt.Sprintf(" and size <= %d", conf.Max_size)
+  }
+  return filter + shard_filter()
+}
+
+type work_item struct {
+  filename string
+  size int64
+}
 
-    f.Close()
+// phase_where returns the condition selecting the outstanding files of one side
+func phase_where(side string, condition string) string {
+  where := fmt.Sprintf("%s is null and status is null",pq.QuoteIdentifier("hash_"+side))
+  if condition != "" {
+    where += " and " + condition
   }
+  return where + work_filter()
 }
 
+// hash_phase hashes the outstanding files of one side, with a pool of hash workers fed from a single query
+func hash_phase(side string, condition string) {
+  l.Print("building hashes in path_",side)
 
-func hash_old_file (to_hash chan string) {
-  defer wg.Done()
+  where := phase_where(side, condition)
+  query := fmt.Sprintf("select filename, size from %s where %s",pq.QuoteIdentifier(conf.Table_name),where)
+  order := schedule_order()
 
-  for {
-    file, ok := <- to_hash
-    if !ok {
-      return // channel closed
-    }
-    
-    // l.Print("got file: ",file)
-    f, err := os.Open(conf.Old_path+"/"+file)
-    if err != nil{
-      l.Print("error opening: ",file, ": ",err)
-      continue
-    }
+  var files, bytes int64
+  err := db.QueryRow("select count(*), coalesce(sum(size), 0) from (" + query + ") w").Scan(&files, &bytes)
+  die_if(err)
+  phase := start_phase("hash_"+side, files, bytes)
+  defer phase.finish()
+  defer start_priority_lane(side, where, phase)()
+  defer drain_retries(side, open_retries(side), phase)
+
+  // spawn hashers; each phase has its own pool, so phases can run side by side
+  threads := hash_threads(side)
 
-    h:=sha256.New()
-    if _ , err = io.Copy(h, f); err!= nil {
-      l.Print("error reading from ",file,": ",err)
-      f.Close()
+  if rdb != nil {
+    redis_phase(side, where, order, threads, phase)
+    l.Print("Redis queue of ",side," files drained, picking up what is left from the database")
+  }
+
+  if conf.Batch_size > 0 {
+    l.Print("claiming work in batches of ",conf.Batch_size,": ",where)
+    hash_batches(side, where, threads, phase)
+    return
+  }
+
+  query += order
+  l.Print("getting statement of work: ",query)
+
+  res, err := db.Query(query)
+  die_if(err)
+
+  to_hash := make (chan []work_item, threads)
+  grouper := &work_grouper{out: to_hash}
+  pool := start_pool(threads, func() error {
+    hash_worker(side, to_hash, phase)
+    return nil
+  })
+
+  // the extent schedule needs the whole statement of work before it can order it
+  var all []work_item
+  for res.Next() && !deadline_passed() {
+    var w work_item
+    err = res.Scan(&w.filename, &w.size)
+    die_if(err)
+    if conf.Schedule == "extent" {
+      all = append(all, w)
       continue
     }
-    hash:=h.Sum(nil)
-    // l.Printf("hash for %s: %x",file,hash)
+    // l.Print("sending to hash channel: ",w.filename)
+    grouper.add(w)
+  }
+  res.Close()
 
-    // add to DB
-    tx, err := db.Begin()
-    if err != nil {
-      l.Print("error adding hash to DB: ", err)
-      continue
+  if conf.Schedule == "extent" {
+    l.Print("ordering ",len(all)," files by physical offset")
+    sort_work(side, all)
+    for _, w := range all {
+      grouper.add(w)
     }
+  }
+  grouper.flush()
+  close(to_hash)
+  pool.Wait()
+}
 
-    _, err = tx.Exec( fmt.Sprintf("update %s set hash_old = $2 where filename = $1",pq.QuoteIdentifier(conf.Table_name)), file, fmt.Sprintf("%x",hash) )
-    if err != nil {
-      l.Print("error adding hash to DB: ", err)
-      continue
+func hash_worker (side string, to_hash chan []work_item, phase *phase_progress) {
+  for group := range to_hash {
+    forget := prehash(side, group)
+    for _, w := range group {
+      hash_one(side, w, phase)
     }
+    forget()
+  }
+}
 
-    err = tx.Commit()
-    if err != nil {
-      l.Print("error adding hash to DB: ", err)
-      continue
+// hash_one claims, hashes and stores a single file
+func hash_one (side string, w work_item, phase *phase_progress) {
+
+  update := fmt.Sprintf("update %s set %s = $2, %s = null, %s = now(), %s = $3, status = null, claimed_by = null, claimed_at = null where filename = $1",pq.QuoteIdentifier(conf.Table_name),pq.QuoteIdentifier("hash_"+side),pq.QuoteIdentifier("error_"+side),pq.QuoteIdentifier("hashed_at_"+side),pq.QuoteIdentifier("hashed_by_"+side))
+
+  file := w.filename
+
+  p := policy_for(file, w.size)
+  if p.Action == "skip" {
+    return
+  }
+
+  pause_gate.wait()
+  if deadline_passed() {
+    return
+  }
+
+  claimed, err := claim(side, file)
+  if err != nil {
+    le.Print("error claiming ",file,": ",err)
+    return
+  }
+  if !claimed {
+    return // another worker has it
+  }
+
+  fspan := sampled_span("hash_file", phase.span)
+  fspan.set("file", file)
+  fspan.set("size", w.size)
+  defer func() { fspan.finish(err) }()
+
+  // l.Print("got file: ",file)
+  rspan := start_span("read", fspan)
+  hash, extra, err := compute_hash_digests(side, file, p, true)
+  rspan.finish(err)
+  if err != nil && retry_later(side, w, err) {
+    if cerr := release_claim(file); cerr != nil {
+      le.Print("error releasing ",file,": ",cerr)
     }
+    return
+  }
+  if err != nil {
+    le.Print("error hashing ",side," ",file,": ",err)
+    record_error(side, file, err)
+    return
+  }
+  // l.Printf("hash for %s: %s",file,hash)
 
-    f.Close()
+  // add to DB
+  dspan := start_span("db.update", fspan)
+  _, err = db_exec(update, file, hash, worker_id)
+  dspan.finish(err)
+  if err != nil {
+    le.Print("error adding hash to DB: ", err)
+    record_error(side, file, fmt.Errorf("adding hash to DB: %s", err))
+    return
+  }
+  if err = confirm_stored(side, file, hash, worker_id); err != nil {
+    le.Print("error hashing ",side," ",file,": ",err)
+    record_error(side, file, err)
+    return
   }
+  phase.done(w.size)
+  after_hash(side, file, extra)
 }
 
+// after_hash records the optional per-file metadata once a file's hash is stored
+func after_hash(side string, file string, extra *digests) {
+  if side == "old" && conf.Old_path == "" {
+    // the OLD hash came from a sidecar: there is no OLD file to look at
+    check_mismatch(file)
+    return
+  }
+
+  if extra != nil && extra.chunks != nil {
+    if err := record_chunks(side, file, extra.chunks); err != nil {
+      le.Print("error recording chunk digests of ",side," ",file,": ",err)
+    }
+  }
+
+  if extra != nil && extra.cdc != nil {
+    if err := record_cdc(side, file, extra.cdc); err != nil {
+      le.Print("error recording chunk fingerprints of ",side," ",file,": ",err)
+    }
+  }
+
+  if conf.Smb_streams {
+    if err := record_smb_metadata(side, file); err != nil {
+      le.Print("error recording streams of ",side," ",file,": ",err)
+    }
+  }
+
+  if conf.Btime {
+    if err := record_btime(side, file); err != nil {
+      le.Print("error recording creation time of ",side," ",file,": ",err)
+    }
+  }
+
+  if side == "old" && remotes["old"] == nil {
+    if err := record_old_stat(file); err != nil {
+      le.Print("error recording mtime and allocation of old ",file,": ",err)
+    }
+  }
 
+  if conf.Detect_mime && side == "new" {
+    if err := record_mime(file); err != nil {
+      le.Print("error detecting type of ",file,": ",err)
+    }
+  }
 
+  if side == conf.Worm_side {
+    if err := record_worm(side, file); err != nil {
+      le.Print("error recording immutability of ",side," ",file,": ",err)
+    }
+  }
+
+  check_mismatch(file)
+}
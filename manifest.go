@@ -0,0 +1,53 @@
+//
+// Baseline manifest: the NEW hashes written out in sha256sum format ("<hash>  <filename>"), so the tree can be
+// checked later with "cd new_path && sha256sum -c manifest" without access to the database.
+//
+
+package main
+
+import (
+  "bufio"
+  "database/sql"
+  "fmt"
+  "regexp"
+
+  pq "github.com/lib/pq"
+)
+
+var plain_sha256 = regexp.MustCompile("^[0-9a-f]{64}$")
+
+func write_manifest(filename string) error {
+  fd, err := create_output(filename)
+  if err != nil {
+    return err
+  }
+  defer fd.Close()
+  w := bufio.NewWriter(fd)
+
+  written, other := 0, 0
+  err = each_row(fmt.Sprintf("select filename, hash_new from %s where hash_new is not null order by filename", pq.QuoteIdentifier(conf.Table_name)), func(rows *sql.Rows) error {
+    var file, hash string
+    if err := rows.Scan(&file, &hash); err != nil {
+      return err
+    }
+    // size-only, sampled and chunked results can't be checked by sha256sum
+    if !plain_sha256.MatchString(hash) {
+      other++
+      return nil
+    }
+    _, err := fmt.Fprintf(w, "%s  %s\n", hash, file)
+    written++
+    return err
+  })
+  if err != nil {
+    return err
+  }
+  if err = w.Flush(); err != nil {
+    return err
+  }
+  l.Print("wrote ",written," entries to manifest ",filename)
+  if other > 0 {
+    l.Print(other," files were verified by a policy other than full SHA256 and are not in the manifest")
+  }
+  return fd.Close()
+}
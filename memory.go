@@ -0,0 +1,88 @@
+//
+// Memory budget of the hash workers.
+//
+// The buffers the workers read files into are leased from a budget shared by all of them, hash_memory_mb
+// (default: half the memory limit, see resources.go; no budget without one). A worker waits until what it needs
+// is free, so a few huge files use up the budget and hold the others back, while small files, which only lease
+// what they fill, keep all the workers busy. A lease larger than the whole budget is cut down to it: a file is
+// never refused, it runs alone. Leases are served in order, so a large one isn't starved by a stream of small
+// ones.
+//
+// What is leased:
+//
+//   - the read buffer of files read as a stream, read_buffer_kb (default 32), or the size of a smaller file
+//   - the segments BLAKE3 hashes side by side (blake3.go), one per thread and one for the tail; fewer threads are
+//     used for a file when the budget doesn't cover one each
+//
+// Memory mapped files (mmap_min_mb) are not counted: their pages belong to the page cache, which the kernel
+// reclaims as needed.
+//
+
+package main
+
+import (
+  "context"
+  "io"
+  "math"
+  "os"
+  "runtime/debug"
+
+  "golang.org/x/sync/semaphore"
+)
+
+var hash_memory *semaphore.Weighted
+var hash_memory_size int64
+
+// set_hash_memory sets the budget up, once the memory limit of the runtime is known
+func set_hash_memory() {
+  size := int64(conf.Hash_memory_mb) << 20
+  if size == 0 {
+    if limit := debug.SetMemoryLimit(-1); limit < math.MaxInt64 {
+      size = limit / 2
+    }
+  }
+  if size > 0 {
+    hash_memory = semaphore.NewWeighted(size)
+    hash_memory_size = size
+    l.Print("hash memory budget ", size >> 20, " MiB")
+  }
+}
+
+// lease_memory waits until n bytes of the budget are free and takes them; the function returned gives them back
+func lease_memory(n int64) func() {
+  if hash_memory == nil || n <= 0 {
+    return func() {}
+  }
+  if n > hash_memory_size {
+    n = hash_memory_size
+  }
+  hash_memory.Acquire(context.Background(), n)
+  return func() { hash_memory.Release(n) }
+}
+
+// memory_fits tells how many pieces of n bytes the whole budget holds, at most max
+func memory_fits(n int64, max int) int {
+  if hash_memory == nil || n <= 0 || hash_memory_size / n >= int64(max) {
+    return max
+  }
+  return int(hash_memory_size / n)
+}
+
+func read_buffer_size() int64 {
+  if conf.Read_buffer_kb > 0 {
+    return int64(conf.Read_buffer_kb) << 10
+  }
+  return 32 << 10
+}
+
+// read_buffer leases a buffer to read in from the budget, no larger than a local file needs
+func read_buffer(in io.Reader) ([]byte, func()) {
+  n := read_buffer_size()
+  if f, ok := in.(*os.File); ok {
+    if fi, err := f.Stat(); err == nil && fi.Mode().IsRegular() && fi.Size() < n {
+      n = fi.Size() + 1 // one more, to read the end of the file
+    }
+  }
+  release := lease_memory(n)
+  return make([]byte, n), release
+}
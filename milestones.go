@@ -0,0 +1,46 @@
+//
+// Run milestones.
+//
+// Coarse points of a run are stamped into its row of <table>_runs as they are reached: "walk" (the table is
+// populated), "<phase>_25", "_50", "_75" and "_100" for each hash phase (hash_new, hash_old, pipeline, replica
+// phases; by files, counted by this process) and "compare" (every hash is in, the comparison can be reported).
+// The milestones column holds all of them with their times, last_milestone and last_milestone_at the latest, so
+// SLAs and alerts are plain SQL:
+//
+//   select run_id, last_milestone from t_runs where status = 'running' and last_milestone_at < now() - interval '12 hours'
+//
+
+package main
+
+import (
+  "fmt"
+  "sync/atomic"
+)
+
+// milestone records that the run has reached a point; a milestone keeps the time it was first reached
+func milestone(name string) {
+  if run_id == 0 {
+    return
+  }
+  _, err := db_exec(fmt.Sprintf(`update %s set milestones = jsonb_build_object($2::text, now()) || coalesce(milestones, '{}'),
+    last_milestone = $2, last_milestone_at = now() where run_id = $1`, runs_table()), run_id, name)
+  if err != nil {
+    le.Print("error recording milestone ", name, ": ", err)
+  }
+}
+
+// reach records the quarters of a phase up to q (1 to 4) not recorded yet
+func (p *phase_progress) reach(q int32) {
+  if q > 4 {
+    q = 4
+  }
+  p.mu.Lock()
+  from := p.quarters
+  if q > from {
+    atomic.StoreInt32(&p.quarters, q)
+  }
+  p.mu.Unlock()
+  for i := from + 1; i <= q; i++ {
+    milestone(fmt.Sprintf("%s_%d", p.phase, i * 25))
+  }
+}
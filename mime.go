@@ -0,0 +1,64 @@
+//
+// File type detection.
+//
+// With detect_mime enabled, the first 512 bytes of each NEW file are sniffed after hashing (they are still in
+// the page cache by then) and the detected MIME type is stored in the mime column, so the report can break
+// mismatches down by file type.
+//
+
+package main
+
+import (
+  "fmt"
+  "io"
+  "net/http"
+  "os"
+
+  pq "github.com/lib/pq"
+)
+
+func sniff_mime(side string, file string) (string, error) {
+  var r io.ReadCloser
+  var err error
+  if rm := remotes[side]; rm != nil {
+    r, err = rm.open(side_name(side, file))
+  } else {
+    r, err = os.Open(side_path(side, file))
+  }
+  if err != nil {
+    return "", err
+  }
+  defer r.Close()
+
+  buf := make([]byte, 512)
+  n, err := io.ReadFull(r, buf)
+  if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+    return "", err
+  }
+  return http.DetectContentType(buf[:n]), nil
+}
+
+func record_mime(file string) error {
+  mime, err := sniff_mime("new", file)
+  if err != nil {
+    return err
+  }
+  _, err = db_exec(fmt.Sprintf("update %s set mime = $2 where filename = $1", pq.QuoteIdentifier(conf.Table_name)), file, mime)
+  return err
+}
+
+// write_mime_breakdown adds the count of mismatched files per detected type to the report summary
+func write_mime_breakdown(w io.Writer) {
+  rows, err := db.Query(fmt.Sprintf(`select coalesce(mime, 'unknown'), count(*), count(*) filter (where hash_new <> hash_old)
+    from %s group by 1 having count(*) filter (where hash_new <> hash_old) > 0 order by 3 desc`, pq.QuoteIdentifier(conf.Table_name)))
+  die_if(err)
+  defer rows.Close()
+
+  for rows.Next() {
+    var mime string
+    var files, mismatched int64
+    die_if(rows.Scan(&mime, &files, &mismatched))
+    fmt.Fprintf(w, "# mismatches of type %s: %d of %d\n", mime, mismatched, files)
+  }
+  die_if(rows.Err())
+}
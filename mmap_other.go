@@ -0,0 +1,12 @@
+//go:build !linux
+
+package main
+
+import (
+  "fmt"
+  "os"
+)
+
+func mmap_sum(f *os.File) ([]byte, error) {
+  return nil, fmt.Errorf("mmap hashing is only available on Linux")
+}
@@ -0,0 +1,51 @@
+//
+// Modification time comparison.
+//
+// Hashing a file's OLD copy records its mtime (changed_old) next to the NEW one recorded by the walk. With
+// "compare_mtime": true the report lists files whose mtimes differ as MTIME problems. Clocks and filesystems
+// don't always agree to the nanosecond, so differences up to "mtime_tolerance" seconds (default 2, the FAT
+// resolution) are ignored, and "mtime_offset" seconds are added to the OLD mtimes first, for an old server whose
+// clock was known to be off: -37 if it was 37 seconds fast.
+//
+
+package main
+
+import (
+  "fmt"
+  "io"
+  "time"
+
+  pq "github.com/lib/pq"
+)
+
+func mtime_tolerance() float64 {
+  tolerance := 2.0
+  if conf.Mtime_tolerance > 0 {
+    tolerance = conf.Mtime_tolerance
+  }
+  if conf.Nfs && nfs_actimeo() > tolerance {
+    // attributes cached by an NFS client can be that much out of date
+    tolerance = nfs_actimeo()
+  }
+  return tolerance
+}
+
+func write_mtime_report(w io.Writer) int64 {
+  rows, err := db.Query(fmt.Sprintf(`select filename, changed, changed_old, extract(epoch from changed - changed_old)::float8 - $1 from %s
+    where abs(extract(epoch from changed - changed_old)::float8 - $1) > $2 order by filename`, pq.QuoteIdentifier(conf.Table_name)),
+    conf.Mtime_offset, mtime_tolerance())
+  die_if(err)
+  defer rows.Close()
+
+  var problems int64
+  for rows.Next() {
+    var file string
+    var changed, changed_old time.Time
+    var skew float64
+    die_if(rows.Scan(&file, &changed, &changed_old, &skew))
+    fmt.Fprintf(w, "MTIME\t%s\tnew=%s old=%s\t%+.3fs\n", file, changed.Format(time.RFC3339Nano), changed_old.Format(time.RFC3339Nano), skew)
+    problems++
+  }
+  die_if(rows.Err())
+  return problems
+}
@@ -0,0 +1,49 @@
+//
+// NFS safeguards.
+//
+// An NFS server failing over, or a directory replaced under a client, makes the client's file handles stale for
+// a while: every open, read and readdir fails with ESTALE, and a whole stretch of the tree ends up recorded as
+// unreadable. With "nfs": true, an operation failing with ESTALE is retried (see retry.go) up to nfs_retries
+// times (5 by default), waiting nfs_backoff_ms (200 by default) and twice as long after every further failure.
+//
+// With "nfs_filehandles": true (Linux, needs CAP_DAC_READ_SEARCH) a file whose hash is started over is re-opened
+// by the NFS file handle it was first opened with rather than by path, so the retry reads the same file even if
+// the name was pointed elsewhere in between; without the capability it falls back on the path.
+//
+// NFS clients cache attributes for up to actimeo seconds, so the mtimes compared with compare_mtime may be that
+// much out of date: in NFS mode differences up to nfs_actimeo seconds (60 by default) are tolerated.
+//
+
+package main
+
+import (
+  "strings"
+  "syscall"
+  "time"
+)
+
+func nfs_retries() int {
+  if conf.Nfs_retries > 0 {
+    return conf.Nfs_retries
+  }
+  return 5
+}
+
+func nfs_backoff() time.Duration {
+  if conf.Nfs_backoff_ms > 0 {
+    return time.Duration(conf.Nfs_backoff_ms) * time.Millisecond
+  }
+  return 200 * time.Millisecond
+}
+
+func nfs_actimeo() float64 {
+  if conf.Nfs_actimeo > 0 {
+    return conf.Nfs_actimeo
+  }
+  return 60
+}
+
+// is_stale tells if an error is a stale file handle; errors are often flattened into text on their way up
+func is_stale(err error) bool {
+  return err != nil && strings.Contains(err.Error(), syscall.ESTALE.Error())
+}
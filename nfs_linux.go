@@ -0,0 +1,49 @@
+package main
+
+import (
+  "os"
+
+  "golang.org/x/sys/unix"
+)
+
+// nfs_opener opens a file by path the first time, and by the file handle it got then afterwards
+type nfs_opener struct {
+  root string
+  handle unix.FileHandle
+  have bool
+}
+
+func new_nfs_opener(side string) *nfs_opener {
+  return &nfs_opener{root: side_root(side)}
+}
+
+func (o *nfs_opener) open(path string) (*os.File, error) {
+  if !conf.Nfs_filehandles {
+    return os.Open(path)
+  }
+  if o.have {
+    if f, err := o.open_by_handle(path); err == nil {
+      return f, nil
+    }
+  }
+  f, err := os.Open(path)
+  if err == nil && !o.have {
+    if h, _, err := unix.NameToHandleAt(unix.AT_FDCWD, path, 0); err == nil {
+      o.handle, o.have = h, true
+    }
+  }
+  return f, err
+}
+
+func (o *nfs_opener) open_by_handle(path string) (*os.File, error) {
+  mount, err := unix.Open(o.root, unix.O_RDONLY|unix.O_DIRECTORY|unix.O_CLOEXEC, 0)
+  if err != nil {
+    return nil, err
+  }
+  defer unix.Close(mount)
+  fd, err := unix.OpenByHandleAt(mount, o.handle, unix.O_RDONLY|unix.O_CLOEXEC)
+  if err != nil {
+    return nil, err
+  }
+  return os.NewFile(uintptr(fd), path), nil
+}
@@ -0,0 +1,262 @@
+//
+// Notifications.
+//
+// Any number of notifiers can be listed, each told about the events it names (all of them when "events" is left
+// out):
+//
+//   "notifiers": [
+//     { "type": "slack", "url": "https://hooks.slack.com/services/...", "events": ["complete", "error-threshold"] },
+//     { "type": "pagerduty", "routing_key": "...", "events": ["error-threshold"] },
+//     { "type": "email", "smtp": "mail:25", "from": "ic@example.com", "to": ["ops@example.com"], "events": ["mismatch-found"] },
+//     { "type": "webhook", "url": "https://tickets.example.com/hook" },
+//     { "type": "stdout" }
+//   ]
+//
+// Events are start (a run begins), complete (a run ends, with its status), error-threshold (the error breaker
+// tripped) and mismatch-found (a file hashed to a different value on both sides). Webhooks receive the event as
+// JSON; email may also take "username" and "password" for SMTP authentication.
+//
+
+package main
+
+import (
+  "bytes"
+  "encoding/json"
+  "fmt"
+  "net"
+  "net/http"
+  "net/smtp"
+  "os"
+  "strings"
+  "time"
+
+  pq "github.com/lib/pq"
+)
+
+type notifier_config struct {
+  Type string `json:"type"`
+  Events []string `json:"events"`
+  Url string `json:"url"`
+  Routing_key string `json:"routing_key"`
+  Smtp string `json:"smtp"`
+  Username string `json:"username"`
+  Password string `json:"password"`
+  From string `json:"from"`
+  To []string `json:"to"`
+}
+
+type notice struct {
+  Event string `json:"event"`
+  Table string `json:"table"`
+  Host string `json:"host"`
+  Run_id int64 `json:"run_id"`
+  Message string `json:"message"`
+  File string `json:"file,omitempty"`
+  Time time.Time `json:"time"`
+}
+
+type notifier interface {
+  send(n notice) error
+}
+
+var notify_events = []string{"start", "complete", "error-threshold", "mismatch-found"}
+
+type notifier_entry struct {
+  name string
+  events map[string]bool
+  notifier
+}
+
+var notifiers []notifier_entry
+
+var notify_client = &http.Client{Timeout: 30 * time.Second}
+
+func start_notifiers() error {
+  for i, c := range conf.Notifiers {
+    var n notifier
+    switch c.Type {
+    case "webhook":
+      n = webhook_notifier{c.Url}
+    case "slack":
+      n = slack_notifier{c.Url}
+    case "pagerduty":
+      n = pagerduty_notifier{c.Routing_key}
+    case "email":
+      n = email_notifier{c}
+    case "stdout":
+      n = stdout_notifier{}
+    default:
+      return fmt.Errorf("notifier %d: unknown type %q", i, c.Type)
+    }
+    if (c.Type == "webhook" || c.Type == "slack") && c.Url == "" {
+      return fmt.Errorf("notifier %d: %s needs a url", i, c.Type)
+    }
+    if c.Type == "pagerduty" && c.Routing_key == "" {
+      return fmt.Errorf("notifier %d: pagerduty needs a routing_key", i)
+    }
+    if c.Type == "email" && (c.Smtp == "" || c.From == "" || len(c.To) == 0) {
+      return fmt.Errorf("notifier %d: email needs smtp, from and to", i)
+    }
+
+    e := notifier_entry{name: c.Type, events: map[string]bool{}, notifier: n}
+    events := c.Events
+    if len(events) == 0 {
+      events = notify_events
+    }
+    for _, ev := range events {
+      known := false
+      for _, k := range notify_events {
+        known = known || ev == k
+      }
+      if !known {
+        return fmt.Errorf("notifier %d: unknown event %q, expected one of %s", i, ev, strings.Join(notify_events, ", "))
+      }
+      e.events[ev] = true
+    }
+    notifiers = append(notifiers, e)
+  }
+  return nil
+}
+
+// notify_wanted says whether any notifier listens for an event
+func notify_wanted(event string) bool {
+  for _, n := range notifiers {
+    if n.events[event] {
+      return true
+    }
+  }
+  return false
+}
+
+// notify tells every notifier listening for the event; failures are logged and otherwise ignored
+func notify(event string, message string, file string) {
+  if !notify_wanted(event) {
+    return
+  }
+  host, _ := os.Hostname()
+  n := notice{Event: event, Table: conf.Table_name, Host: host, Run_id: run_id, Message: message, File: file, Time: time.Now()}
+  for _, e := range notifiers {
+    if !e.events[event] {
+      continue
+    }
+    if err := e.send(n); err != nil {
+      le.Print("error sending ", event, " notification to ", e.name, ": ", err)
+    }
+  }
+}
+
+// check_mismatch sends mismatch-found, runs the per-mismatch hook and quarantines the file once it has a hash on
+// both sides and they differ
+func check_mismatch(file string) {
+  if (!notify_wanted("mismatch-found") && !has_hook("per-mismatch") && conf.Quarantine_dir == "" && !fail_fast) || !has_old() {
+    return
+  }
+  var hash_new, hash_old, archive *string
+  err := db.QueryRow(fmt.Sprintf("select hash_new, hash_old, archive from %s where filename = $1",
+    pq.QuoteIdentifier(conf.Table_name)), file).Scan(&hash_new, &hash_old, &archive)
+  if err != nil {
+    le.Print("error checking ", file, " for a mismatch: ", err)
+    return
+  }
+  if hash_new == nil || hash_old == nil || *hash_new == *hash_old {
+    return
+  }
+  fail_fast_found("mismatch", file)
+  notify("mismatch-found", "hash mismatch: "+file, file)
+  log_hook("per-mismatch", map[string]interface{}{"file": file, "hash_new": *hash_new, "hash_old": *hash_old})
+  if conf.Quarantine_dir != "" && archive == nil {
+    if err = quarantine_file(file); err != nil {
+      le.Print("error quarantining ", file, ": ", err)
+    }
+  }
+}
+
+func (n notice) text() string {
+  return fmt.Sprintf("integrity_check %s on %s (table %s, run %d): %s", n.Event, n.Host, n.Table, n.Run_id, n.Message)
+}
+
+func post_json(url string, body interface{}) error {
+  b, err := json.Marshal(body)
+  if err != nil {
+    return err
+  }
+  resp, err := notify_client.Post(url, "application/json", bytes.NewReader(b))
+  if err != nil {
+    return err
+  }
+  defer resp.Body.Close()
+  if resp.StatusCode/100 != 2 {
+    return fmt.Errorf("%s returned %s", url, resp.Status)
+  }
+  return nil
+}
+
+type webhook_notifier struct {
+  url string
+}
+
+func (w webhook_notifier) send(n notice) error {
+  return post_json(w.url, n)
+}
+
+type slack_notifier struct {
+  url string
+}
+
+func (s slack_notifier) send(n notice) error {
+  return post_json(s.url, map[string]string{"text": n.text()})
+}
+
+type pagerduty_notifier struct {
+  routing_key string
+}
+
+func (p pagerduty_notifier) send(n notice) error {
+  severity := "info"
+  switch n.Event {
+  case "error-threshold":
+    severity = "error"
+  case "mismatch-found":
+    severity = "warning"
+  }
+  return post_json("https://events.pagerduty.com/v2/enqueue", map[string]interface{}{
+    "routing_key": p.routing_key,
+    "event_action": "trigger",
+    "payload": map[string]interface{}{
+      "summary": n.text(),
+      "source": n.Host,
+      "severity": severity,
+      "component": n.Table,
+      "custom_details": n,
+    },
+  })
+}
+
+type email_notifier struct {
+  c notifier_config
+}
+
+func (e email_notifier) send(n notice) error {
+  var auth smtp.Auth
+  if e.c.Username != "" {
+    host, _, err := net.SplitHostPort(e.c.Smtp)
+    if err != nil {
+      return err
+    }
+    auth = smtp.PlainAuth("", e.c.Username, e.c.Password, host)
+  }
+  msg := fmt.Sprintf("From: %s\r\nTo: %s\r\nSubject: integrity_check %s: %s\r\n\r\n%s\r\n",
+    e.c.From, strings.Join(e.c.To, ", "), n.Event, n.Table, n.text())
+  return smtp.SendMail(e.c.Smtp, auth, e.c.From, e.c.To, []byte(msg))
+}
+
+type stdout_notifier struct{}
+
+func (stdout_notifier) send(n notice) error {
+  b, err := json.Marshal(n)
+  if err != nil {
+    return err
+  }
+  _, err = fmt.Println(string(b))
+  return err
+}
@@ -0,0 +1,70 @@
+//
+// Partitioned state tables.
+//
+// For runs of hundreds of millions of files, "partitions": N creates the state table hash-partitioned into N
+// tables, <table>_p0 to <table>_p<N-1>, so vacuum, index builds and the compare queries work on pieces of a
+// manageable size. "partition_by" picks the key: "filename" (the default) spreads files evenly, "directory"
+// keeps each top-level directory within one partition. Queries still go through the parent table.
+//
+// Partitioning is decided when the table is created; an existing table stays as it is (reset it to change).
+//
+
+package main
+
+import (
+  "fmt"
+
+  pq "github.com/lib/pq"
+)
+
+func partition_key() string {
+  switch conf.Partition_by {
+  case "", "filename":
+    return "filename"
+  case "directory":
+    return "split_part(filename, '/', 1)"
+  }
+  die_if(fmt.Errorf("unknown partition_by %q, expected filename or directory", conf.Partition_by))
+  return ""
+}
+
+// partition_clause completes the create table statement of the state table
+func partition_clause() string {
+  if conf.Partitions <= 1 {
+    return ""
+  }
+  return fmt.Sprintf("partition by hash ((%s))", partition_key())
+}
+
+func partition_name(i int) string {
+  return pq.QuoteIdentifier(fmt.Sprintf("%s_p%d", conf.Table_name, i))
+}
+
+// create_partitions creates whichever partitions of the state table are missing
+func create_partitions() error {
+  if conf.Partitions <= 1 {
+    return nil
+  }
+  var partitioned bool
+  err := db.QueryRow("select exists (select 1 from pg_partitioned_table where partrelid = to_regclass($1))",
+    pq.QuoteIdentifier(conf.Table_name)).Scan(&partitioned)
+  if err != nil {
+    return err
+  }
+  if !partitioned {
+    l.Print("table ", conf.Table_name, " already exists without partitions; partitions only apply to a new table")
+    return nil
+  }
+
+  for i := 0; i < conf.Partitions; i++ {
+    _, err = db.Exec(fmt.Sprintf("create table if not exists %s partition of %s for values with (modulus %d, remainder %d)",
+      partition_name(i), pq.QuoteIdentifier(conf.Table_name), conf.Partitions, i))
+    if err != nil {
+      return err
+    }
+    if err = set_table_access(partition_name(i)); err != nil {
+      return err
+    }
+  }
+  return nil
+}
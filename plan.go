@@ -0,0 +1,152 @@
+//
+// Cost planner.
+//
+// Before hashing, the run prints what it is about to do: the bytes each phase has to read, how long that should
+// take at the throughput measured by earlier runs on this table (from <table>_progress) or, failing that, at
+// "plan_mbps", and how many rows it will rewrite in the database. With "plan_max_hours" or "plan_max_tb" set,
+// a plan beyond them needs confirmation (or -yes) before the run goes ahead:
+//
+//   plan: hash_new 412.0 TiB in 1203411 files, hash_old 412.0 TiB in 1203411 files
+//   plan: ~26.5 days at 450 MB/s (measured), ~2406822 row updates, ~1.1 GiB of table writes plus WAL
+//
+
+package main
+
+import (
+  "database/sql"
+  "fmt"
+  "os"
+  "strings"
+  "time"
+
+  pq "github.com/lib/pq"
+)
+
+type phase_plan struct {
+  name string
+  files int64
+  bytes int64
+}
+
+func approx_size(n int64) string {
+  units := []string{"B", "KiB", "MiB", "GiB", "TiB", "PiB"}
+  f := float64(n)
+  u := 0
+  for f >= 1024 && u < len(units)-1 {
+    f /= 1024
+    u++
+  }
+  return fmt.Sprintf("%.1f %s", f, units[u])
+}
+
+func approx_duration(d time.Duration) string {
+  if d >= 48*time.Hour {
+    return fmt.Sprintf("%.1f days", d.Hours()/24)
+  }
+  return fmt.Sprintf("%.1f hours", d.Hours())
+}
+
+// measured_rate returns the hashing throughput of earlier runs in bytes per second, or 0
+func measured_rate() float64 {
+  var exists sql.NullString
+  if err := db.QueryRow("select to_regclass($1)::text", pq.QuoteIdentifier(conf.Table_name + "_progress")).Scan(&exists); err != nil || !exists.Valid {
+    return 0
+  }
+  // the rate of each run is the sum of its workers' rates
+  var rate sql.NullFloat64
+  err := db.QueryRow(fmt.Sprintf(`select avg(rate) from (
+      select date_trunc('minute', ts), sum(rate_bps) as rate from %s
+      where phase like 'hash_%%' and rate_bps > 0 and ts > now() - interval '30 days' group by 1
+    ) r`, progress_table())).Scan(&rate)
+  if err != nil {
+    return 0
+  }
+  return rate.Float64
+}
+
+func plan_phases() []phase_plan {
+  t := pq.QuoteIdentifier(conf.Table_name)
+  phases := []phase_plan{{name: "hash_new"}}
+  queries := []string{fmt.Sprintf("select count(*), coalesce(sum(size), 0) from %s where %s", t, phase_where("new", "verified_by is null and archive is null"))}
+  if has_old() {
+    phases = append(phases, phase_plan{name: "hash_old"})
+    queries = append(queries, fmt.Sprintf("select count(*), coalesce(sum(size), 0) from %s where %s", t, phase_where("old", glacier_condition())))
+  }
+  for _, r := range conf.Replicas {
+    phases = append(phases, phase_plan{name: "replica_" + r.Name})
+    queries = append(queries, fmt.Sprintf(`select count(*), coalesce(sum(size), 0) from %s t where not exists (
+      select 1 from %s r where r.filename = t.filename and r.replica = %s and r.hash is not null)%s`, t, replicas_table(), pq.QuoteLiteral(r.Name), work_filter()))
+  }
+  for i := range phases {
+    die_if(db.QueryRow(queries[i]).Scan(&phases[i].files, &phases[i].bytes))
+  }
+  return phases
+}
+
+// plan_run prints the estimates, and returns false if they exceed the budgets and the run wasn't confirmed
+func plan_run() bool {
+  phases := plan_phases()
+  var parts []string
+  var files, total, longest int64
+  for _, p := range phases {
+    parts = append(parts, fmt.Sprintf("%s %s in %d files", p.name, approx_size(p.bytes), p.files))
+    files += p.files
+    total += p.bytes
+    if p.bytes > longest {
+      longest = p.bytes
+    }
+  }
+  l.Print("plan: ", strings.Join(parts, ", "))
+  if files == 0 {
+    return true
+  }
+
+  // the NEW and OLD phases overlap when the trees are on separate devices
+  to_read := total
+  if conf.Old_path != "" && phases_concurrent() {
+    to_read = total - phases[1].bytes
+    if phases[1].bytes > phases[0].bytes {
+      to_read = total - phases[0].bytes
+    }
+  }
+
+  rate, source := measured_rate(), "measured"
+  if rate == 0 && conf.Plan_mbps > 0 {
+    rate, source = conf.Plan_mbps * 1e6, "configured"
+  }
+  var duration time.Duration
+  estimate := "unknown duration (no earlier runs to measure; set plan_mbps)"
+  if rate > 0 {
+    duration = time.Duration(float64(to_read) / rate * float64(time.Second))
+    estimate = fmt.Sprintf("~%s at %.0f MB/s (%s)", approx_duration(duration), rate/1e6, source)
+  }
+
+  var table_bytes, rows int64
+  die_if(db.QueryRow(fmt.Sprintf("select pg_total_relation_size(%s), (select count(*) from %s)",
+    pq.QuoteLiteral(pq.QuoteIdentifier(conf.Table_name)), pq.QuoteIdentifier(conf.Table_name))).Scan(&table_bytes, &rows))
+  writes := int64(0)
+  if rows > 0 {
+    writes = table_bytes / rows * files // every update writes a new version of the row
+  }
+  l.Printf("plan: %s, ~%d row updates, ~%s of table writes plus WAL", estimate, files, approx_size(writes))
+
+  var over []string
+  if conf.Plan_max_hours > 0 && duration.Hours() > conf.Plan_max_hours {
+    over = append(over, fmt.Sprintf("the estimated %s exceed plan_max_hours (%g)", approx_duration(duration), conf.Plan_max_hours))
+  }
+  if conf.Plan_max_tb > 0 && float64(total) / 1e12 > conf.Plan_max_tb {
+    over = append(over, fmt.Sprintf("%.1f TB to read exceed plan_max_tb (%g)", float64(total)/1e12, conf.Plan_max_tb))
+  }
+  if len(over) == 0 {
+    return true
+  }
+  return confirm("This run is over budget: " + strings.Join(over, "; ") + ".")
+}
+
+func plan_or_exit() {
+  if !plan_run() {
+    l.Print("aborted")
+    finish_run("aborted")
+    os.Exit(1)
+  }
+}
@@ -0,0 +1,93 @@
+//
+// Per-pattern verification policies.
+//
+// The first policy whose pattern matches a file decides how it is verified:
+//   full     SHA256 of the whole content (the default)
+//   size     only compare sizes, recorded as "size:<bytes>"
+//   chunked  SHA256 of fixed-size chunks hashed in parallel, combined into one digest, recorded as "chunked:<hex>"
+//   sampled  the size, first/last N MB and K pseudo-random interior blocks, recorded as "sampled:<hex>"
+//   skip     the file is left out of the run
+//
+// Files not matched by any pattern fall into the highest size tier they reach, if any, so a handful of enormous
+// files can get a cheaper action (e.g. "tiers": [ { "min_size": 1099511627776, "action": "sampled" } ]).
+// Run with -no-tiers to verify them fully anyway.
+//
+// With normalize_eol, full and chunked hashes are computed with CRLF line endings turned into LF on both sides,
+// so text files that only had their line endings converted still match; those hashes are prefixed "eol:".
+//
+// Patterns without a slash match the base name (*.iso); patterns with a slash match the path relative to
+// the tree root, a leading slash anchors them there, and ** matches any number of directories (/scratch/**).
+//
+
+package main
+
+import (
+  "path"
+  "strings"
+)
+
+type policy struct {
+  Pattern string `json:"pattern"`
+  Action string `json:"action"`
+  Normalize_eol bool `json:"normalize_eol"`
+}
+
+type tier struct {
+  Min_size int64 `json:"min_size"`
+  Action string `json:"action"`
+}
+
+var default_policy = policy{Pattern: "**", Action: "full"}
+
+var no_tiers bool
+
+func policy_for(file string, size int64) *policy {
+  for i := range conf.Policies {
+    if match_pattern(conf.Policies[i].Pattern, file) {
+      return &conf.Policies[i]
+    }
+  }
+  if !no_tiers {
+    var best *tier
+    for i := range conf.Tiers {
+      t := &conf.Tiers[i]
+      if size >= t.Min_size && (best == nil || t.Min_size > best.Min_size) {
+        best = t
+      }
+    }
+    if best != nil {
+      return &policy{Pattern: "**", Action: best.Action}
+    }
+  }
+  return &default_policy
+}
+
+func match_pattern(pattern string, file string) bool {
+  if !strings.Contains(pattern, "/") {
+    ok, _ := path.Match(pattern, path.Base(file))
+    return ok
+  }
+  return match_segments(strings.Split(strings.TrimPrefix(pattern, "/"), "/"), strings.Split(file, "/"))
+}
+
+func match_segments(pattern []string, file []string) bool {
+  for len(pattern) > 0 {
+    if pattern[0] == "**" {
+      // ** swallows zero or more directories
+      for i := 0; i <= len(file); i++ {
+        if match_segments(pattern[1:], file[i:]) {
+          return true
+        }
+      }
+      return false
+    }
+    if len(file) == 0 {
+      return false
+    }
+    if ok, _ := path.Match(pattern[0], file[0]); !ok {
+      return false
+    }
+    pattern, file = pattern[1:], file[1:]
+  }
+  return len(file) == 0
+}
@@ -0,0 +1,120 @@
+//
+// Polite mode: backing off when the storage gets slow.
+//
+// With "polite_latency_ms" set, every local file hashed is timed on opening it and reading its first block. When
+// the 90th percentile of those over the last polite_interval (default 10s) exceeds the threshold, we are
+// presumably competing with production traffic, and the number of files hashed at the same time is halved;
+// when it falls under half the threshold, one more is allowed again, up to all workers.
+//
+
+package main
+
+import (
+  "os"
+  "sort"
+  "sync"
+  "time"
+)
+
+type throttle struct {
+  mu sync.Mutex
+  cond *sync.Cond
+  limit int // files that may be hashed at the same time; 0 means no limit
+  active int
+  samples []time.Duration
+}
+
+var polite = new_throttle()
+
+func new_throttle() *throttle {
+  t := &throttle{}
+  t.cond = sync.NewCond(&t.mu)
+  return t
+}
+
+// acquire waits for a hashing slot
+func (t *throttle) acquire() {
+  t.mu.Lock()
+  defer t.mu.Unlock()
+  for t.limit > 0 && t.active >= t.limit {
+    t.cond.Wait()
+  }
+  t.active++
+}
+
+func (t *throttle) release() {
+  t.mu.Lock()
+  defer t.mu.Unlock()
+  t.active--
+  t.cond.Broadcast()
+}
+
+func (t *throttle) sample(d time.Duration) {
+  t.mu.Lock()
+  defer t.mu.Unlock()
+  t.samples = append(t.samples, d)
+}
+
+// probe_latency times opening a file and reading its first block
+func probe_latency(path string) {
+  start := time.Now()
+  f, err := os.Open(path)
+  if err != nil {
+    return
+  }
+  buf := make([]byte, 4096)
+  f.ReadAt(buf, 0)
+  f.Close()
+  polite.sample(time.Since(start))
+}
+
+// adjust sets the limit from the latencies seen since the last call
+func (t *throttle) adjust(threshold time.Duration, max int) {
+  t.mu.Lock()
+  defer t.mu.Unlock()
+  if len(t.samples) == 0 {
+    return
+  }
+  sort.Slice(t.samples, func(i, j int) bool { return t.samples[i] < t.samples[j] })
+  p90 := t.samples[len(t.samples) * 9 / 10]
+  t.samples = t.samples[:0]
+
+  current := t.limit
+  if current == 0 {
+    current = t.active // unlimited so far: start from what is running now
+    if current < 1 {
+      current = 1
+    }
+  }
+  switch {
+  case p90 > threshold && current > 1:
+    t.limit = current / 2
+    l.Print("polite: read latency ", p90.Round(time.Millisecond), " over ", threshold, ", down to ", t.limit, " files at a time")
+  case p90 < threshold / 2 && t.limit > 0:
+    t.limit++
+    if t.limit >= max {
+      t.limit = 0
+    }
+    l.Print("polite: read latency ", p90.Round(time.Millisecond), ", up to ", current + 1, " files at a time")
+    t.cond.Broadcast()
+  }
+}
+
+func start_polite() {
+  if conf.Polite_latency_ms <= 0 {
+    return
+  }
+  interval := 10 * time.Second
+  if conf.Polite_interval > 0 {
+    interval = time.Duration(conf.Polite_interval) * time.Second
+  }
+  threshold := time.Duration(conf.Polite_latency_ms) * time.Millisecond
+  // the most files a process hashes at the same time: both phases, with the pools they were given once the fd
+  // budget was applied, and their priority lanes
+  max := hash_threads("new") + hash_threads("old") + 2 * priority_threads
+  go func() {
+    for range time.Tick(interval) {
+      polite.adjust(threshold, max)
+    }
+  }()
+}
@@ -0,0 +1,22 @@
+//
+// Worker pools.
+//
+// Every phase runs a pool of its own, started with start_pool and waited on by nobody but the phase, so phases
+// compose: hash_all runs the NEW and OLD phases one after the other or side by side (see device.go) without
+// them sharing any state. A worker returning an error doesn't stop the others; Wait returns the first error.
+//
+
+package main
+
+import (
+  "golang.org/x/sync/errgroup"
+)
+
+// start_pool runs n workers of work
+func start_pool(n int, work func() error) *errgroup.Group {
+  pool := new(errgroup.Group)
+  for i := 0; i < n; i++ {
+    pool.Go(work)
+  }
+  return pool
+}
@@ -0,0 +1,229 @@
+//
+// Preflight checks of the OLD tree, before it is copied.
+//
+// "integrity_check preflight [-o file] [-target ntfs|exfat|s3 [-prefix D:\archive\]]" goes through path_old (or
+// its remote) and reports the files that will predictably go wrong in the copy, without touching the database:
+//
+//   CASE_COLLISION   names that differ only by case, e.g. Report.pdf and report.pdf: on a case-insensitive target
+//                    (NTFS, APFS and exFAT as usually set up, SMB shares) one silently overwrites the other, and
+//                    directories differing only by case are merged. Each line lists the colliding paths.
+//
+// With -target, the paths are also checked against the rules of the target filesystem:
+//
+//   PATH_TOO_LONG    longer than the target takes, counting the -prefix the tree is copied under: 259 UTF-16 units
+//                    on NTFS (MAX_PATH, for tools without long path support), 32760 on exFAT, 1024 bytes of UTF-8
+//                    for an S3 key
+//   NAME_TOO_LONG    a name of more than 255 UTF-16 units (NTFS, exFAT)
+//   INVALID_NAME     a name the target can't represent: not UTF-8, characters Windows refuses (<>:"\|?* and control
+//                    characters), device names like CON or LPT1, or a trailing dot or space (NTFS, exFAT)
+//
+
+package main
+
+import (
+  "bufio"
+  "flag"
+  "fmt"
+  "io"
+  "os"
+  "path/filepath"
+  "regexp"
+  "sort"
+  "strings"
+  "time"
+  "unicode/utf16"
+  "unicode/utf8"
+)
+
+func preflight_command(args []string) {
+  fs := flag.NewFlagSet("preflight", flag.ExitOnError)
+  out := fs.String("o", "", "Write the preflight report to this file instead of stdout")
+  target := fs.String("target", "", "Also check the paths against the rules of this target: ntfs, exfat or s3")
+  prefix := fs.String("prefix", "", "With -target, the path the tree is copied under, counted in the path length")
+  fs.Parse(args)
+
+  if conf.Old_path == "" {
+    die_if(fmt.Errorf("preflight needs path_old, the tree about to be copied"))
+  }
+  if *target != "" {
+    p, ok := path_profiles[*target]
+    if !ok {
+      die_if(fmt.Errorf("unknown -target %s: ntfs, exfat or s3", *target))
+    }
+    p.prefix = *prefix
+    preflight_profile = &p
+  }
+
+  fd, err := create_output(*out)
+  die_if(err)
+  w := bufio.NewWriter(fd)
+  problems, err := write_preflight(w)
+  die_if(err)
+  die_if(w.Flush())
+  die_if(fd.Close())
+  l.Print("preflight complete: ", problems, " problems")
+}
+
+func write_preflight(w io.Writer) (int64, error) {
+  fmt.Fprintf(w, "# integrity_check %s\n", build_version())
+  fmt.Fprintf(w, "# preflight of %s\n", conf.Old_path)
+  if preflight_profile != nil {
+    fmt.Fprintf(w, "# target %s\n", preflight_profile.name)
+  }
+
+  if rm := remotes["old"]; rm != nil {
+    return remote_case_collisions(w, rm)
+  }
+  return case_collisions(w, []string{""})
+}
+
+// case_collisions checks the entries of directories whose paths fold to the same (one directory, unless some
+// differ only by case), and recurses into their subdirectories
+func case_collisions(w io.Writer, dirs []string) (int64, error) {
+  var problems int64
+  folded := map[string][]string{}
+  is_dir := map[string]bool{}
+  for _, dir := range dirs {
+    entries, err := os.ReadDir(filepath.Join(conf.Old_path, dir))
+    if err != nil {
+      le.Print("error reading ", filepath.Join(conf.Old_path, dir), ": ", err)
+      continue
+    }
+    for _, e := range entries {
+      rel := filepath.ToSlash(filepath.Join(dir, e.Name()))
+      problems += check_target_path(w, rel)
+      key := strings.ToLower(e.Name())
+      folded[key] = append(folded[key], rel)
+      if e.IsDir() {
+        is_dir[rel] = true
+      }
+    }
+  }
+
+  keys := make([]string, 0, len(folded))
+  for key := range folded {
+    keys = append(keys, key)
+  }
+  sort.Strings(keys)
+  for _, key := range keys {
+    paths := folded[key]
+    if len(paths) > 1 {
+      fmt.Fprintf(w, "CASE_COLLISION\t%s\n", strings.Join(paths, "\t"))
+      problems++
+    }
+    var subdirs []string
+    for _, p := range paths {
+      if is_dir[p] {
+        subdirs = append(subdirs, p)
+      }
+    }
+    if len(subdirs) > 0 {
+      n, err := case_collisions(w, subdirs)
+      problems += n
+      if err != nil {
+        return problems, err
+      }
+    }
+  }
+  return problems, nil
+}
+
+// remote_case_collisions does the same from the listing of a remote tree, which has to be held in memory
+func remote_case_collisions(w io.Writer, rm remote) (int64, error) {
+  folded := map[string][]string{}
+  var problems int64
+  listed := map[string]bool{} // directories, which a remote doesn't list by themselves
+  err := rm.walk(func(name string, size int64, mtime time.Time) error {
+    parts := strings.Split(name, "/")
+    for i := 1; i < len(parts); i++ {
+      if dir := strings.Join(parts[:i], "/"); !listed[dir] {
+        listed[dir] = true
+        problems += check_target_path(w, dir)
+      }
+    }
+    problems += check_target_path(w, name)
+    key := strings.ToLower(name)
+    folded[key] = append(folded[key], name)
+    return nil
+  })
+  if err != nil {
+    return 0, err
+  }
+
+  var collisions []string
+  for _, paths := range folded {
+    if len(paths) > 1 {
+      sort.Strings(paths)
+      collisions = append(collisions, strings.Join(paths, "\t"))
+    }
+  }
+  sort.Strings(collisions)
+  for _, c := range collisions {
+    fmt.Fprintf(w, "CASE_COLLISION\t%s\n", c)
+  }
+  return problems + int64(len(collisions)), nil
+}
+
+// path_profile holds the rules a target filesystem imposes on paths
+type path_profile struct {
+  name string
+  max_path int // in UTF-16 units, or bytes with path_bytes
+  path_bytes bool
+  max_name int // in UTF-16 units
+  windows bool // characters, device names and trailing dots and spaces refused by Windows
+  prefix string
+}
+
+var path_profiles = map[string]path_profile{
+  "ntfs": {name: "ntfs", max_path: 259, max_name: 255, windows: true},
+  "exfat": {name: "exfat", max_path: 32760, max_name: 255, windows: true},
+  "s3": {name: "s3", max_path: 1024, path_bytes: true},
+}
+
+var preflight_profile *path_profile
+
+var windows_devices = regexp.MustCompile(`(?i)^(con|prn|aux|nul|com[0-9¹²³]|lpt[0-9¹²³])(\.|$)`)
+
+// check_target_path reports what keeps a path from being copied to the target as it is
+func check_target_path(w io.Writer, rel string) int64 {
+  p := preflight_profile
+  if p == nil {
+    return 0
+  }
+  var problems int64
+  report := func(kind string, detail string) {
+    fmt.Fprintf(w, "%s\t%s\t%s\n", kind, rel, detail)
+    problems++
+  }
+
+  if !utf8.ValidString(rel) {
+    report("INVALID_NAME", "not valid UTF-8")
+    return problems
+  }
+
+  full := p.prefix + rel
+  length := len(utf16.Encode([]rune(full)))
+  if p.path_bytes {
+    length = len(full)
+  }
+  if length > p.max_path {
+    report("PATH_TOO_LONG", fmt.Sprintf("%d > %d", length, p.max_path))
+  }
+
+  // the directories above were checked when they were listed
+  name := rel[strings.LastIndex(rel, "/") + 1:]
+  if n := len(utf16.Encode([]rune(name))); p.max_name > 0 && n > p.max_name {
+    report("NAME_TOO_LONG", fmt.Sprintf("%d > %d", n, p.max_name))
+  }
+  if !p.windows {
+    return problems
+  }
+  if i := strings.IndexFunc(name, func(r rune) bool { return r < 32 || strings.ContainsRune(`<>:"\|?*`, r) }); i >= 0 {
+    report("INVALID_NAME", fmt.Sprintf("character %q", name[i:i + 1]))
+  } else if windows_devices.MatchString(name) {
+    report("INVALID_NAME", "device name")
+  } else if strings.HasSuffix(name, ".") || strings.HasSuffix(name, " ") {
+    report("INVALID_NAME", "trailing dot or space")
+  }
+  return problems
+}
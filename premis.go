@@ -0,0 +1,164 @@
+//
+// PREMIS export.
+//
+// "integrity_check premis [-o file] [-format xml|json]" writes the verification results as PREMIS 3 events, one
+// per file, for ingest into a digital preservation system as formal fixity check records:
+//
+//   - with an OLD side, a "fixity check" event with outcome "pass" when the NEW hash matches OLD and "fail" when
+//     it doesn't or a side couldn't be read, dated when the NEW copy was hashed;
+//   - without, a "message digest calculation" event with outcome "success" (or "fail" if the file couldn't be read).
+//
+// The file is linked as a local object identifier (its path relative to new_path), the tool as a software agent,
+// and the digests and any error go to the outcome detail. Event identifiers are UUIDs derived from the table, file
+// and time, so exporting twice gives the same identifiers. XML is a single <premis> document; JSON is one event
+// per line with the same fields. Files still pending aren't exported.
+//
+
+package main
+
+import (
+  "bufio"
+  "crypto/sha1"
+  "database/sql"
+  "encoding/json"
+  "encoding/xml"
+  "flag"
+  "fmt"
+  "io"
+  "strings"
+  "time"
+
+  pq "github.com/lib/pq"
+)
+
+type premis_identifier struct {
+  Type string `xml:"premis:eventIdentifierType" json:"eventIdentifierType"`
+  Value string `xml:"premis:eventIdentifierValue" json:"eventIdentifierValue"`
+}
+
+type premis_agent_link struct {
+  Type string `xml:"premis:linkingAgentIdentifierType" json:"linkingAgentIdentifierType"`
+  Value string `xml:"premis:linkingAgentIdentifierValue" json:"linkingAgentIdentifierValue"`
+  Role string `xml:"premis:linkingAgentRole" json:"linkingAgentRole"`
+}
+
+type premis_object_link struct {
+  Type string `xml:"premis:linkingObjectIdentifierType" json:"linkingObjectIdentifierType"`
+  Value string `xml:"premis:linkingObjectIdentifierValue" json:"linkingObjectIdentifierValue"`
+}
+
+type premis_event struct {
+  XMLName xml.Name `xml:"premis:event" json:"-"`
+  Identifier premis_identifier `xml:"premis:eventIdentifier" json:"eventIdentifier"`
+  Type string `xml:"premis:eventType" json:"eventType"`
+  DateTime string `xml:"premis:eventDateTime" json:"eventDateTime"`
+  Detail string `xml:"premis:eventDetailInformation>premis:eventDetail" json:"eventDetail"`
+  Outcome string `xml:"premis:eventOutcomeInformation>premis:eventOutcome" json:"eventOutcome"`
+  OutcomeNote string `xml:"premis:eventOutcomeInformation>premis:eventOutcomeDetail>premis:eventOutcomeDetailNote" json:"eventOutcomeDetailNote"`
+  Agent premis_agent_link `xml:"premis:linkingAgentIdentifier" json:"linkingAgentIdentifier"`
+  Object premis_object_link `xml:"premis:linkingObjectIdentifier" json:"linkingObjectIdentifier"`
+}
+
+// premis_digest names a recorded hash with its algorithm, for the outcome note
+func premis_digest(hash string) string {
+  return hash_algorithm() + " " + strings.TrimPrefix(hash, hash_prefix())
+}
+
+// premis_uuid derives a name-based (version 5 style) UUID, so the same event always gets the same identifier
+func premis_uuid(parts ...string) string {
+  h := sha1.New()
+  for _, p := range parts {
+    h.Write([]byte(p))
+    h.Write([]byte{0})
+  }
+  u := h.Sum(nil)[:16]
+  u[6] = u[6]&0x0f | 0x50
+  u[8] = u[8]&0x3f | 0x80
+  return fmt.Sprintf("%x-%x-%x-%x-%x", u[0:4], u[4:6], u[6:8], u[8:10], u[10:16])
+}
+
+func premis_command(args []string) {
+  fs := flag.NewFlagSet("premis", flag.ExitOnError)
+  out := fs.String("o", "", "Write the events to this file instead of stdout")
+  format := fs.String("format", "xml", "xml or json")
+  fs.Parse(args)
+  if *format != "xml" && *format != "json" {
+    die_if(fmt.Errorf("unknown format %q, expected xml or json", *format))
+  }
+
+  fd, err := create_output(*out)
+  die_if(err)
+  bw := bufio.NewWriter(fd)
+  n, err := write_premis(bw, *format)
+  die_if(err)
+  die_if(bw.Flush())
+  die_if(fd.Close())
+  l.Print("exported ", n, " PREMIS events")
+}
+
+func write_premis(w io.Writer, format string) (int64, error) {
+  where := "hash_new is not null or error_new is not null"
+  if has_old() {
+    where = "(hash_new is not null or error_new is not null) and (hash_old is not null or error_old is not null)"
+  }
+  query := fmt.Sprintf(`select filename, hash_new, hash_old, error_new, error_old, coalesce(hashed_at_new, hashed_at_old, walked_at, now()::timestamp)
+    from %s where %s%s order by filename`, pq.QuoteIdentifier(conf.Table_name), where, work_filter())
+
+  agent := premis_agent_link{Type: "software", Value: "integrity_check " + build_version(), Role: "executing program"}
+  var enc *xml.Encoder
+  js := json.NewEncoder(w)
+  if format == "xml" {
+    fmt.Fprintf(w, "%s<premis:premis xmlns:premis=\"http://www.loc.gov/premis/v3\" version=\"3.0\">\n", xml.Header)
+    enc = xml.NewEncoder(w)
+    enc.Indent("  ", "  ")
+  }
+
+  var n int64
+  err := each_row(query, func(rows *sql.Rows) error {
+    var file string
+    var hash_new, hash_old, error_new, error_old sql.NullString
+    var at time.Time
+    if err := rows.Scan(&file, &hash_new, &hash_old, &error_new, &error_old, &at); err != nil {
+      return err
+    }
+    e := premis_event{Agent: agent, Object: premis_object_link{Type: "local", Value: file}, DateTime: at.UTC().Format(time.RFC3339)}
+    if has_old() {
+      e.Type = "fixity check"
+      e.Detail = "hash of the copy compared with the hash of the original"
+      switch {
+      case error_new.Valid:
+        e.Outcome, e.OutcomeNote = "fail", "copy unreadable: "+error_new.String
+      case error_old.Valid:
+        e.Outcome, e.OutcomeNote = "fail", "original unreadable: "+error_old.String
+      case hash_new.String == hash_old.String:
+        e.Outcome, e.OutcomeNote = "pass", premis_digest(hash_new.String)
+      default:
+        e.Outcome, e.OutcomeNote = "fail", fmt.Sprintf("%s copy %s, original %s", hash_algorithm(), strings.TrimPrefix(hash_new.String, hash_prefix()), strings.TrimPrefix(hash_old.String, hash_prefix()))
+      }
+    } else {
+      e.Type = "message digest calculation"
+      e.Detail = "hash of the file recorded as a baseline"
+      if error_new.Valid {
+        e.Outcome, e.OutcomeNote = "fail", "unreadable: "+error_new.String
+      } else {
+        e.Outcome, e.OutcomeNote = "success", premis_digest(hash_new.String)
+      }
+    }
+    e.Identifier = premis_identifier{Type: "UUID", Value: premis_uuid(conf.Table_name, file, e.DateTime, e.Type)}
+    n++
+    if enc != nil {
+      return enc.Encode(e)
+    }
+    return js.Encode(e)
+  })
+  if err != nil {
+    return n, err
+  }
+  if enc != nil {
+    if err = enc.Flush(); err != nil {
+      return n, err
+    }
+    fmt.Fprintln(w, "\n</premis:premis>")
+  }
+  return n, nil
+}
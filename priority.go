@@ -0,0 +1,156 @@
+//
+// Priority lanes.
+//
+// Files can be pushed ahead of the statement of work while a run is going, when a project needs sign-off
+// before the normal order would get to it:
+//
+//   integrity_check prioritize [-level 5] projects/urgent/ ...     or    curl -X POST 'localhost:8765/prioritize?prefix=projects/urgent/'
+//   integrity_check prioritize -clear projects/urgent/
+//
+// or by setting the priority column directly and sending "integrity_check notify priority". Each running phase
+// has a priority lane: two extra hash workers that go through the outstanding files with a priority, highest
+// first, whenever priorities are announced and every 30 seconds. Claims keep them from hashing a file twice.
+//
+
+package main
+
+import (
+  "flag"
+  "fmt"
+  "strings"
+  "sync"
+  "time"
+
+  pq "github.com/lib/pq"
+)
+
+const priority_poll = 30 * time.Second
+const priority_threads = 2
+
+var priority_mu sync.Mutex
+var priority_wake = make(chan struct{}) // closed and replaced whenever priorities are announced
+
+func announce_priority() {
+  priority_mu.Lock()
+  defer priority_mu.Unlock()
+  close(priority_wake)
+  priority_wake = make(chan struct{})
+}
+
+func priority_wakeup() <-chan struct{} {
+  priority_mu.Lock()
+  defer priority_mu.Unlock()
+  return priority_wake
+}
+
+// set_priority gives the files under a prefix a priority (0 clears it), and tells running instances
+func set_priority(prefix string, level int) (int64, error) {
+  p := strings.TrimPrefix(strings.TrimPrefix(prefix, conf.New_path), "/")
+  if p == "" {
+    return 0, fmt.Errorf("no path prefix")
+  }
+  if !strings.HasSuffix(p, "/") {
+    p += "/"
+  }
+  var value interface{}
+  if level != 0 {
+    value = level
+  }
+  res, err := db_exec(fmt.Sprintf("update %s set priority = $2 where left(filename, length($1)) = $1", pq.QuoteIdentifier(conf.Table_name)), p, value)
+  if err != nil {
+    return 0, err
+  }
+  n, err := res.RowsAffected()
+  if err != nil {
+    return 0, err
+  }
+  return n, notify_event("priority")
+}
+
+func prioritize_command(args []string) {
+  fs := flag.NewFlagSet("prioritize", flag.ExitOnError)
+  level := fs.Int("level", 1, "Priority of the files; higher goes first")
+  clear := fs.Bool("clear", false, "Remove the priority instead")
+  fs.Parse(args)
+  if fs.NArg() == 0 {
+    die_if(fmt.Errorf("prioritize needs at least one path prefix"))
+  }
+  if *clear {
+    *level = 0
+  }
+  for _, prefix := range fs.Args() {
+    n, err := set_priority(prefix, *level)
+    die_if(err)
+    l.Print("set priority ", *level, " on ", n, " files under ", prefix)
+  }
+}
+
+// start_priority_lane runs the priority lane of a phase until the returned function is called
+func start_priority_lane(side string, where string, phase *phase_progress) func() {
+  done := make(chan struct{})
+  var lane sync.WaitGroup
+  lane.Add(1)
+  go func() {
+    defer lane.Done()
+    for {
+      wake := priority_wakeup()
+      priority_pass(side, where, phase, done)
+      select {
+      case <-done:
+        return
+      case <-wake:
+      case <-time.After(priority_poll):
+      }
+    }
+  }()
+  return func() {
+    close(done)
+    lane.Wait()
+  }
+}
+
+// priority_pass hashes the outstanding files with a priority once
+func priority_pass(side string, where string, phase *phase_progress, done chan struct{}) {
+  res, err := db.Query(fmt.Sprintf("select filename, size from %s where %s and priority is not null and %s is null order by priority desc, filename",
+    pq.QuoteIdentifier(conf.Table_name), where, pq.QuoteIdentifier("error_"+side)))
+  if err != nil {
+    le.Print("error getting priority files: ", err)
+    return
+  }
+  var items []work_item
+  for res.Next() {
+    var w work_item
+    if err = res.Scan(&w.filename, &w.size); err != nil {
+      break
+    }
+    items = append(items, w)
+  }
+  if err == nil {
+    err = res.Err()
+  }
+  res.Close()
+  if err != nil {
+    le.Print("error getting priority files: ", err)
+    return
+  }
+  if len(items) == 0 {
+    return
+  }
+  l.Print("priority lane: ", len(items), " ", side, " files")
+
+  to_hash := make(chan work_item)
+  pool := start_pool(priority_threads, func() error {
+    for w := range to_hash {
+      hash_one(side, w, phase)
+    }
+    return nil
+  })
+  for _, w := range items {
+    select {
+    case to_hash <- w:
+    case <-done:
+    }
+  }
+  close(to_hash)
+  pool.Wait()
+}
@@ -0,0 +1,212 @@
+//
+// Progress tracking.
+//
+// Each hash phase counts what it has done; once a minute (progress_interval) every worker writes its phase,
+// counters, smoothed throughput and the resulting ETA to <table>_progress, so dashboards and the "status"
+// command can see how far along a run is even when the process itself can't be reached.
+//
+
+package main
+
+import (
+  "database/sql"
+  "fmt"
+  "os"
+  "sync"
+  "sync/atomic"
+  "text/tabwriter"
+  "time"
+
+  pq "github.com/lib/pq"
+)
+
+type phase_progress struct {
+  mu sync.Mutex
+  phase string
+  files_total int64
+  bytes_total int64
+  files_done int64
+  bytes_done int64
+  last_bytes int64 // bytes_done at the previous report
+  rate float64 // bytes per second, exponentially smoothed
+  active bool
+  span *span
+  quarters int32 // milestones reached, in quarters of files_total
+}
+
+// phases in progress in this process, by name; phases can run concurrently
+var progress_mu sync.Mutex
+var progress = map[string]*phase_progress{}
+
+func progress_table() string {
+  return pq.QuoteIdentifier(conf.Table_name + "_progress")
+}
+
+func progress_interval() time.Duration {
+  if conf.Progress_interval > 0 {
+    return time.Duration(conf.Progress_interval) * time.Second
+  }
+  return time.Minute
+}
+
+// start_phase begins tracking a phase; files and bytes are its outstanding totals
+func start_phase(phase string, files int64, bytes int64) *phase_progress {
+  p := &phase_progress{phase: phase, files_total: files, bytes_total: bytes, active: true, span: start_span(phase, run_span)}
+  p.span.set("files_total", files)
+  p.span.set("bytes_total", bytes)
+  progress_mu.Lock()
+  progress[phase] = p
+  progress_mu.Unlock()
+  return p
+}
+
+func (p *phase_progress) done(bytes int64) {
+  files := atomic.AddInt64(&p.files_done, 1)
+  atomic.AddInt64(&p.bytes_done, bytes)
+  if p.files_total > 0 {
+    if q := int32(files * 4 / p.files_total); q > atomic.LoadInt32(&p.quarters) {
+      p.reach(q)
+    }
+  }
+}
+
+// finish marks the phase complete; it is reported one last time
+func (p *phase_progress) finish() {
+  p.mu.Lock()
+  p.active = false
+  p.mu.Unlock()
+  if !deadline_passed() {
+    // whatever failed was counted as an error: the phase has been through all its files
+    p.reach(4)
+  }
+  p.span.set("files_done", atomic.LoadInt64(&p.files_done))
+  p.span.set("bytes_done", atomic.LoadInt64(&p.bytes_done))
+  p.span.finish(nil)
+}
+
+func start_progress() error {
+  _, err := db.Exec(fmt.Sprintf(`
+    create table if not exists %s (
+      ts timestamp,
+      worker_id text,
+      phase text,
+      files_done bigint,
+      files_total bigint,
+      bytes_done bigint,
+      bytes_total bigint,
+      rate_bps double precision,
+      eta timestamp
+    )
+    `, progress_table()))
+  if err != nil {
+    return err
+  }
+  if err = set_table_access(progress_table()); err != nil {
+    return err
+  }
+
+  go func() {
+    for range time.Tick(progress_interval()) {
+      progress_mu.Lock()
+      var phases []*phase_progress
+      for name, p := range progress {
+        phases = append(phases, p)
+        if !p.active {
+          delete(progress, name)
+        }
+      }
+      progress_mu.Unlock()
+
+      for _, p := range phases {
+        p.report()
+        if len(phases) > 1 {
+          // with phases side by side, say how each is doing
+          p.log()
+        }
+      }
+    }
+  }()
+  return nil
+}
+
+func (p *phase_progress) log() {
+  p.mu.Lock()
+  rate := p.rate
+  p.mu.Unlock()
+  l.Printf("%s: %d of %d files, %d of %d bytes, %.1f MB/s", p.phase, atomic.LoadInt64(&p.files_done), p.files_total,
+    atomic.LoadInt64(&p.bytes_done), p.bytes_total, rate / 1e6)
+}
+
+func (p *phase_progress) report() {
+  p.mu.Lock()
+  done := atomic.LoadInt64(&p.bytes_done)
+  current := float64(done - p.last_bytes) / progress_interval().Seconds()
+  p.last_bytes = done
+  if p.rate == 0 {
+    p.rate = current
+  } else {
+    p.rate = 0.8 * p.rate + 0.2 * current
+  }
+  rate := p.rate
+  p.mu.Unlock()
+
+  var eta interface{}
+  if rate > 0 && p.bytes_total > done {
+    eta = time.Now().Add(time.Duration(float64(p.bytes_total - done) / rate * float64(time.Second)))
+  }
+  _, err := db_exec(fmt.Sprintf("insert into %s (ts, worker_id, phase, files_done, files_total, bytes_done, bytes_total, rate_bps, eta) values (now(), $1, $2, $3, $4, $5, $6, $7, $8)", progress_table()),
+    worker_id, p.phase, atomic.LoadInt64(&p.files_done), p.files_total, done, p.bytes_total, rate, eta)
+  if err != nil {
+    le.Print("error writing progress: ", err)
+  }
+}
+
+// show_status prints the outstanding work and the latest progress reported by each worker
+func show_status() {
+  t := pq.QuoteIdentifier(conf.Table_name)
+  var files, pending_new, pending_old, errors int64
+  var bytes, bytes_new, bytes_old sql.NullInt64
+  err := db.QueryRow(fmt.Sprintf(`select count(*), sum(size),
+      count(*) filter (where hash_new is null and verified_by is null), sum(size) filter (where hash_new is null and verified_by is null),
+      count(*) filter (where hash_old is null), sum(size) filter (where hash_old is null),
+      count(*) filter (where error_new is not null or error_old is not null)
+    from %s`, t)).Scan(&files, &bytes, &pending_new, &bytes_new, &pending_old, &bytes_old, &errors)
+  die_if(err)
+
+  fmt.Printf("files:           %d (%d bytes)\n", files, bytes.Int64)
+  fmt.Printf("pending new:     %d (%d bytes)\n", pending_new, bytes_new.Int64)
+  fmt.Printf("pending old:     %d (%d bytes)\n", pending_old, bytes_old.Int64)
+  fmt.Printf("with errors:     %d\n", errors)
+
+  var exists sql.NullString
+  err = db.QueryRow("select to_regclass($1)::text", conf.Table_name + "_progress").Scan(&exists)
+  die_if(err)
+  if !exists.Valid {
+    return
+  }
+
+  rows, err := db.Query(fmt.Sprintf(`select distinct on (worker_id, phase) worker_id, ts, phase, files_done, files_total, bytes_done, bytes_total, rate_bps, eta
+    from %s where ts > now() - interval '1 day' order by worker_id, phase, ts desc`, progress_table()))
+  die_if(err)
+  defer rows.Close()
+
+  fmt.Println()
+  tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+  fmt.Fprintln(tw, "WORKER\tREPORTED\tPHASE\tFILES\tBYTES\tMB/S\tETA")
+  for rows.Next() {
+    var worker, phase string
+    var ts time.Time
+    var eta pq.NullTime
+    var files_done, files_total, bytes_done, bytes_total int64
+    var rate float64
+    die_if(rows.Scan(&worker, &ts, &phase, &files_done, &files_total, &bytes_done, &bytes_total, &rate, &eta))
+    eta_s := "-"
+    if eta.Valid {
+      eta_s = eta.Time.Format("2006-01-02 15:04")
+    }
+    fmt.Fprintf(tw, "%s\t%s\t%s\t%d/%d\t%d/%d\t%.1f\t%s\n", worker, ts.Format("2006-01-02 15:04:05"), phase,
+      files_done, files_total, bytes_done, bytes_total, rate / 1e6, eta_s)
+  }
+  die_if(rows.Err())
+  tw.Flush()
+}
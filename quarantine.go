@@ -0,0 +1,135 @@
+//
+// Quarantine of mismatched files.
+//
+// With quarantine_dir set, a NEW file whose hash differs from its OLD copy is moved (quarantine_action "move",
+// the default) or copied ("copy") into quarantine_dir under its path relative to new_path, as soon as the
+// mismatch is found, so nothing downstream picks up the damaged copy while it is being dealt with. Where it went
+// and when are recorded in the quarantined and quarantined_at columns. "integrity_check quarantine" does the
+// same for mismatches found before quarantine was configured.
+//
+// Members of archives and files of remote trees are left alone: they can't be moved on their own.
+//
+
+package main
+
+import (
+  "database/sql"
+  "fmt"
+  "io"
+  "os"
+  "path/filepath"
+
+  pq "github.com/lib/pq"
+)
+
+func check_quarantine() error {
+  if conf.Quarantine_dir == "" {
+    return nil
+  }
+  switch conf.Quarantine_action {
+  case "", "move", "copy":
+  default:
+    return fmt.Errorf("unknown quarantine_action %q, expected move or copy", conf.Quarantine_action)
+  }
+  if remotes["new"] != nil {
+    return fmt.Errorf("quarantine_dir can't be used with a remote new_path")
+  }
+  return os.MkdirAll(conf.Quarantine_dir, 0700)
+}
+
+// quarantine_file moves or copies a NEW file into the quarantine directory, and records where it went
+func quarantine_file(file string) error {
+  src := side_path("new", file)
+  dst := filepath.Join(conf.Quarantine_dir, filepath.FromSlash(file))
+  if err := os.MkdirAll(filepath.Dir(dst), 0700); err != nil {
+    return err
+  }
+
+  action := "copied"
+  if conf.Quarantine_action == "copy" {
+    if err := copy_file(src, dst); err != nil {
+      return err
+    }
+  } else {
+    action = "moved"
+    if err := os.Rename(src, dst); err != nil {
+      // another file system: copy, then remove the original
+      if err = copy_file(src, dst); err != nil {
+        return err
+      }
+      if err = os.Remove(src); err != nil {
+        return err
+      }
+    }
+  }
+  lw.Print("QUARANTINE ", file, ": ", action, " to ", dst)
+
+  _, err := db_exec(fmt.Sprintf("update %s set quarantined = $2, quarantined_at = now() where filename = $1", pq.QuoteIdentifier(conf.Table_name)), file, dst)
+  return err
+}
+
+// copy_file copies a file with its permissions and modification time
+func copy_file(src string, dst string) error {
+  in, err := os.Open(src)
+  if err != nil {
+    return err
+  }
+  defer in.Close()
+  fi, err := in.Stat()
+  if err != nil {
+    return err
+  }
+  out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, fi.Mode().Perm())
+  if err != nil {
+    return err
+  }
+  if _, err = io.Copy(out, in); err != nil {
+    out.Close()
+    return err
+  }
+  if err = out.Close(); err != nil {
+    return err
+  }
+  return os.Chtimes(dst, fi.ModTime(), fi.ModTime())
+}
+
+// quarantine_command quarantines every mismatch that hasn't been yet
+func quarantine_command() {
+  if conf.Quarantine_dir == "" {
+    die_if(fmt.Errorf("quarantine_dir is not set"))
+  }
+  mismatched := fmt.Sprintf("from %s where hash_new <> hash_old and archive is null and quarantined is null", pq.QuoteIdentifier(conf.Table_name))
+  mismatched += work_filter()
+
+  pending := 0
+  err := db.QueryRow("select count(*) " + mismatched).Scan(&pending)
+  die_if(err)
+  if pending == 0 {
+    l.Print("no mismatched files to quarantine")
+    return
+  }
+  action := "move"
+  if conf.Quarantine_action == "copy" {
+    action = "copy"
+  }
+  if !confirm(fmt.Sprintf("This will %s %d mismatched files of %s into %s.", action, pending, conf.New_path, conf.Quarantine_dir)) {
+    l.Print("aborted")
+    return
+  }
+
+  n := 0
+  err = each_row("select filename " + mismatched, func(rows *sql.Rows) error {
+    var file string
+    if err := rows.Scan(&file); err != nil {
+      return err
+    }
+    if err := quarantine_file(file); err != nil {
+      le.Print("error quarantining ", file, ": ", err)
+    } else {
+      n++
+    }
+    return nil
+  })
+  die_if(err)
+  l.Print("quarantined ", n, " files")
+}
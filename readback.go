@@ -0,0 +1,108 @@
+//
+// Reading stored hashes back.
+//
+// With "readback": true, every hash stored is read back from the database and compared with the one computed
+// before the file counts as done, against the rare corruption of the hash string on its way through the driver
+// and a long unstable link to the database. A hash that reads back differently is stored again, up to
+// readback_retries times (3 by default); one that never reads back right is removed and the file recorded with
+// an error, so a later run hashes it again rather than anything trusting it.
+//
+// It costs a query per file, or per batch with batch_size. The hashes of the hash workers, of batches and of
+// remote workers (see coordinator.go) are read back.
+//
+
+package main
+
+import (
+  "context"
+  "database/sql"
+  "fmt"
+  "sync/atomic"
+
+  pq "github.com/lib/pq"
+)
+
+// hashes that read back differently from how they were stored, over the life of the process
+var readback_mismatches int64
+
+func readback_retries() int {
+  if conf.Readback_retries > 0 {
+    return conf.Readback_retries
+  }
+  return 3
+}
+
+// read_back returns the indexes of the files whose hash doesn't read back as the one given, with what was read
+func read_back(side string, files []string, hashes []string) ([]int, map[string]string, error) {
+  ctx, cancel := context.WithTimeout(context.Background(), query_timeout())
+  defer cancel()
+  rows, err := db.QueryContext(ctx, fmt.Sprintf("select filename, %s from %s where filename = any($1)",
+    pq.QuoteIdentifier("hash_"+side), pq.QuoteIdentifier(conf.Table_name)), pq.Array(files))
+  if err != nil {
+    return nil, nil, err
+  }
+  defer rows.Close()
+  stored := map[string]string{}
+  for rows.Next() {
+    var file string
+    var hash sql.NullString
+    if err = rows.Scan(&file, &hash); err != nil {
+      return nil, nil, err
+    }
+    stored[file] = hash.String
+  }
+  if err = rows.Err(); err != nil {
+    return nil, nil, err
+  }
+
+  var bad []int
+  for i, file := range files {
+    if stored[file] != hashes[i] {
+      bad = append(bad, i)
+    }
+  }
+  return bad, stored, nil
+}
+
+// confirm_stored reads the hash of a file back, storing it again while it reads back differently. If it can't
+// be read back right, the hash is removed and the error returned is to be recorded for the file.
+func confirm_stored(side string, file string, hash string, by string) error {
+  if !conf.Readback {
+    return nil
+  }
+  err := store_until_read_back(side, file, hash, by)
+  if err != nil {
+    _, rerr := db_exec(fmt.Sprintf("update %s set %s = null, %s = null where filename = $1", pq.QuoteIdentifier(conf.Table_name),
+      pq.QuoteIdentifier("hash_"+side), pq.QuoteIdentifier("hashed_by_"+side)), file)
+    if rerr != nil {
+      le.Print("error removing the hash of ", side, " ", file, ": ", rerr)
+    }
+  }
+  return err
+}
+
+// store_until_read_back stores the hash again while it reads back differently, readback_retries times at most
+func store_until_read_back(side string, file string, hash string, by string) error {
+  table := pq.QuoteIdentifier(conf.Table_name)
+  for attempt := 0; ; attempt++ {
+    bad, stored, err := read_back(side, []string{file}, []string{hash})
+    if err != nil {
+      return fmt.Errorf("adding hash to DB: reading it back: %s", err)
+    }
+    if len(bad) == 0 {
+      return nil
+    }
+    atomic.AddInt64(&readback_mismatches, 1)
+    if attempt == readback_retries() {
+      return fmt.Errorf("adding hash to DB: stored %s, read back as %q every time", hash, stored[file])
+    }
+
+    lw.Print("hash of ", side, " ", file, " read back as ", fmt.Sprintf("%q", stored[file]), " instead of ", hash, ", storing it again")
+    _, err = db_exec(fmt.Sprintf("update %s set %s = $2, %s = null, %s = now(), %s = $3 where filename = $1", table,
+      pq.QuoteIdentifier("hash_"+side), pq.QuoteIdentifier("error_"+side), pq.QuoteIdentifier("hashed_at_"+side), pq.QuoteIdentifier("hashed_by_"+side)),
+      file, hash, by)
+    if err != nil {
+      return fmt.Errorf("adding hash to DB: %s", err)
+    }
+  }
+}
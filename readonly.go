@@ -0,0 +1,36 @@
+//
+// Read-only reporting.
+//
+// With "read_only": true (or -read-only) the tool never issues DDL or writes, so auditors can be given a role
+// with nothing but SELECT on the tables and still run "status", "report" and "premis". Every connection is also
+// opened with default_transaction_read_only, so a write that slips through is refused by the server rather than
+// performed.
+// The tables have to exist already, created by a normal run of the same version.
+//
+
+package main
+
+import (
+  "fmt"
+  "os"
+)
+
+// read_only_commands are the commands that work without writing to the database
+var read_only_commands = map[string]func(args []string){
+  "status": func(args []string) { show_status() },
+  "report": report_command,
+  "premis": premis_command,
+}
+
+func run_read_only(args []string) {
+  if len(args) == 0 {
+    fmt.Fprintln(os.Stderr, "a run needs to write; in read-only mode only status, report and premis are available")
+    os.Exit(2)
+  }
+  run, ok := read_only_commands[args[0]]
+  if !ok {
+    fmt.Fprintf(os.Stderr, "%q is not available in read-only mode; only status, report and premis are\n", args[0])
+    os.Exit(2)
+  }
+  run(args[1:])
+}
@@ -0,0 +1,150 @@
+//
+// Work queue in Redis.
+//
+// With many workers, having each of them query Postgres for its statement of work makes dispatch as slow as the
+// database. With "redis_address" set, one instance per phase fills a Redis list with the outstanding files in
+// groups of 100, and every instance pops its work from there; Postgres stays the durable store, with each file
+// still claimed and its hash stored there. Once the list is drained, instances carry on with the usual query,
+// which picks up whatever the queue missed (files requeued meanwhile, or a filler that died).
+//
+// Keys are integrity_check:<table>:<side>:queue, :filling (held by the filler) and :filled (set for 10 minutes
+// once the list is complete, so a later pass fills it again).
+//
+
+package main
+
+import (
+  "context"
+  "encoding/json"
+  "fmt"
+  "time"
+
+  pq "github.com/lib/pq"
+  "github.com/redis/go-redis/v9"
+)
+
+var rdb *redis.Client
+
+const redis_group = 100
+
+type redis_item struct {
+  Filename string `json:"f"`
+  Size int64 `json:"s"`
+}
+
+func start_redis() error {
+  if conf.Redis_address == "" {
+    return nil
+  }
+  rdb = redis.NewClient(&redis.Options{Addr: conf.Redis_address, Password: conf.Redis_password, DB: conf.Redis_db})
+  return rdb.Ping(context.Background()).Err()
+}
+
+func redis_key(side string, what string) string {
+  return fmt.Sprintf("integrity_check:%s:%s:%s", conf.Table_name, side, what)
+}
+
+// fill_redis pushes the statement of work of a phase into the queue
+func fill_redis(side string, where string, order string) error {
+  ctx := context.Background()
+  if err := rdb.Del(ctx, redis_key(side, "queue")).Err(); err != nil {
+    return err
+  }
+  res, err := db.Query(fmt.Sprintf("select filename, size from %s where %s%s", pq.QuoteIdentifier(conf.Table_name), where, order))
+  if err != nil {
+    return err
+  }
+  defer res.Close()
+
+  var group []redis_item
+  var pushed int
+  push := func() error {
+    b, err := json.Marshal(group)
+    if err != nil {
+      return err
+    }
+    pushed += len(group)
+    group = group[:0]
+    return rdb.RPush(ctx, redis_key(side, "queue"), b).Err()
+  }
+  for res.Next() {
+    var w redis_item
+    if err = res.Scan(&w.Filename, &w.Size); err != nil {
+      return err
+    }
+    group = append(group, w)
+    if len(group) == redis_group {
+      if err = push(); err != nil {
+        return err
+      }
+    }
+  }
+  if err = res.Err(); err != nil {
+    return err
+  }
+  if len(group) > 0 {
+    if err = push(); err != nil {
+      return err
+    }
+  }
+  l.Print("queued ", pushed, " ", side, " files in Redis")
+  if err = rdb.Set(ctx, redis_key(side, "filled"), worker_id, 10*time.Minute).Err(); err != nil {
+    return err
+  }
+  return rdb.Del(ctx, redis_key(side, "filling")).Err()
+}
+
+// redis_phase hashes the files of a phase popped from the queue until it is drained
+func redis_phase(side string, where string, order string, threads int, phase *phase_progress) {
+  ctx := context.Background()
+  to_hash := make(chan []work_item, threads)
+  pool := start_pool(threads, func() error {
+    hash_worker(side, to_hash, phase)
+    return nil
+  })
+  defer func() {
+    close(to_hash)
+    pool.Wait()
+  }()
+
+  for !deadline_passed() {
+    // whoever finds the queue neither filled nor being filled fills it
+    if n, err := rdb.Exists(ctx, redis_key(side, "filled")).Result(); err == nil && n == 0 {
+      if ok, err := rdb.SetNX(ctx, redis_key(side, "filling"), worker_id, time.Hour).Result(); err == nil && ok {
+        go func() {
+          if err := fill_redis(side, where, order); err != nil {
+            le.Print("error filling the Redis queue: ", err)
+          }
+        }()
+      }
+    }
+
+    b, err := rdb.LPop(ctx, redis_key(side, "queue")).Bytes()
+    if err == redis.Nil {
+      n, err := rdb.Exists(ctx, redis_key(side, "filled")).Result()
+      if err == nil && n > 0 {
+        return // drained
+      }
+      filling, err := rdb.Exists(ctx, redis_key(side, "filling")).Result()
+      if err == nil && filling == 0 {
+        return // nobody is filling it: leave it to the database
+      }
+      time.Sleep(time.Second)
+      continue
+    }
+    if err != nil {
+      le.Print("error reading the Redis queue, carrying on from the database: ", err)
+      return
+    }
+    var items []redis_item
+    if err = json.Unmarshal(b, &items); err != nil {
+      l.Print("bad entry in the Redis queue: ", err)
+      continue
+    }
+    group := make([]work_item, len(items))
+    for i, it := range items {
+      group[i] = work_item{it.Filename, it.Size}
+    }
+    to_hash <- group
+  }
+}
@@ -0,0 +1,64 @@
+//
+// Hashes registered by copy pipelines.
+//
+// Movers built on the inline package hash files while copying them and register the hashes in <table>_inline.
+// Before hashing, each run takes those over for the files that are in the state table with the same size and
+// still lack a hash on that side, as long as the file's policy is "full" with neither transforms nor line-ending
+// normalization (the format the inline package produces). Registrations taken over, or made moot by a hash
+// computed since, are removed; the others wait for a later run.
+//
+
+package main
+
+import (
+  "database/sql"
+  "fmt"
+
+  pq "github.com/lib/pq"
+)
+
+func apply_registered() error {
+  exists, err := table_exists(conf.Table_name + "_inline")
+  if err != nil || !exists {
+    return err
+  }
+  t := pq.QuoteIdentifier(conf.Table_name)
+  it := pq.QuoteIdentifier(conf.Table_name + "_inline")
+
+  query := fmt.Sprintf(`select i.filename, i.side, i.hash, t.size from %s i join %s t on t.filename = i.filename and t.size = i.size
+    where (i.side = 'new' and t.hash_new is null) or (i.side = 'old' and t.hash_old is null)`, it, t)
+  taken := 0
+  err = each_row(query, func(rows *sql.Rows) error {
+    var file, side, hash string
+    var size int64
+    if err := rows.Scan(&file, &side, &hash, &size); err != nil {
+      return err
+    }
+    p := policy_for(file, size)
+    if p.Action != "full" || p.Normalize_eol || transformed(side, file) {
+      return nil
+    }
+    // computed by the mover, wherever it ran
+    _, err := db_exec(fmt.Sprintf("update %s set %s = $2, %s = null, %s = now(), %s = 'inline' where filename = $1 and %s is null", t,
+      pq.QuoteIdentifier("hash_"+side), pq.QuoteIdentifier("error_"+side), pq.QuoteIdentifier("hashed_at_"+side), pq.QuoteIdentifier("hashed_by_"+side), pq.QuoteIdentifier("hash_"+side)), file, hash)
+    if err != nil {
+      return err
+    }
+    if _, err = db_exec(fmt.Sprintf("delete from %s where filename = $1 and side = $2", it), file, side); err != nil {
+      return err
+    }
+    after_hash(side, file, nil)
+    taken++
+    return nil
+  })
+  if err != nil {
+    return err
+  }
+  if taken > 0 {
+    l.Print("took over ", taken, " hashes registered by copy pipelines")
+  }
+
+  _, err = db_exec(fmt.Sprintf(`delete from %s i using %s t where t.filename = i.filename
+    and (i.side = 'new' and t.hash_new is not null or i.side = 'old' and t.hash_old is not null)`, it, t))
+  return err
+}
@@ -0,0 +1,168 @@
+//
+// Remote trees.
+//
+// new_path or old_path may name a tree that isn't a local directory; those are walked, listed and read
+// through a remote backend instead of the filesystem:
+//
+//   rclone:<remote>:<path>   any rclone remote (crypt, union, drive, b2, ...), via "rclone lsjson" and "rclone cat"
+//   hdfs://, webhdfs://      HDFS through WebHDFS (see remote_http.go)
+//   dav://, davs://          WebDAV
+//
+
+package main
+
+import (
+  "encoding/json"
+  "fmt"
+  "io"
+  "net/url"
+  "os/exec"
+  "strings"
+  "time"
+)
+
+type remote interface {
+  // walk calls fn for every regular file below the root, with names relative to it
+  walk(fn func(name string, size int64, mtime time.Time) error) error
+  stat(name string) (int64, error)
+  open(name string) (io.ReadCloser, error)
+}
+
+// remotes holds the backend for each side ("new", "old", "replica:<name>") that isn't a local path
+var remotes = map[string]remote{}
+
+func init_remotes() error {
+  roots := map[string]string{"new": conf.New_path, "old": conf.Old_path}
+  for i := range conf.Replicas {
+    roots[replica_side(&conf.Replicas[i])] = conf.Replicas[i].Path
+  }
+  for side, root := range roots {
+    rm, err := remote_for(root)
+    if err != nil {
+      return fmt.Errorf("%s_path: %s", side, err)
+    }
+    if rm != nil {
+      remotes[side] = metered{rm}
+    }
+  }
+  return nil
+}
+
+func remote_for(root string) (remote, error) {
+  if strings.HasPrefix(root, "rclone:") {
+    spec := strings.TrimPrefix(root, "rclone:")
+    if !strings.Contains(spec, ":") {
+      return nil, fmt.Errorf("rclone path must be rclone:<remote>:<path>, got %s", root)
+    }
+    return &rclone_remote{root: strings.TrimSuffix(spec, "/")}, nil
+  }
+
+  u, err := url.Parse(root)
+  if err != nil || u.Host == "" {
+    return nil, nil // a local path
+  }
+  switch u.Scheme {
+  case "hdfs", "webhdfs":
+    return new_webhdfs_remote(u), nil
+  case "dav", "davs":
+    return new_webdav_remote(u), nil
+  }
+  return nil, fmt.Errorf("unsupported remote tree: %s", root)
+}
+
+
+type rclone_remote struct {
+  root string
+}
+
+type rclone_entry struct {
+  Path string
+  Size int64
+  ModTime time.Time
+  IsDir bool
+}
+
+func (r *rclone_remote) command(args ...string) *exec.Cmd {
+  bin := conf.Rclone_binary
+  if bin == "" {
+    bin = "rclone"
+  }
+  return exec.Command(bin, append(strings.Fields(conf.Rclone_flags), args...)...)
+}
+
+func (r *rclone_remote) path(name string) string {
+  if strings.HasSuffix(r.root, ":") {
+    return r.root + name
+  }
+  return r.root + "/" + name
+}
+
+func (r *rclone_remote) walk(fn func(name string, size int64, mtime time.Time) error) error {
+  cmd := r.command("lsjson", "-R", "--files-only", r.root)
+  out, err := cmd.StdoutPipe()
+  if err != nil {
+    return err
+  }
+  if err = cmd.Start(); err != nil {
+    return err
+  }
+
+  // the listing is one big JSON array; decode it element by element rather than all at once
+  js := json.NewDecoder(out)
+  if _, err = js.Token(); err != nil {
+    cmd.Wait()
+    return fmt.Errorf("rclone lsjson: %s", err)
+  }
+  for js.More() {
+    var e rclone_entry
+    if err = js.Decode(&e); err != nil {
+      cmd.Wait()
+      return fmt.Errorf("rclone lsjson: %s", err)
+    }
+    if e.IsDir {
+      continue
+    }
+    if err = fn(e.Path, e.Size, e.ModTime); err != nil {
+      cmd.Process.Kill()
+      cmd.Wait()
+      return err
+    }
+  }
+  io.Copy(io.Discard, out)
+  return cmd.Wait()
+}
+
+func (r *rclone_remote) stat(name string) (int64, error) {
+  out, err := r.command("lsjson", "--files-only", r.path(name)).Output()
+  if err != nil {
+    return 0, fmt.Errorf("rclone lsjson %s: %s", name, err)
+  }
+  var entries []rclone_entry
+  if err = json.Unmarshal(out, &entries); err != nil {
+    return 0, err
+  }
+  if len(entries) != 1 {
+    return 0, fmt.Errorf("rclone lsjson %s: file not found", name)
+  }
+  return entries[0].Size, nil
+}
+
+func (r *rclone_remote) open(name string) (io.ReadCloser, error) {
+  cmd := r.command("cat", r.path(name))
+  out, err := cmd.StdoutPipe()
+  if err != nil {
+    return nil, err
+  }
+  var stderr strings.Builder
+  cmd.Stderr = &stderr
+  if err = cmd.Start(); err != nil {
+    return nil, err
+  }
+  return &chained_reader{Reader: out, close: func() error {
+    io.Copy(io.Discard, out)
+    if err := cmd.Wait(); err != nil {
+      return fmt.Errorf("rclone cat %s: %s: %s", name, err, strings.TrimSpace(stderr.String()))
+    }
+    return nil
+  }}, nil
+}
@@ -0,0 +1,300 @@
+//
+// HTTP-based remote trees:
+//
+//   hdfs://<namenode>[:port]/<path>      HDFS via the WebHDFS REST API (port defaults to webhdfs_port, or 9870)
+//   webhdfs://<namenode>:<port>/<path>   same, with an explicit WebHDFS port
+//   dav://[user:pass@]<host>/<path>      WebDAV over http (davs:// for https)
+//
+// Every request has a connect/response timeout, and a body that stalls for remote_timeout seconds is aborted,
+// so a hung server shows up as a read error on that file instead of a hung hasher.
+//
+
+package main
+
+import (
+  "context"
+  "encoding/json"
+  "encoding/xml"
+  "fmt"
+  "io"
+  "net"
+  "net/http"
+  "net/url"
+  "path"
+  "strconv"
+  "strings"
+  "time"
+)
+
+func remote_timeout() time.Duration {
+  if conf.Remote_timeout > 0 {
+    return time.Duration(conf.Remote_timeout) * time.Second
+  }
+  return 60 * time.Second
+}
+
+var http_client = &http.Client{
+  Transport: &http.Transport{
+    Proxy: http.ProxyFromEnvironment,
+    DialContext: (&net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second}).DialContext,
+    TLSHandshakeTimeout: 30 * time.Second,
+    ResponseHeaderTimeout: 5 * time.Minute,
+    MaxIdleConnsPerHost: 16,
+  },
+}
+
+// http_do issues a request whose body is cancelled if no data arrives for remote_timeout()
+func http_do(method string, u string, header http.Header, body io.Reader) (*http.Response, error) {
+  ctx, cancel := context.WithCancel(context.Background())
+  req, err := http.NewRequestWithContext(ctx, method, u, body)
+  if err != nil {
+    cancel()
+    return nil, err
+  }
+  for k, v := range header {
+    req.Header[k] = v
+  }
+  res, err := http_client.Do(req)
+  if err != nil {
+    cancel()
+    return nil, err
+  }
+  if res.StatusCode >= 300 {
+    msg, _ := io.ReadAll(io.LimitReader(res.Body, 1024))
+    res.Body.Close()
+    cancel()
+    return nil, fmt.Errorf("%s %s: %s: %s", method, u, res.Status, strings.TrimSpace(string(msg)))
+  }
+  res.Body = &idle_body{ReadCloser: res.Body, timer: time.AfterFunc(remote_timeout(), cancel), cancel: cancel}
+  return res, nil
+}
+
+type idle_body struct {
+  io.ReadCloser
+  timer *time.Timer
+  cancel context.CancelFunc
+}
+
+func (b *idle_body) Read(p []byte) (int, error) {
+  b.timer.Reset(remote_timeout())
+  return b.ReadCloser.Read(p)
+}
+
+func (b *idle_body) Close() error {
+  b.timer.Stop()
+  b.cancel()
+  return b.ReadCloser.Close()
+}
+
+
+type webhdfs_remote struct {
+  base string // http://namenode:port/webhdfs/v1
+  root string
+}
+
+type webhdfs_status struct {
+  PathSuffix string `json:"pathSuffix"`
+  Type string `json:"type"`
+  Length int64 `json:"length"`
+  ModificationTime int64 `json:"modificationTime"`
+}
+
+func new_webhdfs_remote(u *url.URL) *webhdfs_remote {
+  host := u.Host
+  if u.Scheme == "hdfs" {
+    port := conf.Webhdfs_port
+    if port == 0 {
+      port = 9870
+    }
+    host = fmt.Sprintf("%s:%d", u.Hostname(), port)
+  }
+  return &webhdfs_remote{base: "http://" + host + "/webhdfs/v1", root: path.Clean("/" + u.Path)}
+}
+
+func (r *webhdfs_remote) call(p string, op string, out interface{}) error {
+  q := url.Values{"op": {op}}
+  if conf.Hdfs_user != "" {
+    q.Set("user.name", conf.Hdfs_user)
+  }
+  res, err := http_do("GET", r.base + (&url.URL{Path: p}).EscapedPath() + "?" + q.Encode(), nil, nil)
+  if err != nil {
+    return err
+  }
+  defer res.Body.Close()
+  return json.NewDecoder(res.Body).Decode(out)
+}
+
+func (r *webhdfs_remote) walk(fn func(name string, size int64, mtime time.Time) error) error {
+  dirs := []string{""}
+  for len(dirs) > 0 {
+    dir := dirs[0]
+    dirs = dirs[1:]
+
+    var list struct {
+      FileStatuses struct {
+        FileStatus []webhdfs_status
+      }
+    }
+    if err := r.call(path.Join(r.root, dir), "LISTSTATUS", &list); err != nil {
+      return err
+    }
+    for _, st := range list.FileStatuses.FileStatus {
+      name := path.Join(dir, st.PathSuffix)
+      switch st.Type {
+      case "DIRECTORY":
+        dirs = append(dirs, name)
+      case "FILE":
+        if err := fn(name, st.Length, time.UnixMilli(st.ModificationTime)); err != nil {
+          return err
+        }
+      }
+    }
+  }
+  return nil
+}
+
+func (r *webhdfs_remote) stat(name string) (int64, error) {
+  var st struct {
+    FileStatus webhdfs_status
+  }
+  if err := r.call(path.Join(r.root, name), "GETFILESTATUS", &st); err != nil {
+    return 0, err
+  }
+  return st.FileStatus.Length, nil
+}
+
+func (r *webhdfs_remote) open(name string) (io.ReadCloser, error) {
+  q := url.Values{"op": {"OPEN"}}
+  if conf.Hdfs_user != "" {
+    q.Set("user.name", conf.Hdfs_user)
+  }
+  // the namenode redirects to a datanode holding the blocks
+  res, err := http_do("GET", r.base + (&url.URL{Path: path.Join(r.root, name)}).EscapedPath() + "?" + q.Encode(), nil, nil)
+  if err != nil {
+    return nil, err
+  }
+  return res.Body, nil
+}
+
+
+type webdav_remote struct {
+  base url.URL
+}
+
+type dav_multistatus struct {
+  Responses []struct {
+    Href string `xml:"href"`
+    Props []struct {
+      Status string `xml:"status"`
+      Length string `xml:"prop>getcontentlength"`
+      Modified string `xml:"prop>getlastmodified"`
+      Collection *struct{} `xml:"prop>resourcetype>collection"`
+    } `xml:"propstat"`
+  } `xml:"response"`
+}
+
+const dav_propfind = `<?xml version="1.0" encoding="utf-8"?>
+<propfind xmlns="DAV:"><prop><getcontentlength/><getlastmodified/><resourcetype/></prop></propfind>`
+
+func new_webdav_remote(u *url.URL) *webdav_remote {
+  base := *u
+  base.Scheme = "http"
+  if u.Scheme == "davs" {
+    base.Scheme = "https"
+  }
+  base.Path = strings.TrimSuffix(base.Path, "/") + "/"
+  return &webdav_remote{base: base}
+}
+
+func (r *webdav_remote) url(name string) string {
+  u := r.base
+  u.Path += name
+  u.User = nil
+  return u.String()
+}
+
+func (r *webdav_remote) header() http.Header {
+  h := http.Header{}
+  if r.base.User != nil {
+    pass, _ := r.base.User.Password()
+    req := &http.Request{Header: h}
+    req.SetBasicAuth(r.base.User.Username(), pass)
+  }
+  return h
+}
+
+func (r *webdav_remote) propfind(name string, depth string) (*dav_multistatus, error) {
+  h := r.header()
+  h.Set("Depth", depth)
+  h.Set("Content-Type", "application/xml")
+  res, err := http_do("PROPFIND", r.url(name), h, strings.NewReader(dav_propfind))
+  if err != nil {
+    return nil, err
+  }
+  defer res.Body.Close()
+  ms := &dav_multistatus{}
+  return ms, xml.NewDecoder(res.Body).Decode(ms)
+}
+
+func (r *webdav_remote) walk(fn func(name string, size int64, mtime time.Time) error) error {
+  dirs := []string{""}
+  for len(dirs) > 0 {
+    dir := dirs[0]
+    dirs = dirs[1:]
+
+    ms, err := r.propfind(dir, "1")
+    if err != nil {
+      return err
+    }
+    for _, resp := range ms.Responses {
+      // parsed before decoding, so an escaped "?", "#" or "%" in a name stays part of the path
+      u, err := url.Parse(resp.Href)
+      if err != nil {
+        return err
+      }
+      name := strings.Trim(strings.TrimPrefix(u.Path, r.base.Path), "/")
+      if name == strings.Trim(dir, "/") {
+        continue // the directory itself
+      }
+      for _, p := range resp.Props {
+        if !strings.Contains(p.Status, " 200 ") {
+          continue
+        }
+        if p.Collection != nil {
+          dirs = append(dirs, name + "/")
+          break
+        }
+        size, _ := strconv.ParseInt(p.Length, 10, 64)
+        mtime, _ := http.ParseTime(p.Modified)
+        if err := fn(name, size, mtime); err != nil {
+          return err
+        }
+        break
+      }
+    }
+  }
+  return nil
+}
+
+func (r *webdav_remote) stat(name string) (int64, error) {
+  ms, err := r.propfind(name, "0")
+  if err != nil {
+    return 0, err
+  }
+  for _, resp := range ms.Responses {
+    for _, p := range resp.Props {
+      if strings.Contains(p.Status, " 200 ") && p.Length != "" {
+        return strconv.ParseInt(p.Length, 10, 64)
+      }
+    }
+  }
+  return 0, fmt.Errorf("no size for %s", name)
+}
+
+func (r *webdav_remote) open(name string) (io.ReadCloser, error) {
+  res, err := http_do("GET", r.url(name), r.header(), nil)
+  if err != nil {
+    return nil, err
+  }
+  return res.Body, nil
+}
@@ -0,0 +1,137 @@
+//
+// N-way comparison across additional replicas.
+//
+// Besides new_path and old_path, any number of further copies can be listed:
+//
+//   "replicas": [ { "name": "tape", "path": "/mnt/replica3" } ]
+//
+// Their hashes go to the normalized table <table>_replicas (filename, replica, hash, error), one row per file
+// and replica, using the same filenames and policies as NEW. The report then takes a majority vote over all
+// trees for every file and names the ones that diverged.
+//
+
+package main
+
+import (
+  "fmt"
+
+  pq "github.com/lib/pq"
+)
+
+type replica struct {
+  Name string `json:"name"`
+  Path string `json:"path"`
+}
+
+func replicas_table() string {
+  return pq.QuoteIdentifier(conf.Table_name + "_replicas")
+}
+
+func replica_side(r *replica) string {
+  return "replica:" + r.Name
+}
+
+func create_replicas_table() error {
+  _, err := db.Exec(fmt.Sprintf(`
+    create table if not exists %s (
+      filename text,
+      replica text,
+      hash text,
+      error text,
+      primary key (filename, replica)
+    )
+    `, replicas_table()))
+  if err != nil {
+    return err
+  }
+  for _, col := range []string{"hashed_at timestamp", "hashed_by text"} {
+    if _, err = db.Exec(fmt.Sprintf("alter table %s add column if not exists %s", replicas_table(), col)); err != nil {
+      return err
+    }
+  }
+  return set_table_access(replicas_table())
+}
+
+// replica_phase hashes the files of one replica that don't have a hash for it yet
+func replica_phase(r *replica) {
+  side := replica_side(r)
+  l.Print("building hashes in replica ", r.Name)
+
+  query := fmt.Sprintf("select filename, size from %s t where not exists (select 1 from %s r where r.filename = t.filename and r.replica = $1 and r.hash is not null)",
+    pq.QuoteIdentifier(conf.Table_name), replicas_table())
+  query += work_filter()
+
+  var files, bytes int64
+  err := db.QueryRow("select count(*), coalesce(sum(size), 0) from (" + query + ") w", r.Name).Scan(&files, &bytes)
+  die_if(err)
+  phase := start_phase("hash_" + side, files, bytes)
+  defer phase.finish()
+
+  res, err := db.Query(query, r.Name)
+  die_if(err)
+
+  store := fmt.Sprintf(`insert into %s (filename, replica, hash, error, hashed_at, hashed_by) values ($1, $2, $3, $4, now(), $5)
+    on conflict (filename, replica) do update set hash = excluded.hash, error = excluded.error, hashed_at = excluded.hashed_at, hashed_by = excluded.hashed_by`, replicas_table())
+
+  // a replica is hashed like NEW, as many files at a time, once the other phases are done
+  threads := hash_threads("new")
+  to_hash := make(chan work_item, threads)
+  pool := start_pool(threads, func() error {
+    for w := range to_hash {
+      p := policy_for(w.filename, w.size)
+      if p.Action == "skip" {
+        continue
+      }
+      pause_gate.wait()
+      if deadline_passed() {
+        continue
+      }
+      hash, err := compute_hash(side, w.filename, p)
+      if err != nil {
+        le.Print("error hashing ", side, " ", w.filename, ": ", err)
+        breaker.failure()
+        _, err = db_exec(store, w.filename, r.Name, nil, err.Error(), worker_id)
+      } else {
+        _, err = db_exec(store, w.filename, r.Name, hash, nil, worker_id)
+        phase.done(w.size)
+      }
+      if err != nil {
+        le.Print("error adding hash to DB: ", err)
+      }
+    }
+    return nil
+  })
+
+  for res.Next() && !deadline_passed() {
+    var w work_item
+    die_if(res.Scan(&w.filename, &w.size))
+    to_hash <- w
+  }
+  die_if(res.Err())
+  res.Close()
+  close(to_hash)
+  pool.Wait()
+}
+
+// majority returns the hash most trees agree on, how many do, and which trees differ from it.
+// Trees without a hash (not yet hashed, or unreadable) don't vote.
+func majority(trees []string, hashes []*string) (string, int, []string) {
+  votes := map[string]int{}
+  best, count := "", 0
+  for _, h := range hashes {
+    if h == nil {
+      continue
+    }
+    votes[*h]++
+    if votes[*h] > count {
+      best, count = *h, votes[*h]
+    }
+  }
+  var diverged []string
+  for i, h := range hashes {
+    if h != nil && *h != best {
+      diverged = append(diverged, trees[i])
+    }
+  }
+  return best, count, diverged
+}
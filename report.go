@@ -0,0 +1,170 @@
+//
+// Comparison report.
+//
+// "integrity_check report [-o file] [-summary file]" writes a summary of the state table followed by one tab-separated line
+// per problem: files whose NEW and OLD hashes differ, files that could not be hashed on either side, and, with
+// replicas configured, files on which the trees don't all agree, with the majority hash and the diverging trees.
+// Mismatches of files with content-defined chunk fingerprints on both sides also show which byte ranges differ,
+// and diagnosed mismatches show the first differing offset. The summary groups the mismatches to bring out
+// what they have in common, and the errors by cause and directory (see analytics.go). Rows come from a server-side cursor and lines are written as they
+// come, so the client's memory doesn't grow with the size of the table.
+//
+
+package main
+
+import (
+  "bufio"
+  "database/sql"
+  "flag"
+  "fmt"
+  "io"
+
+  pq "github.com/lib/pq"
+)
+
+func report_command(args []string) {
+  fs := flag.NewFlagSet("report", flag.ExitOnError)
+  out := fs.String("o", "", "Write the report to this file instead of stdout")
+  summary := fs.String("summary", "", "Also write a summary of the top mismatches to this file")
+  top := fs.Int("top", 20, "Number of entries in each section of the summary")
+  fs.Parse(args)
+
+  if *summary != "" {
+    fd, err := create_output(*summary)
+    die_if(err)
+    bw := bufio.NewWriter(fd)
+    die_if(write_summary(bw, *top))
+    die_if(bw.Flush())
+    die_if(fd.Close())
+  }
+
+  fd, err := create_output(*out)
+  die_if(err)
+  bw := bufio.NewWriter(fd)
+  problems := write_report(bw)
+  die_if(bw.Flush())
+  die_if(fd.Close())
+  l.Print("report complete: ", problems, " problems")
+}
+
+// write_report writes the report and returns the number of problem lines
+func write_report(w io.Writer) int64 {
+  t := pq.QuoteIdentifier(conf.Table_name)
+
+  var files, matched, mismatched, pending, errors int64
+  err := db.QueryRow(fmt.Sprintf(`select count(*),
+      count(*) filter (where hash_new = hash_old),
+      count(*) filter (where hash_new <> hash_old),
+      count(*) filter (where (hash_new is null and verified_by is null or hash_old is null) and error_new is null and error_old is null),
+      count(*) filter (where error_new is not null or error_old is not null)
+    from %s`, t)).Scan(&files, &matched, &mismatched, &pending, &errors)
+  die_if(err)
+
+  fmt.Fprintf(w, "# integrity_check %s\n", build_version())
+  fmt.Fprintf(w, "# table %s: %d files, %d match, %d mismatch, %d errors, %d pending\n", conf.Table_name, files, matched, mismatched, errors, pending)
+  if conf.Detect_mime && mismatched > 0 {
+    write_mime_breakdown(w)
+  }
+  if mismatched > 0 {
+    write_mismatch_patterns(w, mismatched)
+  }
+  if errors > 0 {
+    write_error_patterns(w)
+  }
+
+  var problems int64
+  err = each_row(fmt.Sprintf(`select filename, size, hash_new, hash_old, error_new, error_old, cdc_new, cdc_old, diff_context from %s
+    where hash_new <> hash_old or error_new is not null or error_old is not null order by filename`, t), func(rows *sql.Rows) error {
+    var file string
+    var size int64
+    var hash_new, hash_old, error_new, error_old, context sql.NullString
+    var cdc_new, cdc_old []byte
+    if err := rows.Scan(&file, &size, &hash_new, &hash_old, &error_new, &error_old, &cdc_new, &cdc_old, &context); err != nil {
+      return err
+    }
+    switch {
+    case error_new.Valid && conf.Smb:
+      fmt.Fprintf(w, "%s_NEW\t%s\t%d\t%s\n", error_class(error_new.String), file, size, error_new.String)
+    case error_old.Valid && conf.Smb:
+      fmt.Fprintf(w, "%s_OLD\t%s\t%d\t%s\n", error_class(error_old.String), file, size, error_old.String)
+    case error_new.Valid:
+      fmt.Fprintf(w, "ERROR_NEW\t%s\t%d\t%s\n", file, size, error_new.String)
+    case error_old.Valid:
+      fmt.Fprintf(w, "ERROR_OLD\t%s\t%d\t%s\n", file, size, error_old.String)
+    default:
+      fmt.Fprintf(w, "MISMATCH\t%s\t%d\tnew=%s old=%s", file, size, hash_new.String, hash_old.String)
+      if cdc_new != nil && cdc_old != nil {
+        fmt.Fprintf(w, "\t%s", cdc_diff(cdc_new, cdc_old))
+      }
+      if context.Valid {
+        fmt.Fprintf(w, "\t%s", context.String)
+      }
+      fmt.Fprintln(w)
+    }
+    problems++
+    return nil
+  })
+  die_if(err)
+
+  if len(conf.Replicas) > 0 {
+    problems += write_replica_report(w)
+  }
+  if conf.Btime {
+    problems += write_btime_report(w)
+  }
+  if conf.Compare_mtime {
+    problems += write_mtime_report(w)
+  }
+  if conf.Worm_side != "" {
+    problems += write_worm_report(w)
+  }
+  problems += write_copy_log_report(w)
+  write_sparse_report(w)
+  return problems
+}
+
+func write_replica_report(w io.Writer) int64 {
+  trees := []string{"new", "old"}
+  for _, r := range conf.Replicas {
+    trees = append(trees, r.Name)
+  }
+
+  var problems int64
+  err := each_row(fmt.Sprintf(`select t.filename, t.hash_new, t.hash_old, array_agg(r.replica), array_agg(r.hash)
+    from %s t left join %s r on r.filename = t.filename
+    group by t.filename, t.hash_new, t.hash_old order by t.filename`, pq.QuoteIdentifier(conf.Table_name), replicas_table()), func(rows *sql.Rows) error {
+    var file string
+    var hash_new, hash_old sql.NullString
+    var names, hashes []sql.NullString
+    if err := rows.Scan(&file, &hash_new, &hash_old, pq.Array(&names), pq.Array(&hashes)); err != nil {
+      return err
+    }
+
+    votes := make([]*string, len(trees))
+    if hash_new.Valid {
+      votes[0] = &hash_new.String
+    }
+    if hash_old.Valid {
+      votes[1] = &hash_old.String
+    }
+    for i := range names {
+      if !names[i].Valid || !hashes[i].Valid {
+        continue
+      }
+      for j := 2; j < len(trees); j++ {
+        if trees[j] == names[i].String {
+          votes[j] = &hashes[i].String
+        }
+      }
+    }
+
+    best, count, diverged := majority(trees, votes)
+    if len(diverged) > 0 {
+      fmt.Fprintf(w, "DIVERGED\t%s\tmajority=%s (%d of %d)\t%v\n", file, best, count, len(trees), diverged)
+      problems++
+    }
+    return nil
+  })
+  die_if(err)
+  return problems
+}
@@ -0,0 +1,151 @@
+//
+// requeue: mark a subset of rows for re-hashing.
+//
+//   integrity_check requeue [-side new|old|both] [-prefix path] [-status error|mismatch|match|drift]
+//                           [-older-than 30d] [-hashed-by host[:pid]] [-list file] [-dry-run]
+//
+// Filters combine: only rows matching all of them are requeued. -prefix takes a path relative to the tree root
+// or below new_path; -older-than looks at when the hash was stored; -hashed-by at the process that computed it
+// (hashed_by_new/old, "host:pid"), e.g. to verify again what a host later found to have faulty memory hashed;
+// -list reads one filename per line.
+//
+
+package main
+
+import (
+  "bufio"
+  "flag"
+  "fmt"
+  "os"
+  "strconv"
+  "strings"
+  "time"
+
+  pq "github.com/lib/pq"
+)
+
+// parse_age accepts Go durations ("36h") and days ("30d")
+func parse_age(s string) (time.Duration, error) {
+  if strings.HasSuffix(s, "d") {
+    days, err := strconv.Atoi(strings.TrimSuffix(s, "d"))
+    return time.Duration(days) * 24 * time.Hour, err
+  }
+  return time.ParseDuration(s)
+}
+
+func requeue_command(args []string) {
+  fs := flag.NewFlagSet("requeue", flag.ExitOnError)
+  side := fs.String("side", "both", "Which hashes to clear: new, old or both")
+  prefix := fs.String("prefix", "", "Only files under this path")
+  status := fs.String("status", "", "Only files that are: error, mismatch, match or drift (changed since baseline)")
+  older := fs.String("older-than", "", "Only files whose hash was stored longer ago than this (e.g. 30d, 12h)")
+  list := fs.String("list", "", "Only the files listed in this file, one per line")
+  hashed_by := fs.String("hashed-by", "", "Only files hashed by this host, or host:pid for one process")
+  dry_run := fs.Bool("dry-run", false, "Only count the matching rows")
+  fs.Parse(args)
+
+  sides := []string{"new", "old"}
+  switch *side {
+  case "new", "old":
+    sides = []string{*side}
+  case "both":
+  default:
+    die_if(fmt.Errorf("-side must be new, old or both"))
+  }
+
+  var conds []string
+  var params []interface{}
+  param := func(v interface{}) string {
+    params = append(params, v)
+    return fmt.Sprintf("$%d", len(params))
+  }
+
+  if *prefix != "" {
+    p := strings.TrimPrefix(strings.TrimPrefix(*prefix, conf.New_path), "/")
+    p = strings.TrimSuffix(p, "/") + "/"
+    conds = append(conds, fmt.Sprintf("left(filename, length(%s)) = %s", param(p), param(p)))
+  }
+
+  switch *status {
+  case "":
+  case "error":
+    conds = append(conds, "(error_new is not null or error_old is not null)")
+  case "mismatch":
+    conds = append(conds, "hash_new <> hash_old")
+  case "match":
+    conds = append(conds, "hash_new = hash_old")
+  case "drift":
+    conds = append(conds, "verify_status = 'drift'")
+  default:
+    die_if(fmt.Errorf("unknown -status: %s", *status))
+  }
+
+  if *older != "" {
+    age, err := parse_age(*older)
+    die_if(err)
+    cutoff := param(time.Now().Add(-age))
+    var c []string
+    for _, s := range sides {
+      c = append(c, fmt.Sprintf("hashed_at_%s < %s", s, cutoff))
+    }
+    conds = append(conds, "(" + strings.Join(c, " or ") + ")")
+  }
+
+  if *hashed_by != "" {
+    // a host matches its processes, here or working for a coordinator
+    by := param(*hashed_by)
+    var c []string
+    for _, s := range sides {
+      c = append(c, fmt.Sprintf("(hashed_by_%s = %s or left(hashed_by_%s, length(%s) + 1) = %s || ':')", s, by, s, by, by))
+    }
+    conds = append(conds, "(" + strings.Join(c, " or ") + ")")
+  }
+
+  if *list != "" {
+    fd, err := os.Open(*list)
+    die_if(err)
+    var files []string
+    scanner := bufio.NewScanner(fd)
+    for scanner.Scan() {
+      if f := strings.TrimPrefix(strings.TrimPrefix(strings.TrimSpace(scanner.Text()), conf.New_path), "/"); f != "" {
+        files = append(files, f)
+      }
+    }
+    die_if(scanner.Err())
+    fd.Close()
+    conds = append(conds, fmt.Sprintf("filename = any(%s)", param(pq.Array(files))))
+  }
+
+  if len(conds) == 0 {
+    die_if(fmt.Errorf("requeue needs at least one filter; use \"reset\" to requeue everything"))
+  }
+  where := strings.Join(conds, " and ")
+  t := pq.QuoteIdentifier(conf.Table_name)
+
+  var rows int64
+  err := db.QueryRow(fmt.Sprintf("select count(*) from %s where %s", t, where), params...).Scan(&rows)
+  die_if(err)
+  if *dry_run || rows == 0 {
+    l.Print(rows, " rows match")
+    return
+  }
+  if !confirm(fmt.Sprintf("This will clear the %s hashes of %d rows in table %s.", strings.Join(sides, " and "), rows, conf.Table_name)) {
+    l.Print("aborted")
+    return
+  }
+
+  var set []string
+  for _, s := range sides {
+    set = append(set, fmt.Sprintf("hash_%s = null, error_%s = null, hashed_at_%s = null, hashed_by_%s = null", s, s, s, s))
+    if s == "new" {
+      set = append(set, "verified_by = null, verify_status = null")
+    }
+  }
+  res, err := db.Exec(fmt.Sprintf("update %s set %s, status = null, claimed_by = null, claimed_at = null where %s", t, strings.Join(set, ", "), where), params...)
+  die_if(err)
+  n, err := res.RowsAffected()
+  die_if(err)
+  l.Print("requeued ", n, " rows")
+
+  die_if(notify_event("work"))
+}
@@ -0,0 +1,65 @@
+//
+// reset: clear results so they get recomputed.
+//
+//   integrity_check reset new      forget all NEW hashes (and NEW-side metadata and errors)
+//   integrity_check reset old      forget all OLD hashes
+//   integrity_check reset errors   clear the errors of failed files, so they are retried
+//   integrity_check reset all      delete the whole run: every row of the state table
+//
+
+package main
+
+import (
+  "fmt"
+
+  pq "github.com/lib/pq"
+)
+
+func reset_command(scope string) {
+  t := pq.QuoteIdentifier(conf.Table_name)
+  var update, where string
+
+  switch scope {
+  case "new":
+    update = "hash_new = null, error_new = null, hashed_at_new = null, hashed_by_new = null, verified_by = null, dos_attrs_new = null, streams_new = null, mime = null, verify_status = null, verified_at = null, " +
+      "chunks_new = null, cdc_new = null, btime_new = null, first_diff = null, diff_context = null, verdict = null, verdict_at = null"
+    where = "hash_new is not null or error_new is not null or verified_by is not null"
+  case "old":
+    update = "hash_old = null, error_old = null, hashed_at_old = null, hashed_by_old = null, dos_attrs_old = null, streams_old = null, " +
+      "chunks_old = null, cdc_old = null, btime_old = null, changed_old = null, blocks_old = null, first_diff = null, diff_context = null, verdict = null, verdict_at = null"
+    where = "hash_old is not null or error_old is not null"
+  case "errors":
+    update = "error_new = null, error_old = null"
+    where = "error_new is not null or error_old is not null"
+  case "all":
+    var companions []string
+    if len(conf.Replicas) > 0 {
+      companions = append(companions, replicas_table())
+    }
+    truncate_table(companions...)
+    return
+  default:
+    die_if(fmt.Errorf("reset needs a scope: new, old, errors or all"))
+  }
+
+  var rows int64
+  err := db.QueryRow(fmt.Sprintf("select count(*) from %s where %s", t, where)).Scan(&rows)
+  die_if(err)
+  if rows == 0 {
+    l.Print("nothing to reset")
+    return
+  }
+  if !confirm(fmt.Sprintf("This will clear %s results of %d rows in table %s.", scope, rows, conf.Table_name)) {
+    l.Print("aborted")
+    return
+  }
+
+  res, err := db.Exec(fmt.Sprintf("update %s set %s, status = null, claimed_by = null, claimed_at = null where %s", t, update, where))
+  die_if(err)
+  n, err := res.RowsAffected()
+  die_if(err)
+  l.Print("reset ", scope, " results of ", n, " rows")
+
+  // wake up idle workers
+  die_if(notify_event("work"))
+}
@@ -0,0 +1,50 @@
+//
+// Staying out of the way of production.
+//
+// To run continuously on a file server without users noticing:
+//
+//   "nice": 19                   lower CPU priority (0 to 19)
+//   "io_class": "idle"           I/O scheduling class, "idle" or "best-effort", with "io_priority" 0-7 for the latter
+//   "max_procs": 2               cap on the CPUs used for hashing (GOMAXPROCS)
+//   "memory_limit_mb": 512       soft memory limit for the Go runtime
+//   "hash_memory_mb": 256        budget of the buffers the hash workers read into (see memory.go)
+//
+// Without memory_limit_mb, the limit of the cgroup the process runs in is used, with some headroom. CPU and I/O
+// priorities are only available on Linux; elsewhere they are ignored with a warning.
+//
+
+package main
+
+import (
+  "os"
+  "runtime"
+  "runtime/debug"
+  "strconv"
+  "strings"
+)
+
+func apply_resource_limits() error {
+  if conf.Max_procs > 0 {
+    runtime.GOMAXPROCS(conf.Max_procs)
+  }
+
+  limit := int64(conf.Memory_limit_mb) << 20
+  if limit == 0 {
+    // cgroup v2; leave 10% for what the runtime doesn't account for
+    if b, err := os.ReadFile("/sys/fs/cgroup/memory.max"); err == nil {
+      if n, err := strconv.ParseInt(strings.TrimSpace(string(b)), 10, 64); err == nil {
+        limit = n / 10 * 9
+      }
+    }
+  }
+  if limit > 0 {
+    debug.SetMemoryLimit(limit)
+    l.Print("memory limit ", limit >> 20, " MiB")
+  }
+  set_hash_memory()
+
+  if conf.Nice != 0 || conf.Io_class != "" {
+    return set_priorities()
+  }
+  return nil
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+  "fmt"
+  "os"
+  "strconv"
+  "syscall"
+
+  "golang.org/x/sys/unix"
+)
+
+const ioprio_class_shift = 13
+
+// set_priorities applies nice and the I/O class to every thread of the process. Linux keeps both per thread,
+// and threads started later inherit them from the thread that starts them.
+func set_priorities() error {
+  var ioprio int
+  switch conf.Io_class {
+  case "":
+  case "idle":
+    ioprio = 3 << ioprio_class_shift
+  case "best-effort":
+    if conf.Io_priority < 0 || conf.Io_priority > 7 {
+      return fmt.Errorf("io_priority must be from 0 to 7")
+    }
+    ioprio = 2 << ioprio_class_shift | conf.Io_priority
+  default:
+    return fmt.Errorf("unknown io_class %q, expected idle or best-effort", conf.Io_class)
+  }
+
+  tasks, err := os.ReadDir("/proc/self/task")
+  if err != nil {
+    return err
+  }
+  for _, t := range tasks {
+    tid, err := strconv.Atoi(t.Name())
+    if err != nil {
+      continue
+    }
+    if conf.Nice != 0 {
+      if err = syscall.Setpriority(syscall.PRIO_PROCESS, tid, conf.Nice); err != nil {
+        return fmt.Errorf("setting nice: %s", err)
+      }
+    }
+    if ioprio != 0 {
+      if _, _, errno := unix.Syscall(unix.SYS_IOPRIO_SET, 1, uintptr(tid), uintptr(ioprio)); errno != 0 {
+        return fmt.Errorf("setting I/O class: %s", errno)
+      }
+    }
+  }
+  l.Print("running at nice ", conf.Nice, ", I/O class ", conf.Io_class)
+  return nil
+}
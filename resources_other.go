@@ -0,0 +1,8 @@
+//go:build !linux
+
+package main
+
+func set_priorities() error {
+  l.Print("nice and io_class are only supported on Linux; ignoring them")
+  return nil
+}
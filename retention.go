@@ -0,0 +1,241 @@
+//
+// Archiving runs, and retention.
+//
+// "integrity_check archive-run [-o file] [-drop] [-table name]" exports a finished run, the state table with its
+// _replicas and _runs companions, as gzipped JSON lines ({"table": ..., "row": {...}}, encrypted if gpg_recipients
+// is set) to <table>.jsonl.gz or the given file, and with -drop then drops the table and its companions. A run
+// that is still going, according to its _runs, is refused.
+//
+// With retention_days set, an instance running with -worker also archives, every hour, the tables of other runs
+// whose last run finished more than retention_days ago into archive_dir, and drops them.
+//
+
+package main
+
+import (
+  "bufio"
+  "compress/gzip"
+  "context"
+  "database/sql"
+  "flag"
+  "fmt"
+  "path/filepath"
+  "strings"
+  "time"
+
+  pq "github.com/lib/pq"
+)
+
+// run_companions are the per-run tables besides the state table; the others only hold transient state
+var run_companions = []string{"_replicas", "_runs", "_copied"}
+var transient_companions = []string{"_workers", "_progress", "_shards"}
+
+func archive_run_command(args []string) {
+  fs := flag.NewFlagSet("archive-run", flag.ExitOnError)
+  out := fs.String("o", "", "Write the archive to this file instead of <table>.jsonl.gz")
+  drop := fs.Bool("drop", false, "Drop the tables once archived")
+  table := fs.String("table", conf.Table_name, "Archive this run table instead of the configured one")
+  fs.Parse(args)
+
+  if *out == "" {
+    *out = *table + ".jsonl.gz"
+  }
+  running, err := run_in_progress(*table)
+  die_if(err)
+  if running {
+    die_if(fmt.Errorf("a run on %s is still in progress", *table))
+  }
+
+  rows, err := archive_table(*table, *out)
+  die_if(err)
+  l.Print("archived ", rows, " rows of ", *table, " to ", *out)
+
+  if *drop {
+    if !confirm(fmt.Sprintf("This will drop table %s and its companion tables.", *table)) {
+      l.Print("not dropped")
+      return
+    }
+    die_if(drop_run_tables(*table))
+    l.Print("dropped ", *table)
+  }
+}
+
+func table_exists(name string) (bool, error) {
+  var exists sql.NullString
+  err := db.QueryRow("select to_regclass($1)::text", pq.QuoteIdentifier(name)).Scan(&exists)
+  return exists.Valid, err
+}
+
+// run_in_progress tells if a run on a table hasn't finished; runs that never recorded their end and started
+// over a week ago are taken to have died
+func run_in_progress(table string) (bool, error) {
+  exists, err := table_exists(table + "_runs")
+  if err != nil || !exists {
+    return false, err
+  }
+  var running bool
+  err = db.QueryRow(fmt.Sprintf("select exists (select 1 from %s where finished is null and started > now() - interval '7 days')",
+    pq.QuoteIdentifier(table + "_runs"))).Scan(&running)
+  return running, err
+}
+
+// archive_table writes the rows of a run's tables to filename and returns how many there were
+func archive_table(table string, filename string) (int64, error) {
+  fd, err := create_output(filename)
+  if err != nil {
+    return 0, err
+  }
+  defer fd.Close()
+  gz := gzip.NewWriter(fd)
+  w := bufio.NewWriter(gz)
+
+  var rows int64
+  for _, name := range append([]string{table}, companions(table, run_companions)...) {
+    exists, err := table_exists(name)
+    if err != nil {
+      return rows, err
+    }
+    if !exists {
+      continue
+    }
+    err = each_row(fmt.Sprintf("select json_build_object('table', %s::text, 'row', row_to_json(t))::text from %s t", pq.QuoteLiteral(name), pq.QuoteIdentifier(name)),
+      func(r *sql.Rows) error {
+        var line string
+        if err := r.Scan(&line); err != nil {
+          return err
+        }
+        rows++
+        _, err := fmt.Fprintln(w, line)
+        return err
+      })
+    if err != nil {
+      return rows, err
+    }
+  }
+
+  if err = w.Flush(); err != nil {
+    return rows, err
+  }
+  if err = gz.Close(); err != nil {
+    return rows, err
+  }
+  return rows, fd.Close()
+}
+
+func companions(table string, suffixes []string) []string {
+  var names []string
+  for _, s := range suffixes {
+    names = append(names, table + s)
+  }
+  return names
+}
+
+func drop_run_tables(table string) error {
+  for _, name := range append([]string{table}, companions(table, append(run_companions, transient_companions...))...) {
+    if _, err := db.Exec(fmt.Sprintf("drop table if exists %s cascade", pq.QuoteIdentifier(name))); err != nil {
+      return err
+    }
+  }
+  return nil
+}
+
+// the columns that tell the tables integrity_check made from same-named tables of anything else
+var runs_signature = []string{"run_id", "started", "finished", "version", "config"}
+var state_signature = []string{"filename", "hash_new", "hash_old"}
+
+// expired_runs lists the run tables, other than this one, whose last run finished (or, if it died, started) more
+// than retention_days ago. Only pairs of a state table and its _runs that both look like integrity_check's are
+// considered; anything else in the schema is left alone.
+func expired_runs() ([]string, error) {
+  res, err := db.Query(`select table_name from information_schema.columns
+    where table_schema = current_schema() and table_name like '%\_runs' and column_name = any($1)
+    group by table_name having count(distinct column_name) = $2`, pq.Array(runs_signature), len(runs_signature))
+  if err != nil {
+    return nil, err
+  }
+  var candidates []string
+  for res.Next() {
+    var name string
+    if err = res.Scan(&name); err != nil {
+      res.Close()
+      return nil, err
+    }
+    if table := strings.TrimSuffix(name, "_runs"); table != conf.Table_name {
+      candidates = append(candidates, table)
+    }
+  }
+  res.Close()
+  if err = res.Err(); err != nil {
+    return nil, err
+  }
+
+  var expired []string
+  for _, table := range candidates {
+    var matched int
+    err = db.QueryRow(`select count(distinct column_name) from information_schema.columns
+      where table_schema = current_schema() and table_name = $1 and column_name = any($2)`, table, pq.Array(state_signature)).Scan(&matched)
+    if err != nil {
+      return nil, err
+    }
+    if matched != len(state_signature) {
+      continue // not a state table, or none
+    }
+    var old bool
+    err = db.QueryRow(fmt.Sprintf("select coalesce(max(coalesce(finished, started)) < now() - $1::interval, false) from %s", pq.QuoteIdentifier(table + "_runs")),
+      fmt.Sprintf("%d days", conf.Retention_days)).Scan(&old)
+    if err != nil {
+      lw.Print("retention: skipping ", table, ": ", err)
+      continue
+    }
+    if old {
+      expired = append(expired, table)
+    }
+  }
+  return expired, nil
+}
+
+func apply_retention() error {
+  // only one instance at a time
+  ctx := context.Background()
+  conn, err := db.Conn(ctx)
+  if err != nil {
+    return err
+  }
+  defer conn.Close()
+  var locked bool
+  if err = conn.QueryRowContext(ctx, "select pg_try_advisory_lock(hashtext('integrity_check retention'))").Scan(&locked); err != nil || !locked {
+    return err
+  }
+  defer conn.ExecContext(ctx, "select pg_advisory_unlock(hashtext('integrity_check retention'))")
+
+  expired, err := expired_runs()
+  if err != nil {
+    return err
+  }
+  for _, table := range expired {
+    file := filepath.Join(conf.Archive_dir, table + ".jsonl.gz")
+    rows, err := archive_table(table, file)
+    if err != nil {
+      return fmt.Errorf("archiving %s: %s", table, err)
+    }
+    if err = drop_run_tables(table); err != nil {
+      return fmt.Errorf("dropping %s: %s", table, err)
+    }
+    l.Print("retention: archived ", rows, " rows of ", table, " to ", file, " and dropped it")
+  }
+  return nil
+}
+
+func start_retention() {
+  if conf.Retention_days <= 0 {
+    return
+  }
+  go func() {
+    for {
+      if err := apply_retention(); err != nil {
+        le.Print("error applying retention: ", err)
+      }
+      time.Sleep(time.Hour)
+    }
+  }()
+}
@@ -0,0 +1,157 @@
+//
+// Retrying transient errors.
+//
+// Network filesystems fail in ways that go away by themselves: stale file handles on NFS (see nfs.go), and on
+// SMB gateways the pending, busy, timed out and reset responses a server gives while it is overloaded, failing
+// over or waiting on an oplock break. With "smb": true, an operation failing with one of those is retried up
+// to smb_retries times (5 by default), waiting smb_backoff_ms (500 by default) and twice as long after every
+// further failure. The errors counted as transient are a built-in list for the platform, plus any error
+// message containing one of smb_transient_errors.
+//
+// Retried operations are the hashing of a file (started over), the listing of a directory (read again, skipping
+// the entries already visited) and the stat of a file found by it. A file that still fails after the retries is
+// recorded with its error as usual, but in SMB mode the report tells those transient failures (TRANSIENT_NEW,
+// TRANSIENT_OLD) apart from files that are missing (MISSING_NEW, MISSING_OLD) and from other errors.
+//
+
+package main
+
+import (
+  "os"
+  "strings"
+  "sync/atomic"
+  "syscall"
+  "time"
+)
+
+// operations retried after a transient error, over the life of the process
+var transient_retries int64
+
+func smb_retries() int {
+  if conf.Smb_retries > 0 {
+    return conf.Smb_retries
+  }
+  return 5
+}
+
+func smb_backoff() time.Duration {
+  if conf.Smb_backoff_ms > 0 {
+    return time.Duration(conf.Smb_backoff_ms) * time.Millisecond
+  }
+  return 500 * time.Millisecond
+}
+
+// mentions tells if an error message contains the text of any of the errnos; errors are often flattened into
+// text on their way up
+func mentions(msg string, errnos []syscall.Errno) bool {
+  for _, e := range errnos {
+    if strings.Contains(msg, e.Error()) {
+      return true
+    }
+  }
+  return false
+}
+
+// smb_transient_message tells if an error message is one SMB servers give while they are busy or failing over
+func smb_transient_message(msg string) bool {
+  if mentions(msg, smb_transient_errnos) {
+    return true
+  }
+  for _, s := range conf.Smb_transient_errors {
+    if s != "" && strings.Contains(msg, s) {
+      return true
+    }
+  }
+  return false
+}
+
+func is_smb_transient(err error) bool {
+  return err != nil && smb_transient_message(err.Error())
+}
+
+// transient tells how often and how patiently to retry an error; a kind of "" means it isn't transient
+func transient(err error) (string, int, time.Duration) {
+  switch {
+  case conf.Nfs && is_stale(err):
+    return "stale file handle", nfs_retries(), nfs_backoff()
+  case conf.Smb && is_smb_transient(err):
+    return "transient SMB error", smb_retries(), smb_backoff()
+  case is_fd_exhausted(err):
+    return "out of file descriptors", fd_retries(), fd_backoff()
+  }
+  return "", 0, 0
+}
+
+// retry_transient calls fn until it succeeds, fails with an error that isn't transient, or runs out of retries
+func retry_transient(what string, fn func() error) error {
+  err := fn()
+  for attempt := 0; err != nil; attempt++ {
+    kind, retries, backoff := transient(err)
+    if kind == "" || attempt >= retries {
+      break
+    }
+    atomic.AddInt64(&transient_retries, 1)
+    l.Print(kind, " ", what, ", retrying: ", err)
+    time.Sleep(backoff << attempt)
+    err = fn()
+  }
+  return err
+}
+
+// retry_hash hashes a local file, starting over after a transient error
+func retry_hash(side string, file string, p *policy, extras bool) (string, *digests, error) {
+  open := os.Open
+  if conf.Nfs {
+    open = new_nfs_opener(side).open
+  }
+  var hash string
+  var d *digests
+  err := retry_transient("hashing "+side+" "+file, func() error {
+    var err error
+    hash, d, err = local_hash(side, file, p, extras, open)
+    return err
+  })
+  return hash, d, err
+}
+
+// retry_lstat stats a file again after a transient error
+func retry_lstat(path string) (os.FileInfo, error) {
+  var info os.FileInfo
+  err := retry_transient("on "+path, func() error {
+    var err error
+    info, err = os.Lstat(path)
+    return err
+  })
+  return info, err
+}
+
+// error_class sorts the error recorded for a file for the report: "MISSING", "TRANSIENT" or "ERROR"
+func error_class(msg string) string {
+  switch {
+  case mentions(msg, missing_errnos) || strings.Contains(msg, os.ErrNotExist.Error()):
+    return "MISSING"
+  case smb_transient_message(msg):
+    return "TRANSIENT"
+  }
+  return "ERROR"
+}
+
+// the causes of error_cause, in the order the report lists them
+var error_causes = []string{"permission", "missing", "io", "timeout", "db", "other"}
+
+// error_cause sorts the error recorded for a file by what it takes to fix it, for the breakdown of the report
+func error_cause(msg string) string {
+  switch {
+  case error_class(msg) == "MISSING":
+    return "missing"
+  case mentions(msg, permission_errnos):
+    return "permission"
+  case strings.HasPrefix(msg, "adding hash to DB") || strings.Contains(msg, "pq: "):
+    return "db"
+  case mentions(msg, timeout_errnos) || strings.Contains(msg, "timeout") || strings.Contains(msg, "timed out"):
+    return "timeout"
+  case mentions(msg, io_errnos):
+    return "io"
+  }
+  return "other"
+}
@@ -0,0 +1,21 @@
+//go:build !windows
+
+package main
+
+import (
+  "syscall"
+)
+
+// errors of the Linux and BSD SMB clients for the server's pending, busy, timeout and disconnect responses
+var smb_transient_errnos = []syscall.Errno{syscall.EAGAIN, syscall.EBUSY, syscall.ETIMEDOUT, syscall.ECONNRESET, syscall.ECONNABORTED, syscall.EHOSTDOWN, syscall.ENETRESET}
+
+var missing_errnos = []syscall.Errno{syscall.ENOENT}
+
+// errors hashing a file worth trying again later (see retryq.go), and those that never are
+var transient_file_errnos = []syscall.Errno{syscall.EAGAIN, syscall.EIO, syscall.ETIMEDOUT, syscall.EBUSY, syscall.EINTR}
+var permanent_file_errnos = []syscall.Errno{syscall.ENOENT, syscall.EACCES, syscall.EPERM}
+
+// the causes of errors in the report (see error_cause)
+var permission_errnos = []syscall.Errno{syscall.EACCES, syscall.EPERM}
+var timeout_errnos = []syscall.Errno{syscall.ETIMEDOUT}
+var io_errnos = []syscall.Errno{syscall.EIO, syscall.ENXIO}
@@ -0,0 +1,25 @@
+//go:build windows
+
+package main
+
+import (
+  "syscall"
+)
+
+// ERROR_SHARING_VIOLATION, ERROR_LOCK_VIOLATION, ERROR_UNEXP_NET_ERR, ERROR_NETNAME_DELETED, ERROR_SEM_TIMEOUT,
+// ERROR_NETWORK_BUSY and ERROR_VC_DISCONNECTED: what the redirector makes of a busy or failing over server
+var smb_transient_errnos = []syscall.Errno{32, 33, 59, 64, 121, 54, 240}
+
+// ERROR_FILE_NOT_FOUND and ERROR_PATH_NOT_FOUND
+var missing_errnos = []syscall.Errno{2, 3}
+
+// ERROR_NOT_READY, ERROR_CRC, ERROR_SEM_TIMEOUT and ERROR_IO_DEVICE are worth trying again later (see retryq.go),
+// besides the SMB ones; ERROR_FILE_NOT_FOUND, ERROR_PATH_NOT_FOUND and ERROR_ACCESS_DENIED never are
+var transient_file_errnos = []syscall.Errno{21, 23, 121, 1117}
+var permanent_file_errnos = []syscall.Errno{2, 3, 5}
+
+// the causes of errors in the report (see error_cause): ERROR_ACCESS_DENIED and ERROR_SHARING_VIOLATION,
+// ERROR_SEM_TIMEOUT, and ERROR_NOT_READY, ERROR_CRC and ERROR_IO_DEVICE
+var permission_errnos = []syscall.Errno{5, 32}
+var timeout_errnos = []syscall.Errno{121}
+var io_errnos = []syscall.Errno{21, 23, 1117}
@@ -0,0 +1,177 @@
+//
+// Retry queue for transient file errors.
+//
+// A file that fails to hash with an error that may go away by itself is put back instead of having the error
+// recorded: EAGAIN, EIO (a flaky disk or cable), timeouts, a busy file, a dropped connection to a remote tree,
+// and whatever retry.go retries in place (stale NFS handles, busy SMB servers, running out of descriptors).
+// Missing files and refused permissions (ENOENT, EACCES, EPERM) are final at once, as is anything else.
+//
+// Requeued files are hashed again once the phase has gone through the rest of its work, after file_backoff_s
+// (30 by default), twice as long after every further failure, up to file_retries times (3 by default; -1
+// records every error at once). A file still failing then has its last error recorded as usual. Files waiting
+// at the deadline are left outstanding, as unworked files are.
+//
+// The hash phases of a run requeue, with their priority lanes, batches and Redis queues; the pipeline and watch
+// modes don't.
+//
+
+package main
+
+import (
+  "fmt"
+  "io"
+  "strings"
+  "sync"
+  "time"
+
+  pq "github.com/lib/pq"
+)
+
+func file_retries() int {
+  if conf.File_retries != 0 {
+    return conf.File_retries
+  }
+  return 3
+}
+
+func file_backoff() time.Duration {
+  if conf.File_backoff_s > 0 {
+    return time.Duration(conf.File_backoff_s) * time.Second
+  }
+  return 30 * time.Second
+}
+
+// messages of transient errors that come without an errno, from the network
+var transient_messages = []string{"i/o timeout", "connection reset", "broken pipe", io.ErrUnexpectedEOF.Error()}
+
+// is_transient_file_error tells if hashing a file again later may succeed
+func is_transient_file_error(err error) bool {
+  msg := err.Error()
+  if mentions(msg, permanent_file_errnos) {
+    return false
+  }
+  if kind, _, _ := transient(err); kind != "" {
+    return true
+  }
+  if mentions(msg, transient_file_errnos) {
+    return true
+  }
+  for _, s := range transient_messages {
+    if strings.Contains(msg, s) {
+      return true
+    }
+  }
+  return false
+}
+
+type retry_item struct {
+  w work_item
+  due time.Time
+}
+
+// retry_queue holds the files of a phase waiting to be hashed again
+type retry_queue struct {
+  mu sync.Mutex
+  items []retry_item
+  attempts map[string]int
+}
+
+var retry_queues = map[string]*retry_queue{}
+var retry_queues_mu sync.Mutex
+
+func open_retries(side string) *retry_queue {
+  rq := &retry_queue{attempts: map[string]int{}}
+  retry_queues_mu.Lock()
+  retry_queues[side] = rq
+  retry_queues_mu.Unlock()
+  return rq
+}
+
+// retry_later puts a file back after a transient error, if its phase takes it and it has retries left
+func retry_later(side string, w work_item, err error) bool {
+  retry_queues_mu.Lock()
+  rq := retry_queues[side]
+  retry_queues_mu.Unlock()
+  if rq == nil || file_retries() < 0 || !is_transient_file_error(err) {
+    return false
+  }
+
+  rq.mu.Lock()
+  defer rq.mu.Unlock()
+  attempt := rq.attempts[w.filename]
+  if attempt >= file_retries() {
+    return false
+  }
+  rq.attempts[w.filename] = attempt + 1
+  wait := file_backoff() << attempt
+  rq.items = append(rq.items, retry_item{w: w, due: time.Now().Add(wait)})
+  lw.Print("transient error hashing ", side, " ", w.filename, ", retrying in ", wait, " (", attempt + 1, " of ", file_retries(), "): ", err)
+  return true
+}
+
+// take returns the files due, and how many wait and when the next one is due
+func (rq *retry_queue) take() ([]work_item, int, time.Time) {
+  rq.mu.Lock()
+  defer rq.mu.Unlock()
+  var due []work_item
+  var next time.Time
+  waiting := rq.items[:0]
+  for _, it := range rq.items {
+    if !it.due.After(time.Now()) {
+      due = append(due, it.w)
+      continue
+    }
+    if next.IsZero() || it.due.Before(next) {
+      next = it.due
+    }
+    waiting = append(waiting, it)
+  }
+  rq.items = waiting
+  return due, len(waiting), next
+}
+
+// release_claim lets a requeued file be claimed again
+func release_claim(file string) error {
+  _, err := db_exec(fmt.Sprintf("update %s set status = null, claimed_by = null, claimed_at = null where filename = $1", pq.QuoteIdentifier(conf.Table_name)), file)
+  return err
+}
+
+// drain_retries hashes the requeued files of a phase as they come due, until none is left or the deadline
+func drain_retries(side string, rq *retry_queue, phase *phase_progress) {
+  defer func() {
+    retry_queues_mu.Lock()
+    delete(retry_queues, side)
+    retry_queues_mu.Unlock()
+  }()
+
+  for !deadline_passed() {
+    due, waiting, next := rq.take()
+    if len(due) == 0 && waiting == 0 {
+      return
+    }
+    if len(due) == 0 {
+      l.Print("waiting for ", waiting, " files to retry in path_", side)
+      for time.Now().Before(next) && !deadline_passed() {
+        time.Sleep(time.Second)
+      }
+      continue
+    }
+
+    // those failing again are queued again, by hash_one
+    next_file := make(chan work_item)
+    pool := start_pool(hash_threads(side), func() error {
+      for w := range next_file {
+        hash_one(side, w, phase)
+      }
+      return nil
+    })
+    for _, w := range due {
+      next_file <- w
+    }
+    close(next_file)
+    pool.Wait()
+  }
+  if due, waiting, _ := rq.take(); len(due) + waiting > 0 {
+    l.Print(len(due) + waiting, " files waiting for a retry in path_", side, " are left outstanding at the deadline")
+  }
+}
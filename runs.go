@@ -0,0 +1,189 @@
+//
+// Run history.
+//
+// Every run that works on a table gets a row in <table>_runs holding the effective configuration (with the
+// database password masked), the host, the command line and the build of the binary, so it can later be shown
+// exactly what was verified, how, and by what.
+//
+
+package main
+
+import (
+  "encoding/json"
+  "fmt"
+  "net/url"
+  "os"
+  "regexp"
+  "runtime"
+  "runtime/debug"
+  "strings"
+
+  pq "github.com/lib/pq"
+)
+
+var run_id int64
+
+// Set at build time:
+//   go build -ldflags "-X main.version=1.4.0 -X main.commit=$(git rev-parse HEAD) -X main.build_date=$(date -u +%FT%TZ)"
+var (
+  version = "dev"
+  commit = ""
+  build_date = ""
+)
+
+// Columns added to the runs table after the original schema
+var run_columns = []string{
+  "restore_requests bigint",
+  "restore_bytes bigint",
+  "restore_cost double precision",
+  "api_calls bigint",
+  "egress_bytes bigint",
+  "est_cost double precision",
+  "milestones jsonb",
+  "last_milestone text",
+  "last_milestone_at timestamp",
+}
+
+func runs_table() string {
+  return pq.QuoteIdentifier(conf.Table_name + "_runs")
+}
+
+// build_version describes the binary: the version stamped in at build time, falling back on the
+// build info embedded by the Go toolchain for the commit
+func build_version() string {
+  rev := commit
+  if bi, ok := debug.ReadBuildInfo(); ok && rev == "" {
+    for _, s := range bi.Settings {
+      if s.Key == "vcs.revision" {
+        rev = s.Value
+      }
+    }
+  }
+  v := version
+  if rev != "" {
+    v += " (" + rev + ")"
+  }
+  if build_date != "" {
+    v += " built " + build_date
+  }
+  return v + " " + runtime.Version()
+}
+
+var keyword_password = regexp.MustCompile(`password\s*=\s*('(\\.|[^'])*'|\S+)`)
+
+// redacted_config returns the configuration as JSON with every secret masked, for <table>_runs, which read-only
+// roles can read. A setting holding a secret has to be masked here.
+func redacted_config() ([]byte, error) {
+  c := conf
+  c.Db_connstr = redact_connstr(c.Db_connstr)
+  c.New_path, c.Old_path = redact_url(c.New_path), redact_url(c.Old_path)
+  c.Replicas = nil
+  for _, r := range conf.Replicas {
+    r.Path = redact_url(r.Path)
+    c.Replicas = append(c.Replicas, r)
+  }
+  c.Redis_password = redact(c.Redis_password)
+  c.Coordinator_token = redact(c.Coordinator_token)
+  c.Notifiers = nil
+  for _, n := range conf.Notifiers {
+    n.Url = redact_url(n.Url)
+    if u, err := url.Parse(n.Url); err == nil && (n.Type == "slack" || u.RawQuery != "") {
+      // a Slack webhook's path is its token, and other webhooks often take one in the query
+      n.Url = u.Scheme + "://" + u.Host + "/xxx"
+    }
+    n.Routing_key = redact(n.Routing_key)
+    n.Password = redact(n.Password)
+    c.Notifiers = append(c.Notifiers, n)
+  }
+  c.Otlp_headers = map[string]string{}
+  for k, v := range conf.Otlp_headers {
+    c.Otlp_headers[k] = redact(v) // authorization or API keys, typically
+  }
+  return json.Marshal(c)
+}
+
+// redact_connstr masks the password of a connection string, in either of its forms
+func redact_connstr(s string) string {
+  return keyword_password.ReplaceAllString(redact_url(s), "password=xxx")
+}
+
+// redact returns a secret masked, or nothing if there is none
+func redact(secret string) string {
+  if secret == "" {
+    return ""
+  }
+  return "xxx"
+}
+
+// redact_url masks the password of a URL, if it has one
+func redact_url(s string) string {
+  u, err := url.Parse(s)
+  if err != nil || u.User == nil {
+    return s
+  }
+  if _, has := u.User.Password(); !has {
+    return s
+  }
+  u.User = url.UserPassword(u.User.Username(), "xxx")
+  return u.String()
+}
+
+func start_run() error {
+  _, err := db.Exec(fmt.Sprintf(`
+    create table if not exists %s (
+      run_id bigserial primary key,
+      started timestamp,
+      finished timestamp,
+      status text,
+      host text,
+      worker_id text,
+      command text,
+      version text,
+      config jsonb
+    )
+    `, runs_table()))
+  if err != nil {
+    return err
+  }
+  if err = set_table_access(runs_table()); err != nil {
+    return err
+  }
+  for _, col := range run_columns {
+    if _, err = db.Exec(fmt.Sprintf("alter table %s add column if not exists %s", runs_table(), col)); err != nil {
+      return err
+    }
+  }
+
+  config, err := redacted_config()
+  if err != nil {
+    return err
+  }
+  host, _ := os.Hostname()
+  err = db.QueryRow(fmt.Sprintf(`insert into %s (started, status, host, worker_id, command, version, config)
+    values (now(), 'running', $1, $2, $3, $4, $5) returning run_id`, runs_table()),
+    host, worker_id, strings.Join(os.Args, " "), build_version(), string(config)).Scan(&run_id)
+  if err != nil {
+    return err
+  }
+  start_tracing(strings.Join(os.Args, " "))
+  notify("start", "run started: " + strings.Join(os.Args, " "), "")
+  return nil
+}
+
+func finish_run(status string) {
+  if run_id == 0 {
+    return
+  }
+  record_cost()
+  if _, err := db_exec(fmt.Sprintf("update %s set finished = now(), status = $2 where run_id = $1", runs_table()), run_id, status); err != nil {
+    le.Print("error recording end of run: ", err)
+  }
+  notify("complete", "run finished with status " + status, "")
+  log_hook("post-run", map[string]interface{}{"status": status})
+
+  var err error
+  if status != "complete" {
+    err = fmt.Errorf("run ended with status %s", status)
+  }
+  stop_tracing(err)
+}
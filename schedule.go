@@ -0,0 +1,118 @@
+//
+// Work scheduling.
+//
+// By default files are hashed in whatever order the database returns them, which on spinning disks defeats
+// readahead and has the heads jumping between directories. With schedule = "directory", work is ordered by
+// directory and handed out one directory at a time, so each hash worker streams through a single directory
+// before moving on.
+//
+
+package main
+
+import (
+  "fmt"
+  "path"
+  "sort"
+)
+
+// directories larger than this are handed out in several pieces, so one huge directory doesn't starve the pool
+const max_group = 10000
+
+func dir_of(file string) string {
+  dir := path.Dir(file)
+  if dir == "." {
+    return ""
+  }
+  return dir
+}
+
+// schedule_order returns the ORDER BY clause of the statement of work
+func schedule_order() string {
+  switch conf.Schedule {
+  case "":
+    return ""
+  case "directory":
+    return " order by regexp_replace(filename, '(^|/)[^/]*$', ''), filename"
+  case "extent":
+    return " order by filename"
+  }
+  die_if(fmt.Errorf("unknown schedule: %s", conf.Schedule))
+  return ""
+}
+
+// sort_work orders a list of work items of one side according to the schedule
+func sort_work(side string, items []work_item) {
+  switch conf.Schedule {
+  case "extent":
+    sort_by_extent(side, items)
+  case "directory":
+    sort.SliceStable(items, func(i, j int) bool {
+      di, dj := dir_of(items[i].filename), dir_of(items[j].filename)
+      if di != dj {
+        return di < dj
+      }
+      return items[i].filename < items[j].filename
+    })
+  }
+}
+
+// work_grouper collects consecutive work items into the groups handed to one hash worker at a time:
+// single files by default, whole directories with the directory schedule
+type work_grouper struct {
+  out chan []work_item
+  group []work_item
+}
+
+func (g *work_grouper) add(w work_item) {
+  if len(g.group) > 0 && (conf.Schedule != "directory" || dir_of(w.filename) != dir_of(g.group[0].filename) || len(g.group) >= max_group) {
+    g.flush()
+  }
+  g.group = append(g.group, w)
+}
+
+func (g *work_grouper) flush() {
+  if len(g.group) > 0 {
+    g.out <- g.group
+    g.group = nil
+  }
+}
+
+type extent_key struct {
+  mapped bool
+  dev uint64
+  offset uint64
+}
+
+func sort_by_extent(side string, items []work_item) {
+  if remotes[side] != nil {
+    return // no physical layout to go by
+  }
+
+  keys := make(map[string]extent_key, len(items))
+  failed := 0
+  for _, w := range items {
+    dev, offset, err := physical_offset(side_path(side, w.filename))
+    if err != nil {
+      if failed == 0 {
+        lw.Print("can't map extents of ",w.filename,", hashing unmapped files last: ",err)
+      }
+      failed++
+      continue
+    }
+    keys[w.filename] = extent_key{true, dev, offset}
+  }
+  if failed > 0 {
+    l.Print(failed," of ",len(items)," ",side," files have no known physical offset")
+  }
+
+  sort.SliceStable(items, func(i, j int) bool {
+    ki, kj := keys[items[i].filename], keys[items[j].filename]
+    if ki.mapped != kj.mapped {
+      return ki.mapped
+    }
+    if ki.dev != kj.dev {
+      return ki.dev < kj.dev
+    }
+    return ki.offset < kj.offset
+  })
+}
@@ -0,0 +1,143 @@
+//
+// Reusing an earlier walk.
+//
+// Walking 80M files takes hours. "-seed-from <table>" fills a new, empty table from the files of an earlier run
+// table instead (filename, size, mtime, archive membership and stat fields; no hashes), within the database.
+// "-restat-older-than 30d" then stats again the entries walked longer ago than that, updating those that changed
+// and dropping those that are gone; without it, the earlier walk is taken as is. Files added since that walk are
+// not found this way.
+//
+
+package main
+
+import (
+  "database/sql"
+  "fmt"
+  "os"
+  "strings"
+  "sync/atomic"
+  "time"
+
+  pq "github.com/lib/pq"
+)
+
+func seed_walk(seed string, restat_older string) error {
+  exists, err := table_exists(seed)
+  if err != nil {
+    return err
+  }
+  if !exists {
+    return fmt.Errorf("no table %s to seed from", seed)
+  }
+
+  // walked_at was only recorded from this version on; older seeds count as walked when their first run started
+  var seeded_at interface{}
+  if ok, _ := table_exists(seed + "_runs"); ok {
+    var started sql.NullTime
+    if err = db.QueryRow(fmt.Sprintf("select min(started) from %s", pq.QuoteIdentifier(seed + "_runs"))).Scan(&started); err != nil {
+      return err
+    }
+    if started.Valid {
+      seeded_at = started.Time
+    }
+  }
+
+  // seeds made by older versions lack some of the columns
+  has := map[string]bool{}
+  cols, err := db.Query("select column_name from information_schema.columns where table_schema = current_schema() and table_name = $1", seed)
+  if err != nil {
+    return err
+  }
+  for cols.Next() {
+    var c string
+    if err = cols.Scan(&c); err != nil {
+      cols.Close()
+      return err
+    }
+    has[c] = true
+  }
+  cols.Close()
+
+  var columns, values []string
+  for _, c := range copy_columns() {
+    switch {
+    case c == "walked_at" && has[c]:
+      columns, values = append(columns, c), append(values, "coalesce(walked_at, $1::timestamp)")
+    case c == "walked_at":
+      columns, values = append(columns, c), append(values, "$1::timestamp")
+    case has[c]:
+      columns, values = append(columns, c), append(values, c)
+    }
+  }
+  res, err := db.Exec(fmt.Sprintf("insert into %s (%s) select %s from %s", pq.QuoteIdentifier(conf.Table_name),
+    strings.Join(columns, ", "), strings.Join(values, ", "), pq.QuoteIdentifier(seed)), seeded_at)
+  if err != nil {
+    return err
+  }
+  n, err := res.RowsAffected()
+  if err != nil {
+    return err
+  }
+  l.Print("seeded ", n, " files from ", seed)
+
+  if restat_older == "" {
+    return nil
+  }
+  age, err := parse_age(restat_older)
+  if err != nil {
+    return err
+  }
+  if remotes["new"] != nil {
+    l.Print("path_new is a remote tree; not statting entries again")
+    return nil
+  }
+  return restat(age)
+}
+
+// restat stats again the local files walked longer than age ago
+func restat(age time.Duration) error {
+  t := pq.QuoteIdentifier(conf.Table_name)
+  sets := []string{"size = $2", "changed = $3", "walked_at = now()"}
+  for i, c := range stat_columns {
+    sets = append(sets, fmt.Sprintf("%s = $%d", c, i+4))
+  }
+  update := fmt.Sprintf("update %s set %s where filename = $1", t, strings.Join(sets, ", "))
+  remove := fmt.Sprintf("delete from %s where filename = $1", t)
+
+  var updated, removed int64
+  to_stat := make(chan string, 64)
+  pool := start_pool(8, func() error {
+    // keep draining after a failure, so the feeder isn't left blocked
+    var failed error
+    for file := range to_stat {
+      info, err := os.Stat(side_path("new", file))
+      if os.IsNotExist(err) {
+        _, err = db_exec(remove, file)
+        atomic.AddInt64(&removed, 1)
+      } else if err == nil {
+        _, err = db_exec(update, append([]interface{}{file, info.Size(), info.ModTime()}, stat_fields(info)...)...)
+        atomic.AddInt64(&updated, 1)
+      }
+      if err != nil && failed == nil {
+        failed = fmt.Errorf("statting %s again: %s", file, err)
+      }
+    }
+    return failed
+  })
+
+  err := each_row(fmt.Sprintf("select filename from %s where archive is null and (walked_at is null or walked_at < now() - %s::interval)",
+    t, pq.QuoteLiteral(fmt.Sprintf("%d seconds", int64(age.Seconds())))), func(rows *sql.Rows) error {
+    var file string
+    if err := rows.Scan(&file); err != nil {
+      return err
+    }
+    to_stat <- file
+    return nil
+  })
+  close(to_stat)
+  if werr := pool.Wait(); err == nil {
+    err = werr
+  }
+  l.Print("statted again: ", updated, " files updated, ", removed, " gone")
+  return err
+}
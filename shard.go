@@ -0,0 +1,116 @@
+//
+// Sharding the hash phases across processes.
+//
+// Run as an indexed Kubernetes Job (completionMode: Indexed) with shards set to the number of completions, each
+// pod takes its index from JOB_COMPLETION_INDEX and only hashes the files whose hash(filename) mod shards equals
+// it. Shard 0 is the coordinator: it walks the tree while the others wait for the walk, hashes its own shard,
+// then waits until every shard has reported in <table>_shards before the steps covering the whole table
+// (mismatch diagnostics, the manifest) and the end of the run. The other shards exit when their part is done.
+// Reports from before the coordinator's walk don't count; on a table that was already walked (a resumed run)
+// earlier reports are accepted.
+//
+// Outside Kubernetes the same split is set with -shard k/n, k counting from 1, on each of n hosts that all see
+// the storage; 1/n is the coordinator.
+//
+
+package main
+
+import (
+  "fmt"
+  "os"
+  "strconv"
+  "time"
+
+  pq "github.com/lib/pq"
+)
+
+var shard_index, shard_count int
+
+func shards_table() string {
+  return pq.QuoteIdentifier(conf.Table_name + "_shards")
+}
+
+// init_shard picks up the shard of this process from the environment of an indexed Job
+func init_shard() error {
+  index, ok := os.LookupEnv("JOB_COMPLETION_INDEX")
+  if !ok || conf.Shards <= 1 {
+    return nil
+  }
+  i, err := strconv.Atoi(index)
+  if err != nil {
+    return fmt.Errorf("JOB_COMPLETION_INDEX: %s", err)
+  }
+  return set_shard(i, conf.Shards)
+}
+
+// parse_shard takes a shard given as "k/n", with k from 1 to n
+func parse_shard(s string) error {
+  var k, n int
+  if _, err := fmt.Sscanf(s, "%d/%d", &k, &n); err != nil {
+    return fmt.Errorf("shard %q: expected k/n", s)
+  }
+  return set_shard(k - 1, n)
+}
+
+func set_shard(index int, count int) error {
+  if count < 1 || index < 0 || index >= count {
+    return fmt.Errorf("invalid shard %d of %d", index, count)
+  }
+  shard_index, shard_count = index, count
+  l.Printf("working on shard %d of %d", index, count)
+  return nil
+}
+
+func sharded() bool {
+  return shard_count > 1
+}
+
+// shard_filter returns the condition (prefixed with " and ") selecting this process's shard of the rows
+func shard_filter() string {
+  if !sharded() {
+    return ""
+  }
+  return fmt.Sprintf(" and mod(abs(hashtext(filename)::bigint), %d) = %d", shard_count, shard_index)
+}
+
+// shard_done records that this shard has hashed everything in it
+func shard_done() error {
+  _, err := db.Exec(fmt.Sprintf(`
+    create table if not exists %s (
+      shard int primary key,
+      shards int,
+      worker_id text,
+      finished timestamp
+    )
+    `, shards_table()))
+  if err != nil {
+    return err
+  }
+  if err = set_table_access(shards_table()); err != nil {
+    return err
+  }
+  _, err = db_exec(fmt.Sprintf(`insert into %s (shard, shards, worker_id, finished) values ($1, $2, $3, now())
+    on conflict (shard) do update set shards = $2, worker_id = $3, finished = now()`, shards_table()), shard_index, shard_count, worker_id)
+  if err != nil {
+    return err
+  }
+  return notify_event("work")
+}
+
+// wait_for_shards blocks until every shard has finished since the given (database) time
+func wait_for_shards(since time.Time) {
+  for {
+    var done int
+    err := db.QueryRow(fmt.Sprintf("select count(*) from %s where shards = $1 and finished >= $2", shards_table()), shard_count, since).Scan(&done)
+    die_if(err)
+    if done >= shard_count {
+      l.Print("all ",shard_count," shards are done")
+      return
+    }
+    l.Printf("%d of %d shards done, waiting for the rest", done, shard_count)
+    select {
+    case <- work_events:
+    case <- time.After(time.Minute):
+    }
+  }
+}
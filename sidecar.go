@@ -0,0 +1,78 @@
+//
+// Checksum sidecars as the OLD hashes.
+//
+// Instruments often write a checksum file next to each file they produce. With "old_sidecars": true the OLD hash
+// of a file is read from its sidecar, <file>.sha256 (or old_sidecar_suffix), instead of from the source file: in
+// old_path under the file's OLD name, or next to the file in new_path when there is no old_path, making the
+// instrument's checksums the reference. Sidecars hold the hex SHA-256 as the first field, as written by
+// sha256sum; anything after it (the file's name) is ignored.
+// Without old_path the sidecars are part of new_path too: give them a policy of their own,
+// { "pattern": "*.sha256", "action": "skip" }, so they aren't taken for data.
+//
+// A sidecar is only comparable with a hash of the raw content, so files whose policy is not "full", or that are
+// transformed or normalized, are hashed from old_path as usual (and are errors without old_path). So are files
+// without a sidecar when there is an old_path to read them from.
+//
+
+package main
+
+import (
+  "bufio"
+  "fmt"
+  "io"
+  "os"
+  "strings"
+)
+
+// has_old tells if there is an OLD side to compare against: a tree, or sidecars
+func has_old() bool {
+  return conf.Old_path != "" || conf.Old_sidecars
+}
+
+func sidecar_suffix() string {
+  if conf.Old_sidecar_suffix != "" {
+    return conf.Old_sidecar_suffix
+  }
+  return ".sha256"
+}
+
+// open_sidecar opens the sidecar of a file, in old_path if there is one and next to the NEW file otherwise
+func open_sidecar(file string) (io.ReadCloser, error) {
+  side := "old"
+  if conf.Old_path == "" {
+    side = "new"
+  }
+  name := side_name(side, file) + sidecar_suffix()
+  if rm := remotes[side]; rm != nil {
+    return rm.open(name)
+  }
+  return os.Open(side_root(side) + "/" + name)
+}
+
+// sidecar_hash returns the OLD hash of a file from its sidecar; ok is false when the file has to be hashed instead
+func sidecar_hash(file string, p *policy) (string, bool, error) {
+  if p.Action != "full" || p.Normalize_eol || transformed("new", file) || transformed("old", file) {
+    if conf.Old_path == "" {
+      return "", true, fmt.Errorf("policy %s can't be checked against a sidecar", p.Action)
+    }
+    return "", false, nil
+  }
+  f, err := open_sidecar(file)
+  if err != nil {
+    if os.IsNotExist(err) && conf.Old_path != "" {
+      return "", false, nil
+    }
+    return "", true, fmt.Errorf("reading sidecar: %s", err)
+  }
+  defer f.Close()
+
+  line, err := bufio.NewReader(io.LimitReader(f, 64<<10)).ReadString('\n')
+  if err != nil && err != io.EOF {
+    return "", true, fmt.Errorf("reading sidecar: %s", err)
+  }
+  fields := strings.Fields(line)
+  if len(fields) == 0 || len(fields[0]) != 64 || strings.Trim(strings.ToLower(fields[0]), "0123456789abcdef") != "" {
+    return "", true, fmt.Errorf("sidecar holds no SHA-256")
+  }
+  return strings.ToLower(fields[0]), true, nil
+}
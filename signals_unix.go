@@ -0,0 +1,24 @@
+//go:build !windows
+
+package main
+
+import (
+  "os"
+  "os/signal"
+  "syscall"
+)
+
+// handle_signals pauses hash workers on SIGUSR1 and resumes them on SIGUSR2
+func handle_signals() {
+  sigs := make(chan os.Signal, 1)
+  signal.Notify(sigs, syscall.SIGUSR1, syscall.SIGUSR2)
+  go func() {
+    for sig := range sigs {
+      if sig == syscall.SIGUSR1 {
+        pause_gate.pause("operator")
+      } else {
+        pause_gate.operator_resume()
+      }
+    }
+  }()
+}
@@ -0,0 +1,7 @@
+//go:build windows
+
+package main
+
+// There are no user signals on Windows; use the control endpoint instead
+func handle_signals() {
+}
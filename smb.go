@@ -0,0 +1,54 @@
+//
+// Windows file server metadata: DOS attributes and NTFS alternate data streams.
+//
+// With smb_streams enabled, every hashed file also gets its DOS attribute bits and a digest of each of its
+// alternate data streams recorded (dos_attrs_new/old, streams_new/old), so a copy that dropped them shows up
+// as a difference even when the main stream matches. How they are read depends on the platform, see smb_*.go.
+//
+
+package main
+
+import (
+  "crypto/sha256"
+  "fmt"
+  "io"
+  "sort"
+  "strings"
+
+  pq "github.com/lib/pq"
+)
+
+type data_stream struct {
+  name string
+  size int64
+  hash string
+}
+
+func format_streams(streams []data_stream) string {
+  sort.Slice(streams, func(i, j int) bool { return streams[i].name < streams[j].name })
+  parts := make([]string, len(streams))
+  for i, s := range streams {
+    parts[i] = fmt.Sprintf("%s:%d:%s", s.name, s.size, s.hash)
+  }
+  return strings.Join(parts, ";")
+}
+
+func hash_data_stream(name string, r io.Reader) (data_stream, error) {
+  h := sha256.New()
+  n, err := io.Copy(h, r)
+  return data_stream{name: name, size: n, hash: fmt.Sprintf("%x", h.Sum(nil))}, err
+}
+
+// record_smb_metadata stores the DOS attributes and alternate data streams of a file
+func record_smb_metadata(side string, file string) error {
+  if remotes[side] != nil {
+    return nil
+  }
+  attrs, streams, err := smb_metadata(side_path(side, file))
+  if err != nil {
+    return err
+  }
+  _, err = db_exec(fmt.Sprintf("update %s set %s = $2, %s = $3 where filename = $1", pq.QuoteIdentifier(conf.Table_name),
+    pq.QuoteIdentifier("dos_attrs_"+side), pq.QuoteIdentifier("streams_"+side)), file, attrs, format_streams(streams))
+  return err
+}
@@ -0,0 +1,78 @@
+//go:build linux
+
+package main
+
+import (
+  "bytes"
+  "strings"
+  "syscall"
+)
+
+// On Linux the metadata is found in extended attributes: a CIFS client mount exposes the DOS attributes as
+// user.cifs.dosattrib, and a Samba server (vfs_streams_xattr) stores them as user.DOSATTRIB and each stream
+// as a user.DosStream.<name>:$DATA attribute. Streams are not visible through a CIFS client mount.
+func smb_metadata(path string) (string, []data_stream, error) {
+  var attrs string
+  for _, name := range []string{"user.cifs.dosattrib", "user.DOSATTRIB"} {
+    if v, err := get_xattr(path, name); err == nil {
+      attrs = strings.TrimRight(string(v), "\x00")
+      break
+    }
+  }
+
+  names, err := list_xattrs(path)
+  if err == syscall.ENOTSUP {
+    return attrs, nil, nil // a filesystem without extended attributes has no streams either
+  }
+  if err != nil {
+    return "", nil, err
+  }
+  var streams []data_stream
+  for _, name := range strings.Split(string(names), "\x00") {
+    if !strings.HasPrefix(name, "user.DosStream.") {
+      continue
+    }
+    v, err := get_xattr(path, name)
+    if err != nil {
+      return "", nil, err
+    }
+    s, _ := hash_data_stream(strings.TrimPrefix(name, "user.DosStream."), bytes.NewReader(v))
+    streams = append(streams, s)
+  }
+  return attrs, streams, nil
+}
+
+func get_xattr(path string, name string) ([]byte, error) {
+  n, err := syscall.Getxattr(path, name, nil)
+  if err != nil {
+    return nil, err
+  }
+  buf := make([]byte, n)
+  n, err = syscall.Getxattr(path, name, buf)
+  return buf[:n], err
+}
+
+// list_xattrs returns the names of the extended attributes of a file, NUL-separated
+func list_xattrs(path string) ([]byte, error) {
+  for {
+    n, err := syscall.Listxattr(path, nil)
+    if err != nil {
+      return nil, err
+    }
+    if n <= 0 {
+      return nil, nil
+    }
+    buf := make([]byte, n)
+    n, err = syscall.Listxattr(path, buf)
+    if err == syscall.ERANGE {
+      continue // attributes added since the size was asked for
+    }
+    if err != nil {
+      return nil, err
+    }
+    if n < 0 {
+      return nil, nil
+    }
+    return buf[:n], nil
+  }
+}
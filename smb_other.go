@@ -0,0 +1,7 @@
+//go:build !linux && !windows
+
+package main
+
+func smb_metadata(path string) (string, []data_stream, error) {
+  return "", nil, nil
+}
@@ -0,0 +1,68 @@
+//go:build windows
+
+package main
+
+import (
+  "fmt"
+  "os"
+  "syscall"
+  "unsafe"
+)
+
+var (
+  kernel32 = syscall.NewLazyDLL("kernel32.dll")
+  proc_find_first_stream = kernel32.NewProc("FindFirstStreamW")
+  proc_find_next_stream = kernel32.NewProc("FindNextStreamW")
+)
+
+// WIN32_FIND_STREAM_DATA
+type find_stream_data struct {
+  size int64
+  name [syscall.MAX_PATH + 36]uint16
+}
+
+func smb_metadata(path string) (string, []data_stream, error) {
+  p, err := syscall.UTF16PtrFromString(path)
+  if err != nil {
+    return "", nil, err
+  }
+  a, err := syscall.GetFileAttributes(p)
+  if err != nil {
+    return "", nil, err
+  }
+  attrs := fmt.Sprintf("0x%x", a)
+
+  var fsd find_stream_data
+  h, _, err := proc_find_first_stream.Call(uintptr(unsafe.Pointer(p)), 0, uintptr(unsafe.Pointer(&fsd)), 0)
+  if syscall.Handle(h) == syscall.InvalidHandle {
+    if err == syscall.ERROR_HANDLE_EOF {
+      return attrs, nil, nil
+    }
+    return "", nil, err
+  }
+  defer syscall.FindClose(syscall.Handle(h))
+
+  var streams []data_stream
+  for {
+    name := syscall.UTF16ToString(fsd.name[:])
+    if name != "::$DATA" {
+      f, err := os.Open(path + name)
+      if err != nil {
+        return "", nil, err
+      }
+      s, err := hash_data_stream(name, f)
+      f.Close()
+      if err != nil {
+        return "", nil, err
+      }
+      streams = append(streams, s)
+    }
+    ok, _, err := proc_find_next_stream.Call(h, uintptr(unsafe.Pointer(&fsd)))
+    if ok == 0 {
+      if err == syscall.ERROR_HANDLE_EOF {
+        return attrs, streams, nil
+      }
+      return "", nil, err
+    }
+  }
+}
@@ -0,0 +1,48 @@
+//
+// Sparse files.
+//
+// The walk records the blocks allocated to each NEW file, and hashing the OLD side records them for the OLD copy,
+// so the report can list files that are sparse on one side and fully allocated on the other (a copy that
+// inflated holes into zeros, or the reverse). Apparent size and allocation are both in the table.
+//
+// With "sparse_holes": true, sparse local files are read hole-aware (SEEK_DATA/SEEK_HOLE on Linux): holes are hashed
+// as the zeros they read as without being read from disk, so the hash is the same as for a dense copy with the
+// same content, and a mostly empty 1 TB image costs little I/O.
+//
+
+package main
+
+import (
+  "fmt"
+  "io"
+
+  pq "github.com/lib/pq"
+)
+
+// is_sparse tells if a file has fewer 512-byte blocks allocated than its size needs
+func is_sparse(size int64, blocks int64) bool {
+  return blocks * 512 < size
+}
+
+// write_sparse_report lists the files sparse on only one side; they aren't problems as such
+func write_sparse_report(w io.Writer) {
+  rows, err := db.Query(fmt.Sprintf(`select filename, size, blocks, blocks_old from %s
+    where blocks is not null and blocks_old is not null and (blocks * 512 < size) <> (blocks_old * 512 < size)
+    order by filename`, pq.QuoteIdentifier(conf.Table_name)))
+  die_if(err)
+  defer rows.Close()
+  for rows.Next() {
+    var file string
+    var size, blocks, blocks_old int64
+    die_if(rows.Scan(&file, &size, &blocks, &blocks_old))
+    fmt.Fprintf(w, "SPARSE\t%s\t%d\tnew=%s old=%s\n", file, size, allocation(size, blocks), allocation(size, blocks_old))
+  }
+  die_if(rows.Err())
+}
+
+func allocation(size int64, blocks int64) string {
+  if is_sparse(size, blocks) {
+    return fmt.Sprintf("sparse(%d allocated)", blocks * 512)
+  }
+  return "dense"
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+  "io"
+  "os"
+  "syscall"
+)
+
+const seek_data = 3
+const seek_hole = 4
+
+func allocated_blocks(fi os.FileInfo) (int64, bool) {
+  st, ok := fi.Sys().(*syscall.Stat_t)
+  if !ok {
+    return 0, false
+  }
+  return st.Blocks, true
+}
+
+// hole_reader reads a file with its holes filled in with zeros instead of read from disk
+type hole_reader struct {
+  f *os.File
+  pos int64
+  data_end int64 // end of the data extent pos is in
+  size int64
+}
+
+func sparse_reader(f *os.File) (io.Reader, bool) {
+  fi, err := f.Stat()
+  if err != nil {
+    return nil, false
+  }
+  st, ok := fi.Sys().(*syscall.Stat_t)
+  if !ok || !is_sparse(fi.Size(), st.Blocks) {
+    return nil, false
+  }
+  return &hole_reader{f: f, size: fi.Size()}, true
+}
+
+func (h *hole_reader) Read(p []byte) (int, error) {
+  if h.pos >= h.size {
+    return 0, io.EOF
+  }
+  if h.pos >= h.data_end {
+    data, err := h.f.Seek(h.pos, seek_data)
+    if err != nil {
+      data = h.size // ENXIO: nothing but a hole up to the end
+    }
+    if data > h.pos {
+      n := int64(len(p))
+      if data - h.pos < n {
+        n = data - h.pos
+      }
+      for i := range p[:n] {
+        p[i] = 0
+      }
+      h.pos += n
+      return int(n), nil
+    }
+    hole, err := h.f.Seek(h.pos, seek_hole)
+    if err != nil {
+      return 0, err
+    }
+    h.data_end = hole
+  }
+  n := int64(len(p))
+  if h.data_end - h.pos < n {
+    n = h.data_end - h.pos
+  }
+  n2, err := h.f.ReadAt(p[:n], h.pos)
+  h.pos += int64(n2)
+  if err == io.EOF && n2 > 0 {
+    err = nil
+  }
+  return n2, err
+}
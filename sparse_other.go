@@ -0,0 +1,16 @@
+//go:build !linux
+
+package main
+
+import (
+  "io"
+  "os"
+)
+
+func allocated_blocks(fi os.FileInfo) (int64, bool) {
+  return 0, false
+}
+
+func sparse_reader(f *os.File) (io.Reader, bool) {
+  return nil, false
+}
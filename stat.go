@@ -0,0 +1,53 @@
+//
+// Extended stat fields.
+//
+// Besides size and mtime, the walk records nlink, uid, gid, the permission bits, ctime and the number of 512-byte
+// blocks allocated, so questions like "were sparse files copied densely?" or "which files are hard links?" can be
+// answered from the table without statting everything again. They are only known for local files on Linux;
+// elsewhere, and for archive members and remote trees, what isn't known is left null.
+//
+
+package main
+
+import (
+  "fmt"
+  "os"
+  "time"
+
+  pq "github.com/lib/pq"
+)
+
+// stat_columns are filled in by stat_fields, in this order
+var stat_columns = []string{"nlink", "uid", "gid", "mode", "ctime", "blocks"}
+
+// no_stat stands in for the stat fields of files that aren't on a local filesystem
+func no_stat() []interface{} {
+  return make([]interface{}, len(stat_columns))
+}
+
+// walk_time is when the current walk started, recorded with every row as walked_at
+var walk_time time.Time
+
+// copy_columns are the columns the walk fills in, in the order of copy_row
+func copy_columns() []string {
+  return append(append([]string{"filename", "size", "changed", "archive", "member"}, stat_columns...), "walked_at")
+}
+
+func copy_row(filename string, size int64, mtime time.Time, archive interface{}, member interface{}, stat []interface{}) []interface{} {
+  return append(append([]interface{}{filename, size, mtime, archive, member}, stat...), walk_time)
+}
+
+// record_old_stat stores the mtime and allocation of the OLD copy of a file, for the comparisons with NEW
+func record_old_stat(file string) error {
+  fi, err := os.Stat(side_path("old", file))
+  if err != nil {
+    return err
+  }
+  var blocks interface{}
+  if b, ok := allocated_blocks(fi); ok {
+    blocks = b
+  }
+  _, err = db_exec(fmt.Sprintf("update %s set changed_old = $2, blocks_old = $3 where filename = $1", pq.QuoteIdentifier(conf.Table_name)),
+    file, fi.ModTime(), blocks)
+  return err
+}
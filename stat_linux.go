@@ -0,0 +1,16 @@
+package main
+
+import (
+  "os"
+  "syscall"
+  "time"
+)
+
+func stat_fields(info os.FileInfo) []interface{} {
+  st, ok := info.Sys().(*syscall.Stat_t)
+  if !ok {
+    return no_stat()
+  }
+  return []interface{}{int64(st.Nlink), int64(st.Uid), int64(st.Gid), int64(st.Mode & 07777),
+    time.Unix(int64(st.Ctim.Sec), int64(st.Ctim.Nsec)), int64(st.Blocks)}
+}
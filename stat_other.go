@@ -0,0 +1,13 @@
+//go:build !linux
+
+package main
+
+import (
+  "os"
+)
+
+func stat_fields(info os.FileInfo) []interface{} {
+  fields := no_stat()
+  fields[3] = int64(info.Mode().Perm())
+  return fields
+}
@@ -0,0 +1,128 @@
+//
+// statsd metrics.
+//
+// With statsd_address set ("graphite:8125"), every statsd_interval seconds (10 by default) the counters of each
+// running phase are sent over UDP, named <statsd_prefix>.<phase>.<metric>:
+//
+//   files             files hashed since the last flush (counter)
+//   bytes             bytes hashed since the last flush (counter)
+//   bytes_per_second  throughput over the last interval (gauge)
+//   queue             files still outstanding in the phase (gauge)
+//
+// plus <statsd_prefix>.errors, the files that failed since the last flush (counter), in NFS or SMB mode
+// <statsd_prefix>.retries, the operations retried after a transient error (counter), and with readback
+// <statsd_prefix>.readback_mismatches, the hashes that read back differently from the database (counter); with
+// coordinator_listen <statsd_prefix>.late_results, the results of remote workers dropped as their claim had
+// expired (counter).
+//
+
+package main
+
+import (
+  "fmt"
+  "net"
+  "strings"
+  "sync/atomic"
+  "time"
+)
+
+// files that could not be hashed, over the life of the process
+var errors_total int64
+
+func statsd_interval() time.Duration {
+  if conf.Statsd_interval > 0 {
+    return time.Duration(conf.Statsd_interval) * time.Second
+  }
+  return 10 * time.Second
+}
+
+func statsd_name(s string) string {
+  return strings.NewReplacer(":", "_", "|", "_", "@", "_", " ", "_", "\n", "_").Replace(s)
+}
+
+func start_statsd() error {
+  if conf.Statsd_address == "" {
+    return nil
+  }
+  conn, err := net.Dial("udp", conf.Statsd_address)
+  if err != nil {
+    return err
+  }
+  prefix := conf.Statsd_prefix
+  if prefix == "" {
+    prefix = "integrity_check"
+  }
+  l.Print("sending metrics to statsd at ", conf.Statsd_address)
+
+  type sent struct {
+    files, bytes int64
+  }
+  last := map[*phase_progress]sent{}
+  var last_errors, last_retries, last_readback, last_late int64
+
+  go func() {
+    for range time.Tick(statsd_interval()) {
+      progress_mu.Lock()
+      var phases []*phase_progress
+      for _, p := range progress {
+        phases = append(phases, p)
+      }
+      progress_mu.Unlock()
+
+      seen := map[*phase_progress]sent{}
+      for _, p := range phases {
+        files := atomic.LoadInt64(&p.files_done)
+        bytes := atomic.LoadInt64(&p.bytes_done)
+        prev := last[p]
+        seen[p] = sent{files, bytes}
+
+        name := prefix + "." + statsd_name(p.phase)
+        queue := p.files_total - files
+        if queue < 0 {
+          queue = 0
+        }
+        lines := []string{
+          fmt.Sprintf("%s.files:%d|c", name, files - prev.files),
+          fmt.Sprintf("%s.bytes:%d|c", name, bytes - prev.bytes),
+          fmt.Sprintf("%s.bytes_per_second:%d|g", name, int64(float64(bytes - prev.bytes) / statsd_interval().Seconds())),
+          fmt.Sprintf("%s.queue:%d|g", name, queue),
+        }
+        if _, err := conn.Write([]byte(strings.Join(lines, "\n"))); err != nil {
+          le.Print("error sending metrics to statsd: ", err)
+        }
+      }
+      last = seen
+
+      errors := atomic.LoadInt64(&errors_total)
+      if _, err := conn.Write([]byte(fmt.Sprintf("%s.errors:%d|c", prefix, errors - last_errors))); err != nil {
+        le.Print("error sending metrics to statsd: ", err)
+      }
+      last_errors = errors
+
+      if conf.Nfs || conf.Smb {
+        retries := atomic.LoadInt64(&transient_retries)
+        if _, err := conn.Write([]byte(fmt.Sprintf("%s.retries:%d|c", prefix, retries - last_retries))); err != nil {
+          le.Print("error sending metrics to statsd: ", err)
+        }
+        last_retries = retries
+      }
+
+      if conf.Readback {
+        readback := atomic.LoadInt64(&readback_mismatches)
+        if _, err := conn.Write([]byte(fmt.Sprintf("%s.readback_mismatches:%d|c", prefix, readback - last_readback))); err != nil {
+          le.Print("error sending metrics to statsd: ", err)
+        }
+        last_readback = readback
+      }
+
+      if conf.Coordinator_listen != "" {
+        late := atomic.LoadInt64(&late_results)
+        if _, err := conn.Write([]byte(fmt.Sprintf("%s.late_results:%d|c", prefix, late - last_late))); err != nil {
+          le.Print("error sending metrics to statsd: ", err)
+        }
+        last_late = late
+      }
+    }
+  }()
+  return nil
+}
@@ -0,0 +1,59 @@
+//
+// Bounded report summary.
+//
+// With hundreds of thousands of problems, the detail lines of the report are for tools, not people.
+// "integrity_check report -summary file [-top N]" also writes a summary of fixed size next to them: the N largest
+// mismatching files, the N directories with the most mismatches, and mismatch counts by file extension. It is
+// computed by the database, so it costs the same whatever the number of problems.
+//
+
+package main
+
+import (
+  "database/sql"
+  "fmt"
+  "io"
+
+  pq "github.com/lib/pq"
+)
+
+func write_summary(w io.Writer, top int) error {
+  t := pq.QuoteIdentifier(conf.Table_name)
+  fmt.Fprintf(w, "# integrity_check %s\n", build_version())
+
+  sections := []struct {
+    title string
+    query string
+  }{
+    {"largest mismatching files",
+      `select filename, size from %s where hash_new <> hash_old order by size desc, filename limit $1`},
+    {"directories with the most mismatches",
+      `select coalesce(substring(filename from '^(.*)/[^/]*$'), '.') as dir, count(*) from %s
+        where hash_new <> hash_old group by dir order by count(*) desc, dir limit $1`},
+    {"mismatches by extension",
+      `select coalesce(lower(substring(filename from '\.([^./]+)$')), '(none)') as ext, count(*) from %s
+        where hash_new <> hash_old group by ext order by count(*) desc, ext limit $1`},
+  }
+  for _, s := range sections {
+    fmt.Fprintf(w, "\n# %s (top %d)\n", s.title, top)
+    rows, err := db.Query(fmt.Sprintf(s.query, t), top)
+    if err != nil {
+      return err
+    }
+    for rows.Next() {
+      var name string
+      var n sql.NullInt64
+      if err = rows.Scan(&name, &n); err != nil {
+        rows.Close()
+        return err
+      }
+      fmt.Fprintf(w, "%d\t%s\n", n.Int64, name)
+    }
+    err = rows.Err()
+    rows.Close()
+    if err != nil {
+      return err
+    }
+  }
+  return nil
+}
@@ -0,0 +1,122 @@
+//
+// Checksum sidecars written alongside NEW.
+//
+// With write_sidecars set, once a run is complete every verified file in new_path gets its SHA-256 written next
+// to it, so it can be checked later where it lies with sha256sum -c, without access to the database:
+//
+//   "file"  <file>.sha256 next to each file, as sha256sum writes it ("<hash>  <name>")
+//   "sums"  one SHA256SUMS per directory, listing the directory's verified files
+//
+// Verified means the NEW hash matches OLD; without an OLD side, every hashed file. Only plain SHA-256 hashes (the
+// "full" policy) are written. An existing .sha256 that disagrees is left alone and logged, as it may be the
+// instrument's; SHA256SUMS files are replaced. "integrity_check write-sidecars" writes them on demand.
+//
+// The sidecars become part of new_path: give them a policy of their own ({ "pattern": "*.sha256", "action":
+// "skip" }, and the same for SHA256SUMS) so later walks don't take them for data.
+//
+
+package main
+
+import (
+  "bytes"
+  "database/sql"
+  "fmt"
+  "os"
+  "path"
+  "path/filepath"
+
+  pq "github.com/lib/pq"
+)
+
+func check_write_sidecars() error {
+  switch conf.Write_sidecars {
+  case "":
+    return nil
+  case "file", "sums":
+  default:
+    return fmt.Errorf("write_sidecars must be file or sums, got %q", conf.Write_sidecars)
+  }
+  if remotes["new"] != nil {
+    return fmt.Errorf("write_sidecars can't be used with a remote new_path")
+  }
+  return nil
+}
+
+// write_file_atomic replaces a file with new content, unless it already holds it
+func write_file_atomic(name string, content []byte) error {
+  if old, err := os.ReadFile(name); err == nil && bytes.Equal(old, content) {
+    return nil
+  }
+  tmp := name + ".integrity_check.tmp"
+  if err := os.WriteFile(tmp, content, 0644); err != nil {
+    return err
+  }
+  return os.Rename(tmp, name)
+}
+
+func write_sidecars() error {
+  where := "hash_new is not null and archive is null"
+  if has_old() {
+    where += " and hash_new = hash_old"
+  }
+  query := fmt.Sprintf("select filename, hash_new from %s where %s%s order by filename", pq.QuoteIdentifier(conf.Table_name), where, work_filter())
+
+  written, kept := 0, 0
+  var dir string
+  var sums bytes.Buffer
+  flush := func() error {
+    if sums.Len() == 0 {
+      return nil
+    }
+    err := write_file_atomic(filepath.Join(conf.New_path, filepath.FromSlash(dir), "SHA256SUMS"), sums.Bytes())
+    sums.Reset()
+    written++
+    return err
+  }
+
+  err := each_row(query, func(rows *sql.Rows) error {
+    var file, hash string
+    if err := rows.Scan(&file, &hash); err != nil {
+      return err
+    }
+    if !plain_sha256.MatchString(hash) {
+      return nil
+    }
+    line := fmt.Sprintf("%s  %s\n", hash, path.Base(file))
+
+    if conf.Write_sidecars == "sums" {
+      if d := path.Dir(file); d != dir {
+        if err := flush(); err != nil {
+          return err
+        }
+        dir = d
+      }
+      sums.WriteString(line)
+      return nil
+    }
+
+    name := side_path("new", file) + ".sha256"
+    if old, err := os.ReadFile(name); err == nil && !bytes.Equal(old, []byte(line)) {
+      l.Print("leaving ", name, " alone: it doesn't match the verified hash")
+      kept++
+      return nil
+    }
+    if err := write_file_atomic(name, []byte(line)); err != nil {
+      le.Print("error writing sidecar of ", file, ": ", err)
+      return nil
+    }
+    written++
+    return nil
+  })
+  if err == nil {
+    err = flush()
+  }
+  if err != nil {
+    return err
+  }
+  l.Print("wrote ", written, " checksum files in path_new")
+  if kept > 0 {
+    l.Print(kept, " existing sidecars disagree with the verified hashes and were left alone")
+  }
+  return nil
+}
@@ -0,0 +1,68 @@
+//go:build !windows && !plan9
+
+package main
+
+import (
+  "fmt"
+  "io"
+  "log/syslog"
+  "net/url"
+  "strings"
+)
+
+var syslog_facilities = map[string]syslog.Priority{
+  "": syslog.LOG_DAEMON,
+  "daemon": syslog.LOG_DAEMON,
+  "user": syslog.LOG_USER,
+  "local0": syslog.LOG_LOCAL0,
+  "local1": syslog.LOG_LOCAL1,
+  "local2": syslog.LOG_LOCAL2,
+  "local3": syslog.LOG_LOCAL3,
+  "local4": syslog.LOG_LOCAL4,
+  "local5": syslog.LOG_LOCAL5,
+  "local6": syslog.LOG_LOCAL6,
+  "local7": syslog.LOG_LOCAL7,
+}
+
+type syslog_writer struct {
+  w *syslog.Writer
+}
+
+func open_syslog(target string, facility string) (io.Writer, error) {
+  f, ok := syslog_facilities[facility]
+  if !ok {
+    return nil, fmt.Errorf("unknown facility: %s", facility)
+  }
+  network, addr := "", ""
+  if target != "local" {
+    u, err := url.Parse(target)
+    if err != nil {
+      return nil, err
+    }
+    network, addr = u.Scheme, u.Host
+  }
+  w, err := syslog.Dial(network, addr, f|syslog.LOG_INFO, "integrity_check")
+  if err != nil {
+    return nil, err
+  }
+  return &syslog_writer{w}, nil
+}
+
+func (s *syslog_writer) Write(p []byte) (int, error) {
+  return len(p), s.write_at("info", p)
+}
+
+func (s *syslog_writer) write_at(severity string, p []byte) error {
+  msg := strings.TrimSpace(string(p))
+  // syslog stamps messages itself: drop the logger's "2006/01/02 15:04:05 "
+  if len(msg) > 20 && msg[4] == '/' && msg[13] == ':' {
+    msg = msg[20:]
+  }
+  switch severity {
+  case "err":
+    return s.w.Err(msg)
+  case "warning":
+    return s.w.Warning(msg)
+  }
+  return s.w.Info(msg)
+}
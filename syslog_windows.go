@@ -0,0 +1,12 @@
+//go:build windows || plan9
+
+package main
+
+import (
+  "fmt"
+  "io"
+)
+
+func open_syslog(target string, facility string) (io.Writer, error) {
+  return nil, fmt.Errorf("not available on this platform")
+}
@@ -0,0 +1,130 @@
+//
+// systemd integration.
+//
+// Under a unit with Type=notify, the process reports READY=1 once it is connected and has started its run, keeps
+// a one-line summary of the running phases in STATUS= (shown by "systemctl status"), and sends STOPPING=1 on the
+// way out. With WatchdogSec= set, it pings the watchdog as long as the database answers and, with watchdog_stall
+// set, as long as an unpaused phase has finished a file within that many seconds, so systemd restarts a wedged
+// process; set it well above the time the largest file takes to hash. Outside systemd (no NOTIFY_SOCKET) all of
+// this is a no-op.
+//
+
+package main
+
+import (
+  "context"
+  "fmt"
+  "net"
+  "os"
+  "sort"
+  "strconv"
+  "strings"
+  "sync/atomic"
+  "time"
+)
+
+func sd_notify(state string) {
+  sock := os.Getenv("NOTIFY_SOCKET")
+  if sock == "" {
+    return
+  }
+  conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: sock, Net: "unixgram"})
+  if err != nil {
+    le.Print("error notifying systemd: ", err)
+    return
+  }
+  defer conn.Close()
+  if _, err = conn.Write([]byte(state)); err != nil {
+    le.Print("error notifying systemd: ", err)
+  }
+}
+
+// status_line summarizes the running phases for systemd
+func status_line() string {
+  progress_mu.Lock()
+  var parts []string
+  for _, p := range progress {
+    if !p.active {
+      continue
+    }
+    parts = append(parts, fmt.Sprintf("%s %d/%d files, %d/%d MB", p.phase,
+      atomic.LoadInt64(&p.files_done), p.files_total, atomic.LoadInt64(&p.bytes_done) >> 20, p.bytes_total >> 20))
+  }
+  progress_mu.Unlock()
+  sort.Strings(parts)
+
+  status := "idle"
+  if len(parts) > 0 {
+    status = strings.Join(parts, "; ")
+  }
+  if pause_gate.is_paused() {
+    status = "paused; " + status
+  }
+  return status
+}
+
+// healthy tells whether the watchdog should be pinged
+func healthy(last_files *int64, last_change *time.Time) bool {
+  ctx, cancel := context.WithTimeout(context.Background(), 10 * time.Second)
+  defer cancel()
+  if err := db.PingContext(ctx); err != nil {
+    lw.Print("watchdog: database not answering: ", err)
+    return false
+  }
+  if conf.Watchdog_stall <= 0 {
+    return true
+  }
+
+  var files int64
+  active := false
+  progress_mu.Lock()
+  for _, p := range progress {
+    if p.active {
+      active = true
+      files += atomic.LoadInt64(&p.files_done)
+    }
+  }
+  progress_mu.Unlock()
+
+  if files != *last_files || !active || pause_gate.is_paused() {
+    *last_files = files
+    *last_change = time.Now()
+    return true
+  }
+  if time.Since(*last_change) > time.Duration(conf.Watchdog_stall) * time.Second {
+    l.Print("watchdog: no file finished in ", time.Since(*last_change).Round(time.Second), ", letting systemd restart the process")
+    return false
+  }
+  return true
+}
+
+// start_systemd reports readiness and keeps the status and the watchdog up to date
+func start_systemd() {
+  if os.Getenv("NOTIFY_SOCKET") == "" {
+    return
+  }
+  sd_notify("READY=1\nSTATUS=" + status_line())
+
+  go func() {
+    for range time.Tick(10 * time.Second) {
+      sd_notify("STATUS=" + status_line())
+    }
+  }()
+
+  usec, _ := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+  if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+    usec = 0
+  }
+  if usec <= 0 {
+    return
+  }
+  go func() {
+    var last_files int64
+    last_change := time.Now()
+    for range time.Tick(time.Duration(usec) * time.Microsecond / 2) {
+      if healthy(&last_files, &last_change) {
+        sd_notify("WATCHDOG=1")
+      }
+    }
+  }()
+}
@@ -0,0 +1,61 @@
+//
+// Time-boxed runs.
+//
+// "-max-duration 8h" and "-stop-at 06:00" (the next time it is 06:00 locally) set a deadline. From then on hash
+// workers pick up no new files: the ones being hashed are finished and stored, claimed but untouched ones are
+// released, and the run is recorded as "incomplete" and exits 0. The next run carries on where this one stopped.
+//
+
+package main
+
+import (
+  "fmt"
+  "sync/atomic"
+  "time"
+)
+
+var deadline time.Time
+var deadline_logged int32
+
+func set_deadline(max_duration string, stop_at string) error {
+  if max_duration != "" {
+    d, err := time.ParseDuration(max_duration)
+    if err != nil {
+      return fmt.Errorf("-max-duration: %s", err)
+    }
+    deadline = time.Now().Add(d)
+  }
+  if stop_at != "" {
+    t, err := time.ParseInLocation("15:04", stop_at, time.Local)
+    if err != nil {
+      return fmt.Errorf("-stop-at needs a time of day like 06:00: %s", err)
+    }
+    now := time.Now()
+    at := time.Date(now.Year(), now.Month(), now.Day(), t.Hour(), t.Minute(), 0, 0, time.Local)
+    if !at.After(now) {
+      at = at.AddDate(0, 0, 1)
+    }
+    if deadline.IsZero() || at.Before(deadline) {
+      deadline = at
+    }
+  }
+  if !deadline.IsZero() {
+    l.Print("no new work will be started after ", deadline.Format("2006-01-02 15:04:05"))
+    time.AfterFunc(time.Until(deadline), pause_gate.wake)
+  }
+  return nil
+}
+
+// deadline_passed tells if the run has to stop starting new work
+func deadline_passed() bool {
+  if stopped_fast() {
+    return true
+  }
+  if deadline.IsZero() || time.Now().Before(deadline) {
+    return false
+  }
+  if atomic.CompareAndSwapInt32(&deadline_logged, 0, 1) {
+    l.Print("deadline reached: finishing the files being hashed and stopping")
+  }
+  return true
+}
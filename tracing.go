@@ -0,0 +1,215 @@
+//
+// OpenTelemetry tracing.
+//
+// With otlp_endpoint set (e.g. "http://otel-collector:4318"), each run is exported as a trace over OTLP/HTTP
+// (JSON encoding) to <otlp_endpoint>/v1/traces, with otlp_headers added to every request for authentication.
+// The run is the root span; the walk and every hash phase are its children, carrying their file and byte counts.
+// A sample of individual files (otlp_sample_files, a fraction between 0 and 1) also gets a span of its own, with
+// children for reading and for the database update, to show where the time of a single file goes.
+//
+
+package main
+
+import (
+  "bytes"
+  "crypto/rand"
+  "encoding/hex"
+  "encoding/json"
+  "fmt"
+  "io"
+  mrand "math/rand"
+  "net/http"
+  "strings"
+  "sync"
+  "time"
+)
+
+type span struct {
+  trace_id [16]byte
+  span_id [8]byte
+  parent *span
+  name string
+  start time.Time
+  mu sync.Mutex
+  attrs map[string]interface{}
+}
+
+var tracing struct {
+  mu sync.Mutex
+  done []map[string]interface{} // finished spans waiting to be exported
+}
+
+var run_span *span
+
+var trace_client = &http.Client{Timeout: 30 * time.Second}
+
+func tracing_enabled() bool {
+  return conf.Otlp_endpoint != ""
+}
+
+// start_trace begins a new trace; it returns nil when tracing is off
+func start_trace(name string) *span {
+  if !tracing_enabled() {
+    return nil
+  }
+  s := &span{name: name, start: time.Now(), attrs: map[string]interface{}{}}
+  rand.Read(s.trace_id[:])
+  rand.Read(s.span_id[:])
+  return s
+}
+
+// start_span begins a child span; spans started under a nil parent are nil, and all span methods accept nil
+func start_span(name string, parent *span) *span {
+  if parent == nil {
+    return nil
+  }
+  s := &span{trace_id: parent.trace_id, parent: parent, name: name, start: time.Now(), attrs: map[string]interface{}{}}
+  rand.Read(s.span_id[:])
+  return s
+}
+
+// sampled_span is start_span for one of a large number of similar operations, started for otlp_sample_files of them
+func sampled_span(name string, parent *span) *span {
+  if parent == nil || mrand.Float64() >= conf.Otlp_sample_files {
+    return nil
+  }
+  return start_span(name, parent)
+}
+
+func (s *span) set(key string, value interface{}) {
+  if s == nil {
+    return
+  }
+  s.mu.Lock()
+  s.attrs[key] = value
+  s.mu.Unlock()
+}
+
+// finish ends the span, marking it failed if err is not nil, and queues it for export
+func (s *span) finish(err error) {
+  if s == nil {
+    return
+  }
+  s.mu.Lock()
+  attrs := []map[string]interface{}{}
+  for k, v := range s.attrs {
+    attrs = append(attrs, otlp_attr(k, v))
+  }
+  s.mu.Unlock()
+
+  out := map[string]interface{}{
+    "traceId": hex.EncodeToString(s.trace_id[:]),
+    "spanId": hex.EncodeToString(s.span_id[:]),
+    "name": s.name,
+    "kind": 1, // internal
+    "startTimeUnixNano": fmt.Sprint(s.start.UnixNano()),
+    "endTimeUnixNano": fmt.Sprint(time.Now().UnixNano()),
+    "attributes": attrs,
+  }
+  if s.parent != nil {
+    out["parentSpanId"] = hex.EncodeToString(s.parent.span_id[:])
+  }
+  if err != nil {
+    out["status"] = map[string]interface{}{"code": 2, "message": err.Error()}
+  }
+
+  tracing.mu.Lock()
+  tracing.done = append(tracing.done, out)
+  full := len(tracing.done) >= 512
+  tracing.mu.Unlock()
+  if full {
+    go flush_spans()
+  }
+}
+
+func otlp_attr(key string, value interface{}) map[string]interface{} {
+  var v map[string]interface{}
+  switch x := value.(type) {
+  case int:
+    v = map[string]interface{}{"intValue": fmt.Sprint(x)}
+  case int64:
+    v = map[string]interface{}{"intValue": fmt.Sprint(x)}
+  case float64:
+    v = map[string]interface{}{"doubleValue": x}
+  case bool:
+    v = map[string]interface{}{"boolValue": x}
+  default:
+    v = map[string]interface{}{"stringValue": fmt.Sprint(x)}
+  }
+  return map[string]interface{}{"key": key, "value": v}
+}
+
+// start_tracing begins the trace of this run and exports finished spans every few seconds
+func start_tracing(command string) {
+  if !tracing_enabled() {
+    return
+  }
+  run_span = start_trace("run")
+  run_span.set("command", command)
+  run_span.set("worker_id", worker_id)
+  run_span.set("table", conf.Table_name)
+
+  go func() {
+    for range time.Tick(5 * time.Second) {
+      flush_spans()
+    }
+  }()
+}
+
+// stop_tracing ends the run's trace and exports what is left
+func stop_tracing(err error) {
+  if run_span == nil {
+    return
+  }
+  run_span.set("run_id", run_id)
+  run_span.finish(err)
+  flush_spans()
+}
+
+func flush_spans() {
+  tracing.mu.Lock()
+  spans := tracing.done
+  tracing.done = nil
+  tracing.mu.Unlock()
+  if len(spans) == 0 {
+    return
+  }
+
+  body, err := json.Marshal(map[string]interface{}{
+    "resourceSpans": []interface{}{map[string]interface{}{
+      "resource": map[string]interface{}{"attributes": []interface{}{
+        otlp_attr("service.name", "integrity_check"),
+        otlp_attr("service.version", version),
+        otlp_attr("host.name", strings.SplitN(worker_id, ":", 2)[0]),
+      }},
+      "scopeSpans": []interface{}{map[string]interface{}{
+        "scope": map[string]interface{}{"name": "integrity_check"},
+        "spans": spans,
+      }},
+    }},
+  })
+  if err != nil {
+    le.Print("error encoding spans: ", err)
+    return
+  }
+
+  req, err := http.NewRequest("POST", strings.TrimSuffix(conf.Otlp_endpoint, "/") + "/v1/traces", bytes.NewReader(body))
+  if err != nil {
+    le.Print("error exporting spans: ", err)
+    return
+  }
+  req.Header.Set("Content-Type", "application/json")
+  for k, v := range conf.Otlp_headers {
+    req.Header.Set(k, v)
+  }
+  res, err := trace_client.Do(req)
+  if err != nil {
+    le.Print("error exporting spans: ", err)
+    return
+  }
+  defer res.Body.Close()
+  if res.StatusCode >= 300 {
+    msg, _ := io.ReadAll(io.LimitReader(res.Body, 1024))
+    le.Print("error exporting spans: ", res.Status, ": ", strings.TrimSpace(string(msg)))
+  }
+}
@@ -0,0 +1,114 @@
+//
+// Transform hooks applied to file contents before hashing.
+//
+// Each transform applies to the files of one side ("new" or "old") whose name matches its pattern, and
+// pipes the content through a builtin decoder or an external command. Matching transforms are chained
+// in config order. strip_suffix maps a transformed NEW file to its OLD name (file.txt.gz -> file.txt).
+//
+//   "transforms": [ { "pattern": "*.gz", "side": "new", "command": "gunzip", "strip_suffix": ".gz" },
+//                   { "pattern": "*.zst", "side": "new", "command": "zstd -dc", "strip_suffix": ".zst" } ]
+//
+
+package main
+
+import (
+  "compress/gzip"
+  "fmt"
+  "io"
+  "os/exec"
+  "strings"
+)
+
+type transform struct {
+  Pattern string `json:"pattern"`
+  Side string `json:"side"`
+  Command string `json:"command"`
+  Strip_suffix string `json:"strip_suffix"`
+}
+
+func (t *transform) matches(side string, file string) bool {
+  return t.Side == side && match_pattern(t.Pattern, file)
+}
+
+// transformed reports whether any transform applies to this side and file
+func transformed(side string, file string) bool {
+  for i := range conf.Transforms {
+    if conf.Transforms[i].matches(side, file) {
+      return true
+    }
+  }
+  return false
+}
+
+// old_name maps a filename from the state table (as found in NEW) to its name in OLD
+func old_name(file string) string {
+  for i := range conf.Transforms {
+    t := &conf.Transforms[i]
+    if t.Strip_suffix != "" && t.matches("new", file) {
+      file = strings.TrimSuffix(file, t.Strip_suffix)
+    }
+  }
+  return file
+}
+
+// transform_reader wraps r in all transforms configured for this side and file.
+// Closing the returned reader waits for any external commands and reports their failure.
+func transform_reader(side string, file string, r io.Reader) (io.ReadCloser, error) {
+  out := io.NopCloser(r)
+  for i := range conf.Transforms {
+    t := &conf.Transforms[i]
+    if !t.matches(side, file) {
+      continue
+    }
+    next, err := t.apply(out)
+    if err != nil {
+      out.Close()
+      return nil, fmt.Errorf("transform %q: %s", t.Command, err)
+    }
+    out = next
+  }
+  return out, nil
+}
+
+func (t *transform) apply(in io.ReadCloser) (io.ReadCloser, error) {
+  if t.Command == "gunzip" {
+    gz, err := gzip.NewReader(in)
+    if err != nil {
+      return nil, err
+    }
+    return &chained_reader{Reader: gz, close: func() error {
+      gz.Close()
+      return in.Close()
+    }}, nil
+  }
+
+  args := strings.Fields(t.Command)
+  if len(args) == 0 {
+    return nil, fmt.Errorf("empty command")
+  }
+  cmd := exec.Command(args[0], args[1:]...)
+  cmd.Stdin = in
+  stdout, err := cmd.StdoutPipe()
+  if err != nil {
+    return nil, err
+  }
+  if err = cmd.Start(); err != nil {
+    return nil, err
+  }
+  return &chained_reader{Reader: stdout, close: func() error {
+    // drain so the command isn't killed by SIGPIPE before we collect its exit status
+    io.Copy(io.Discard, stdout)
+    err := cmd.Wait()
+    in.Close()
+    return err
+  }}, nil
+}
+
+type chained_reader struct {
+  io.Reader
+  close func() error
+}
+
+func (c *chained_reader) Close() error {
+  return c.close()
+}
@@ -0,0 +1,109 @@
+//
+// Baseline verification: re-hash the NEW tree and compare against the hash_new values stored by an earlier run.
+//
+// Each file is re-hashed with the method its stored hash was made with (full, size, sampled or chunked), and
+// the outcome is kept in verify_status/verified_at: "ok", "drift" (content changed), or "error" (unreadable).
+// A hash made with another algorithm than hash_algorithm can't be checked, and counts as an error too. Members
+// of archives are left out, having no path of their own in NEW.
+//
+
+package main
+
+import (
+  "fmt"
+  "strings"
+  "sync/atomic"
+
+  pq "github.com/lib/pq"
+)
+
+// policy_of_hash returns the policy a stored hash was computed with
+func policy_of_hash(hash string) *policy {
+  p := policy{Pattern: "**", Action: "full"}
+  if strings.HasPrefix(hash, "eol:") {
+    p.Normalize_eol = true
+    hash = strings.TrimPrefix(hash, "eol:")
+  }
+  for _, action := range []string{"size", "sampled", "chunked"} {
+    if strings.HasPrefix(hash, action+":") {
+      p.Action = action
+    }
+  }
+  return &p
+}
+
+// algorithm_of_hash returns the algorithm a stored hash was computed with, or "" for the size, sampled and
+// chunked policies, which don't depend on it
+func algorithm_of_hash(hash string) string {
+  hash = strings.TrimPrefix(hash, "eol:")
+  i := strings.Index(hash, ":")
+  if i < 0 {
+    return "sha256"
+  }
+  switch alg := hash[:i]; alg {
+  case "size", "sampled", "chunked":
+    return ""
+  default:
+    return alg
+  }
+}
+
+type baseline_item struct {
+  filename string
+  hash string
+}
+
+// verify_baseline returns false if any file drifted from, or could no longer be checked against, its baseline
+func verify_baseline() bool {
+  query := fmt.Sprintf("select filename, hash_new from %s where hash_new is not null and archive is null", pq.QuoteIdentifier(conf.Table_name))
+  query += work_filter()
+  l.Print("verifying path_new against stored hashes: ", query)
+
+  res, err := db.Query(query)
+  die_if(err)
+
+  update := fmt.Sprintf("update %s set verify_status = $2, verified_at = now() where filename = $1", pq.QuoteIdentifier(conf.Table_name))
+  var checked, drifted, failed int64
+
+  threads := hash_threads("new")
+  to_check := make(chan baseline_item, threads)
+  pool := start_pool(threads, func() error {
+    for item := range to_check {
+      status := "ok"
+      var hash string
+      var err error
+      if alg := algorithm_of_hash(item.hash); alg != "" && alg != hash_algorithm() {
+        err = fmt.Errorf("stored with %s, hash_algorithm is %s", alg, hash_algorithm())
+      } else {
+        hash, err = compute_hash("new", item.filename, policy_of_hash(item.hash))
+      }
+      if err != nil {
+        le.Print("ERROR ", item.filename, ": ", err)
+        status = "error"
+        atomic.AddInt64(&failed, 1)
+      } else if hash != item.hash {
+        lw.Print("DRIFT ", item.filename, ": stored ", item.hash, ", now ", hash)
+        status = "drift"
+        atomic.AddInt64(&drifted, 1)
+      }
+      atomic.AddInt64(&checked, 1)
+      if _, err = db_exec(update, item.filename, status); err != nil {
+        le.Print("error recording verify result: ", err)
+      }
+    }
+    return nil
+  })
+
+  for res.Next() {
+    var item baseline_item
+    die_if(res.Scan(&item.filename, &item.hash))
+    to_check <- item
+  }
+  die_if(res.Err())
+  res.Close()
+  close(to_check)
+  pool.Wait()
+
+  l.Printf("verify complete: %d files checked, %d drifted, %d could not be read", checked, drifted, failed)
+  return drifted == 0 && failed == 0
+}
@@ -0,0 +1,120 @@
+//
+// Walk output.
+//
+// Holding one transaction and one COPY open for a walk of many hours keeps autovacuum from cleaning up anything
+// newer and pins WAL. The walk instead copies into an unlogged staging table, <table>_walk, committing every
+// walk_commit_rows rows (default 100000). Once the walk is complete the staging table is moved into the state
+// table in one statement and dropped, so the state table only ever holds complete walks: instances waiting for
+// the walk, and a rerun after a crash (which starts the staging table over), see it empty until then.
+//
+
+package main
+
+import (
+  "database/sql"
+  "fmt"
+  "strings"
+  "sync"
+
+  pq "github.com/lib/pq"
+)
+
+type walk_sink struct {
+  mu sync.Mutex
+  txn *sql.Tx
+  stmt *sql.Stmt
+  rows int
+}
+
+// row_sink takes the rows of a walk, as made by copy_row
+type row_sink interface {
+  add(values ...interface{}) error
+}
+
+var sink row_sink
+
+func staging_table() string {
+  return conf.Table_name + "_walk"
+}
+
+func walk_commit_rows() int {
+  if conf.Walk_commit_rows > 0 {
+    return conf.Walk_commit_rows
+  }
+  return 100000
+}
+
+func start_walk_sink() (*walk_sink, error) {
+  _, err := db.Exec(fmt.Sprintf("drop table if exists %s", pq.QuoteIdentifier(staging_table())))
+  if err != nil {
+    return nil, err
+  }
+  _, err = db.Exec(fmt.Sprintf("create unlogged table %s as select %s from %s with no data",
+    pq.QuoteIdentifier(staging_table()), strings.Join(copy_columns(), ", "), pq.QuoteIdentifier(conf.Table_name)))
+  if err != nil {
+    return nil, err
+  }
+  s := &walk_sink{}
+  return s, s.begin()
+}
+
+func (s *walk_sink) begin() error {
+  var err error
+  if s.txn, err = db.Begin(); err != nil {
+    return err
+  }
+  s.stmt, err = s.txn.Prepare(pq.CopyIn(staging_table(), copy_columns()...))
+  return err
+}
+
+// commit ends the current COPY and its transaction
+func (s *walk_sink) commit() error {
+  if _, err := s.stmt.Exec(); err != nil {
+    return err
+  }
+  if err := s.stmt.Close(); err != nil {
+    return err
+  }
+  s.rows = 0
+  return s.txn.Commit()
+}
+
+// add copies one row, as made by copy_row
+func (s *walk_sink) add(values ...interface{}) error {
+  s.mu.Lock()
+  defer s.mu.Unlock()
+  if _, err := s.stmt.Exec(values...); err != nil {
+    return err
+  }
+  s.rows++
+  if s.rows < walk_commit_rows() {
+    return nil
+  }
+  if err := s.commit(); err != nil {
+    return err
+  }
+  return s.begin()
+}
+
+// finish moves the completed walk into the state table
+func (s *walk_sink) finish() error {
+  s.mu.Lock()
+  defer s.mu.Unlock()
+  if err := s.commit(); err != nil {
+    return err
+  }
+  columns := strings.Join(copy_columns(), ", ")
+  txn, err := db.Begin()
+  if err != nil {
+    return err
+  }
+  defer txn.Rollback()
+  _, err = txn.Exec(fmt.Sprintf("insert into %s (%s) select %s from %s", pq.QuoteIdentifier(conf.Table_name), columns, columns, pq.QuoteIdentifier(staging_table())))
+  if err != nil {
+    return err
+  }
+  if _, err = txn.Exec(fmt.Sprintf("drop table %s", pq.QuoteIdentifier(staging_table()))); err != nil {
+    return err
+  }
+  return txn.Commit()
+}
@@ -0,0 +1,156 @@
+//
+// Watch mode.
+//
+// "integrity_check watch" keeps verification in step with a transfer that takes weeks, instead of starting once
+// it is over. It watches path_new (inotify, so Linux only, and local trees only) and every file that is closed
+// after writing or moved into place is hashed on both sides and compared as soon as it has been left alone for
+// watch_settle seconds (default 10; a copy tool's temporary file renamed within that time is never looked at).
+// Each file gets a row in the table if it has none, a rewritten one has its hashes reset first, and the verdict
+// is recorded as in the pipeline mode, with mismatches logged, notified and quarantined as they are found.
+//
+// When it starts, the watch goes through what is already in path_new, hashing what the table doesn't have yet.
+// It runs until the deadline (-max-duration, -stop-at) or -fail-fast stops it.
+//
+
+package main
+
+import (
+  "fmt"
+  "os"
+  "strings"
+  "sync"
+  "time"
+
+  pq "github.com/lib/pq"
+)
+
+func watch_settle() time.Duration {
+  if conf.Watch_settle > 0 {
+    return time.Duration(conf.Watch_settle) * time.Second
+  }
+  return 10 * time.Second
+}
+
+// settler passes a path on once no event has been seen for it for watch_settle. Seeing a path never blocks,
+// so the events are read as fast as they come, even when the hash workers are behind.
+type settler struct {
+  mu sync.Mutex
+  pending map[string]time.Time // last event
+  out chan string
+}
+
+func (s *settler) seen(path string) {
+  s.mu.Lock()
+  s.pending[path] = time.Now()
+  s.mu.Unlock()
+}
+
+// run passes on the settled paths until stopped, and then closes out
+func (s *settler) run(stop chan struct{}) {
+  defer close(s.out)
+  for {
+    select {
+    case <-stop:
+      return
+    case <-time.After(time.Second):
+    }
+    var ready []string
+    s.mu.Lock()
+    for path, t := range s.pending {
+      if time.Since(t) >= watch_settle() {
+        ready = append(ready, path)
+        delete(s.pending, path)
+      }
+    }
+    s.mu.Unlock()
+    for _, path := range ready {
+      select {
+      case s.out <- path:
+      case <-stop:
+        return
+      }
+    }
+  }
+}
+
+func watch_command() {
+  if remotes["new"] != nil {
+    die_if(fmt.Errorf("watch mode needs path_new to be a local tree"))
+  }
+
+  threads := hash_threads("new")
+  s := &settler{pending: map[string]time.Time{}, out: make(chan string, threads)}
+  stop := make(chan struct{})
+  go s.run(stop)
+  phase := start_phase("watch", 0, 0)
+
+  pool := start_pool(threads, func() error {
+    for path := range s.out {
+      if deadline_passed() {
+        continue
+      }
+      watch_file(path, phase)
+    }
+    return nil
+  })
+
+  failed := make(chan error, 1)
+  go func() {
+    failed <- watch_tree(conf.New_path, s.seen)
+  }()
+  l.Print("watching ", conf.New_path)
+
+  for !deadline_passed() {
+    select {
+    case err := <-failed:
+      finish_run("aborted")
+      die_if(err)
+    case <-time.After(time.Second):
+    }
+  }
+
+  // the workers finish what they have; files still settling are left to the next run
+  close(stop)
+  pool.Wait()
+  phase.finish()
+  if stopped_fast() {
+    finish_run("failed")
+    lw.Print("stopped at the first difference (-fail-fast)")
+    os.Exit(1)
+  }
+  finish_run("incomplete")
+  l.Print("watch stopped at the deadline")
+}
+
+// watch_file brings the row of a file written in path_new up to date, and hashes and compares it
+func watch_file(path string, phase *phase_progress) {
+  info, err := os.Lstat(path)
+  if err != nil || !info.Mode().IsRegular() {
+    return // gone again, or not a file
+  }
+  rel := strings.TrimPrefix(path, conf.New_path+"/")
+  if policy_for(rel, info.Size()).Action == "skip" {
+    return
+  }
+
+  // a file written again is verified again
+  table := pq.QuoteIdentifier(conf.Table_name)
+  _, err = db_exec(fmt.Sprintf(`update %s set size = $2, changed = $3, hash_new = null, hash_old = null, error_new = null, error_old = null,
+    verdict = null, verdict_at = null where filename = $1 and status is null and (size is distinct from $2 or changed is distinct from $3)`, table),
+    rel, info.Size(), info.ModTime())
+  if err == nil {
+    _, err = db_exec(fmt.Sprintf("insert into %s (filename, size, changed, walked_at) select $1, $2, $3, now() where not exists (select 1 from %s where filename = $1)", table, table),
+      rel, info.Size(), info.ModTime())
+  }
+  if err != nil {
+    le.Print("error adding ", rel, " to the table: ", err)
+    return
+  }
+
+  w := work_item{filename: rel, size: info.Size()}
+  hash_one("new", w, phase)
+  if has_old() {
+    hash_one("old", w, phase)
+    record_verdict(rel)
+  }
+}
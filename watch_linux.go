@@ -0,0 +1,82 @@
+package main
+
+import (
+  "bytes"
+  "fmt"
+  "io/fs"
+  "path/filepath"
+  "unsafe"
+
+  "golang.org/x/sys/unix"
+)
+
+const watch_mask = unix.IN_CLOSE_WRITE | unix.IN_MOVED_TO | unix.IN_CREATE
+
+// watch_tree watches every directory under root, passing on the files written or moved in, and those already
+// there when a directory is first watched
+func watch_tree(root string, found func(string)) error {
+  fd, err := unix.InotifyInit1(unix.IN_CLOEXEC)
+  if err != nil {
+    return fmt.Errorf("inotify: %s", err)
+  }
+  defer unix.Close(fd)
+
+  dirs := map[int32]string{}
+  add := func(top string) error {
+    return filepath.WalkDir(top, func(path string, d fs.DirEntry, err error) error {
+      if err != nil {
+        le.Print("error watching ", path, ": ", err)
+        return nil
+      }
+      if !d.IsDir() {
+        found(path)
+        return nil
+      }
+      wd, err := unix.InotifyAddWatch(fd, path, watch_mask)
+      if err == unix.ENOSPC {
+        return fmt.Errorf("watching %s: out of inotify watches, raise fs.inotify.max_user_watches", path)
+      }
+      if err != nil {
+        le.Print("error watching ", path, ": ", err)
+        return nil
+      }
+      dirs[int32(wd)] = path
+      return nil
+    })
+  }
+  if err = add(root); err != nil {
+    return err
+  }
+
+  buf := make([]byte, 64 * 1024)
+  for {
+    n, err := unix.Read(fd, buf)
+    if err == unix.EINTR {
+      continue
+    }
+    if err != nil {
+      return fmt.Errorf("reading inotify events: %s", err)
+    }
+    for off := 0; off + unix.SizeofInotifyEvent <= n; {
+      ev := (*unix.InotifyEvent)(unsafe.Pointer(&buf[off]))
+      name := string(bytes.TrimRight(buf[off + unix.SizeofInotifyEvent : off + unix.SizeofInotifyEvent + int(ev.Len)], "\x00"))
+      off += unix.SizeofInotifyEvent + int(ev.Len)
+
+      switch {
+      case ev.Mask & unix.IN_Q_OVERFLOW != 0:
+        // events were lost: go through the whole tree again, unchanged files are skipped
+        l.Print("inotify queue overflowed, rescanning ", root)
+        err = add(root)
+      case ev.Mask & unix.IN_IGNORED != 0:
+        delete(dirs, ev.Wd)
+      case ev.Mask & unix.IN_ISDIR != 0 && ev.Mask & (unix.IN_CREATE | unix.IN_MOVED_TO) != 0:
+        err = add(filepath.Join(dirs[ev.Wd], name))
+      case ev.Mask & (unix.IN_CLOSE_WRITE | unix.IN_MOVED_TO) != 0:
+        found(filepath.Join(dirs[ev.Wd], name))
+      }
+      if err != nil {
+        return err
+      }
+    }
+  }
+}
@@ -0,0 +1,11 @@
+//go:build !linux
+
+package main
+
+import (
+  "fmt"
+)
+
+func watch_tree(root string, found func(string)) error {
+  return fmt.Errorf("watch mode needs inotify, which is only available on Linux")
+}
@@ -0,0 +1,161 @@
+//
+// WORM (immutability) verification.
+//
+// Compliance archives are only as good as their write protection. With worm_side set to the tree that lives on
+// WORM storage ("new" or "old"), every file hashed there also has its immutability checked and recorded in the
+// worm (what was found) and worm_ok columns:
+//
+//   - local trees: the file must carry the immutable attribute (chattr +i), or the append-only one (chattr +a)
+//     with "worm_expect": "append-only". This is read with FS_IOC_GETFLAGS, so only on Linux.
+//   - S3 with Object Lock: with worm_s3_bucket set, the object <worm_s3_prefix><filename> must have a retention
+//     that hasn't expired (of mode worm_s3_mode, COMPLIANCE or GOVERNANCE, if set) or a legal hold. This is asked
+//     of the aws CLI (worm_aws_binary, "aws" by default), with its usual credentials.
+//
+// The report lists the files that aren't protected as expected as WORM problems.
+//
+
+package main
+
+import (
+  "encoding/json"
+  "fmt"
+  "io"
+  "os/exec"
+  "strings"
+  "time"
+
+  pq "github.com/lib/pq"
+)
+
+const fs_immutable_fl = 0x10
+const fs_append_fl = 0x20
+
+func check_worm() error {
+  switch conf.Worm_side {
+  case "", "new", "old":
+  default:
+    return fmt.Errorf("worm_side must be new or old, got %q", conf.Worm_side)
+  }
+  switch conf.Worm_expect {
+  case "", "immutable", "append-only":
+  default:
+    return fmt.Errorf("worm_expect must be immutable or append-only, got %q", conf.Worm_expect)
+  }
+  switch conf.Worm_s3_mode {
+  case "", "COMPLIANCE", "GOVERNANCE":
+  default:
+    return fmt.Errorf("worm_s3_mode must be COMPLIANCE or GOVERNANCE, got %q", conf.Worm_s3_mode)
+  }
+  return nil
+}
+
+// worm_status describes the write protection of a file, and whether it is what is expected
+func worm_status(side string, file string) (string, bool, error) {
+  if conf.Worm_s3_bucket != "" {
+    return s3_lock_status(conf.Worm_s3_prefix + side_name(side, file))
+  }
+  if remotes[side] != nil {
+    return "", false, fmt.Errorf("immutability of remote trees can only be checked on S3")
+  }
+  flags, err := file_flags(side_path(side, file))
+  if err != nil {
+    return "", false, err
+  }
+  switch {
+  case flags&fs_immutable_fl != 0:
+    return "immutable", conf.Worm_expect != "append-only", nil
+  case flags&fs_append_fl != 0:
+    return "append-only", conf.Worm_expect == "append-only", nil
+  }
+  return "mutable", false, nil
+}
+
+func aws_s3api(args ...string) ([]byte, error) {
+  bin := conf.Worm_aws_binary
+  if bin == "" {
+    bin = "aws"
+  }
+  cmd := exec.Command(bin, append([]string{"s3api"}, append(args, "--output", "json")...)...)
+  var stderr strings.Builder
+  cmd.Stderr = &stderr
+  out, err := cmd.Output()
+  if err != nil {
+    return nil, fmt.Errorf("%s: %s", err, strings.TrimSpace(stderr.String()))
+  }
+  return out, nil
+}
+
+func s3_lock_status(key string) (string, bool, error) {
+  var status []string
+  ok := false
+
+  out, err := aws_s3api("get-object-retention", "--bucket", conf.Worm_s3_bucket, "--key", key)
+  if err != nil && !strings.Contains(err.Error(), "NoSuchObjectLockConfiguration") {
+    return "", false, err
+  }
+  if err == nil {
+    var r struct {
+      Retention struct {
+        Mode string
+        RetainUntilDate time.Time
+      }
+    }
+    if err = json.Unmarshal(out, &r); err != nil {
+      return "", false, err
+    }
+    if r.Retention.Mode != "" {
+      status = append(status, fmt.Sprintf("%s until %s", r.Retention.Mode, r.Retention.RetainUntilDate.Format(time.RFC3339)))
+      // COMPLIANCE is the stricter mode, so it does where GOVERNANCE is expected
+      ok = r.Retention.RetainUntilDate.After(time.Now()) && (conf.Worm_s3_mode == "" || conf.Worm_s3_mode == r.Retention.Mode || r.Retention.Mode == "COMPLIANCE")
+    }
+  }
+
+  out, err = aws_s3api("get-object-legal-hold", "--bucket", conf.Worm_s3_bucket, "--key", key)
+  if err != nil && !strings.Contains(err.Error(), "NoSuchObjectLockConfiguration") {
+    return "", false, err
+  }
+  if err == nil {
+    var h struct {
+      LegalHold struct {
+        Status string
+      }
+    }
+    if err = json.Unmarshal(out, &h); err != nil {
+      return "", false, err
+    }
+    if h.LegalHold.Status == "ON" {
+      status = append(status, "legal hold")
+      ok = true
+    }
+  }
+
+  if len(status) == 0 {
+    return "no object lock", false, nil
+  }
+  return strings.Join(status, ", "), ok, nil
+}
+
+func record_worm(side string, file string) error {
+  status, ok, err := worm_status(side, file)
+  if err != nil {
+    status = "error: " + err.Error()
+  }
+  _, err = db_exec(fmt.Sprintf("update %s set worm = $2, worm_ok = $3 where filename = $1", pq.QuoteIdentifier(conf.Table_name)), file, status, ok)
+  return err
+}
+
+func write_worm_report(w io.Writer) int64 {
+  rows, err := db.Query(fmt.Sprintf("select filename, worm from %s where not worm_ok order by filename", pq.QuoteIdentifier(conf.Table_name)))
+  die_if(err)
+  defer rows.Close()
+
+  var problems int64
+  for rows.Next() {
+    var file, status string
+    die_if(rows.Scan(&file, &status))
+    fmt.Fprintf(w, "WORM\t%s\t%s\n", file, status)
+    problems++
+  }
+  die_if(rows.Err())
+  return problems
+}
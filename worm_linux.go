@@ -0,0 +1,18 @@
+package main
+
+import (
+  "os"
+  "syscall"
+
+  "golang.org/x/sys/unix"
+)
+
+// file_flags returns the inode flags of a file, as shown by lsattr
+func file_flags(path string) (uint32, error) {
+  f, err := os.OpenFile(path, os.O_RDONLY|syscall.O_NONBLOCK, 0)
+  if err != nil {
+    return 0, err
+  }
+  defer f.Close()
+  return unix.IoctlGetUint32(int(f.Fd()), unix.FS_IOC_GETFLAGS)
+}
@@ -0,0 +1,11 @@
+//go:build !linux
+
+package main
+
+import (
+  "fmt"
+)
+
+func file_flags(path string) (uint32, error) {
+  return 0, fmt.Errorf("immutability attributes can only be read on Linux")
+}